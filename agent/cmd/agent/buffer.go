@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/Guliveer/vitalis/agent/internal/buffer"
+	"github.com/Guliveer/vitalis/agent/internal/config"
+	"github.com/Guliveer/vitalis/agent/internal/credential"
+	"github.com/Guliveer/vitalis/agent/internal/sender"
+)
+
+// bufferUsage describes the "buffer" subcommand.
+const bufferUsage = `Usage: vitalis-agent buffer <command> [flags]
+
+Inspects and manages the offline buffer in buffer.db_path.
+
+Commands:
+  stats   Show the number of buffered batches, their size and time range
+  list    List buffered batches, oldest first
+  dump    Print buffered batches as NDJSON (one metric batch per line)
+  purge   Delete all buffered batches
+  flush   Send all buffered batches to the server now
+
+stats, list and dump can be used while the agent is running; purge and
+flush require the agent to be stopped. With additional servers configured
+(server.servers), each server has its own buffer; select one with -server.
+`
+
+// runBuffer implements the "buffer" subcommand. Returns the process exit code.
+func runBuffer(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprint(os.Stderr, bufferUsage)
+		return 2
+	}
+
+	command := args[0]
+	fs := flag.NewFlagSet("buffer "+command, flag.ExitOnError)
+	limit := fs.Int("limit", 0, "Maximum number of batches to list or dump (0 = all)")
+	yes := fs.Bool("yes", false, "Do not ask for confirmation before purging")
+	url := fs.String("url", "", "Server URL for flush (overrides config)")
+	token := fs.String("token", "", "Machine token for flush (overrides config)")
+	server := fs.String("server", "", "URL of an additional server whose buffer to use (default: the primary server)")
+	fs.Usage = func() {
+		fmt.Fprint(os.Stderr, bufferUsage)
+		fmt.Fprintln(os.Stderr, "\nFlags:")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args[1:])
+
+	cfg, err := config.LoadLayered(config.CLIOverrides{URL: *url, Token: *token}, embeddedConfig)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to load config: %v\n", err)
+		return 1
+	}
+
+	if *server != "" {
+		target := findTarget(cfg, *server)
+		if target == nil {
+			fmt.Fprintf(os.Stderr, "Server %s is not configured\n", *server)
+			return 1
+		}
+		cfg = target
+	}
+
+	logger := newCLILogger()
+	defer logger.Sync()
+
+	switch command {
+	case "stats", "list", "dump":
+		buf, err := buffer.OpenReadOnly(cfg.Buffer, logger)
+		if os.IsNotExist(err) {
+			fmt.Printf("No buffer at %s (nothing has been buffered yet).\n", cfg.Buffer.DBPath)
+			return 0
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to open buffer %s: %v\n", cfg.Buffer.DBPath, err)
+			return 1
+		}
+		defer buf.Close()
+
+		switch command {
+		case "stats":
+			printBufferStats(cfg.Buffer, buf.Stats())
+			return 0
+		case "list":
+			printBufferList(buf.Records(), *limit)
+			return 0
+		default:
+			return dumpBuffer(buf, *limit)
+		}
+
+	case "purge", "flush":
+		buf, err := buffer.New(cfg.Buffer, logger)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to open buffer %s: %v\n", cfg.Buffer.DBPath, err)
+			return 1
+		}
+		defer buf.Close()
+
+		if command == "purge" {
+			return purgeBuffer(buf, *yes)
+		}
+		return flushBuffer(cfg, buf, logger)
+
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown buffer command %q\n\n", command)
+		fmt.Fprint(os.Stderr, bufferUsage)
+		return 2
+	}
+}
+
+// findTarget returns the configuration of the server with the given URL,
+// or nil if it is not configured.
+func findTarget(cfg *config.Config, url string) *config.Config {
+	for _, t := range cfg.Targets() {
+		if strings.TrimRight(t.Server.URL, "/") == strings.TrimRight(url, "/") {
+			return t
+		}
+	}
+	return nil
+}
+
+// printBufferStats prints the buffer summary.
+func printBufferStats(cfg config.BufferConfig, stats buffer.Stats) {
+	fmt.Printf("Buffer:   %s\n", cfg.DBPath)
+	fmt.Printf("Batches:  %d\n", stats.Batches)
+	fmt.Printf("Size:     %s of %d MB (%d segments)\n", formatBytes(stats.Bytes), cfg.MaxSizeMB, stats.Segments)
+	if stats.Batches == 0 {
+		return
+	}
+	fmt.Printf("Oldest:   %s (%s ago)\n", stats.Oldest.Format(time.RFC3339), time.Since(stats.Oldest).Round(time.Second))
+	fmt.Printf("Newest:   %s (%s ago)\n", stats.Newest.Format(time.RFC3339), time.Since(stats.Newest).Round(time.Second))
+}
+
+// printBufferList prints one line per buffered batch.
+func printBufferList(records []buffer.RecordInfo, limit int) {
+	if limit > 0 && len(records) > limit {
+		records = records[:limit]
+	}
+	fmt.Printf("%-24s %-25s %10s  %s\n", "ID", "STORED", "SIZE", "FLAGS")
+	for _, r := range records {
+		var flags []string
+		if r.Encrypted {
+			flags = append(flags, "encrypted")
+		}
+		if r.Downsampled {
+			flags = append(flags, "downsampled")
+		}
+		fmt.Printf("%-24s %-25s %10s  %s\n", r.ID, r.Stored.Format(time.RFC3339), formatBytes(r.Bytes), strings.Join(flags, ","))
+	}
+}
+
+// dumpBuffer writes buffered batches to stdout as NDJSON, in the same format
+// as the file output, so a dump can be replayed with the import command.
+func dumpBuffer(buf *buffer.Buffer, limit int) int {
+	entries, err := buf.Peek(limit)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to read buffer: %v\n", err)
+		return 1
+	}
+
+	w := bufio.NewWriter(os.Stdout)
+	defer w.Flush()
+	enc := json.NewEncoder(w)
+	for _, e := range entries {
+		if err := enc.Encode(e.Batch); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to write batch %s: %v\n", e.ID, err)
+			return 1
+		}
+	}
+	return 0
+}
+
+// purgeBuffer deletes all buffered batches after confirmation.
+func purgeBuffer(buf *buffer.Buffer, yes bool) int {
+	count := buf.Count()
+	if count == 0 {
+		fmt.Println("Buffer is empty.")
+		return 0
+	}
+	if !yes {
+		fmt.Printf("Delete %d buffered batches? They cannot be recovered. [y/N] ", count)
+		answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+		if a := strings.ToLower(strings.TrimSpace(answer)); a != "y" && a != "yes" {
+			fmt.Println("Aborted.")
+			return 1
+		}
+	}
+
+	purged, err := buf.Purge()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Purge failed: %v\n", err)
+		return 1
+	}
+	fmt.Printf("✓ Deleted %d buffered batches\n", purged)
+	return 0
+}
+
+// flushBuffer sends every buffered batch to the server, oldest first,
+// removing each one once the server accepted it.
+func flushBuffer(cfg *config.Config, buf *buffer.Buffer, logger *zap.Logger) int {
+	cfg.Server.Disabled = false
+	if err := cfg.Validate(); err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid configuration: %v\n", err)
+		return 1
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+
+	snd, err := sender.New(cfg, logger, nil)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Flush failed: %v\n", err)
+		return 1
+	}
+	cred, err := credential.Open(ctx, cfg, logger)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Flush failed: %v\n", err)
+		return 1
+	}
+	snd.SetCredential(cred)
+	total := buf.Count()
+	fmt.Printf("Flushing %d buffered batches to %s\n", total, cfg.Server.URL)
+
+	sent := 0
+	for {
+		entries, err := buf.Peek(1)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to read buffer: %v\n", err)
+			return 1
+		}
+		if len(entries) == 0 {
+			break
+		}
+		e := entries[0]
+
+		if err := snd.Replay(ctx, e.Batch); err != nil {
+			buf.Nack(e.ID)
+			if errors.Is(err, context.Canceled) {
+				fmt.Fprintf(os.Stderr, "Flush interrupted after %d of %d batches; the rest stay buffered.\n", sent, total)
+			} else {
+				fmt.Fprintf(os.Stderr, "Flush failed after %d of %d batches: %v\nThe rest stay buffered.\n", sent, total, err)
+			}
+			return 1
+		}
+		if err := buf.Ack(e.ID); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to remove sent batch %s: %v\n", e.ID, err)
+			return 1
+		}
+		sent++
+		fmt.Printf("  [%d/%d] %s: %d snapshots from %s\n", sent, total, e.ID, len(e.Batch.Metrics), e.Stored.Format(time.RFC3339))
+	}
+
+	fmt.Printf("✓ Flushed %d batches\n", sent)
+	return 0
+}
+
+// formatBytes formats a byte count for humans.
+func formatBytes(n int64) string {
+	switch {
+	case n >= 1024*1024:
+		return fmt.Sprintf("%.1f MB", float64(n)/(1024*1024))
+	case n >= 1024:
+		return fmt.Sprintf("%.1f KB", float64(n)/1024)
+	default:
+		return fmt.Sprintf("%d B", n)
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"runtime"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/Guliveer/vitalis/agent/internal/collector"
+	"github.com/Guliveer/vitalis/agent/internal/command"
+	"github.com/Guliveer/vitalis/agent/internal/config"
+	"github.com/Guliveer/vitalis/agent/internal/models"
+)
+
+// diagnosticsLogLines is how many of the last log lines a diagnostics
+// bundle includes.
+const diagnosticsLogLines = 200
+
+// diagnostics is the bundle the diagnostics command uploads: what is
+// needed to see why an agent misbehaves, without its secrets.
+type diagnostics struct {
+	Version    string             `json:"version"`
+	GoVersion  string             `json:"go_version"`
+	OS         string             `json:"os"`
+	Arch       string             `json:"arch"`
+	Hostname   string             `json:"hostname"`
+	StartedAt  time.Time          `json:"started_at"`
+	Uptime     string             `json:"uptime"`
+	Goroutines int                `json:"goroutines"`
+	HeapBytes  uint64             `json:"heap_bytes"`
+	LogLevel   string             `json:"log_level"`
+	Collectors []string           `json:"collectors"`
+	Sender     *models.AgentStats `json:"sender,omitempty"`
+	Config     string             `json:"config"` // YAML, secrets redacted
+	Log        []string           `json:"log,omitempty"`
+	LogOmitted int                `json:"log_omitted,omitempty"` // oldest lines left out to fit the size limit
+	LogError   string             `json:"log_error,omitempty"`
+}
+
+// collectDiagnostics builds the diagnostics bundle as JSON. stats is nil
+// when the server output is disabled.
+func collectDiagnostics(cfg *config.Config, registry *collector.Registry, stats func() models.AgentStats, startedAt time.Time) (string, error) {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	hostname, _ := os.Hostname()
+
+	d := diagnostics{
+		Version:    version,
+		GoVersion:  runtime.Version(),
+		OS:         runtime.GOOS,
+		Arch:       runtime.GOARCH,
+		Hostname:   hostname,
+		StartedAt:  startedAt.UTC(),
+		Uptime:     time.Since(startedAt).Round(time.Second).String(),
+		Goroutines: runtime.NumGoroutine(),
+		HeapBytes:  mem.HeapAlloc,
+		LogLevel:   logLevel.Level().String(),
+	}
+	for _, c := range registry.Collectors() {
+		d.Collectors = append(d.Collectors, c.Name())
+	}
+	if stats != nil {
+		s := stats()
+		d.Sender = &s
+	}
+
+	data, err := yaml.Marshal(cfg.Redacted())
+	if err != nil {
+		return "", fmt.Errorf("marshal config: %w", err)
+	}
+	d.Config = string(data)
+
+	if agentLog != nil {
+		lines, err := agentLog.Tail(diagnosticsLogLines)
+		if err != nil {
+			d.LogError = err.Error()
+		}
+		d.Log = lines
+	}
+
+	out, err := json.MarshalIndent(d, "", "  ")
+	if err != nil {
+		return "", fmt.Errorf("marshal diagnostics: %w", err)
+	}
+	// Leave out the oldest log lines until the bundle fits in a command
+	// result, rather than have the result cut mid-JSON
+	for len(out) > command.MaxOutputSize && len(d.Log) > 0 {
+		excess, drop := len(out)-command.MaxOutputSize, 0
+		for drop < len(d.Log) && excess > 0 {
+			excess -= len(d.Log[drop])
+			drop++
+		}
+		d.Log = d.Log[drop:]
+		d.LogOmitted += drop
+		if out, err = json.MarshalIndent(d, "", "  "); err != nil {
+			return "", fmt.Errorf("marshal diagnostics: %w", err)
+		}
+	}
+	return string(out), nil
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/Guliveer/vitalis/agent/internal/collector"
+	"github.com/Guliveer/vitalis/agent/internal/command"
+	"github.com/Guliveer/vitalis/agent/internal/config"
+)
+
+func TestCollectDiagnostics_TrimsLogToFit(t *testing.T) {
+	log, err := openLogFile(filepath.Join(t.TempDir(), "agent.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer log.file.Close()
+	// JSON log lines grow when escaped, so a full tail does not fit as is
+	for i := 0; i < diagnosticsLogLines; i++ {
+		fmt.Fprintf(log, "%03d %s\n", i, strings.Repeat(`{"msg":"x"}`, 300))
+	}
+	agentLog = log
+	defer func() { agentLog = nil }()
+
+	out, err := collectDiagnostics(config.DefaultConfig(), collector.NewRegistry(zap.NewNop()), nil, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(out) > command.MaxOutputSize {
+		t.Fatalf("bundle is %d bytes, want at most %d", len(out), command.MaxOutputSize)
+	}
+	var d diagnostics
+	if err := json.Unmarshal([]byte(out), &d); err != nil {
+		t.Fatalf("bundle is not valid JSON: %v", err)
+	}
+	if d.LogOmitted == 0 {
+		t.Errorf("kept %d lines and omitted none, want the oldest omitted", len(d.Log))
+	}
+	if len(d.Log) == 0 || !strings.HasPrefix(d.Log[len(d.Log)-1], "199 ") {
+		t.Error("the newest log lines were not kept")
+	}
+}
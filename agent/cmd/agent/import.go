@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+
+	"github.com/Guliveer/vitalis/agent/internal/buffer"
+	"github.com/Guliveer/vitalis/agent/internal/config"
+	"github.com/Guliveer/vitalis/agent/internal/credential"
+	"github.com/Guliveer/vitalis/agent/internal/importer"
+	"github.com/Guliveer/vitalis/agent/internal/sender"
+)
+
+// runImport implements the "import" subcommand: it replays NDJSON exports
+// or buffer files from another (e.g. air-gapped) machine to the configured
+// server. Returns the process exit code.
+func runImport(args []string) int {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	url := fs.String("url", "", "Server URL (overrides config)")
+	token := fs.String("token", "", "Machine token of the machine the data belongs to (overrides config)")
+	stateDir := fs.String("state-dir", "", "Directory for resume state files (default: next to each input file)")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: vitalis-agent import [flags] <file|dir>...\n\n")
+		fmt.Fprintf(os.Stderr, "Replays exported NDJSON (.ndjson, .ndjson.gz) or offline buffer (.wal, .json) files to the server.\n")
+		fmt.Fprintf(os.Stderr, "Interrupted imports resume from where they stopped.\n\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return 2
+	}
+
+	cfg, err := config.LoadLayered(config.CLIOverrides{URL: *url, Token: *token}, embeddedConfig)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to load config: %v\n", err)
+		return 1
+	}
+	// The importing machine sends even if its own config only writes files.
+	cfg.Server.Disabled = false
+	if err := cfg.Validate(); err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid configuration: %v\n", err)
+		return 1
+	}
+
+	files, err := importer.ExpandInputs(fs.Args())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Import failed: %v\n", err)
+		return 1
+	}
+	if *stateDir != "" {
+		if err := os.MkdirAll(*stateDir, 0750); err != nil {
+			fmt.Fprintf(os.Stderr, "Import failed: %v\n", err)
+			return 1
+		}
+	}
+
+	logger := newCLILogger()
+	defer logger.Sync()
+
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+
+	// Buffer segments copied from an agent with buffer encryption are read
+	// with the key from this machine's config (same secret or key file).
+	key, err := buffer.LoadKey(cfg.Buffer, false)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Import failed: %v\n", err)
+		return 1
+	}
+
+	snd, err := sender.New(cfg, logger, nil)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Import failed: %v\n", err)
+		return 1
+	}
+	cred, err := credential.Open(ctx, cfg, logger)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Import failed: %v\n", err)
+		return 1
+	}
+	snd.SetCredential(cred)
+	imp := importer.New(snd.Replay, *stateDir, logger)
+	imp.BufferKey = key
+	imp.OnProgress = func(file string, stats importer.Stats) {
+		fmt.Printf("  %s: record %d, %d snapshots sent\n", file, stats.Records, stats.Sent)
+	}
+
+	fmt.Printf("Importing %d file(s) to %s\n", len(files), cfg.Server.URL)
+	for _, file := range files {
+		stats, err := imp.ImportFile(ctx, file)
+		if err != nil {
+			if ctx.Err() != nil {
+				fmt.Fprintf(os.Stderr, "Import interrupted in %s; re-run the same command to resume.\n", file)
+			} else {
+				fmt.Fprintf(os.Stderr, "Import failed in %s: %v\nRe-run the same command to resume.\n", file, err)
+			}
+			return 1
+		}
+		fmt.Printf("✓ %s: %d records (%d already imported), %d snapshots sent, %d invalid skipped\n",
+			file, stats.Records, stats.Resumed, stats.Sent, stats.Invalid)
+	}
+	return 0
+}
+
+// newCLILogger creates a console logger on stderr for interactive
+// subcommands, leaving stdout for progress output.
+func newCLILogger() *zap.Logger {
+	encoderConfig := zap.NewDevelopmentEncoderConfig()
+	encoderConfig.EncodeTime = zapcore.ISO8601TimeEncoder
+	core := zapcore.NewCore(
+		zapcore.NewConsoleEncoder(encoderConfig),
+		zapcore.AddSync(os.Stderr),
+		zapcore.InfoLevel,
+	)
+	return zap.New(core)
+}
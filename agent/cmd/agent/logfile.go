@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// tailBytes is how much of the end of the log file Tail reads.
+const tailBytes = 256 * 1024
+
+// logFile is the agent's JSON log file (logging.file). Unlike a plain
+// *os.File it can be rotated while the logger writes to it.
+type logFile struct {
+	path string
+
+	mu   sync.Mutex
+	file *os.File
+}
+
+// openLogFile opens (or creates) the log file for appending.
+func openLogFile(path string) (*logFile, error) {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0640)
+	if err != nil {
+		return nil, err
+	}
+	return &logFile{path: path, file: f}, nil
+}
+
+func (l *logFile) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.file.Write(p)
+}
+
+func (l *logFile) Sync() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.file.Sync()
+}
+
+// Rotate renames the log file with a timestamp suffix and continues in a
+// new one. Returns the name of the rotated file.
+func (l *logFile) Rotate() (string, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	rotated := l.path + "." + time.Now().UTC().Format("20060102T150405")
+	if err := os.Rename(l.path, rotated); err != nil {
+		return "", fmt.Errorf("rotate log file: %w", err)
+	}
+	f, err := os.OpenFile(l.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0640)
+	if err != nil {
+		// Keep writing to the renamed file rather than losing logs
+		return rotated, fmt.Errorf("reopen log file: %w", err)
+	}
+	l.file.Close()
+	l.file = f
+	return rotated, nil
+}
+
+// Tail returns up to n of the last lines of the log file, read from at
+// most its last tailBytes.
+func (l *logFile) Tail(n int) ([]string, error) {
+	f, err := os.Open(l.path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	offset := max(info.Size()-tailBytes, 0)
+	data := make([]byte, info.Size()-offset)
+	if _, err := f.ReadAt(data, offset); err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	if len(data) == 0 {
+		return nil, nil
+	}
+	lines := strings.Split(strings.TrimRight(string(data), "\n"), "\n")
+	if offset > 0 {
+		lines = lines[1:] // starts mid-line
+	}
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	return lines, nil
+}
@@ -9,7 +9,12 @@ import (
 	"fmt"
 	"os"
 	"os/signal"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
+	"time"
 
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
@@ -17,13 +22,20 @@ import (
 	"github.com/Guliveer/vitalis/agent/internal/autostart"
 	"github.com/Guliveer/vitalis/agent/internal/buffer"
 	"github.com/Guliveer/vitalis/agent/internal/collector"
+	"github.com/Guliveer/vitalis/agent/internal/command"
 	"github.com/Guliveer/vitalis/agent/internal/config"
+	"github.com/Guliveer/vitalis/agent/internal/credential"
+	"github.com/Guliveer/vitalis/agent/internal/fileout"
+	"github.com/Guliveer/vitalis/agent/internal/httpclient"
 	"github.com/Guliveer/vitalis/agent/internal/models"
+	"github.com/Guliveer/vitalis/agent/internal/mqtt"
 	"github.com/Guliveer/vitalis/agent/internal/platform"
+	"github.com/Guliveer/vitalis/agent/internal/remoteconfig"
 	"github.com/Guliveer/vitalis/agent/internal/scheduler"
 	"github.com/Guliveer/vitalis/agent/internal/sender"
 	"github.com/Guliveer/vitalis/agent/internal/service"
 	"github.com/Guliveer/vitalis/agent/internal/setup"
+	"github.com/Guliveer/vitalis/agent/internal/stream"
 	"github.com/Guliveer/vitalis/agent/internal/updater"
 )
 
@@ -38,11 +50,36 @@ var (
 	flagMode    = flag.String("mode", "", "Install mode: system or user (used with --setup)")
 	flagURL     = flag.String("url", "", "Server URL (used with --setup or as runtime override)")
 	flagToken   = flag.String("token", "", "Machine token (used with --setup or as runtime override)")
+	flagEnroll  = flag.String("enroll", "", "One-time enrollment code (used with --setup instead of --token)")
+
+	// logLevel is the level of the agent's logger, which config overrides
+	// from the server can change at runtime.
+	logLevel = zap.NewAtomicLevel()
+
+	// agentLog is the log file, if logging.file is set; the rotate_logs
+	// command rotates it.
+	agentLog *logFile
+
+	// startedAt is when the agent started, across in-process restarts.
+	startedAt = time.Now()
 )
 
 func main() {
 	flag.Parse()
 
+	// Subcommands (e.g. "vitalis-agent import ...") take over entirely.
+	if flag.NArg() > 0 {
+		switch flag.Arg(0) {
+		case "import":
+			os.Exit(runImport(flag.Args()[1:]))
+		case "buffer":
+			os.Exit(runBuffer(flag.Args()[1:]))
+		default:
+			fmt.Fprintf(os.Stderr, "Unknown command %q\n", flag.Arg(0))
+			os.Exit(2)
+		}
+	}
+
 	if *showVersion {
 		fmt.Printf("vitalis-agent %s\n", version)
 		os.Exit(0)
@@ -78,9 +115,10 @@ func main() {
 	// Handle --setup: run interactive/non-interactive setup wizard and exit.
 	if *setupMode {
 		opts := setup.Options{
-			Mode:  *flagMode,
-			URL:   *flagURL,
-			Token: *flagToken,
+			Mode:           *flagMode,
+			URL:            *flagURL,
+			Token:          *flagToken,
+			EnrollmentCode: *flagEnroll,
 		}
 		if err := setup.Run(version, opts); err != nil {
 			fmt.Fprintf(os.Stderr, "Setup failed: %v\n", err)
@@ -89,12 +127,8 @@ func main() {
 		os.Exit(0)
 	}
 
-	// Load configuration with layered precedence:
-	// CLI flags > env vars > external YAML > embedded config > defaults
-	cfg, err := config.LoadLayered(config.CLIOverrides{
-		URL:   *flagURL,
-		Token: *flagToken,
-	}, embeddedConfig)
+	// Load configuration
+	cfg, err := loadConfig()
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Failed to load config: %v\n", err)
 		os.Exit(1)
@@ -141,7 +175,7 @@ func main() {
 	if service.IsWindowsService() {
 		logger.Info("Running as Windows service")
 		svc := service.New(logger, func(ctx context.Context) {
-			runAgent(ctx, cfg, logger)
+			run(ctx, cfg, logger)
 		})
 		if err := svc.Run(); err != nil {
 			logger.Fatal("Service failed", zap.Error(err))
@@ -164,24 +198,198 @@ func main() {
 		cancel()
 	}()
 
-	runAgent(ctx, cfg, logger)
+	run(ctx, cfg, logger)
 	logger.Info("Agent stopped")
 }
 
+// restartRetryDelay is how long run waits before starting the components
+// again when they fail to start with a configuration they ran with before.
+var restartRetryDelay = 30 * time.Second
+
+// run runs the agent until ctx is cancelled, reloading the configuration
+// on SIGHUP or when the config file changes. Changes runAgent cannot apply
+// in place restart its components with the new configuration; if they
+// cannot be started with it, they are started again with the previous one.
+func run(ctx context.Context, cfg *config.Config, logger *zap.Logger) {
+	reloads := watchConfig(ctx, cfg, logger)
+	var good *config.Config // the last configuration the components ran with
+	for ctx.Err() == nil {
+		next, err := runAgent(ctx, cfg, logger, reloads)
+		switch {
+		case err == nil:
+			if next == nil {
+				return
+			}
+			good, cfg = cfg, next
+		case good == nil:
+			logger.Fatal("Failed to start the agent", zap.Error(err))
+		case cfg != good:
+			logger.Error("Invalid configuration, keeping the current one", zap.Error(err))
+			cfg = good
+		default:
+			// The configuration that ran before fails now, e.g. with its
+			// server unreachable during enrollment
+			logger.Error("Failed to restart the agent, retrying",
+				zap.Error(err),
+				zap.Duration("retry_in", restartRetryDelay))
+			select {
+			case <-time.After(restartRetryDelay):
+			case <-ctx.Done():
+			}
+		}
+	}
+}
+
 // runAgent initializes all components and starts the collection/send loop.
-// It blocks until the context is cancelled.
-func runAgent(ctx context.Context, cfg *config.Config, logger *zap.Logger) {
-	// Initialize file-based buffer
-	buf, err := buffer.New(cfg.Buffer.DBPath, cfg.Buffer.MaxSizeMB, logger)
-	if err != nil {
-		logger.Fatal("Failed to initialize buffer", zap.Error(err))
+// It blocks until the context is cancelled, or until a reloaded
+// configuration needs the components restarted, which it then returns. It
+// fails, before starting anything, if a component cannot be initialized.
+func runAgent(ctx context.Context, cfg *config.Config, logger *zap.Logger, reloads <-chan *config.Config) (*config.Config, error) {
+	ctx, stop := context.WithCancel(ctx)
+	defer stop()
+	logLevel.SetLevel(parseLevel(cfg.Logging.Level)) // it may have changed with a reload
+
+	// Background goroutines are waited for before the buffers are closed
+	var wg sync.WaitGroup
+	spawn := func(fn func()) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			fn()
+		}()
+	}
+
+	// Initialize HTTP sender and its offline buffer, unless the server output
+	// is disabled (e.g. air-gapped machines writing to a local file only)
+	var snd *sender.Group
+	var streamer *stream.Streamer
+	var overrides *remoteconfig.Poller
+	var commands *command.Channel
+	var senders []*sender.Sender     // one per server, the primary first
+	var creds []*credential.Store    // their machine tokens
+	var primary *credential.Store    // token store of the primary server
+	var primarySender *sender.Sender // sender to the primary server
+	if !cfg.Server.Disabled {
+		// Fetch config overrides set for this machine on the dashboard
+		if cfg.Server.RemoteConfig.Enabled {
+			var err error
+			overrides, err = remoteconfig.New(cfg, logger)
+			if err != nil {
+				return nil, fmt.Errorf("initialize remote config: %w", err)
+			}
+		}
+
+		// Run allowlisted commands queued for this machine on the dashboard
+		if cfg.Server.Commands.Enabled {
+			var err error
+			commands, err = command.New(cfg, logger)
+			if err != nil {
+				return nil, fmt.Errorf("initialize command channel: %w", err)
+			}
+		}
+
+		// One sender per server, each with its own token and buffer; the
+		// primary server comes first
+		for _, target := range cfg.Targets() {
+			log := logger
+			if target.Server.Name != "" {
+				log = logger.With(zap.String("server", target.Server.Name), zap.String("url", target.Server.URL))
+			}
+
+			buf, err := buffer.New(target.Buffer, log)
+			if err != nil {
+				return nil, fmt.Errorf("initialize buffer for %s: %w", target.Server.URL, err)
+			}
+			defer buf.Close()
+
+			// Load the machine token, enrolling with the enrollment code on
+			// the first start
+			cred, err := credential.Open(ctx, target, log)
+			if err != nil {
+				if ctx.Err() != nil {
+					// Nothing may use the buffers once they are closed
+					stop()
+					wg.Wait()
+					return nil, nil
+				}
+				return nil, fmt.Errorf("obtain machine token for %s: %w", target.Server.URL, err)
+			}
+			creds = append(creds, cred)
+
+			s, err := sender.New(target, log, buf)
+			if err != nil {
+				return nil, fmt.Errorf("initialize sender for %s: %w", target.Server.URL, err)
+			}
+			s.SetCredential(cred)
+			if primary == nil {
+				primary, primarySender = cred, s
+				// Ingest responses report when the overrides change
+				if overrides != nil {
+					overrides.SetCredential(cred)
+					s.OnConfigETag(overrides.Notify)
+				}
+				// ... and when commands are waiting
+				if commands != nil {
+					commands.SetCredential(cred)
+					s.OnCommandsPending(commands.Notify)
+				}
+			}
+			senders = append(senders, s)
+		}
+		snd = sender.NewGroup(cfg.Server.Mode, senders, logger)
+		if len(senders) > 1 {
+			logger.Info("Sending to multiple servers",
+				zap.String("mode", cfg.Server.Mode),
+				zap.Int("servers", len(senders)))
+		}
+
+		// Optionally push snapshots live as they are collected; anything the
+		// stream did not deliver still goes out with the batch
+		if cfg.Server.Stream.Enabled {
+			var err error
+			streamer, err = stream.New(cfg, logger)
+			if err != nil {
+				return nil, fmt.Errorf("initialize stream: %w", err)
+			}
+			streamer.SetCredential(primary)
+		}
+	} else {
+		logger.Info("Server output disabled, not sending metrics over HTTP")
+	}
+
+	// Initialize optional local NDJSON output (stdout or rotating file)
+	var fileOut *fileout.Writer
+	if cfg.FileOutput.Enabled {
+		w, err := fileout.New(cfg.FileOutput, logger)
+		if err != nil {
+			return nil, fmt.Errorf("initialize file output: %w", err)
+		}
+		fileOut = w
+		defer fileOut.Close()
 	}
 
-	// Initialize HTTP sender
-	snd := sender.New(cfg, logger, buf)
+	updateClient, err := httpclient.NewForUpdates(cfg.Server, 60*time.Second)
+	if err != nil {
+		return nil, fmt.Errorf("initialize update client: %w", err)
+	}
 
-	// Flush any buffered metrics from previous runs
-	snd.FlushBuffer()
+	// Everything that can fail is set up; start the background work
+	for _, cred := range creds {
+		// Keep the machine token rotated
+		spawn(func() { cred.Run(ctx) })
+	}
+	for _, s := range senders {
+		// Send batches from a bounded queue so collection never waits
+		// for the network
+		spawn(s.RunQueue)
+
+		// Replay buffered metrics from previous runs and outages in the
+		// background, interleaved with live batches
+		spawn(func() { s.RunDrainer(ctx) })
+	}
+	if streamer != nil {
+		spawn(func() { streamer.Run(ctx) })
+	}
 
 	// Initialize platform-specific provider (GPU temp fallback, shutdown time, etc.)
 	plat := platform.New()
@@ -193,70 +401,201 @@ func runAgent(ctx context.Context, cfg *config.Config, logger *zap.Logger) {
 	registry.Register(collector.NewMemoryCollector())
 	registry.Register(collector.NewDiskCollector(logger))
 	registry.Register(collector.NewNetworkCollector())
-	registry.Register(collector.NewProcessCollector(cfg.Collection.TopProcesses))
+	processes := collector.NewProcessCollector(cfg.Collection.TopProcesses)
+	registry.Register(processes)
 	registry.Register(collector.NewUptimeCollector())
 	registry.Register(collector.NewTemperatureCollector(plat, logger))
 	registry.Register(collector.NewShutdownCollector())
 	registry.Register(collector.NewOSInfoCollector())
 
+	// Initialize optional MQTT publisher (last-value state for home automation)
+	var pub *mqtt.Publisher
+	if cfg.MQTT.Enabled {
+		pub = mqtt.NewPublisher(cfg.MQTT, logger)
+		defer pub.Close()
+	}
+
 	// Initialize scheduler with batch-ready callback
 	sched := scheduler.New(registry, cfg, logger)
+	if snd != nil {
+		sched.AgentStats(snd.Stats)
+	}
+	if streamer != nil {
+		sched.OnSnapshot(streamer.Push)
+	}
+	// Local outputs get their own workers, like the HTTP sender, so neither
+	// holds up collection
+	var outputs []*outputQueue
+	if fileOut != nil {
+		outputs = append(outputs, newOutputQueue("file", func(batch []models.MetricSnapshot) {
+			if err := fileOut.Write(batch); err != nil {
+				logger.Error("Failed to write batch to file output", zap.Error(err))
+			}
+		}, logger))
+	}
+	if pub != nil {
+		outputs = append(outputs, newOutputQueue("mqtt", func(batch []models.MetricSnapshot) {
+			pub.Publish(ctx, batch)
+		}, logger))
+	}
+	for _, q := range outputs {
+		spawn(q.Run)
+	}
 	sched.OnBatchReady(func(batch []models.MetricSnapshot) {
-		snd.Send(batch)
+		for _, q := range outputs {
+			q.Push(batch)
+		}
+		if snd != nil {
+			unsent := batch
+			if streamer != nil {
+				unsent = streamer.Settle(batch)
+			}
+			if len(unsent) > 0 {
+				snd.Enqueue(unsent)
+			}
+		}
 	})
 
-	// Initialize and start the auto-updater
+	// Start the auto-updater
 	updateCfg := updater.Config{
 		Enabled:       cfg.Update.Enabled,
 		CheckInterval: cfg.Update.CheckInterval.Duration,
+		HTTPClient:    updateClient,
 	}
 	upd := updater.New(version, updateCfg, logger)
 	upd.Start(ctx)
 	defer upd.Stop()
 
+	// Settings that reloads and the server's config overrides change in place
+	live := &settings{
+		registry:  registry,
+		sched:     sched,
+		processes: processes,
+		poller:    overrides,
+		upd:       upd,
+		cred:      primary,
+		sender:    primarySender,
+		commands:  commands,
+		streamer:  streamer,
+		cfg:       cfg,
+	}
+
+	// Apply config overrides from the server on top of the config file,
+	// starting with those saved by the last run
+	if overrides != nil {
+		overrides.OnChange(live.SetOverrides)
+		overrides.Load()
+		spawn(func() { overrides.Run(ctx) })
+	}
+
+	if commands != nil {
+		commands.Handle("collect_now", func(ctx context.Context) (string, error) {
+			if err := sched.CollectNow(ctx); err != nil {
+				return "", err
+			}
+			return "collected a snapshot and flushed the batch", nil
+		})
+		commands.Handle("flush_buffer", func(ctx context.Context) (string, error) {
+			sent := snd.FlushBuffer(ctx)
+			return fmt.Sprintf("sent %d buffered batches, %d still buffered", sent, snd.Stats().BufferedBatches), nil
+		})
+		commands.Handle("check_update", upd.CheckNow)
+		commands.Handle("rotate_logs", func(ctx context.Context) (string, error) {
+			return rotateLogs(fileOut)
+		})
+		commands.Handle("diagnostics", func(ctx context.Context) (string, error) {
+			return collectDiagnostics(live.Config(), registry, snd.Stats, startedAt)
+		})
+		commands.Handle(command.Restart, func(ctx context.Context) (string, error) {
+			return "", upd.RequestRestart()
+		})
+		spawn(func() { commands.Run(ctx) })
+		logger.Info("Command channel enabled", zap.Strings("allow", cfg.Server.Commands.Allow))
+	}
+
+	// Apply reloaded configurations, in place where possible
+	var restartWith atomic.Pointer[config.Config]
+	spawn(func() {
+		for {
+			var next *config.Config
+			select {
+			case <-ctx.Done():
+				return
+			case next = <-reloads:
+			}
+			current := live.Config()
+			switch {
+			case reflect.DeepEqual(current, next):
+				logger.Info("Configuration unchanged")
+			case needsRestart(current, next):
+				logger.Info("Configuration changed, restarting components")
+				restartWith.Store(next)
+				stop()
+				return
+			default:
+				if err := live.Reload(ctx, next); err != nil {
+					logger.Error("Invalid configuration, keeping the current one", zap.Error(err))
+					continue
+				}
+				if next.Logging.File != current.Logging.File {
+					logger.Warn("The log file changes when the agent restarts",
+						zap.String("file", next.Logging.File))
+				}
+				logger.Info("Configuration reloaded")
+			}
+		}
+	})
+
 	// Start the scheduler (blocks until context is cancelled)
 	logger.Info("Agent running",
 		zap.Duration("collect_interval", cfg.Collection.Interval.Duration),
 		zap.Duration("batch_interval", cfg.Collection.BatchInterval.Duration))
 	sched.Start(ctx)
+
+	// Send what is still queued, buffering whatever misses the deadline,
+	// and let the local outputs write theirs
+	if snd != nil {
+		snd.CloseQueue(cfg.Server.Queue.DrainTimeout.Duration)
+	}
+	for _, q := range outputs {
+		q.Close()
+	}
+	wg.Wait()
+	return restartWith.Load(), nil
 }
 
 // initLogger creates a zap logger based on the configuration.
 // It outputs to both console (human-readable) and optionally a JSON log file.
 func initLogger(cfg *config.Config) *zap.Logger {
-	var level zapcore.Level
-	switch cfg.Logging.Level {
-	case "debug":
-		level = zapcore.DebugLevel
-	case "warn":
-		level = zapcore.WarnLevel
-	case "error":
-		level = zapcore.ErrorLevel
-	default:
-		level = zapcore.InfoLevel
-	}
+	logLevel.SetLevel(parseLevel(cfg.Logging.Level))
 
 	encoderConfig := zap.NewProductionEncoderConfig()
 	encoderConfig.TimeKey = "time"
 	encoderConfig.EncodeTime = zapcore.ISO8601TimeEncoder
 
-	// Console output (human-readable)
+	// Console output (human-readable). Logs move to stderr when stdout
+	// carries the NDJSON metric stream.
+	console := os.Stdout
+	if cfg.FileOutput.Enabled && fileout.IsStdout(cfg.FileOutput.Path) {
+		console = os.Stderr
+	}
 	consoleCore := zapcore.NewCore(
 		zapcore.NewConsoleEncoder(encoderConfig),
-		zapcore.AddSync(os.Stdout),
-		level,
+		zapcore.AddSync(console),
+		logLevel,
 	)
 
 	cores := []zapcore.Core{consoleCore}
 
 	// File output (structured JSON, if configured)
 	if cfg.Logging.File != "" {
-		file, err := os.OpenFile(cfg.Logging.File, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0640)
+		file, err := openLogFile(cfg.Logging.File)
 		if err == nil {
+			agentLog = file
 			fileCore := zapcore.NewCore(
 				zapcore.NewJSONEncoder(encoderConfig),
-				zapcore.AddSync(file),
-				level,
+				file,
+				logLevel,
 			)
 			cores = append(cores, fileCore)
 		}
@@ -264,3 +603,44 @@ func initLogger(cfg *config.Config) *zap.Logger {
 
 	return zap.New(zapcore.NewTee(cores...))
 }
+
+// rotateLogs rotates the agent's log file and the metric output file, those
+// that are configured, and reports the names they were rotated to.
+func rotateLogs(fileOut *fileout.Writer) (string, error) {
+	var rotated []string
+	if agentLog != nil {
+		name, err := agentLog.Rotate()
+		if err != nil {
+			return "", err
+		}
+		rotated = append(rotated, name)
+	}
+	if fileOut != nil {
+		name, err := fileOut.Rotate()
+		if err != nil {
+			return "rotated " + strings.Join(rotated, ", "), err
+		}
+		if name != "" {
+			rotated = append(rotated, name)
+		}
+	}
+	if len(rotated) == 0 {
+		return "no log or output file to rotate", nil
+	}
+	return "rotated " + strings.Join(rotated, ", "), nil
+}
+
+// parseLevel maps a configured log level to a zap level; anything unknown
+// is info.
+func parseLevel(name string) zapcore.Level {
+	switch name {
+	case "debug":
+		return zapcore.DebugLevel
+	case "warn":
+		return zapcore.WarnLevel
+	case "error":
+		return zapcore.ErrorLevel
+	default:
+		return zapcore.InfoLevel
+	}
+}
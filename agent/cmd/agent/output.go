@@ -0,0 +1,54 @@
+package main
+
+import (
+	"go.uber.org/zap"
+
+	"github.com/Guliveer/vitalis/agent/internal/models"
+)
+
+// outputQueueSize is how many batches an output may fall behind before
+// new ones are dropped.
+const outputQueueSize = 4
+
+// outputQueue hands batches to an output (MQTT, the file output) on its own
+// goroutine, so a slow disk or an unreachable broker never holds up
+// collection. A batch that finds the queue full is dropped.
+type outputQueue struct {
+	name   string
+	ch     chan []models.MetricSnapshot
+	write  func([]models.MetricSnapshot)
+	logger *zap.Logger
+}
+
+func newOutputQueue(name string, write func([]models.MetricSnapshot), logger *zap.Logger) *outputQueue {
+	return &outputQueue{
+		name:   name,
+		ch:     make(chan []models.MetricSnapshot, outputQueueSize),
+		write:  write,
+		logger: logger,
+	}
+}
+
+// Push queues a batch for the output and returns at once.
+func (q *outputQueue) Push(batch []models.MetricSnapshot) {
+	select {
+	case q.ch <- batch:
+	default:
+		q.logger.Warn("Output is falling behind, dropping batch",
+			zap.String("output", q.name),
+			zap.Int("metrics", len(batch)))
+	}
+}
+
+// Run writes queued batches until Close is called and the queue is empty.
+func (q *outputQueue) Run() {
+	for batch := range q.ch {
+		q.write(batch)
+	}
+}
+
+// Close stops accepting batches; Run returns once the queued ones are
+// written. Push must not be called after Close.
+func (q *outputQueue) Close() {
+	close(q.ch)
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/Guliveer/vitalis/agent/internal/models"
+)
+
+func TestOutputQueue_DropsWhileOutputIsStuck(t *testing.T) {
+	release := make(chan struct{})
+	var written []float64
+	q := newOutputQueue("test", func(batch []models.MetricSnapshot) {
+		<-release
+		written = append(written, batch[0].CPUOverall)
+	}, zap.NewNop())
+	done := make(chan struct{})
+	go func() {
+		q.Run()
+		close(done)
+	}()
+
+	// One batch is being written and outputQueueSize wait; the rest are
+	// dropped without blocking the caller.
+	start := time.Now()
+	for i := 0; i < outputQueueSize+5; i++ {
+		q.Push([]models.MetricSnapshot{{CPUOverall: float64(i)}})
+		if i == 0 {
+			for len(q.ch) > 0 {
+				time.Sleep(time.Millisecond)
+			}
+		}
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Push blocked for %s", elapsed)
+	}
+
+	close(release)
+	q.Close()
+	<-done
+	if len(written) != outputQueueSize+1 {
+		t.Errorf("wrote %v, want the first %d batches", written, outputQueueSize+1)
+	}
+	for i, cpu := range written {
+		if cpu != float64(i) {
+			t.Fatalf("wrote %v, want batches in order", written)
+		}
+	}
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"reflect"
+	"sync"
+	"syscall"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/Guliveer/vitalis/agent/internal/collector"
+	"github.com/Guliveer/vitalis/agent/internal/command"
+	"github.com/Guliveer/vitalis/agent/internal/config"
+	"github.com/Guliveer/vitalis/agent/internal/credential"
+	"github.com/Guliveer/vitalis/agent/internal/remoteconfig"
+	"github.com/Guliveer/vitalis/agent/internal/scheduler"
+	"github.com/Guliveer/vitalis/agent/internal/sender"
+	"github.com/Guliveer/vitalis/agent/internal/stream"
+	"github.com/Guliveer/vitalis/agent/internal/updater"
+)
+
+// loadConfig loads the configuration with layered precedence:
+// CLI flags > env vars > external YAML > embedded config > defaults
+func loadConfig() (*config.Config, error) {
+	return config.LoadLayered(config.CLIOverrides{
+		URL:   *flagURL,
+		Token: *flagToken,
+	}, embeddedConfig)
+}
+
+// fileStamp identifies a version of the config file.
+type fileStamp struct {
+	path    string
+	modTime time.Time
+	size    int64
+}
+
+// configStamp returns the stamp of the config file in use, if any.
+func configStamp() fileStamp {
+	path := config.Locate()
+	if path == "" {
+		return fileStamp{}
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return fileStamp{path: path}
+	}
+	return fileStamp{path: path, modTime: info.ModTime(), size: info.Size()}
+}
+
+// watchConfig reloads the configuration on SIGHUP and, with
+// reload.watch_file, when the config file changes. Every configuration that
+// loads and validates is sent on the returned channel; one that does not is
+// logged and dropped, and the current one stays in effect.
+func watchConfig(ctx context.Context, cfg *config.Config, logger *zap.Logger) <-chan *config.Config {
+	reloads := make(chan *config.Config)
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	stamp := configStamp()
+
+	go func() {
+		defer signal.Stop(hup)
+		watch := cfg.Reload
+		ticker := time.NewTicker(watch.WatchInterval.Duration)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-hup:
+				logger.Info("Received SIGHUP, reloading configuration")
+			case <-ticker.C:
+				if !watch.WatchFile {
+					continue
+				}
+				current := configStamp()
+				if current == stamp {
+					continue
+				}
+				stamp = current
+				logger.Info("Config file changed, reloading configuration", zap.String("path", current.path))
+			}
+
+			stamp = configStamp()
+			next, err := loadConfig()
+			if err == nil {
+				err = next.Validate()
+			}
+			if err != nil {
+				logger.Error("Invalid configuration, keeping the current one", zap.Error(err))
+				continue
+			}
+			if next.Reload != watch {
+				watch = next.Reload
+				ticker.Reset(watch.WatchInterval.Duration)
+			}
+			select {
+			case reloads <- next:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return reloads
+}
+
+// needsRestart reports whether the agent's components must be rebuilt to
+// apply next, i.e. it changes more than what settings.Reload applies in
+// place. The primary server's URL and a machine token from the config are
+// applied in place; switching between a config token and enrollment is not.
+func needsRestart(current, next *config.Config) bool {
+	inPlace := *next
+	inPlace.Collection = current.Collection
+	inPlace.Logging = current.Logging
+	inPlace.Update = current.Update
+	inPlace.Reload = current.Reload
+	inPlace.Server.URL = current.Server.URL
+	if current.Server.MachineToken != "" && next.Server.MachineToken != "" {
+		inPlace.Server.MachineToken = current.Server.MachineToken
+		inPlace.Server.MachineTokenFile = current.Server.MachineTokenFile
+	}
+	return !reflect.DeepEqual(current, &inPlace)
+}
+
+// settings holds the configuration the running components use, and applies
+// what can change without rebuilding them: the collection intervals, the
+// number of top processes, the log level and the update settings, each
+// with the server's config overrides on top, and the primary server's URL
+// and machine token.
+type settings struct {
+	registry  *collector.Registry
+	sched     *scheduler.Scheduler
+	processes *collector.ProcessCollector
+	poller    *remoteconfig.Poller // nil without remote config
+	upd       *updater.Updater
+
+	// Clients of the primary server; nil with the server output disabled
+	// or the feature off
+	cred     *credential.Store
+	sender   *sender.Sender
+	commands *command.Channel
+	streamer *stream.Streamer
+
+	mu        sync.Mutex
+	cfg       *config.Config
+	overrides remoteconfig.Overrides
+}
+
+// Config returns the configuration in effect, without the overrides.
+func (s *settings) Config() *config.Config {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.cfg
+}
+
+// SetOverrides applies config overrides from the server.
+func (s *settings) SetOverrides(o remoteconfig.Overrides) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.registry.SetEnabled(o.Collectors); err != nil {
+		return err
+	}
+	s.overrides = o
+	s.apply()
+	return nil
+}
+
+// Reload applies a reloaded configuration that needs no restart (see
+// needsRestart). It fails, changing nothing, if the server's overrides
+// are not valid on top of it.
+func (s *settings) Reload(ctx context.Context, cfg *config.Config) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.overrides.Validate(cfg.Collection); err != nil {
+		return fmt.Errorf("conflicts with the config overrides from the server: %w", err)
+	}
+	if cfg.Update != s.cfg.Update {
+		s.upd.Reconfigure(ctx, updater.Config{
+			Enabled:       cfg.Update.Enabled,
+			CheckInterval: cfg.Update.CheckInterval.Duration,
+		})
+	}
+	if s.poller != nil {
+		s.poller.SetBase(cfg.Collection)
+	}
+	if cfg.Server.URL != s.cfg.Server.URL || cfg.Server.MachineToken != s.cfg.Server.MachineToken {
+		s.setServer(cfg.Server.URL, cfg.Server.MachineToken)
+	}
+	s.cfg = cfg
+	s.apply()
+	return nil
+}
+
+// setServer points the primary server's clients at url, authenticating
+// with token. Must be called with s.mu held.
+func (s *settings) setServer(url, token string) {
+	if s.cred != nil {
+		s.cred.SetServer(url, token)
+	}
+	if s.sender != nil {
+		s.sender.SetServer(url, token)
+	}
+	if s.poller != nil {
+		s.poller.SetURL(url)
+	}
+	if s.commands != nil {
+		s.commands.SetURL(url)
+	}
+	if s.streamer != nil {
+		s.streamer.SetURL(url)
+	}
+}
+
+// apply sets the effective settings on the components. Must be called with
+// s.mu held.
+func (s *settings) apply() {
+	collection := s.overrides.Collection(s.cfg.Collection)
+	s.sched.SetIntervals(collection.Interval.Duration, collection.BatchInterval.Duration)
+	s.processes.SetTopN(collection.TopProcesses)
+	logLevel.SetLevel(parseLevel(s.overrides.Logging(s.cfg.Logging).Level))
+}
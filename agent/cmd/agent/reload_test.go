@@ -0,0 +1,323 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+
+	"github.com/Guliveer/vitalis/agent/internal/collector"
+	"github.com/Guliveer/vitalis/agent/internal/config"
+	"github.com/Guliveer/vitalis/agent/internal/models"
+	"github.com/Guliveer/vitalis/agent/internal/remoteconfig"
+	"github.com/Guliveer/vitalis/agent/internal/scheduler"
+	"github.com/Guliveer/vitalis/agent/internal/sender"
+	"github.com/Guliveer/vitalis/agent/internal/updater"
+)
+
+func TestNeedsRestart(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		change func(*config.Config)
+		want   bool
+	}{
+		{"unchanged", func(c *config.Config) {}, false},
+		{"collection", func(c *config.Config) { c.Collection.Interval.Duration = 5 * time.Second }, false},
+		{"top processes", func(c *config.Config) { c.Collection.TopProcesses = 3 }, false},
+		{"logging", func(c *config.Config) { c.Logging.Level = "debug" }, false},
+		{"update", func(c *config.Config) { c.Update.CheckInterval.Duration = time.Hour }, false},
+		{"reload", func(c *config.Config) { c.Reload.WatchFile = true }, false},
+		{"server url", func(c *config.Config) { c.Server.URL = "https://moved.example.com" }, false},
+		{"machine token", func(c *config.Config) { c.Server.MachineToken = "mtoken_new" }, false},
+		{"token to enrollment", func(c *config.Config) {
+			c.Server.MachineToken = ""
+			c.Server.EnrollmentCode = "enr_code"
+		}, true},
+		{"signing secret", func(c *config.Config) { c.Server.SigningSecret = "msecret_0123456789abcdef" }, true},
+		{"additional server", func(c *config.Config) {
+			c.Server.Servers = []config.ServerEndpoint{{URL: "https://backup.example.com", MachineToken: "mtoken_b"}}
+		}, true},
+		{"stream", func(c *config.Config) { c.Server.Stream.Enabled = true }, true},
+		{"commands", func(c *config.Config) { c.Server.Commands.Enabled = true }, true},
+		{"buffer", func(c *config.Config) { c.Buffer.MaxSizeMB = 1 }, true},
+		{"mqtt", func(c *config.Config) { c.MQTT.Enabled = true }, true},
+		{"file output", func(c *config.Config) { c.FileOutput.Enabled = true }, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			current := config.DefaultConfig()
+			current.Server.URL = "https://metrics.example.com"
+			current.Server.MachineToken = "mtoken_test"
+			next := config.DefaultConfig()
+			next.Server.URL = current.Server.URL
+			next.Server.MachineToken = current.Server.MachineToken
+			tc.change(next)
+
+			if got := needsRestart(current, next); got != tc.want {
+				t.Errorf("needsRestart = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestWatchConfig_FileChange(t *testing.T) {
+	path := useConfigFile(t)
+	writeConfig(t, path, "15s", true)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	reloads := watchConfig(ctx, loadTestConfig(t), zap.NewNop())
+
+	writeConfig(t, path, "5s", true)
+	if next := nextReload(t, reloads); next.Collection.Interval.Duration != 5*time.Second {
+		t.Errorf("reloaded interval = %s, want 5s", next.Collection.Interval)
+	}
+	noReload(t, reloads, 1500*time.Millisecond)
+
+	// An invalid file is not reloaded, and the watch goes on.
+	writeFile(t, path, "server: [")
+	noReload(t, reloads, 1500*time.Millisecond)
+	writeConfig(t, path, "20s", true)
+	if next := nextReload(t, reloads); next.Collection.Interval.Duration != 20*time.Second {
+		t.Errorf("reloaded interval = %s, want 20s", next.Collection.Interval)
+	}
+}
+
+func TestWatchConfig_IgnoresFileWithoutWatchFile(t *testing.T) {
+	path := useConfigFile(t)
+	writeConfig(t, path, "15s", false)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	cfg := loadTestConfig(t)
+	cfg.Reload.WatchInterval.Duration = 10 * time.Millisecond
+	reloads := watchConfig(ctx, cfg, zap.NewNop())
+
+	writeConfig(t, path, "5s", false)
+	noReload(t, reloads, 200*time.Millisecond)
+}
+
+func TestRun_KeepsConfigWhenRestartFails(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer srv.Close()
+	path := useConfigFile(t)
+	dir := filepath.Dir(path)
+	agentConfig := func(dbPath string) string {
+		return fmt.Sprintf(`server:
+  url: %s
+  machine_token: mtoken_test
+buffer:
+  db_path: %s
+reload:
+  watch_file: true
+  watch_interval: 1s
+`, srv.URL, dbPath)
+	}
+	writeFile(t, path, agentConfig(filepath.Join(dir, "data")))
+	// A directory cannot be created under a regular file, even as root
+	blocked := filepath.Join(dir, "file")
+	writeFile(t, blocked, "")
+
+	core, logs := observer.New(zapcore.InfoLevel)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		run(ctx, loadTestConfig(t), zap.New(core))
+		close(done)
+	}()
+	waitLogged(t, logs, "Agent running", 1)
+
+	writeFile(t, path, agentConfig(filepath.Join(blocked, "data")))
+	waitLogged(t, logs, "Invalid configuration, keeping the current one", 1)
+	entry := logs.FilterMessage("Invalid configuration, keeping the current one").All()[0]
+	if err, _ := entry.ContextMap()["error"].(string); !strings.Contains(err, "initialize buffer") {
+		t.Errorf("logged error %q, want the buffer failure", err)
+	}
+	// The components run again with the previous configuration
+	waitLogged(t, logs, "Agent running", 2)
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("agent did not stop")
+	}
+}
+
+func TestSettings_Reload(t *testing.T) {
+	var moved atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost && r.Header.Get("Authorization") == "Bearer mtoken_new" {
+			moved.Add(1)
+		}
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer srv.Close()
+	defer logLevel.SetLevel(logLevel.Level())
+
+	cfg := config.DefaultConfig()
+	cfg.Server.URL = "http://127.0.0.1:1"
+	cfg.Server.MachineToken = "mtoken_test"
+	cfg.Buffer.DBPath = t.TempDir()
+	live := newSettings(t, cfg)
+
+	next := *cfg
+	next.Collection.Interval.Duration = 5 * time.Second
+	next.Logging.Level = "debug"
+	next.Update.CheckInterval.Duration = time.Hour
+	next.Server.URL = srv.URL
+	next.Server.MachineToken = "mtoken_new"
+	if err := live.Reload(context.Background(), &next); err != nil {
+		t.Fatalf("Reload: %v", err)
+	}
+	if live.Config() != &next {
+		t.Error("Config() does not return the reloaded configuration")
+	}
+	if logLevel.Level() != zapcore.DebugLevel {
+		t.Errorf("log level = %s, want debug", logLevel.Level())
+	}
+	live.sender.Send([]models.MetricSnapshot{{CPUOverall: 1}})
+	if moved.Load() != 1 {
+		t.Errorf("new server got %d batches with the new token, want 1", moved.Load())
+	}
+}
+
+func TestSettings_ReloadConflictingWithOverrides(t *testing.T) {
+	cfg := config.DefaultConfig()
+	cfg.Collection.BatchInterval.Duration = 2 * time.Minute
+	live := newSettings(t, cfg)
+	if err := live.SetOverrides(remoteconfig.Overrides{Interval: 60}); err != nil {
+		t.Fatal(err)
+	}
+
+	// A 30s batch interval is shorter than the overridden 60s interval.
+	next := *cfg
+	next.Collection.BatchInterval.Duration = 30 * time.Second
+	if err := live.Reload(context.Background(), &next); err == nil {
+		t.Fatal("Reload succeeded with a config that conflicts with the overrides")
+	}
+	if live.Config() != cfg {
+		t.Error("a rejected reload replaced the configuration")
+	}
+}
+
+// newSettings returns settings for cfg with the components a reload
+// changes, and a sender unless the server URL is unset.
+func newSettings(t *testing.T, cfg *config.Config) *settings {
+	t.Helper()
+	registry := collector.NewRegistry(zap.NewNop())
+	processes := collector.NewProcessCollector(cfg.Collection.TopProcesses)
+	registry.Register(processes)
+	s := &settings{
+		registry:  registry,
+		sched:     scheduler.New(registry, cfg, zap.NewNop()),
+		processes: processes,
+		upd:       updater.New("dev", updater.Config{}, zap.NewNop()),
+		cfg:       cfg,
+	}
+	if cfg.Server.URL != "" {
+		snd, err := sender.New(cfg, zap.NewNop(), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.sender = snd
+	}
+	return s
+}
+
+// useConfigFile makes the agent find its config file in a temporary
+// directory, ignoring the environment, and returns the file's path.
+func useConfigFile(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+	for _, name := range []string{"SA_SERVER_URL", "SA_MACHINE_TOKEN", "SA_ENROLLMENT_CODE", "SA_LOG_LEVEL"} {
+		t.Setenv(name, "")
+	}
+	return filepath.Join(dir, "vitalis-config.yaml")
+}
+
+// writeConfig writes a valid config file with the given collection
+// interval.
+func writeConfig(t *testing.T, path, interval string, watch bool) {
+	t.Helper()
+	writeFile(t, path, fmt.Sprintf(`server:
+  url: http://localhost:8080
+  machine_token: mtoken_test
+collection:
+  interval: %s
+reload:
+  watch_file: %t
+  watch_interval: 1s
+`, interval, watch))
+}
+
+// writeFile replaces the file at path in one step, so it is never seen
+// half written.
+func writeFile(t *testing.T, path, data string) {
+	t.Helper()
+	if err := os.WriteFile(path+".tmp", []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func loadTestConfig(t *testing.T) *config.Config {
+	t.Helper()
+	cfg, err := loadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cfg
+}
+
+func nextReload(t *testing.T, reloads <-chan *config.Config) *config.Config {
+	t.Helper()
+	select {
+	case next := <-reloads:
+		return next
+	case <-time.After(5 * time.Second):
+		t.Fatal("configuration was not reloaded")
+		return nil
+	}
+}
+
+// waitLogged waits until msg has been logged n times.
+func waitLogged(t *testing.T, logs *observer.ObservedLogs, msg string, n int) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for logs.FilterMessage(msg).Len() < n {
+		if time.Now().After(deadline) {
+			t.Fatalf("%q logged %d times, want %d", msg, logs.FilterMessage(msg).Len(), n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// noReload fails if a reload arrives within wait.
+func noReload(t *testing.T, reloads <-chan *config.Config, wait time.Duration) {
+	t.Helper()
+	select {
+	case next := <-reloads:
+		t.Fatalf("unexpected reload with interval %s", next.Collection.Interval)
+	case <-time.After(wait):
+	}
+}
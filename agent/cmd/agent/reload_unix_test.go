@@ -0,0 +1,37 @@
+//go:build !windows
+
+package main
+
+import (
+	"context"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func TestWatchConfig_SIGHUP(t *testing.T) {
+	path := useConfigFile(t)
+	writeConfig(t, path, "15s", false)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	reloads := watchConfig(ctx, loadTestConfig(t), zap.NewNop())
+
+	writeConfig(t, path, "5s", false)
+	if err := syscall.Kill(os.Getpid(), syscall.SIGHUP); err != nil {
+		t.Fatal(err)
+	}
+	if next := nextReload(t, reloads); next.Collection.Interval.Duration != 5*time.Second {
+		t.Errorf("reloaded interval = %s, want 5s", next.Collection.Interval)
+	}
+	noReload(t, reloads, 200*time.Millisecond)
+
+	// An invalid file keeps the current configuration.
+	writeFile(t, path, "server: [")
+	if err := syscall.Kill(os.Getpid(), syscall.SIGHUP); err != nil {
+		t.Fatal(err)
+	}
+	noReload(t, reloads, 200*time.Millisecond)
+}
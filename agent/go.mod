@@ -1,10 +1,12 @@
 module github.com/Guliveer/vitalis/agent
 
-go 1.21
+go 1.22
 
 require (
+	github.com/klauspost/compress v1.18.0
 	github.com/shirou/gopsutil/v3 v3.24.1
 	go.uber.org/zap v1.27.0
+	golang.org/x/crypto v0.19.0
 	golang.org/x/sys v0.17.0
 	gopkg.in/yaml.v3 v3.0.1
 )
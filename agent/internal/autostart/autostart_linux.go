@@ -20,6 +20,7 @@ Wants=network-online.target
 [Service]
 Type=simple
 ExecStart={execPath}
+ExecReload=/bin/kill -HUP $MAINPID
 Restart=always
 RestartSec=10
 StandardOutput=journal
@@ -44,6 +45,7 @@ After=default.target
 [Service]
 Type=simple
 ExecStart={execPath}
+ExecReload=/bin/kill -HUP $MAINPID
 Restart=always
 RestartSec=10
 
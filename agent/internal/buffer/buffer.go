@@ -1,152 +1,715 @@
 // Package buffer provides a local file-based buffer for offline metric storage.
-// Metrics are written as timestamped JSON files when the API is unavailable.
+// Metrics are appended to a segmented write-ahead log when the API is unavailable.
 // Data persists across crashes and reboots. Auto-cleanup enforces size limits.
 package buffer
 
 import (
+	"bytes"
+	"crypto/cipher"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"os"
 	"path/filepath"
+	"sort"
 	"sync"
 	"time"
 
 	"go.uber.org/zap"
 
+	"github.com/Guliveer/vitalis/agent/internal/config"
 	"github.com/Guliveer/vitalis/agent/internal/models"
 )
 
-// Buffer provides local file-based storage for metrics when the API is unavailable.
-// Each batch is stored as a separate timestamped JSON file in the configured directory.
+const (
+	// maxSegmentSize is the size at which the active segment is closed and a
+	// new one started. Smaller buffers use smaller segments so eviction,
+	// which works a segment at a time, stays fine-grained.
+	maxSegmentSize = 4 * 1024 * 1024
+
+	// CursorFile persists the position of the oldest unacknowledged record.
+	CursorFile = "cursor.json"
+
+	// lockFile is held locked while a process has the buffer open for writing.
+	lockFile = "buffer.lock"
+
+	// tmpSuffix marks a file that is still being written.
+	tmpSuffix = ".tmp"
+)
+
+// Buffer provides local storage for metrics when the API is unavailable.
+// Batches are appended as gzip-compressed, checksummed records to fixed-size
+// segment files; an in-memory index tracks record positions and sizes, and
+// whole segments are evicted oldest first when the size limit is reached.
+//
+// Batches are consumed with Peek, then acknowledged with Ack once the server
+// has confirmed receipt, or released with Nack for a later attempt. The
+// position of the oldest unacknowledged batch is persisted, so nothing is
+// lost if the agent crashes mid-flush.
 type Buffer struct {
-	dir       string
-	maxSizeMB int
-	logger    *zap.Logger
-	mu        sync.Mutex
+	dir         string
+	maxBytes    int64
+	segmentSize int64
+	maxAge      time.Duration
+	downsample  int
+	logger      *zap.Logger
+	key         *Key        // nil unless encryption is enabled
+	salt        []byte      // of new segments
+	aead        cipher.AEAD // for new records, nil unless encryption is enabled
+	readOnly    bool
+	lock        *os.File
+	mu          sync.Mutex
+
+	segments []*segment // oldest first; the last one is appended to
+	nextID   uint64
+	active   *os.File
+	head     int // index of the first unacknowledged record in segments[0]
+	size     int64
+	pending  int // stored batches not yet acknowledged
+
+	acked    map[string]bool // acknowledged out of order, beyond head
+	inFlight map[string]bool // peeked but not yet acked or nacked
+
+	now func() time.Time
+}
+
+// Entry is a buffered batch returned by Peek.
+type Entry struct {
+	// ID identifies the batch for Ack and Nack.
+	ID     string
+	Stored time.Time
+	Batch  models.MetricBatch
+}
+
+// cursor is the persisted position of the oldest unacknowledged record.
+type cursor struct {
+	Segment uint64 `json:"segment"`
+	Offset  int64  `json:"offset"`
+}
+
+// ErrLocked is returned by New when another process (usually the running
+// agent) has the buffer open.
+var ErrLocked = errors.New("buffer is in use by another process (is the agent running?)")
+
+// errReadOnly is returned by modifying operations on a read-only buffer.
+var errReadOnly = errors.New("buffer is open read-only")
+
+// New opens (or creates) the buffer in cfg.DBPath. Segments are scanned to
+// rebuild the index; a record torn by a crash is truncated. Batch files
+// written by older agent versions are migrated into the log. If encryption
+// is enabled, new records are encrypted and the key file is created if
+// needed. Only one process can have a buffer open with New at a time.
+func New(cfg config.BufferConfig, logger *zap.Logger) (*Buffer, error) {
+	return open(cfg, logger, false)
 }
 
-// New creates a new file-based buffer at the given directory path.
-// The directory is created if it does not exist.
-func New(dir string, maxSizeMB int, logger *zap.Logger) (*Buffer, error) {
+// OpenReadOnly opens the buffer for inspection without taking the lock or
+// modifying anything on disk, so it can be used while the agent is running.
+// Store, Ack and Purge fail on a read-only buffer.
+func OpenReadOnly(cfg config.BufferConfig, logger *zap.Logger) (*Buffer, error) {
+	if _, err := os.Stat(cfg.DBPath); err != nil {
+		return nil, err
+	}
+	return open(cfg, logger, true)
+}
+
+// open implements New and OpenReadOnly.
+func open(cfg config.BufferConfig, logger *zap.Logger, readOnly bool) (*Buffer, error) {
+	dir := cfg.DBPath
 	if err := os.MkdirAll(dir, 0750); err != nil {
 		return nil, err
 	}
-	return &Buffer{
-		dir:       dir,
-		maxSizeMB: maxSizeMB,
-		logger:    logger,
-	}, nil
+
+	var lock *os.File
+	if !readOnly {
+		f, err := os.OpenFile(filepath.Join(dir, lockFile), os.O_RDWR|os.O_CREATE, 0640)
+		if err != nil {
+			return nil, fmt.Errorf("open buffer lock: %w", err)
+		}
+		if err := tryLock(f); err != nil {
+			f.Close()
+			return nil, ErrLocked
+		}
+		lock = f
+	}
+
+	key, err := LoadKey(cfg, !readOnly)
+	if err == nil {
+		var b *Buffer
+		if b, err = newBuffer(cfg, logger, key, lock, readOnly); err == nil {
+			return b, nil
+		}
+	}
+	if lock != nil {
+		lock.Close()
+	}
+	return nil, err
 }
 
-// Store saves a batch of metrics to a timestamped JSON file.
-// If the buffer exceeds the configured size limit, the oldest batch is dropped.
-func (b *Buffer) Store(metrics []models.MetricSnapshot) error {
-	b.mu.Lock()
-	defer b.mu.Unlock()
+// newBuffer builds the Buffer and loads its index.
+func newBuffer(cfg config.BufferConfig, logger *zap.Logger, key *Key, lock *os.File, readOnly bool) (*Buffer, error) {
+	dir := cfg.DBPath
+	if !readOnly {
+		if tmps, err := filepath.Glob(filepath.Join(dir, "*"+tmpSuffix)); err == nil {
+			for _, tmp := range tmps {
+				os.Remove(tmp)
+			}
+		}
+	}
 
-	// Enforce size limit by dropping oldest batches
-	if b.currentSizeMB() >= b.maxSizeMB {
-		b.logger.Warn("Buffer full, dropping oldest batch")
-		b.dropOldest()
+	maxBytes := int64(cfg.MaxSizeMB) * 1024 * 1024
+	segmentSize := int64(maxSegmentSize)
+	if maxBytes/8 < segmentSize {
+		segmentSize = maxBytes / 8
+	}
+	if segmentSize < 64*1024 {
+		segmentSize = 64 * 1024
 	}
 
-	filename := filepath.Join(b.dir, time.Now().UTC().Format("20060102T150405.000")+".json")
-	data, err := json.Marshal(metrics)
+	b := &Buffer{
+		dir:         dir,
+		maxBytes:    maxBytes,
+		segmentSize: segmentSize,
+		maxAge:      cfg.MaxAge.Duration,
+		downsample:  cfg.Downsample,
+		logger:      logger,
+		key:         key,
+		readOnly:    readOnly,
+		lock:        lock,
+		acked:       make(map[string]bool),
+		inFlight:    make(map[string]bool),
+		now:         time.Now,
+	}
+	if err := b.load(); err != nil {
+		b.closeFiles()
+		return nil, err
+	}
+	if readOnly {
+		return b, nil
+	}
+	if err := b.migrateLegacy(); err != nil {
+		b.closeFiles()
+		return nil, err
+	}
+	return b, nil
+}
+
+// load rebuilds the in-memory index from the segment files and the cursor.
+func (b *Buffer) load() error {
+	entries, err := os.ReadDir(b.dir)
 	if err != nil {
 		return err
 	}
+	var ids []uint64
+	for _, e := range entries {
+		if id, ok := parseSegmentID(e.Name()); ok && !e.IsDir() {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
 
-	return os.WriteFile(filename, data, 0640)
-}
+	var cur cursor
+	if data, err := os.ReadFile(filepath.Join(b.dir, CursorFile)); err == nil {
+		if err := json.Unmarshal(data, &cur); err != nil {
+			b.logger.Warn("Failed to parse buffer cursor, replaying whole buffer", zap.Error(err))
+			cur = cursor{}
+		}
+	}
 
-// RetrieveAll reads all buffered batches and removes the corresponding files.
-// Corrupted files are removed and logged. Returns batches in chronological order.
-func (b *Buffer) RetrieveAll() ([][]models.MetricSnapshot, error) {
-	b.mu.Lock()
-	defer b.mu.Unlock()
+	// Never reuse the id of a segment the cursor may still refer to.
+	b.nextID = cur.Segment + 1
+	if n := len(ids); n > 0 && ids[n-1] >= b.nextID {
+		b.nextID = ids[n-1] + 1
+	}
 
-	entries, err := os.ReadDir(b.dir)
-	if err != nil {
-		return nil, err
+	if err := b.loadSalt(ids); err != nil {
+		return err
 	}
 
-	var batches [][]models.MetricSnapshot
-	for _, entry := range entries {
-		if entry.IsDir() || filepath.Ext(entry.Name()) != ".json" {
+	for _, id := range ids {
+		path := segmentPath(b.dir, id)
+		if id < cur.Segment {
+			// Fully acknowledged before a crash prevented its removal.
+			if !b.readOnly {
+				os.Remove(path)
+			}
 			continue
 		}
+		seg, truncated, err := scanSegment(path, id, !b.readOnly, segmentHeader(b.salt))
+		if err != nil {
+			return fmt.Errorf("scan buffer segment %s: %w", path, err)
+		}
+		if truncated > 0 {
+			b.logger.Warn("Truncated torn record in buffer segment",
+				zap.String("segment", path),
+				zap.Int64("bytes", truncated))
+		}
+		b.segments = append(b.segments, seg)
+		b.size += seg.size
+		b.pending += len(seg.records)
+	}
+
+	if len(b.segments) > 0 && b.segments[0].id == cur.Segment {
+		for b.head < len(b.segments[0].records) && b.segments[0].records[b.head].offset < cur.Offset {
+			b.head++
+		}
+		b.pending -= b.head
+	}
 
-		path := filepath.Join(b.dir, entry.Name())
-		data, err := os.ReadFile(path)
+	if b.readOnly {
+		return nil
+	}
+	if len(b.segments) == 0 {
+		return b.roll()
+	}
+	last := b.segments[len(b.segments)-1]
+	if !bytes.Equal(last.salt, b.salt) {
+		// Records are only appended to a segment with the buffer's salt
+		return b.roll()
+	}
+	f, err := os.OpenFile(last.path, os.O_WRONLY|os.O_APPEND, 0640)
+	if err != nil {
+		return err
+	}
+	b.active = f
+	return nil
+}
+
+// loadSalt picks the salt for new segments: that of the newest segment
+// with one, so the key is derived only once, or a new random salt.
+func (b *Buffer) loadSalt(ids []uint64) error {
+	for i := len(ids) - 1; i >= 0 && b.salt == nil; i-- {
+		f, err := os.Open(segmentPath(b.dir, ids[i]))
 		if err != nil {
-			b.logger.Warn("Failed to read buffer file",
-				zap.String("file", path),
-				zap.Error(err))
 			continue
 		}
+		b.salt, _, _ = readSegmentHeader(f)
+		f.Close()
+	}
+	if b.salt == nil {
+		salt, err := newSalt()
+		if err != nil {
+			return err
+		}
+		b.salt = salt
+	}
+	aead, err := b.key.aead(b.salt)
+	if err != nil {
+		return err
+	}
+	b.aead = aead
+	return nil
+}
 
-		var batch []models.MetricSnapshot
-		if err := json.Unmarshal(data, &batch); err != nil {
-			b.logger.Warn("Failed to parse buffer file, removing corrupted file",
-				zap.String("file", path),
-				zap.Error(err))
-			os.Remove(path)
-			continue
+// Store appends a batch to the log and syncs it to disk. Its batch ID and
+// sequence number are kept; the machine token is not stored.
+// Expired batches are dropped first. If the buffer would be more than 80%
+// full, old segments are downsampled; if it would still exceed the size
+// limit, the oldest segments are dropped until the batch fits.
+func (b *Buffer) Store(batch models.MetricBatch) error {
+	if b.readOnly {
+		return errReadOnly
+	}
+	now := b.now()
+	rec, err := encodeRecord(batch, now, b.aead, 0)
+	if err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.expire(now)
+	b.compact(int64(len(rec)))
+	b.evictFor(int64(len(rec)))
+
+	if last := b.segments[len(b.segments)-1]; last.size+int64(len(rec)) > b.segmentSize && len(last.records) > 0 {
+		if err := b.roll(); err != nil {
+			return err
 		}
+	}
+	return b.append(rec, now)
+}
 
-		batches = append(batches, batch)
-		os.Remove(path) // Remove after successful read
+// append writes a record to the active segment and indexes it.
+// Must be called with b.mu held.
+func (b *Buffer) append(rec []byte, stored time.Time) error {
+	last := b.segments[len(b.segments)-1]
+	if _, err := b.active.Write(rec); err != nil {
+		// Cut off whatever part of the record made it to disk.
+		b.active.Truncate(last.size)
+		return fmt.Errorf("append buffer record: %w", err)
+	}
+	if err := b.active.Sync(); err != nil {
+		return fmt.Errorf("sync buffer segment: %w", err)
 	}
 
-	return batches, nil
+	meta := recordMeta{
+		offset: last.size,
+		size:   int64(len(rec)),
+		stored: time.UnixMilli(stored.UnixMilli()),
+		flags:  rec[16],
+	}
+	last.records = append(last.records, meta)
+	last.size += meta.size
+	b.size += meta.size
+	b.pending++
+	return nil
 }
 
-// Count returns the number of buffered batch files.
-func (b *Buffer) Count() int {
-	entries, err := os.ReadDir(b.dir)
+// roll closes the active segment and starts a new one.
+// Must be called with b.mu held (or during New).
+func (b *Buffer) roll() error {
+	id := b.nextID
+	path := segmentPath(b.dir, id)
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC|os.O_APPEND, 0640)
 	if err != nil {
-		return 0
+		return fmt.Errorf("create buffer segment: %w", err)
 	}
-	count := 0
-	for _, e := range entries {
-		if !e.IsDir() && filepath.Ext(e.Name()) == ".json" {
-			count++
+	header := segmentHeader(b.salt)
+	if _, err := f.Write(header); err != nil {
+		f.Close()
+		return fmt.Errorf("create buffer segment: %w", err)
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return fmt.Errorf("create buffer segment: %w", err)
+	}
+	syncDir(b.dir)
+
+	if b.active != nil {
+		b.active.Close()
+	}
+	b.active = f
+	b.nextID++
+	b.segments = append(b.segments, &segment{id: id, path: path, salt: b.salt, size: int64(len(header))})
+	b.size += int64(len(header))
+	return nil
+}
+
+// evictFor drops the oldest segments until a record of n bytes fits within
+// the size limit.
+// Must be called with b.mu held.
+func (b *Buffer) evictFor(n int64) {
+	for b.size+n > b.maxBytes {
+		if len(b.segments) == 1 {
+			if len(b.segments[0].records) == 0 {
+				return // a single record larger than the limit: keep it anyway
+			}
+			if err := b.roll(); err != nil {
+				b.logger.Error("Failed to start new buffer segment", zap.Error(err))
+				return
+			}
 		}
+
+		oldest := b.segments[0]
+		dropped := b.unacked(oldest)
+		b.removeOldest()
+		b.logger.Warn("Buffer full, dropping oldest segment",
+			zap.String("segment", oldest.path),
+			zap.Int("batches", dropped))
 	}
-	return count
 }
 
-// currentSizeMB returns the total size of all buffer files in megabytes.
+// unacked counts the records of the oldest segment not yet acknowledged.
 // Must be called with b.mu held.
-func (b *Buffer) currentSizeMB() int {
-	var totalSize int64
-	entries, err := os.ReadDir(b.dir)
+func (b *Buffer) unacked(oldest *segment) int {
+	return b.unackedFrom(oldest, b.head)
+}
+
+// removeOldest deletes the oldest segment and moves the cursor to the next.
+// Must be called with b.mu held, with at least two segments.
+func (b *Buffer) removeOldest() {
+	oldest := b.segments[0]
+	b.pending -= b.unacked(oldest)
+	for _, r := range oldest.records {
+		id := recordID(oldest.id, r.offset)
+		delete(b.acked, id)
+		delete(b.inFlight, id)
+	}
+
+	b.segments = b.segments[1:]
+	b.size -= oldest.size
+	b.head = 0
+	b.saveCursor()
+
+	if err := os.Remove(oldest.path); err != nil && !os.IsNotExist(err) {
+		b.logger.Warn("Failed to remove buffer segment",
+			zap.String("segment", oldest.path),
+			zap.Error(err))
+	}
+}
+
+// decode decodes the payload of a record in seg, decrypting it with the
+// key for the segment's salt.
+func (b *Buffer) decode(seg *segment, meta recordMeta, flags byte, payload []byte) (models.MetricBatch, error) {
+	aead, err := b.key.aead(seg.salt)
 	if err != nil {
-		return 0
+		return models.MetricBatch{}, err
 	}
-	for _, entry := range entries {
-		if info, err := entry.Info(); err == nil {
-			totalSize += info.Size()
+	return decodePayload(meta, flags, payload, aead)
+}
+
+// Peek returns up to n of the oldest buffered batches (all of them if n <= 0)
+// without removing them. Returned batches are not returned again by Peek
+// until they are released with Nack. Records that fail to decode or are
+// past the maximum age are dropped.
+func (b *Buffer) Peek(n int) ([]Entry, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := b.now()
+	b.expire(now)
+
+	var entries []Entry
+	for si, seg := range b.segments {
+		if n > 0 && len(entries) >= n {
+			break
+		}
+		records := seg.records
+		if si == 0 {
+			records = records[b.head:]
+		}
+		if len(records) == 0 {
+			continue
+		}
+
+		f, err := os.Open(seg.path)
+		if err != nil {
+			return entries, err
 		}
+		for _, r := range records {
+			if n > 0 && len(entries) >= n {
+				break
+			}
+			id := recordID(seg.id, r.offset)
+			if b.acked[id] || b.inFlight[id] {
+				continue
+			}
+			if b.expired(r, now) {
+				b.ackLocked(id)
+				continue
+			}
+
+			meta, flags, payload, err := readRecord(f, r.offset)
+			var batch models.MetricBatch
+			if err == nil {
+				batch, err = b.decode(seg, meta, flags, payload)
+			}
+			if err != nil {
+				b.logger.Warn("Failed to read buffer record, dropping it",
+					zap.String("segment", seg.path),
+					zap.Int64("offset", r.offset),
+					zap.Error(err))
+				b.ackLocked(id)
+				continue
+			}
+
+			b.inFlight[id] = true
+			entries = append(entries, Entry{ID: id, Stored: r.stored, Batch: batch})
+		}
+		f.Close()
+	}
+
+	b.advance()
+	return entries, nil
+}
+
+// Ack marks a delivered batch as consumed. Once every batch before it has
+// been acknowledged too, the cursor moves past it and fully consumed
+// segments are deleted.
+func (b *Buffer) Ack(id string) error {
+	if b.readOnly {
+		return errReadOnly
 	}
-	return int(totalSize / (1024 * 1024))
+	if _, _, err := parseRecordID(id); err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	delete(b.inFlight, id)
+	b.ackLocked(id)
+	b.advance()
+	return nil
 }
 
-// dropOldest removes the oldest buffer file to free space.
+// ackLocked records an acknowledgement.
 // Must be called with b.mu held.
-func (b *Buffer) dropOldest() {
-	entries, err := os.ReadDir(b.dir)
+func (b *Buffer) ackLocked(id string) {
+	if b.acked[id] || !b.contains(id) {
+		return
+	}
+	b.acked[id] = true
+	b.pending--
+}
+
+// contains reports whether id refers to a record that is still buffered and
+// not yet behind the cursor.
+// Must be called with b.mu held.
+func (b *Buffer) contains(id string) bool {
+	segID, offset, err := parseRecordID(id)
 	if err != nil {
+		return false
+	}
+	for si, seg := range b.segments {
+		if seg.id != segID {
+			continue
+		}
+		i := sort.Search(len(seg.records), func(i int) bool { return seg.records[i].offset >= offset })
+		if i == len(seg.records) || seg.records[i].offset != offset {
+			return false
+		}
+		return si > 0 || i >= b.head
+	}
+	return false
+}
+
+// advance moves the cursor past acknowledged records, deletes segments that
+// were fully consumed and persists the new cursor.
+// Must be called with b.mu held.
+func (b *Buffer) advance() {
+	if b.readOnly {
 		return
 	}
-	for _, entry := range entries {
-		if !entry.IsDir() && filepath.Ext(entry.Name()) == ".json" {
-			path := filepath.Join(b.dir, entry.Name())
-			if err := os.Remove(path); err != nil {
-				b.logger.Warn("Failed to remove oldest buffer file",
-					zap.String("file", path),
-					zap.Error(err))
+	moved := false
+	for len(b.segments) > 0 {
+		first := b.segments[0]
+		for b.head < len(first.records) {
+			id := recordID(first.id, first.records[b.head].offset)
+			if !b.acked[id] {
+				break
 			}
-			return // Remove just one
+			delete(b.acked, id)
+			b.head++
+			moved = true
+		}
+		if b.head < len(first.records) || len(b.segments) == 1 {
+			break
 		}
+		b.removeOldest()
+		moved = false // removeOldest saved the cursor
+	}
+	if moved {
+		b.saveCursor()
+	}
+}
+
+// saveCursor persists the position of the oldest unacknowledged record.
+// Must be called with b.mu held.
+func (b *Buffer) saveCursor() {
+	if len(b.segments) == 0 {
+		return
+	}
+	first := b.segments[0]
+	cur := cursor{Segment: first.id, Offset: first.size}
+	if b.head < len(first.records) {
+		cur.Offset = first.records[b.head].offset
+	}
+	data, err := json.Marshal(cur)
+	if err == nil {
+		err = writeFileAtomic(filepath.Join(b.dir, CursorFile), data, 0640)
+	}
+	if err != nil {
+		b.logger.Warn("Failed to save buffer cursor", zap.Error(err))
+	}
+}
+
+// Nack releases a batch that could not be delivered. It stays in the buffer,
+// in its original position, and is returned by the next Peek.
+func (b *Buffer) Nack(id string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.inFlight, id)
+}
+
+// Count returns the number of buffered batches not yet acknowledged.
+func (b *Buffer) Count() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.pending
+}
+
+// Size returns the number of bytes the buffer occupies on disk.
+func (b *Buffer) Size() int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.size
+}
+
+// Close releases the active segment file.
+func (b *Buffer) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.closeFiles()
+}
+
+// closeFiles releases the active segment and the lock.
+func (b *Buffer) closeFiles() error {
+	var err error
+	if b.active != nil {
+		err = b.active.Close()
+		b.active = nil
+	}
+	if b.lock != nil {
+		b.lock.Close()
+		b.lock = nil
+	}
+	return err
+}
+
+// recordID formats the opaque batch ID used by Peek, Ack and Nack.
+func recordID(segment uint64, offset int64) string {
+	return fmt.Sprintf("%d:%d", segment, offset)
+}
+
+// parseRecordID parses an ID created by recordID.
+func parseRecordID(id string) (uint64, int64, error) {
+	var segment uint64
+	var offset int64
+	if _, err := fmt.Sscanf(id, "%d:%d", &segment, &offset); err != nil {
+		return 0, 0, fmt.Errorf("invalid buffer entry id %q", id)
+	}
+	return segment, offset, nil
+}
+
+// writeFileAtomic writes data to a temporary file next to path, syncs it and
+// renames it over path, then syncs the directory so the rename is durable.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp := path + tmpSuffix
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	syncDir(filepath.Dir(path))
+	return nil
+}
+
+// syncDir makes renames and file creations in dir durable. It is best
+// effort: not every platform supports syncing a directory.
+func syncDir(dir string) {
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
 	}
 }
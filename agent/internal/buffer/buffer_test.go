@@ -0,0 +1,521 @@
+package buffer
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/Guliveer/vitalis/agent/internal/config"
+	"github.com/Guliveer/vitalis/agent/internal/models"
+)
+
+func newTestBuffer(t *testing.T) *Buffer {
+	t.Helper()
+	b, err := New(config.BufferConfig{DBPath: t.TempDir(), MaxSizeMB: 10}, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func store(t *testing.T, b *Buffer, cpu float64) {
+	t.Helper()
+	if err := b.Store(models.MetricBatch{Metrics: []models.MetricSnapshot{{CPUOverall: cpu}}}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// peekCPU returns the CPU value of each pending batch, oldest first,
+// releasing them again.
+func peekCPU(t *testing.T, b *Buffer) []float64 {
+	t.Helper()
+	entries, err := b.Peek(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var cpu []float64
+	for _, e := range entries {
+		cpu = append(cpu, e.Batch.Metrics[0].CPUOverall)
+		b.Nack(e.ID)
+	}
+	return cpu
+}
+
+func TestPeekAckNack(t *testing.T) {
+	b := newTestBuffer(t)
+	store(t, b, 1)
+	store(t, b, 2)
+
+	first, err := b.Peek(1)
+	if err != nil || len(first) != 1 || first[0].Batch.Metrics[0].CPUOverall != 1 {
+		t.Fatalf("Peek(1) = %+v, %v", first, err)
+	}
+
+	// An in-flight batch is not handed out twice.
+	second, _ := b.Peek(0)
+	if len(second) != 1 || second[0].Batch.Metrics[0].CPUOverall != 2 {
+		t.Fatalf("Peek(0) while in flight = %+v", second)
+	}
+
+	// Nack keeps the batch, in order; Ack removes it.
+	b.Nack(first[0].ID)
+	b.Nack(second[0].ID)
+	if got := b.Count(); got != 2 {
+		t.Fatalf("Count after Nack = %d, want 2", got)
+	}
+	again, _ := b.Peek(1)
+	if len(again) != 1 || again[0].ID != first[0].ID {
+		t.Fatalf("Peek after Nack = %+v, want %s", again, first[0].ID)
+	}
+	if err := b.Ack(again[0].ID); err != nil {
+		t.Fatal(err)
+	}
+	if got := b.Count(); got != 1 {
+		t.Errorf("Count after Ack = %d, want 1", got)
+	}
+}
+
+func TestNew_RemovesInterruptedWrites(t *testing.T) {
+	dir := t.TempDir()
+	tmp := filepath.Join(dir, CursorFile+tmpSuffix)
+	if err := os.WriteFile(tmp, []byte(`{"segm`), 0640); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := New(config.BufferConfig{DBPath: dir, MaxSizeMB: 10}, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(tmp); !os.IsNotExist(err) {
+		t.Error("temporary file from an interrupted write was not removed")
+	}
+	if entries, _ := b.Peek(0); len(entries) != 0 {
+		t.Errorf("Peek returned %d entries for an empty buffer", len(entries))
+	}
+}
+
+func TestStore_SameMillisecondDoesNotOverwrite(t *testing.T) {
+	b := newTestBuffer(t)
+	for i := 0; i < 100; i++ {
+		store(t, b, float64(i))
+	}
+	if got := b.Count(); got != 100 {
+		t.Errorf("Count = %d, want 100", got)
+	}
+}
+
+func TestReopen_ResumesAtCursorAndTruncatesTornRecord(t *testing.T) {
+	dir := t.TempDir()
+	b, err := New(config.BufferConfig{DBPath: dir, MaxSizeMB: 10}, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, cpu := range []float64{1, 2, 3} {
+		store(t, b, cpu)
+	}
+	entries, _ := b.Peek(2)
+	// Out-of-order ack: only the first record is behind the cursor.
+	if err := b.Ack(entries[1].ID); err != nil {
+		t.Fatal(err)
+	}
+	b.Nack(entries[0].ID)
+	entries, _ = b.Peek(1)
+	if err := b.Ack(entries[0].ID); err != nil {
+		t.Fatal(err)
+	}
+	b.Close()
+
+	// Simulate a crash in the middle of appending a record.
+	seg := segmentPath(dir, 1)
+	f, err := os.OpenFile(seg, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte{0, 0, 1, 0, 0xde, 0xad})
+	f.Close()
+	before, _ := os.Stat(seg)
+
+	b, err = New(config.BufferConfig{DBPath: dir, MaxSizeMB: 10}, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	if got := peekCPU(t, b); len(got) != 1 || got[0] != 3 {
+		t.Errorf("pending after reopen = %v, want [3]", got)
+	}
+	after, _ := os.Stat(seg)
+	if after.Size() != before.Size()-6 {
+		t.Errorf("torn record not truncated: size %d -> %d", before.Size(), after.Size())
+	}
+
+	// Appending after recovery produces readable records.
+	store(t, b, 4)
+	if got := peekCPU(t, b); len(got) != 2 || got[1] != 4 {
+		t.Errorf("pending after append = %v, want [3 4]", got)
+	}
+}
+
+func TestStore_EvictsOldestSegments(t *testing.T) {
+	b := newTestBuffer(t)
+	b.maxBytes = 4096
+	b.segmentSize = 1024
+
+	for i := 0; i < 200; i++ {
+		store(t, b, float64(i))
+	}
+	if b.Size() > b.maxBytes {
+		t.Errorf("Size = %d, exceeds limit %d", b.Size(), b.maxBytes)
+	}
+	got := peekCPU(t, b)
+	if len(got) == 0 || len(got) != b.Count() {
+		t.Fatalf("pending = %d entries, Count = %d", len(got), b.Count())
+	}
+	if got[0] == 0 || got[len(got)-1] != 199 {
+		t.Errorf("expected oldest batches evicted and newest kept, got %v", got)
+	}
+	for i := 1; i < len(got); i++ {
+		if got[i] != got[i-1]+1 {
+			t.Fatalf("pending batches not contiguous: %v", got)
+		}
+	}
+
+	// Acknowledging everything deletes all but the active segment.
+	entries, _ := b.Peek(0)
+	for _, e := range entries {
+		b.Ack(e.ID)
+	}
+	if b.Count() != 0 || len(b.segments) != 1 {
+		t.Errorf("after acking all: Count = %d, segments = %d", b.Count(), len(b.segments))
+	}
+}
+
+func TestNew_MigratesLegacyFiles(t *testing.T) {
+	dir := t.TempDir()
+	for i, name := range []string{"20240101T000000.000.json", "20240101T000001.000.json"} {
+		data := fmt.Sprintf(`[{"cpu_overall":%d}]`, i+1)
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(data), 0640); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	b, err := New(config.BufferConfig{DBPath: dir, MaxSizeMB: 10}, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	if got := peekCPU(t, b); len(got) != 2 || got[0] != 1 || got[1] != 2 {
+		t.Errorf("migrated batches = %v, want [1 2]", got)
+	}
+	if matches, _ := filepath.Glob(filepath.Join(dir, "2024*.json")); len(matches) != 0 {
+		t.Errorf("legacy files not removed: %v", matches)
+	}
+}
+
+func TestEncryption_SecretRoundTripAndWrongKey(t *testing.T) {
+	dir := t.TempDir()
+	cfg := config.BufferConfig{DBPath: dir, MaxSizeMB: 10}
+	cfg.Encryption = config.BufferEncryptionConfig{Enabled: true, Secret: "correct horse battery staple"}
+
+	b, err := New(cfg, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Store(models.MetricBatch{Metrics: []models.MetricSnapshot{{CPUOverall: 1, OSVersion: "secret-os"}}}); err != nil {
+		t.Fatal(err)
+	}
+	b.Close()
+
+	data, err := os.ReadFile(segmentPath(dir, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data[segmentHeaderSize+16]&flagEncrypted == 0 {
+		t.Fatal("record not marked as encrypted")
+	}
+
+	b, err = New(cfg, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := peekCPU(t, b); len(got) != 1 || got[0] != 1 {
+		t.Errorf("decrypted batches = %v, want [1]", got)
+	}
+	b.Close()
+
+	// A different key cannot decrypt the record: it is dropped like a
+	// corrupted one.
+	cfg.Encryption.Secret = "a different secret value"
+	b, err = New(cfg, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	if got := peekCPU(t, b); len(got) != 0 {
+		t.Errorf("wrong key decrypted %v", got)
+	}
+	if b.Count() != 0 {
+		t.Errorf("undecryptable record still counted: %d", b.Count())
+	}
+}
+
+func TestEncryption_SaltedSecretAndLegacySegments(t *testing.T) {
+	enc := config.BufferEncryptionConfig{Enabled: true, Secret: "correct horse battery staple"}
+	key, err := LoadKey(config.BufferConfig{Encryption: enc}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A segment written before salts were added, with the key derived by
+	// HMAC, stays readable.
+	dir := t.TempDir()
+	legacy, err := key.aead(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec, err := encodeRecord(models.MetricBatch{Metrics: []models.MetricSnapshot{{CPUOverall: 1}}}, time.Now(), legacy, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(segmentPath(dir, 1), append([]byte(legacyMagic), rec...), 0640); err != nil {
+		t.Fatal(err)
+	}
+	cfg := config.BufferConfig{DBPath: dir, MaxSizeMB: 10, Encryption: enc}
+	b, err := New(cfg, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	store(t, b, 2)
+	if got := peekCPU(t, b); len(got) != 2 || got[0] != 1 || got[1] != 2 {
+		t.Errorf("batches = %v, want [1 2]", got)
+	}
+	b.Close()
+
+	// New segments carry the buffer's salt, so they can be read elsewhere
+	// with the secret alone, and each buffer has its own salt.
+	seg, err := OpenSegment(segmentPath(dir, 2), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer seg.Close()
+	if batch, err := seg.Next(); err != nil || batch.Metrics[0].CPUOverall != 2 {
+		t.Errorf("Next() = %+v, %v, want the stored batch", batch, err)
+	}
+	other, err := New(config.BufferConfig{DBPath: t.TempDir(), MaxSizeMB: 10, Encryption: enc}, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	if string(other.salt) == string(b.salt) {
+		t.Error("two buffers share a salt")
+	}
+}
+
+func TestLoadKey_GeneratesKeyFile(t *testing.T) {
+	dir := t.TempDir()
+	cfg := config.BufferConfig{DBPath: dir}
+	cfg.Encryption.Enabled = true
+
+	if _, err := LoadKey(cfg, false); err == nil {
+		t.Error("expected error for a missing key file without create")
+	}
+
+	key, err := LoadKey(cfg, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(filepath.Join(dir, defaultKeyFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if runtime.GOOS != "windows" && info.Mode().Perm() != 0600 {
+		t.Errorf("key file mode = %v, want 0600", info.Mode().Perm())
+	}
+
+	again, err := LoadKey(cfg, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(again.raw) != string(key.raw) {
+		t.Error("key file was regenerated instead of reused")
+	}
+}
+
+// fill stores n batches of 8 snapshots each, numbered by batch, into a
+// small buffer and returns the pending batches.
+func fill(t *testing.T, downsample, n int) []Entry {
+	t.Helper()
+	b, err := New(config.BufferConfig{DBPath: t.TempDir(), MaxSizeMB: 10, Downsample: downsample}, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { b.Close() })
+	b.maxBytes = 32 * 1024
+	b.segmentSize = 2 * 1024
+
+	for i := 0; i < n; i++ {
+		batch := make([]models.MetricSnapshot, 8)
+		for j := range batch {
+			batch[j] = models.MetricSnapshot{CPUOverall: float64(i), RAMUsed: uint64(i*8 + j*7919)}
+		}
+		if err := b.Store(models.MetricBatch{BatchID: fmt.Sprintf("batch-%d", i), Sequence: uint64(i + 1), Metrics: batch}); err != nil {
+			t.Fatal(err)
+		}
+		if b.Size() > b.maxBytes {
+			t.Fatalf("Size = %d, exceeds limit %d", b.Size(), b.maxBytes)
+		}
+	}
+
+	entries, err := b.Peek(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != b.Count() {
+		t.Fatalf("Peek returned %d entries, Count = %d", len(entries), b.Count())
+	}
+	return entries
+}
+
+func TestStore_DownsamplesBeforeEvicting(t *testing.T) {
+	const n = 600
+	plain := fill(t, 0, n)
+	sampled := fill(t, 4, n)
+
+	// Downsampling keeps history further back than plain eviction.
+	if sampled[0].Batch.Metrics[0].CPUOverall >= plain[0].Batch.Metrics[0].CPUOverall {
+		t.Errorf("oldest batch with downsampling = %v, without = %v; expected older history",
+			sampled[0].Batch.Metrics[0].CPUOverall, plain[0].Batch.Metrics[0].CPUOverall)
+	}
+
+	// Old batches are thinned out, the newest keep full detail.
+	if got := len(sampled[0].Batch.Metrics); got >= 8 {
+		t.Errorf("oldest batch has %d snapshots, expected it to be downsampled", got)
+	}
+	last := sampled[len(sampled)-1]
+	if len(last.Batch.Metrics) != 8 || last.Batch.Metrics[0].CPUOverall != n-1 {
+		t.Errorf("newest batch = %d snapshots of batch %v, want 8 of %d",
+			len(last.Batch.Metrics), last.Batch.Metrics[0].CPUOverall, n-1)
+	}
+
+	// Downsampled batches keep their ID and sequence number.
+	oldest := sampled[0].Batch
+	i := int(oldest.Metrics[0].CPUOverall)
+	if oldest.BatchID != fmt.Sprintf("batch-%d", i) || oldest.Sequence != uint64(i+1) {
+		t.Errorf("downsampled batch %d has ID %q, sequence %d", i, oldest.BatchID, oldest.Sequence)
+	}
+}
+
+func TestStore_KeepsBatchIDButNotToken(t *testing.T) {
+	b := newTestBuffer(t)
+	defer b.Close()
+
+	batch := models.MetricBatch{
+		MachineToken: "mtoken_secret",
+		BatchID:      "6f1c2d3e-4a5b-4c6d-8e7f-901234567890",
+		Sequence:     42,
+		Metrics:      []models.MetricSnapshot{{CPUOverall: 1}},
+	}
+	if err := b.Store(batch); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := b.Peek(0)
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("Peek = %+v, %v", entries, err)
+	}
+	got := entries[0].Batch
+	if got.BatchID != batch.BatchID || got.Sequence != batch.Sequence {
+		t.Errorf("batch ID and sequence = %q, %d; want %q, %d", got.BatchID, got.Sequence, batch.BatchID, batch.Sequence)
+	}
+	if got.MachineToken != "" {
+		t.Error("machine token was written to the buffer")
+	}
+}
+
+func TestDecodePayload_LegacyArray(t *testing.T) {
+	meta := recordMeta{stored: time.UnixMilli(1700000000000)}
+	batch, err := decodePayload(meta, 0, []byte(`[{"cpu_overall": 7}]`), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if batch.BatchID != "" || len(batch.Metrics) != 1 || batch.Metrics[0].CPUOverall != 7 {
+		t.Errorf("decoded legacy record = %+v", batch)
+	}
+}
+
+func TestMaxAge_DropsExpiredBatches(t *testing.T) {
+	b, err := New(config.BufferConfig{DBPath: t.TempDir(), MaxSizeMB: 10, MaxAge: config.Duration{Duration: time.Hour}}, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	now := time.Unix(1700000000, 0)
+	b.now = func() time.Time { return now }
+	store(t, b, 1)
+	if err := b.roll(); err != nil {
+		t.Fatal(err)
+	}
+	now = now.Add(30 * time.Minute)
+	store(t, b, 2)
+
+	now = now.Add(45 * time.Minute) // the first batch is now 75 minutes old
+	store(t, b, 3)
+
+	if got := peekCPU(t, b); len(got) != 2 || got[0] != 2 || got[1] != 3 {
+		t.Errorf("pending = %v, want [2 3]", got)
+	}
+	if b.Count() != 2 {
+		t.Errorf("Count = %d, want 2", b.Count())
+	}
+	if _, err := os.Stat(segmentPath(b.dir, 1)); !os.IsNotExist(err) {
+		t.Error("expired segment was not removed")
+	}
+}
+
+func TestInspect_ReadOnlyWhileLocked(t *testing.T) {
+	dir := t.TempDir()
+	cfg := config.BufferConfig{DBPath: dir, MaxSizeMB: 10}
+	b, err := New(cfg, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	store(t, b, 1)
+	store(t, b, 2)
+
+	// A second writer is refused while the first holds the lock.
+	if _, err := New(cfg, zap.NewNop()); err != ErrLocked {
+		t.Fatalf("second New: err = %v, want ErrLocked", err)
+	}
+
+	ro, err := OpenReadOnly(cfg, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ro.Close()
+
+	stats := ro.Stats()
+	if stats.Batches != 2 || stats.Oldest.IsZero() || stats.Newest.Before(stats.Oldest) {
+		t.Errorf("stats = %+v", stats)
+	}
+	if records := ro.Records(); len(records) != 2 || records[0].Bytes == 0 {
+		t.Errorf("records = %+v", records)
+	}
+	if _, err := ro.Purge(); err == nil {
+		t.Error("Purge succeeded on a read-only buffer")
+	}
+
+	n, err := b.Purge()
+	if err != nil || n != 2 {
+		t.Fatalf("Purge = %d, %v", n, err)
+	}
+	store(t, b, 3)
+	if got := peekCPU(t, b); len(got) != 1 || got[0] != 3 {
+		t.Errorf("pending after purge = %v, want [3]", got)
+	}
+}
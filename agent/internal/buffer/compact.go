@@ -0,0 +1,200 @@
+package buffer
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/Guliveer/vitalis/agent/internal/models"
+)
+
+// compactThreshold is the fill ratio above which old segments are
+// downsampled before anything is evicted.
+const compactThreshold = 0.8
+
+// expire drops batches older than the configured maximum age. Whole
+// segments are removed once their newest batch has expired; individual
+// expired batches in a partly expired segment are skipped by Peek.
+// Must be called with b.mu held.
+func (b *Buffer) expire(now time.Time) {
+	if b.maxAge <= 0 || b.readOnly {
+		return
+	}
+	cutoff := now.Add(-b.maxAge)
+
+	for len(b.segments) > 1 {
+		oldest := b.segments[0]
+		if n := len(oldest.records); n > 0 && !oldest.records[n-1].stored.Before(cutoff) {
+			return
+		}
+		dropped := b.unacked(oldest)
+		b.removeOldest()
+		if dropped > 0 {
+			b.logger.Info("Dropped expired buffer segment",
+				zap.String("segment", oldest.path),
+				zap.Int("batches", dropped),
+				zap.Duration("max_age", b.maxAge))
+		}
+	}
+}
+
+// expired reports whether a record is past the configured maximum age.
+// Must be called with b.mu held.
+func (b *Buffer) expired(r recordMeta, now time.Time) bool {
+	return b.maxAge > 0 && r.stored.Before(now.Add(-b.maxAge))
+}
+
+// compact downsamples the oldest segments, keeping every Nth snapshot,
+// while adding n bytes would leave the buffer more than compactThreshold
+// full. After a long outage this keeps coarse history for the whole gap
+// instead of full detail for only the most recent part. Segments already
+// downsampled, the active segment and segments with batches in flight are
+// left alone.
+// Must be called with b.mu held.
+func (b *Buffer) compact(n int64) {
+	if b.downsample <= 1 {
+		return
+	}
+	limit := int64(float64(b.maxBytes) * compactThreshold)
+
+	for i := 0; i < len(b.segments)-1 && b.size+n > limit; i++ {
+		seg := b.segments[i]
+		if !b.compactable(seg) {
+			continue
+		}
+		before, kept, err := b.downsampleSegment(i)
+		if err != nil {
+			b.logger.Warn("Failed to downsample buffer segment",
+				zap.String("segment", seg.path),
+				zap.Error(err))
+			return
+		}
+		b.logger.Info("Downsampled buffer segment",
+			zap.String("segment", seg.path),
+			zap.Int64("bytes_before", before),
+			zap.Int64("bytes_after", seg.size),
+			zap.Int("snapshots_kept", kept))
+	}
+}
+
+// compactable reports whether a segment can be downsampled: it must hold
+// records that were not downsampled before, and none of them may be in
+// flight (their IDs change when the segment is rewritten).
+// Must be called with b.mu held.
+func (b *Buffer) compactable(seg *segment) bool {
+	fresh := false
+	for _, r := range seg.records {
+		id := recordID(seg.id, r.offset)
+		if b.inFlight[id] {
+			return false
+		}
+		if r.flags&flagDownsampled == 0 {
+			fresh = true
+		}
+	}
+	return fresh
+}
+
+// downsampleSegment rewrites segment i keeping every Nth snapshot of its
+// unacknowledged batches. The new segment is written to a temporary file
+// and renamed over the old one, so a crash leaves either version intact.
+// Returns the previous segment size and the number of snapshots kept.
+// Must be called with b.mu held.
+func (b *Buffer) downsampleSegment(i int) (int64, int, error) {
+	seg := b.segments[i]
+	skip := 0
+	if i == 0 {
+		skip = b.head
+	}
+
+	f, err := os.Open(seg.path)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+
+	out := segmentHeader(b.salt)
+	var records []recordMeta
+	kept, index := 0, 0
+	for _, r := range seg.records[skip:] {
+		if b.acked[recordID(seg.id, r.offset)] {
+			continue
+		}
+		meta, flags, payload, err := readRecord(f, r.offset)
+		var batch models.MetricBatch
+		if err == nil {
+			batch, err = b.decode(seg, meta, flags, payload)
+		}
+		if err != nil {
+			b.logger.Warn("Failed to read buffer record during downsampling, dropping it",
+				zap.String("segment", seg.path),
+				zap.Int64("offset", r.offset),
+				zap.Error(err))
+			continue
+		}
+
+		var sampled []models.MetricSnapshot
+		for _, m := range batch.Metrics {
+			if r.flags&flagDownsampled != 0 || index%b.downsample == 0 {
+				sampled = append(sampled, m)
+			}
+			index++
+		}
+		if len(sampled) == 0 {
+			continue
+		}
+
+		// The batch keeps its ID: the server must not ingest both the
+		// full batch and its downsampled copy.
+		batch.Metrics = sampled
+		rec, err := encodeRecord(batch, r.stored, b.aead, flagDownsampled)
+		if err != nil {
+			return 0, 0, err
+		}
+		records = append(records, recordMeta{
+			offset: int64(len(out)),
+			size:   int64(len(rec)),
+			stored: r.stored,
+			flags:  rec[16],
+		})
+		out = append(out, rec...)
+		kept += len(sampled)
+	}
+
+	if err := writeFileAtomic(seg.path, out, 0640); err != nil {
+		return 0, 0, fmt.Errorf("rewrite segment: %w", err)
+	}
+
+	// Update the index: acknowledged records were not copied, so the
+	// cursor now points at the start of the rewritten segment.
+	pendingBefore := b.unackedFrom(seg, skip)
+	for _, r := range seg.records {
+		delete(b.acked, recordID(seg.id, r.offset))
+	}
+	before := seg.size
+	seg.salt = b.salt
+	seg.records = records
+	seg.size = int64(len(out))
+	b.size += seg.size - before
+	b.pending += len(records) - pendingBefore
+	if i == 0 {
+		b.head = 0
+		b.saveCursor()
+	}
+	return before, kept, nil
+}
+
+// unackedFrom counts the records of seg from index skip on that are not
+// acknowledged.
+// Must be called with b.mu held.
+func (b *Buffer) unackedFrom(seg *segment, skip int) int {
+	n := 0
+	for _, r := range seg.records[skip:] {
+		if !b.acked[recordID(seg.id, r.offset)] {
+			n++
+		}
+	}
+	return n
+}
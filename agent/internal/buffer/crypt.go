@@ -0,0 +1,205 @@
+package buffer
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"golang.org/x/crypto/scrypt"
+
+	"github.com/Guliveer/vitalis/agent/internal/config"
+)
+
+const (
+	// keySize is the AES-256 key length in bytes.
+	keySize = 32
+
+	// defaultKeyFile is the key file name used when key_file is not set.
+	defaultKeyFile = "buffer.key"
+
+	// saltSize is the length of the random salt in segment headers.
+	saltSize = 16
+
+	// scrypt cost parameters for deriving a key from a secret: about
+	// 100ms and 32 MiB per derivation, done once per buffer.
+	scryptN = 1 << 15
+	scryptR = 8
+	scryptP = 1
+
+	// legacyKeyLabel separates buffer keys from any other use of the same
+	// secret in segments written before keys were derived with scrypt.
+	legacyKeyLabel = "vitalis buffer encryption v1"
+)
+
+// errNoKey is returned when reading an encrypted record without a key.
+var errNoKey = errors.New("record is encrypted but buffer encryption is not configured")
+
+// Key is the buffer encryption key: either a random AES-256 key from the
+// key file, or a secret that a key is derived from with scrypt, salted
+// with the salt in each segment's header. It is safe for concurrent use.
+type Key struct {
+	raw    []byte // from the key file
+	secret string
+
+	mu    sync.Mutex
+	aeads map[string]cipher.AEAD // by salt
+}
+
+// LoadKey returns the buffer encryption key, or nil if encryption is
+// disabled. A configured secret is used as is; otherwise the key is read
+// from the key file. If create is true and the key file does not exist, a
+// random key is generated and written with 0600 permissions.
+func LoadKey(cfg config.BufferConfig, create bool) (*Key, error) {
+	enc := cfg.Encryption
+	if !enc.Enabled {
+		return nil, nil
+	}
+
+	if enc.Secret != "" {
+		return &Key{secret: enc.Secret}, nil
+	}
+
+	raw, err := loadKeyFile(cfg, create)
+	if err != nil {
+		return nil, err
+	}
+	return &Key{raw: raw}, nil
+}
+
+// aead returns the cipher for the segments with the given header salt, or
+// nil for a nil key. A nil salt stands for segments written before salts
+// were added, whose key was derived from the secret with HMAC-SHA256.
+func (k *Key) aead(salt []byte) (cipher.AEAD, error) {
+	if k == nil {
+		return nil, nil
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if aead, ok := k.aeads[string(salt)]; ok {
+		return aead, nil
+	}
+
+	key := k.raw
+	switch {
+	case k.secret != "" && salt == nil:
+		mac := hmac.New(sha256.New, []byte(k.secret))
+		mac.Write([]byte(legacyKeyLabel))
+		key = mac.Sum(nil)
+	case k.secret != "":
+		var err error
+		key, err = scrypt.Key([]byte(k.secret), salt, scryptN, scryptR, scryptP, keySize)
+		if err != nil {
+			return nil, fmt.Errorf("derive buffer key: %w", err)
+		}
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	if k.aeads == nil {
+		k.aeads = make(map[string]cipher.AEAD)
+	}
+	k.aeads[string(salt)] = aead
+	return aead, nil
+}
+
+// newSalt returns a random segment salt.
+func newSalt() ([]byte, error) {
+	salt := make([]byte, saltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, fmt.Errorf("generate buffer salt: %w", err)
+	}
+	return salt, nil
+}
+
+// loadKeyFile reads the random key from the key file, creating it if
+// create is true and it does not exist.
+func loadKeyFile(cfg config.BufferConfig, create bool) ([]byte, error) {
+	enc := cfg.Encryption
+
+	path := enc.KeyFile
+	if path == "" {
+		path = filepath.Join(cfg.DBPath, defaultKeyFile)
+	}
+
+	key, err := os.ReadFile(path)
+	if err == nil {
+		if len(key) != keySize {
+			return nil, fmt.Errorf("buffer key file %s: expected %d bytes, got %d", path, keySize, len(key))
+		}
+		return key, nil
+	}
+	if !os.IsNotExist(err) || !create {
+		return nil, fmt.Errorf("read buffer key file: %w", err)
+	}
+
+	key = make([]byte, keySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, fmt.Errorf("generate buffer key: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, fmt.Errorf("create buffer key directory: %w", err)
+	}
+	// O_EXCL: never overwrite a key that appeared concurrently, or every
+	// record written with it would become unreadable.
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("create buffer key file: %w", err)
+	}
+	if _, err := f.Write(key); err != nil {
+		f.Close()
+		os.Remove(path)
+		return nil, fmt.Errorf("write buffer key file: %w", err)
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(path)
+		return nil, fmt.Errorf("write buffer key file: %w", err)
+	}
+	return key, f.Close()
+}
+
+// newAEAD creates the AES-GCM cipher for a key, or nil for a nil key.
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	if key == nil {
+		return nil, nil
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("create buffer cipher: %w", err)
+	}
+	return cipher.NewGCM(block)
+}
+
+// seal encrypts a payload, prefixing the random nonce. The additional data
+// binds the ciphertext to its record header.
+func seal(aead cipher.AEAD, plaintext, additional []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plaintext)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("generate nonce: %w", err)
+	}
+	return aead.Seal(nonce, nonce, plaintext, additional), nil
+}
+
+// unseal decrypts a payload produced by seal.
+func unseal(aead cipher.AEAD, payload, additional []byte) ([]byte, error) {
+	if aead == nil {
+		return nil, errNoKey
+	}
+	if len(payload) < aead.NonceSize() {
+		return nil, errors.New("encrypted record too short")
+	}
+	nonce, ciphertext := payload[:aead.NonceSize()], payload[aead.NonceSize():]
+	plaintext, err := aead.Open(nil, nonce, ciphertext, additional)
+	if err != nil {
+		return nil, fmt.Errorf("decrypt record: %w", err)
+	}
+	return plaintext, nil
+}
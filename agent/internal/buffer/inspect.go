@@ -0,0 +1,112 @@
+package buffer
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Stats summarises the pending contents of the buffer.
+type Stats struct {
+	Batches  int
+	Bytes    int64
+	Segments int
+	Oldest   time.Time // zero if the buffer is empty
+	Newest   time.Time
+}
+
+// RecordInfo describes a pending batch without decoding it.
+type RecordInfo struct {
+	ID          string
+	Stored      time.Time
+	Bytes       int64
+	Encrypted   bool
+	Downsampled bool
+}
+
+// Stats returns the number, size and age range of pending batches.
+func (b *Buffer) Stats() Stats {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	stats := Stats{
+		Batches:  b.pending,
+		Bytes:    b.size,
+		Segments: len(b.segments),
+	}
+	b.eachPending(func(_ *segment, r recordMeta) {
+		if stats.Oldest.IsZero() {
+			stats.Oldest = r.stored
+		}
+		stats.Newest = r.stored
+	})
+	return stats
+}
+
+// Records lists the pending batches, oldest first.
+func (b *Buffer) Records() []RecordInfo {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var records []RecordInfo
+	b.eachPending(func(seg *segment, r recordMeta) {
+		records = append(records, RecordInfo{
+			ID:          recordID(seg.id, r.offset),
+			Stored:      r.stored,
+			Bytes:       r.size,
+			Encrypted:   r.flags&flagEncrypted != 0,
+			Downsampled: r.flags&flagDownsampled != 0,
+		})
+	})
+	return records
+}
+
+// eachPending calls fn for every record not yet acknowledged, oldest first.
+// Must be called with b.mu held.
+func (b *Buffer) eachPending(fn func(seg *segment, r recordMeta)) {
+	for i, seg := range b.segments {
+		records := seg.records
+		if i == 0 {
+			records = records[b.head:]
+		}
+		for _, r := range records {
+			if !b.acked[recordID(seg.id, r.offset)] {
+				fn(seg, r)
+			}
+		}
+	}
+}
+
+// Purge deletes every buffered batch and returns how many were removed.
+func (b *Buffer) Purge() (int, error) {
+	if b.readOnly {
+		return 0, errReadOnly
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	purged := b.pending
+	if b.active != nil {
+		b.active.Close()
+		b.active = nil
+	}
+	for _, seg := range b.segments {
+		if err := os.Remove(seg.path); err != nil && !os.IsNotExist(err) {
+			return 0, err
+		}
+	}
+	os.Remove(filepath.Join(b.dir, CursorFile))
+
+	b.segments = nil
+	b.head = 0
+	b.size = 0
+	b.pending = 0
+	b.acked = make(map[string]bool)
+	b.inFlight = make(map[string]bool)
+
+	b.logger.Info("Buffer purged", zap.Int("batches", purged))
+	return purged, b.roll()
+}
@@ -0,0 +1,72 @@
+package buffer
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/Guliveer/vitalis/agent/internal/models"
+)
+
+// legacyTimeFormat is the file name format of the one-file-per-batch buffer
+// used by older agent versions (e.g. 20240101T120000.000.json).
+const legacyTimeFormat = "20060102T150405.000"
+
+// migrateLegacy moves batch files written by older agent versions into the
+// log, oldest first, and removes them. Unreadable files are left in place.
+// Called from New, before the buffer is shared.
+func (b *Buffer) migrateLegacy() error {
+	paths, err := filepath.Glob(filepath.Join(b.dir, "*.json"))
+	if err != nil {
+		return err
+	}
+	sort.Strings(paths)
+
+	migrated := 0
+	for _, path := range paths {
+		name := filepath.Base(path)
+		stored, err := time.Parse(legacyTimeFormat, name[:len(name)-len(".json")])
+		if err != nil {
+			continue // not a batch file (e.g. the cursor)
+		}
+
+		data, err := os.ReadFile(path)
+		if err != nil {
+			b.logger.Warn("Failed to read legacy buffer file", zap.String("file", path), zap.Error(err))
+			continue
+		}
+		var metrics []models.MetricSnapshot
+		if err := json.Unmarshal(data, &metrics); err != nil {
+			b.logger.Warn("Failed to parse legacy buffer file, removing corrupted file",
+				zap.String("file", path),
+				zap.Error(err))
+			os.Remove(path)
+			continue
+		}
+
+		rec, err := encodeRecord(models.MetricBatch{Metrics: metrics}, stored, b.aead, 0)
+		if err != nil {
+			return err
+		}
+		b.evictFor(int64(len(rec)))
+		if last := b.segments[len(b.segments)-1]; last.size+int64(len(rec)) > b.segmentSize && len(last.records) > 0 {
+			if err := b.roll(); err != nil {
+				return err
+			}
+		}
+		if err := b.append(rec, stored); err != nil {
+			return err
+		}
+		os.Remove(path)
+		migrated++
+	}
+
+	if migrated > 0 {
+		b.logger.Info("Migrated legacy buffer files", zap.Int("batches", migrated))
+	}
+	return nil
+}
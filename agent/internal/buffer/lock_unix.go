@@ -0,0 +1,13 @@
+//go:build !windows
+
+package buffer
+
+import (
+	"os"
+	"syscall"
+)
+
+// tryLock takes an exclusive, non-blocking advisory lock on f.
+func tryLock(f *os.File) error {
+	return syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+}
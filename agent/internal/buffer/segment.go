@@ -0,0 +1,362 @@
+package buffer
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/cipher"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Guliveer/vitalis/agent/internal/models"
+)
+
+// On-disk layout
+//
+// The buffer directory holds numbered segment files (00000000000000000001.wal,
+// ...) that are only ever appended to. Each segment starts with an 8-byte
+// magic string and a 16-byte random salt, followed by records:
+//
+//	offset  size  field
+//	0       4     payload length (big endian)
+//	4       4     CRC-32C of bytes 8..end of record
+//	8       8     time the record was stored (Unix milliseconds)
+//	16      1     flags (flagGzip, flagEncrypted, flagDownsampled)
+//	17      3     reserved, zero
+//	20      n     payload: JSON metric batch, gzip-compressed
+//
+// Records written by earlier versions hold a bare JSON array of snapshots
+// instead of a batch object; they are read as a batch without an ID.
+//
+// Encrypted payloads are the 12-byte GCM nonce followed by the AES-256-GCM
+// ciphertext of the compressed data, authenticated together with the
+// record's timestamp. A key derived from a secret is salted with the
+// segment's salt; the buffer writes the same salt into all its segments.
+// Segments written by earlier versions have no salt (magic version 1).
+//
+// A record whose length or checksum does not match marks the end of the
+// valid data in its segment (a torn write after a crash); the segment is
+// truncated there when the buffer is opened.
+
+const (
+	segmentMagic      = "VTLSWAL\x02"
+	legacyMagic       = "VTLSWAL\x01" // without a salt
+	segmentHeaderSize = len(segmentMagic) + saltSize
+	segmentExt        = ".wal"
+	recordHeaderSize  = 20
+
+	// flagGzip marks a gzip-compressed payload.
+	flagGzip byte = 1 << 0
+
+	// flagEncrypted marks an AES-GCM encrypted payload.
+	flagEncrypted byte = 1 << 1
+
+	// flagDownsampled marks a record rewritten by compaction, so it is not
+	// thinned out again.
+	flagDownsampled byte = 1 << 2
+
+	// maxRecordSize guards against reading a garbage length field.
+	maxRecordSize = 64 * 1024 * 1024
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// errCorruptRecord is returned for records failing length or checksum checks.
+var errCorruptRecord = errors.New("corrupt buffer record")
+
+// recordMeta locates a record inside its segment.
+type recordMeta struct {
+	offset int64 // start of the record header
+	size   int64 // header plus payload
+	stored time.Time
+	flags  byte
+}
+
+// segment is the in-memory index of one segment file.
+type segment struct {
+	id      uint64
+	path    string
+	salt    []byte // nil for segments without one
+	size    int64
+	records []recordMeta
+}
+
+// segmentHeader returns the header of a new segment.
+func segmentHeader(salt []byte) []byte {
+	return append([]byte(segmentMagic), salt...)
+}
+
+// readSegmentHeader reads the header of a segment file and returns its
+// salt (nil for a legacy segment) and size. ok is false if the file does
+// not start with a complete header.
+func readSegmentHeader(r io.ReaderAt) (salt []byte, size int64, ok bool) {
+	var header [segmentHeaderSize]byte
+	n, _ := r.ReadAt(header[:], 0)
+	switch {
+	case n >= len(legacyMagic) && string(header[:len(legacyMagic)]) == legacyMagic:
+		return nil, int64(len(legacyMagic)), true
+	case n == segmentHeaderSize && string(header[:len(segmentMagic)]) == segmentMagic:
+		return header[len(segmentMagic):], int64(segmentHeaderSize), true
+	}
+	return nil, 0, false
+}
+
+// segmentPath returns the file name for a segment id.
+func segmentPath(dir string, id uint64) string {
+	return filepath.Join(dir, fmt.Sprintf("%020d%s", id, segmentExt))
+}
+
+// parseSegmentID extracts the segment id from a segment file name.
+func parseSegmentID(name string) (uint64, bool) {
+	if !strings.HasSuffix(name, segmentExt) {
+		return 0, false
+	}
+	id, err := strconv.ParseUint(strings.TrimSuffix(name, segmentExt), 10, 64)
+	return id, err == nil
+}
+
+// encodeRecord builds a record (header and payload) for the given batch,
+// encrypting the payload if aead is not nil. extraFlags are added to the
+// record flags. The machine token is never written to disk.
+func encodeRecord(batch models.MetricBatch, stored time.Time, aead cipher.AEAD, extraFlags byte) ([]byte, error) {
+	batch.MachineToken = ""
+	data, err := json.Marshal(batch)
+	if err != nil {
+		return nil, fmt.Errorf("marshal batch: %w", err)
+	}
+
+	var compressed bytes.Buffer
+	gz := gzip.NewWriter(&compressed)
+	if _, err := gz.Write(data); err != nil {
+		return nil, fmt.Errorf("compress batch: %w", err)
+	}
+	if err := gz.Close(); err != nil {
+		return nil, fmt.Errorf("compress batch: %w", err)
+	}
+
+	payload := compressed.Bytes()
+	flags := flagGzip | extraFlags
+	if aead != nil {
+		payload, err = seal(aead, payload, timestampBytes(stored))
+		if err != nil {
+			return nil, fmt.Errorf("encrypt batch: %w", err)
+		}
+		flags |= flagEncrypted
+	}
+
+	buf := make([]byte, recordHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(buf[0:4], uint32(len(payload)))
+	copy(buf[8:16], timestampBytes(stored))
+	buf[16] = flags
+	copy(buf[recordHeaderSize:], payload)
+	binary.BigEndian.PutUint32(buf[4:8], crc32.Checksum(buf[8:], crcTable))
+	return buf, nil
+}
+
+// timestampBytes encodes a record timestamp as stored in its header.
+func timestampBytes(t time.Time) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, uint64(t.UnixMilli()))
+	return b
+}
+
+// readRecord reads and verifies one record at offset. It returns the record
+// metadata, its flags and raw payload, io.EOF at the clean end of the
+// segment, or errCorruptRecord for a torn or damaged record.
+func readRecord(r io.ReaderAt, offset int64) (recordMeta, byte, []byte, error) {
+	var header [recordHeaderSize]byte
+	n, err := r.ReadAt(header[:], offset)
+	if n == 0 && err == io.EOF {
+		return recordMeta{}, 0, nil, io.EOF
+	}
+	if n < recordHeaderSize {
+		return recordMeta{}, 0, nil, errCorruptRecord
+	}
+
+	length := binary.BigEndian.Uint32(header[0:4])
+	if length > maxRecordSize {
+		return recordMeta{}, 0, nil, errCorruptRecord
+	}
+	payload := make([]byte, length)
+	if n, _ := r.ReadAt(payload, offset+recordHeaderSize); n < int(length) {
+		return recordMeta{}, 0, nil, errCorruptRecord
+	}
+
+	crc := crc32.Update(crc32.Checksum(header[8:], crcTable), crcTable, payload)
+	if crc != binary.BigEndian.Uint32(header[4:8]) {
+		return recordMeta{}, 0, nil, errCorruptRecord
+	}
+
+	meta := recordMeta{
+		offset: offset,
+		size:   recordHeaderSize + int64(length),
+		stored: time.UnixMilli(int64(binary.BigEndian.Uint64(header[8:16]))),
+		flags:  header[16],
+	}
+	return meta, header[16], payload, nil
+}
+
+// decodePayload turns a record payload back into a batch, decrypting it
+// with aead if the record is encrypted.
+func decodePayload(meta recordMeta, flags byte, payload []byte, aead cipher.AEAD) (models.MetricBatch, error) {
+	var batch models.MetricBatch
+	if flags&flagEncrypted != 0 {
+		var err error
+		payload, err = unseal(aead, payload, timestampBytes(meta.stored))
+		if err != nil {
+			return batch, err
+		}
+	}
+
+	var r io.Reader = bytes.NewReader(payload)
+	if flags&flagGzip != 0 {
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			return batch, err
+		}
+		defer gz.Close()
+		r = gz
+	}
+
+	var raw json.RawMessage
+	if err := json.NewDecoder(r).Decode(&raw); err != nil {
+		return batch, err
+	}
+	if trimmed := bytes.TrimSpace(raw); len(trimmed) > 0 && trimmed[0] == '[' {
+		err := json.Unmarshal(trimmed, &batch.Metrics)
+		return batch, err
+	}
+	err := json.Unmarshal(raw, &batch)
+	return batch, err
+}
+
+// scanSegment builds the index of a segment file. If the segment ends in a
+// torn or corrupt record and repair is true, it is truncated to the last
+// valid record and truncated reports how many bytes were cut; otherwise
+// the index simply ends there. A segment without a complete header is
+// started over with header.
+func scanSegment(path string, id uint64, repair bool, header []byte) (seg *segment, truncated int64, err error) {
+	flag := os.O_RDONLY
+	if repair {
+		flag = os.O_RDWR
+	}
+	f, err := os.OpenFile(path, flag, 0)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	seg = &segment{id: id, path: path}
+	salt, offset, ok := readSegmentHeader(f)
+	if !ok {
+		seg.salt = header[len(segmentMagic):]
+		seg.size = int64(len(header))
+		if !repair {
+			return seg, 0, nil
+		}
+		// Not even the header made it to disk: start the segment over.
+		if err := f.Truncate(0); err != nil {
+			return nil, 0, err
+		}
+		if _, err := f.WriteAt(header, 0); err != nil {
+			return nil, 0, err
+		}
+		return seg, info.Size(), f.Sync()
+	}
+	seg.salt = salt
+
+	for {
+		meta, _, _, err := readRecord(f, offset)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			if !repair {
+				break
+			}
+			if err := f.Truncate(offset); err != nil {
+				return nil, 0, err
+			}
+			truncated = info.Size() - offset
+			if err := f.Sync(); err != nil {
+				return nil, 0, err
+			}
+			break
+		}
+		seg.records = append(seg.records, meta)
+		offset += meta.size
+	}
+	seg.size = offset
+	return seg, truncated, nil
+}
+
+// SegmentReader iterates over the records of a single segment file, for
+// tools that read buffer files outside a running agent (e.g. the import
+// command).
+type SegmentReader struct {
+	f      *os.File
+	offset int64
+	aead   cipher.AEAD
+}
+
+// IsSegment reports whether data starts with the segment file magic.
+func IsSegment(data []byte) bool {
+	return bytes.HasPrefix(data, []byte(segmentMagic)) || bytes.HasPrefix(data, []byte(legacyMagic))
+}
+
+// OpenSegment opens a segment file for reading. key is the buffer
+// encryption key (see LoadKey), or nil if the segment is not encrypted.
+func OpenSegment(path string, key *Key) (*SegmentReader, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	salt, offset, ok := readSegmentHeader(f)
+	if !ok {
+		f.Close()
+		return nil, fmt.Errorf("%s is not a buffer segment", path)
+	}
+	aead, err := key.aead(salt)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &SegmentReader{f: f, offset: offset, aead: aead}, nil
+}
+
+// Next returns the batch in the next record, or io.EOF at the end of the
+// segment. A torn record at the end of the segment is treated as the end.
+func (r *SegmentReader) Next() (models.MetricBatch, error) {
+	meta, flags, payload, err := readRecord(r.f, r.offset)
+	if err == errCorruptRecord {
+		return models.MetricBatch{}, io.EOF
+	}
+	if err != nil {
+		return models.MetricBatch{}, err
+	}
+	r.offset += meta.size
+
+	batch, err := decodePayload(meta, flags, payload, r.aead)
+	if err != nil {
+		return batch, fmt.Errorf("decode record at offset %d: %w", meta.offset, err)
+	}
+	return batch, nil
+}
+
+// Close releases the segment file.
+func (r *SegmentReader) Close() error {
+	return r.f.Close()
+}
@@ -6,6 +6,7 @@ import (
 	"context"
 	"sort"
 	"strings"
+	"sync/atomic"
 
 	"github.com/shirou/gopsutil/v3/process"
 	"github.com/Guliveer/vitalis/agent/internal/models"
@@ -55,13 +56,20 @@ func normalizeStatus(raw string, cpuPct float64) string {
 
 // ProcessCollector collects the top N processes by CPU usage.
 type ProcessCollector struct {
-	topN int
+	topN atomic.Int64
 }
 
 // NewProcessCollector creates a new process collector that returns the top N
 // processes sorted by CPU usage descending.
 func NewProcessCollector(topN int) *ProcessCollector {
-	return &ProcessCollector{topN: topN}
+	c := &ProcessCollector{}
+	c.topN.Store(int64(topN))
+	return c
+}
+
+// SetTopN changes the number of processes returned by later collections.
+func (c *ProcessCollector) SetTopN(topN int) {
+	c.topN.Store(int64(topN))
 }
 
 // Name returns the collector identifier.
@@ -103,8 +111,8 @@ func (c *ProcessCollector) Collect(ctx context.Context) (interface{}, error) {
 	})
 
 	// Return top N
-	if len(infos) > c.topN {
-		infos = infos[:c.topN]
+	if topN := int(c.topN.Load()); len(infos) > topN {
+		infos = infos[:topN]
 	}
 
 	return infos, nil
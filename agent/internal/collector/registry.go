@@ -5,6 +5,7 @@ package collector
 
 import (
 	"context"
+	"fmt"
 	"sync"
 
 	"go.uber.org/zap"
@@ -13,13 +14,18 @@ import (
 // Registry manages all registered collectors and orchestrates concurrent collection.
 type Registry struct {
 	collectors []Collector
+	known      map[string]bool // names of all collectors, available or not
 	logger     *zap.Logger
+
+	mu       sync.Mutex
+	disabled map[string]bool
 }
 
 // NewRegistry creates a new collector registry with the given logger.
 func NewRegistry(logger *zap.Logger) *Registry {
 	return &Registry{
 		collectors: make([]Collector, 0),
+		known:      make(map[string]bool),
 		logger:     logger,
 	}
 }
@@ -27,6 +33,7 @@ func NewRegistry(logger *zap.Logger) *Registry {
 // Register adds a collector if it's available on the current platform.
 // Unavailable collectors are logged and skipped.
 func (r *Registry) Register(c Collector) {
+	r.known[c.Name()] = true
 	if c.IsAvailable() {
 		r.collectors = append(r.collectors, c)
 		r.logger.Info("Registered collector", zap.String("name", c.Name()))
@@ -43,7 +50,14 @@ func (r *Registry) CollectAll(ctx context.Context) map[string]interface{} {
 	var mu sync.Mutex
 	var wg sync.WaitGroup
 
+	r.mu.Lock()
+	disabled := r.disabled
+	r.mu.Unlock()
+
 	for _, c := range r.collectors {
+		if disabled[c.Name()] {
+			continue
+		}
 		wg.Add(1)
 		go func(col Collector) {
 			defer wg.Done()
@@ -64,6 +78,33 @@ func (r *Registry) CollectAll(ctx context.Context) map[string]interface{} {
 	return results
 }
 
+// SetEnabled limits collection to the named collectors; with no names,
+// all registered collectors run. It fails, changing nothing, if a name is
+// not a collector the agent has. Naming a collector that is unavailable on
+// this platform is allowed but does not make it run.
+func (r *Registry) SetEnabled(names []string) error {
+	var disabled map[string]bool
+	if len(names) > 0 {
+		enabled := make(map[string]bool, len(names))
+		for _, name := range names {
+			if !r.known[name] {
+				return fmt.Errorf("unknown collector %q", name)
+			}
+			enabled[name] = true
+		}
+		disabled = make(map[string]bool)
+		for _, c := range r.collectors {
+			if !enabled[c.Name()] {
+				disabled[c.Name()] = true
+			}
+		}
+	}
+	r.mu.Lock()
+	r.disabled = disabled
+	r.mu.Unlock()
+	return nil
+}
+
 // Collectors returns a copy of all registered collectors.
 func (r *Registry) Collectors() []Collector {
 	result := make([]Collector, len(r.collectors))
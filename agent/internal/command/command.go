@@ -0,0 +1,384 @@
+// Package command runs actions queued for this machine on the dashboard,
+// such as flushing the buffer or restarting the agent, so they no longer
+// need someone with shell access to the machine.
+//
+// The channel is pull-based: the agent polls GET /api/agent/commands, and
+// ingest responses carry the X-Pending-Commands header while commands are
+// waiting, so they are fetched with the next batch instead of the next poll.
+// Only a fixed set of commands exists (config.AgentCommands), and the agent
+// runs only those in its allowlist. Each command carries an HMAC signature
+// over its ID, name and expiry, keyed with the machine's signing secret,
+// which the agent checks before running it; without a secret it runs none. Every command's
+// result, including a rejection, is reported to
+// POST /api/agent/commands/{id}/result.
+package command
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"go.uber.org/zap"
+
+	"github.com/Guliveer/vitalis/agent/internal/config"
+	"github.com/Guliveer/vitalis/agent/internal/credential"
+	"github.com/Guliveer/vitalis/agent/internal/httpclient"
+	"github.com/Guliveer/vitalis/agent/internal/signing"
+)
+
+const (
+	// PendingHeader is the ingest response header set while commands are
+	// waiting for the agent.
+	PendingHeader = "X-Pending-Commands"
+
+	// Restart is the command that restarts the agent. Its handler must
+	// return once the service manager has accepted the restart; the result
+	// is then reported while the agent shuts down.
+	Restart = "restart"
+
+	// endpoint serves the machine's pending commands.
+	endpoint = "/api/agent/commands"
+
+	// signatureScheme is the first line of the string a command is signed over.
+	signatureScheme = "VITALIS-COMMAND-HMAC-SHA256"
+
+	// MaxOutputSize is the most output a result carries, in bytes. Longer
+	// output is cut at a character boundary and marked as truncated.
+	MaxOutputSize = 256 * 1024
+
+	requestTimeout  = 30 * time.Second
+	commandTimeout  = 5 * time.Minute
+	maxResponseSize = 64 * 1024
+)
+
+// Handler runs a command and returns its output.
+type Handler func(ctx context.Context) (string, error)
+
+// Command is a command as delivered by the server.
+type Command struct {
+	ID        string `json:"id"`
+	Name      string `json:"command"`
+	ExpiresAt int64  `json:"expires_at"` // Unix seconds
+	Signature string `json:"signature"`
+}
+
+// result is the outcome of a command reported to the server.
+type result struct {
+	Status string `json:"status"` // "succeeded" or "failed"
+	Output string `json:"output,omitempty"`
+	// Truncated is set when Output was cut to MaxOutputSize
+	Truncated bool   `json:"truncated,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+// Channel fetches commands, runs the allowlisted ones through their
+// handlers and reports the results. It is safe for concurrent use.
+type Channel struct {
+	token    func() string
+	secret   string
+	interval time.Duration
+	allow    map[string]bool
+	client   *http.Client
+	logger   *zap.Logger
+	now      func() time.Time
+
+	handlers map[string]Handler
+	wake     chan struct{}
+
+	mu   sync.Mutex
+	url  string
+	seen map[string]time.Time // IDs of commands run, until they expire
+}
+
+// New creates a Channel for the primary server in cfg.
+func New(cfg *config.Config, logger *zap.Logger) (*Channel, error) {
+	client, err := httpclient.New(cfg.Server, requestTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("create http client: %w", err)
+	}
+	allow := make(map[string]bool, len(cfg.Server.Commands.Allow))
+	for _, name := range cfg.Server.Commands.Allow {
+		allow[name] = true
+	}
+	token := cfg.Server.MachineToken
+	return &Channel{
+		url:      cfg.Server.URL,
+		token:    func() string { return token },
+		secret:   cfg.Server.SigningSecret,
+		interval: cfg.Server.Commands.PollInterval.Duration,
+		allow:    allow,
+		client:   client,
+		logger:   logger,
+		now:      time.Now,
+		handlers: make(map[string]Handler),
+		wake:     make(chan struct{}, 1),
+		seen:     make(map[string]time.Time),
+	}, nil
+}
+
+// SetCredential makes the channel authenticate with the store's token.
+// Call it before Run.
+func (c *Channel) SetCredential(store *credential.Store) {
+	c.client.Transport = store.Transport(c.client.Transport)
+	c.token = store.Token
+}
+
+// SetURL points the channel at another server, e.g. after the config file
+// was reloaded.
+func (c *Channel) SetURL(url string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.url = url
+}
+
+// server returns the base URL of the server.
+func (c *Channel) server() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.url
+}
+
+// Handle sets the handler for the named command. Commands without a
+// handler are reported as unsupported. Call it before Run.
+func (c *Channel) Handle(name string, fn Handler) {
+	c.handlers[name] = fn
+}
+
+// Notify tells the channel that commands are waiting, as reported in an
+// ingest response, so they are fetched at once.
+func (c *Channel) Notify() {
+	select {
+	case c.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Run fetches and runs commands at startup, every poll interval and when
+// Notify reports waiting commands, until ctx is cancelled. Commands run one
+// at a time, in the order they were queued.
+func (c *Channel) Run(ctx context.Context) {
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+
+	for {
+		if err := c.poll(ctx); err != nil && ctx.Err() == nil {
+			c.logger.Debug("Failed to fetch commands", zap.Error(err))
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-c.wake:
+		}
+	}
+}
+
+// poll fetches the pending commands and runs them.
+func (c *Channel) poll(ctx context.Context) error {
+	commands, err := c.fetch(ctx)
+	if err != nil {
+		return err
+	}
+	for _, cmd := range commands {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		c.run(ctx, cmd)
+	}
+	return nil
+}
+
+// fetch requests the pending commands.
+func (c *Channel) fetch(ctx context.Context) ([]Command, error) {
+	ctx, cancel := context.WithTimeout(ctx, requestTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.server()+endpoint, nil)
+	if err != nil {
+		return nil, fmt.Errorf("create request: %w", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+c.token())
+	if c.secret != "" {
+		if err := signing.Sign(req, c.secret, endpoint, nil); err != nil {
+			return nil, fmt.Errorf("sign request: %w", err)
+		}
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("send request: %w", err)
+	}
+	defer resp.Body.Close()
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, maxResponseSize))
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("server returned %d", resp.StatusCode)
+	}
+
+	var parsed struct {
+		Data struct {
+			Commands []Command `json:"commands"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(data, &parsed); err != nil {
+		return nil, fmt.Errorf("decode response: %w", err)
+	}
+	return parsed.Data.Commands, nil
+}
+
+// run checks a command, runs it if it may be run and reports the result.
+// A command already run (e.g. a replayed response) is skipped silently.
+func (c *Channel) run(ctx context.Context, cmd Command) {
+	log := c.logger.With(zap.String("command", cmd.Name), zap.String("id", cmd.ID))
+
+	if err := c.check(cmd); err != nil {
+		log.Warn("Rejected command", zap.Error(err))
+		c.report(ctx, log, cmd.ID, result{Status: "failed", Error: err.Error()})
+		return
+	}
+	if !c.claim(cmd) {
+		return
+	}
+
+	handler := c.handlers[cmd.Name]
+	if cmd.Name == Restart {
+		log.Info("Restarting on command from the server")
+		if _, err := handler(ctx); err != nil {
+			log.Error("Failed to restart", zap.Error(err))
+			c.report(ctx, log, cmd.ID, result{Status: "failed", Error: err.Error()})
+			return
+		}
+		// The shutdown the restart causes must not cut the report short
+		c.report(context.WithoutCancel(ctx), log, cmd.ID, result{Status: "succeeded", Output: "restarting"})
+		return
+	}
+
+	log.Info("Running command from the server")
+	runCtx, cancel := context.WithTimeout(ctx, commandTimeout)
+	output, err := handler(runCtx)
+	cancel()
+	res := result{Status: "succeeded"}
+	res.Output, res.Truncated = truncate(output, MaxOutputSize)
+	if err != nil {
+		log.Warn("Command failed", zap.Error(err))
+		res.Status, res.Error = "failed", err.Error()
+	}
+	c.report(ctx, log, cmd.ID, res)
+}
+
+// check verifies the command's signature and expiry, and that it is
+// allowlisted and has a handler.
+func (c *Channel) check(cmd Command) error {
+	if c.secret == "" {
+		return fmt.Errorf("the agent has no signing secret to verify commands with")
+	}
+	if !Verify(c.secret, cmd) {
+		return fmt.Errorf("invalid command signature")
+	}
+	if !c.now().Before(time.Unix(cmd.ExpiresAt, 0)) {
+		return fmt.Errorf("command expired")
+	}
+	if !c.allow[cmd.Name] {
+		return fmt.Errorf("command %q is not allowed by the agent's configuration", cmd.Name)
+	}
+	if c.handlers[cmd.Name] == nil {
+		return fmt.Errorf("command %q is not supported by this agent", cmd.Name)
+	}
+	return nil
+}
+
+// claim records that the command is being run, and reports false if it
+// already was. IDs are forgotten once their command has expired.
+func (c *Channel) claim(cmd Command) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := c.now()
+	for id, expires := range c.seen {
+		if now.After(expires) {
+			delete(c.seen, id)
+		}
+	}
+	if _, ok := c.seen[cmd.ID]; ok {
+		return false
+	}
+	c.seen[cmd.ID] = time.Unix(cmd.ExpiresAt, 0)
+	return true
+}
+
+// report sends a command's result to the server. A result that cannot be
+// delivered is logged and dropped; the command is not run again.
+func (c *Channel) report(ctx context.Context, log *zap.Logger, id string, res result) {
+	body, err := json.Marshal(res)
+	if err != nil {
+		log.Error("Failed to encode command result", zap.Error(err))
+		return
+	}
+	path := endpoint + "/" + id + "/result"
+
+	ctx, cancel := context.WithTimeout(ctx, requestTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.server()+path, bytes.NewReader(body))
+	if err != nil {
+		log.Error("Failed to report command result", zap.Error(err))
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+c.token())
+	if c.secret != "" {
+		if err := signing.Sign(req, c.secret, path, body); err != nil {
+			log.Error("Failed to report command result", zap.Error(err))
+			return
+		}
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		log.Warn("Failed to report command result", zap.Error(err))
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		log.Warn("Failed to report command result", zap.Int("status", resp.StatusCode))
+	}
+}
+
+// truncate cuts s to at most max bytes without splitting a UTF-8 sequence,
+// and reports whether it cut anything.
+func truncate(s string, max int) (string, bool) {
+	if len(s) <= max {
+		return s, false
+	}
+	cut := max
+	for cut > 0 && !utf8.RuneStart(s[cut]) {
+		cut--
+	}
+	return s[:cut], true
+}
+
+// Sign returns the signature of a command under key, as the server
+// computes it.
+func Sign(key string, cmd Command) string {
+	canonical := strings.Join([]string{signatureScheme, cmd.ID, cmd.Name, strconv.FormatInt(cmd.ExpiresAt, 10)}, "\n")
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(canonical))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify reports whether the command's signature is valid under key.
+func Verify(key string, cmd Command) bool {
+	got, err := hex.DecodeString(cmd.Signature)
+	if err != nil {
+		return false
+	}
+	want, _ := hex.DecodeString(Sign(key, cmd))
+	return hmac.Equal(got, want)
+}
@@ -0,0 +1,248 @@
+package command
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"go.uber.org/zap"
+
+	"github.com/Guliveer/vitalis/agent/internal/config"
+)
+
+// commandServer is a fake /api/agent/commands endpoint.
+type commandServer struct {
+	mu       sync.Mutex
+	commands []Command         // delivered on the next fetch
+	results  map[string]result // by command ID
+	order    []string          // "result:<id>" and "run:<command>" events, in order
+}
+
+func (s *commandServer) queue(cmds ...Command) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.commands = append(s.commands, cmds...)
+}
+
+func (s *commandServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if r.Header.Get("Authorization") != "Bearer test" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	switch {
+	case r.Method == http.MethodGet && r.URL.Path == endpoint:
+		data, _ := json.Marshal(s.commands)
+		s.commands = nil
+		w.Write([]byte(`{"success":true,"data":{"commands":` + string(data) + `}}`))
+	case r.Method == http.MethodPost && strings.HasSuffix(r.URL.Path, "/result"):
+		id := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, endpoint+"/"), "/result")
+		var res result
+		json.NewDecoder(r.Body).Decode(&res)
+		s.results[id] = res
+		s.order = append(s.order, "result:"+id)
+		w.Write([]byte(`{"success":true}`))
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (s *commandServer) result(id string) (result, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	res, ok := s.results[id]
+	return res, ok
+}
+
+// secret is the signing secret commands are signed with.
+const secret = "msecret_test"
+
+func signed(key, id, name string) Command {
+	cmd := Command{ID: id, Name: name, ExpiresAt: time.Now().Add(time.Minute).Unix()}
+	cmd.Signature = Sign(key, cmd)
+	return cmd
+}
+
+func TestChannel_RunsAllowlistedSignedCommands(t *testing.T) {
+	srv := &commandServer{results: make(map[string]result)}
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+
+	cfg := config.DefaultConfig()
+	cfg.Server.URL = ts.URL
+	cfg.Server.MachineToken = "test"
+	cfg.Server.SigningSecret = secret
+	cfg.Server.Commands.Allow = []string{"collect_now", "flush_buffer", Restart}
+	ch, err := New(cfg, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var mu sync.Mutex
+	var ran []string
+	handler := func(name string) Handler {
+		return func(ctx context.Context) (string, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			ran = append(ran, name)
+			srv.mu.Lock()
+			srv.order = append(srv.order, "run:"+name)
+			srv.mu.Unlock()
+			return name + " done", nil
+		}
+	}
+	for _, name := range config.AgentCommands {
+		ch.Handle(name, handler(name))
+	}
+
+	expired := signed(secret, "c5", "collect_now")
+	expired.ExpiresAt = time.Now().Add(-time.Minute).Unix()
+	expired.Signature = Sign(secret, expired)
+	srv.queue(
+		signed(secret, "c1", "collect_now"),
+		signed(secret, "c2", "rotate_logs"),   // not allowlisted
+		signed("wrong", "c3", "flush_buffer"), // not signed with the secret
+		signed(secret, "c4", Restart),
+		expired,
+	)
+	if err := ch.poll(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if res, _ := srv.result("c1"); res.Status != "succeeded" || res.Output != "collect_now done" {
+		t.Errorf("c1 result = %+v, want the handler's output", res)
+	}
+	for _, id := range []string{"c2", "c3", "c5"} {
+		if res, ok := srv.result(id); !ok || res.Status != "failed" || res.Error == "" {
+			t.Errorf("%s result = %+v, want a rejection", id, res)
+		}
+	}
+	if got := strings.Join(ran, ","); got != "collect_now,restart" {
+		t.Errorf("ran %s, want collect_now,restart", got)
+	}
+
+	// The restart is reported once the service manager has accepted it
+	srv.mu.Lock()
+	order := strings.Join(srv.order, ",")
+	srv.mu.Unlock()
+	if !strings.Contains(order, "run:restart,result:c4") {
+		t.Errorf("events %s, want the restart result reported after it was requested", order)
+	}
+	if res, _ := srv.result("c4"); res.Status != "succeeded" {
+		t.Errorf("c4 result = %+v, want succeeded", res)
+	}
+
+	// A replayed command is not run twice
+	srv.queue(signed(secret, "c1", "collect_now"))
+	if err := ch.poll(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if len(ran) != 2 {
+		t.Errorf("ran %v, want the replayed command skipped", ran)
+	}
+}
+
+func TestChannel_ReportsFailedRestart(t *testing.T) {
+	srv := &commandServer{results: make(map[string]result)}
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+
+	cfg := config.DefaultConfig()
+	cfg.Server.URL = ts.URL
+	cfg.Server.MachineToken = "test"
+	cfg.Server.SigningSecret = secret
+	cfg.Server.Commands.Allow = []string{Restart}
+	ch, err := New(cfg, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ch.Handle(Restart, func(ctx context.Context) (string, error) {
+		return "", errors.New("no supported service manager found")
+	})
+
+	srv.queue(signed(secret, "c1", Restart))
+	if err := ch.poll(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if res, _ := srv.result("c1"); res.Status != "failed" || res.Error != "no supported service manager found" {
+		t.Errorf("c1 result = %+v, want the service manager's error", res)
+	}
+}
+
+func TestChannel_RejectsCommandsWithoutSigningSecret(t *testing.T) {
+	srv := &commandServer{results: make(map[string]result)}
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+
+	cfg := config.DefaultConfig()
+	cfg.Server.URL = ts.URL
+	cfg.Server.MachineToken = "test"
+	ch, err := New(cfg, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ran := false
+	ch.Handle("collect_now", func(ctx context.Context) (string, error) {
+		ran = true
+		return "", nil
+	})
+
+	// Signed with the token, as servers did before secrets were required
+	srv.queue(signed("test", "c1", "collect_now"))
+	if err := ch.poll(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if ran {
+		t.Error("ran a command without a signing secret")
+	}
+	if res, _ := srv.result("c1"); res.Status != "failed" || !strings.Contains(res.Error, "no signing secret") {
+		t.Errorf("c1 result = %+v, want a rejection", res)
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	tests := []struct {
+		in        string
+		max       int
+		want      string
+		truncated bool
+	}{
+		{"short", 10, "short", false},
+		{"exactly", 7, "exactly", false},
+		{"abcdef", 3, "abc", true},
+		{"zażółć", 3, "za", true}, // "ż" takes bytes 3 and 4
+		{"zażółć", 5, "zaż", true},
+	}
+	for _, tt := range tests {
+		got, truncated := truncate(tt.in, tt.max)
+		if got != tt.want || truncated != tt.truncated {
+			t.Errorf("truncate(%q, %d) = %q, %v, want %q, %v", tt.in, tt.max, got, truncated, tt.want, tt.truncated)
+		}
+		if !utf8.ValidString(got) {
+			t.Errorf("truncate(%q, %d) = %q, not valid UTF-8", tt.in, tt.max, got)
+		}
+	}
+}
+
+func TestVerify(t *testing.T) {
+	cmd := signed("msecret_0123456789abcdef", "3b241101-e2bb-4255-8caf-4136c566a962", "diagnostics")
+	if !Verify("msecret_0123456789abcdef", cmd) {
+		t.Error("Verify() = false for a correctly signed command")
+	}
+	tampered := cmd
+	tampered.Name = Restart
+	if Verify("msecret_0123456789abcdef", tampered) {
+		t.Error("Verify() = true for a command with a changed name")
+	}
+	if Verify("other", cmd) {
+		t.Error("Verify() = true under another key")
+	}
+}
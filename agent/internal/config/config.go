@@ -4,8 +4,10 @@ package config
 
 import (
 	"fmt"
+	"net/url"
 	"os"
 	"path/filepath"
+	"slices"
 	"strings"
 	"time"
 
@@ -46,12 +48,167 @@ type Config struct {
 	Buffer     BufferConfig     `yaml:"buffer"`
 	Logging    LoggingConfig    `yaml:"logging"`
 	Update     UpdateConfig     `yaml:"update"`
+	MQTT       MQTTConfig       `yaml:"mqtt"`
+	FileOutput FileOutputConfig `yaml:"file_output"`
+	Reload     ReloadConfig     `yaml:"reload"`
 }
 
-// ServerConfig holds API server connection settings.
+// ServerConfig holds API server connection settings. The secret-bearing
+// fields accept ${env:NAME}, ${file:/path} and ${keyring:name} references
+// instead of inline values.
 type ServerConfig struct {
 	URL          string `yaml:"url"`
 	MachineToken string `yaml:"machine_token"`
+	// MachineTokenFile is read for the machine token when MachineToken is
+	// not set, e.g. a file provisioned by a secrets manager.
+	MachineTokenFile string `yaml:"machine_token_file"`
+	// EnrollmentCode is a one-time code the agent exchanges for its own
+	// machine token on first start, instead of a pasted MachineToken. The
+	// token is kept in the data directory and rotated automatically (see
+	// package credential); the used code can stay in the file.
+	EnrollmentCode string `yaml:"enrollment_code"`
+	// CredentialStore is where an enrolled token is kept: "file" (default,
+	// credential.json in the data directory) or "keyring" (the OS keyring,
+	// see package keyring).
+	CredentialStore string `yaml:"credential_store"`
+	// SigningSecret, if set, signs every request with HMAC-SHA256 (see
+	// package signing) and keeps the machine token out of the payload.
+	// The server then rejects unsigned requests for this machine.
+	SigningSecret string `yaml:"signing_secret"`
+	// Servers are additional servers to send to, each with its own token,
+	// buffer and sequence numbers, so an outage on one neither loses nor
+	// duplicates data on the others. Mode decides how they are used
+	// together with the primary server above: "failover" (default) sends
+	// each batch to the first server in order whose circuit breaker is
+	// closed, "fanout" sends every batch to every server.
+	Servers []ServerEndpoint `yaml:"servers,omitempty"`
+	Mode    string           `yaml:"mode"`
+	// Name identifies an additional server in its buffer directory and
+	// keyring entry; it is empty for the primary server. Set by Targets.
+	Name string `yaml:"-"`
+	// Disabled turns off the HTTP sender entirely, e.g. on air-gapped
+	// machines that only write to a local file output.
+	Disabled bool `yaml:"disabled"`
+	// RateLimit is the initial ingest rate limit; the agent adapts to the
+	// limits the server reports in its response headers.
+	RateLimit RateLimitConfig `yaml:"rate_limit"`
+	// CircuitBreaker stops send attempts while the server is failing, so
+	// batches go straight to the buffer instead of waiting out retries.
+	CircuitBreaker CircuitBreakerConfig `yaml:"circuit_breaker"`
+	// Queue holds batches between the scheduler and the send worker, so
+	// collection never waits for the network.
+	Queue QueueConfig `yaml:"queue"`
+	// RemoteConfig fetches per-machine overrides set on the dashboard
+	// (see package remoteconfig).
+	RemoteConfig RemoteConfigConfig `yaml:"remote_config"`
+	// Commands runs allowlisted actions queued on the dashboard (see
+	// package command). Off by default.
+	Commands CommandsConfig `yaml:"commands"`
+	// Stream pushes snapshots over a persistent connection as they are
+	// collected, in addition to the batch POSTs.
+	Stream StreamConfig `yaml:"stream"`
+	// Encoding ("json" or "msgpack") and Compression ("gzip" or "zstd") are
+	// the preferred ingest payload format. Anything but json with gzip is
+	// only used if the server advertises support for it.
+	Encoding    string `yaml:"encoding"`
+	Compression string `yaml:"compression"`
+	// Delta sends host-level fields once per batch and counters as
+	// differences (see wire.DeltaBatch), if the server supports it.
+	Delta bool `yaml:"delta"`
+	// TLS configures trust, client certificates and pinning for HTTPS
+	// connections to the server.
+	TLS TLSConfig `yaml:"tls"`
+	// Proxy routes connections to the server and the update host through
+	// an HTTP(S) or SOCKS5 proxy. Without a URL, the HTTPS_PROXY, HTTP_PROXY
+	// and NO_PROXY environment variables apply.
+	Proxy ProxyConfig `yaml:"proxy"`
+}
+
+// ServerEndpoint is an additional server in ServerConfig.Servers. Its
+// credentials are never inherited from the primary server; TLS settings
+// are, unless the endpoint sets its own. All other settings are shared.
+type ServerEndpoint struct {
+	URL              string     `yaml:"url"`
+	MachineToken     string     `yaml:"machine_token"`
+	MachineTokenFile string     `yaml:"machine_token_file"`
+	EnrollmentCode   string     `yaml:"enrollment_code"`
+	SigningSecret    string     `yaml:"signing_secret"`
+	TLS              *TLSConfig `yaml:"tls,omitempty"`
+}
+
+// ProxyConfig holds settings for connecting through a proxy. Credentials
+// may also be given in the URL; Username and Password take precedence.
+type ProxyConfig struct {
+	URL          string   `yaml:"url"`           // http://, https://, socks5:// or socks5h://host:port
+	Username     string   `yaml:"username"`      // proxy credentials
+	Password     string   `yaml:"password"`      //
+	PasswordFile string   `yaml:"password_file"` // file holding the password, instead of password
+	NoProxy      []string `yaml:"no_proxy"`      // hosts, .domains, IPs or CIDRs to reach directly; "*" for all
+}
+
+// TLSConfig holds TLS settings for connections to the server. CAFile
+// replaces the system roots for the server; the updater only adds it to
+// them, and ignores ServerName and PinnedSHA256, which identify the server.
+type TLSConfig struct {
+	CAFile       string   `yaml:"ca_file"`       // PEM bundle of trusted CAs
+	CertFile     string   `yaml:"cert_file"`     // client certificate for mutual TLS
+	KeyFile      string   `yaml:"key_file"`      // client certificate key
+	ServerName   string   `yaml:"server_name"`   // name to verify and send as SNI instead of the URL host
+	MinVersion   string   `yaml:"min_version"`   // "1.2" (default) or "1.3"
+	PinnedSHA256 []string `yaml:"pinned_sha256"` // base64 SHA-256 of a certificate's SubjectPublicKeyInfo
+}
+
+// StreamConfig holds settings for the live streaming transport.
+type StreamConfig struct {
+	Enabled    bool     `yaml:"enabled"`
+	Heartbeat  Duration `yaml:"heartbeat"`   // idle interval between heartbeats
+	MaxBackoff Duration `yaml:"max_backoff"` // longest wait between reconnection attempts
+}
+
+// RemoteConfigConfig holds settings for server-driven configuration
+// overrides, off by default. Overrides are fetched every PollInterval, and
+// as soon as an ingest response reports that they changed.
+type RemoteConfigConfig struct {
+	Enabled      bool     `yaml:"enabled"`
+	PollInterval Duration `yaml:"poll_interval"`
+}
+
+// AgentCommands are the commands the command channel can run.
+var AgentCommands = []string{"collect_now", "flush_buffer", "check_update", "rotate_logs", "diagnostics", "restart"}
+
+// CommandsConfig holds settings for the remote command channel. Pending
+// commands are fetched every PollInterval, and as soon as an ingest
+// response reports that some are waiting. Only commands in Allow are run;
+// all others are reported back as rejected. The channel requires the
+// server's signing secret, which the commands are signed with.
+type CommandsConfig struct {
+	Enabled      bool     `yaml:"enabled"`
+	PollInterval Duration `yaml:"poll_interval"`
+	Allow        []string `yaml:"allow"`
+}
+
+// CircuitBreakerConfig holds settings for the sender's circuit breaker.
+// After FailureThreshold consecutive failed send attempts the circuit opens;
+// the server is then probed after OpenTimeout, doubling up to MaxOpenTimeout
+// while it keeps failing.
+type CircuitBreakerConfig struct {
+	FailureThreshold int      `yaml:"failure_threshold"`
+	OpenTimeout      Duration `yaml:"open_timeout"`
+	MaxOpenTimeout   Duration `yaml:"max_open_timeout"`
+}
+
+// QueueConfig holds settings for the in-memory send queue. Batches that do
+// not fit are buffered on disk; on shutdown, queued batches are sent for up
+// to DrainTimeout and the rest are buffered.
+type QueueConfig struct {
+	Size         int      `yaml:"size"`
+	DrainTimeout Duration `yaml:"drain_timeout"`
+}
+
+// RateLimitConfig describes how many ingest requests are allowed per window.
+type RateLimitConfig struct {
+	Requests int      `yaml:"requests"`
+	Window   Duration `yaml:"window"`
 }
 
 // CollectionConfig holds metric collection settings.
@@ -61,10 +218,22 @@ type CollectionConfig struct {
 	TopProcesses  int      `yaml:"top_processes"`
 }
 
-// BufferConfig holds local SQLite buffer settings.
+// BufferConfig holds offline buffer settings.
 type BufferConfig struct {
-	MaxSizeMB int    `yaml:"max_size_mb"`
-	DBPath    string `yaml:"db_path"`
+	MaxSizeMB  int                    `yaml:"max_size_mb"`
+	DBPath     string                 `yaml:"db_path"`
+	MaxAge     Duration               `yaml:"max_age"`    // 0 = keep until evicted by size
+	Downsample int                    `yaml:"downsample"` // keep every Nth snapshot of old data when nearly full; 0 or 1 = off
+	Encryption BufferEncryptionConfig `yaml:"encryption"`
+}
+
+// BufferEncryptionConfig holds settings for encrypting buffered batches at
+// rest with AES-256-GCM. The key is derived from Secret if set; otherwise a
+// random key is read from KeyFile, which is generated on first run.
+type BufferEncryptionConfig struct {
+	Enabled bool   `yaml:"enabled"`
+	Secret  string `yaml:"secret"`
+	KeyFile string `yaml:"key_file"` // default: <db_path>/buffer.key
 }
 
 // LoggingConfig holds logging settings.
@@ -79,12 +248,76 @@ type UpdateConfig struct {
 	CheckInterval Duration `yaml:"check_interval"`
 }
 
+// ReloadConfig holds settings for reloading the configuration while the
+// agent runs. It is always reloaded on SIGHUP; with WatchFile, also when
+// the config file changes, checked every WatchInterval.
+type ReloadConfig struct {
+	WatchFile     bool     `yaml:"watch_file"`
+	WatchInterval Duration `yaml:"watch_interval"`
+}
+
+// MQTTConfig holds MQTT publishing settings for home-automation brokers.
+type MQTTConfig struct {
+	Enabled         bool     `yaml:"enabled"`
+	Broker          string   `yaml:"broker"`
+	ClientID        string   `yaml:"client_id"`
+	Username        string   `yaml:"username"`
+	Password        string   `yaml:"password"`
+	TopicPrefix     string   `yaml:"topic_prefix"`
+	Hostname        string   `yaml:"hostname"`
+	Retain          bool     `yaml:"retain"`
+	KeepAlive       Duration `yaml:"keep_alive"`
+	Discovery       bool     `yaml:"discovery"`
+	DiscoveryPrefix string   `yaml:"discovery_prefix"`
+}
+
+// FileOutputConfig holds settings for writing batches as newline-delimited
+// JSON to stdout or a rotating local file.
+type FileOutputConfig struct {
+	Enabled   bool     `yaml:"enabled"`
+	Path      string   `yaml:"path"`
+	MaxSizeMB int      `yaml:"max_size_mb"`
+	MaxAge    Duration `yaml:"max_age"`
+	MaxFiles  int      `yaml:"max_files"`
+	Compress  bool     `yaml:"compress"`
+}
+
 // DefaultConfig returns the default configuration.
 func DefaultConfig() *Config {
 	return &Config{
 		Server: ServerConfig{
 			URL:          "http://localhost:3000",
 			MachineToken: "",
+			Mode:         "failover",
+			RateLimit: RateLimitConfig{
+				Requests: 10,
+				Window:   Duration{1 * time.Minute},
+			},
+			CircuitBreaker: CircuitBreakerConfig{
+				FailureThreshold: 5,
+				OpenTimeout:      Duration{30 * time.Second},
+				MaxOpenTimeout:   Duration{5 * time.Minute},
+			},
+			Queue: QueueConfig{
+				Size:         20,
+				DrainTimeout: Duration{10 * time.Second},
+			},
+			RemoteConfig: RemoteConfigConfig{
+				Enabled:      false,
+				PollInterval: Duration{5 * time.Minute},
+			},
+			Commands: CommandsConfig{
+				Enabled:      false,
+				PollInterval: Duration{1 * time.Minute},
+				Allow:        append([]string(nil), AgentCommands...),
+			},
+			Stream: StreamConfig{
+				Enabled:    false,
+				Heartbeat:  Duration{15 * time.Second},
+				MaxBackoff: Duration{1 * time.Minute},
+			},
+			Encoding:    "json",
+			Compression: "gzip",
 		},
 		Collection: CollectionConfig{
 			Interval:      Duration{15 * time.Second},
@@ -92,8 +325,10 @@ func DefaultConfig() *Config {
 			TopProcesses:  10,
 		},
 		Buffer: BufferConfig{
-			MaxSizeMB: 50,
-			DBPath:    "./buffer.db",
+			MaxSizeMB:  50,
+			DBPath:     "./buffer.db",
+			MaxAge:     Duration{0},
+			Downsample: 4,
 		},
 		Logging: LoggingConfig{
 			Level: "info",
@@ -103,6 +338,27 @@ func DefaultConfig() *Config {
 			Enabled:       false,
 			CheckInterval: Duration{1 * time.Hour},
 		},
+		MQTT: MQTTConfig{
+			Enabled:         false,
+			Broker:          "tcp://localhost:1883",
+			TopicPrefix:     "vitalis",
+			Retain:          true,
+			KeepAlive:       Duration{60 * time.Second},
+			Discovery:       false,
+			DiscoveryPrefix: "homeassistant",
+		},
+		FileOutput: FileOutputConfig{
+			Enabled:   false,
+			Path:      "./metrics.ndjson",
+			MaxSizeMB: 100,
+			MaxAge:    Duration{0},
+			MaxFiles:  10,
+			Compress:  false,
+		},
+		Reload: ReloadConfig{
+			WatchFile:     false,
+			WatchInterval: Duration{10 * time.Second},
+		},
 	}
 }
 
@@ -120,6 +376,9 @@ func LoadFromBytes(data []byte) (*Config, error) {
 	// Environment variable overrides (highest precedence)
 	applyEnvOverrides(cfg)
 
+	if err := resolveSecrets(cfg); err != nil {
+		return nil, fmt.Errorf("resolving secrets: %w", err)
+	}
 	return cfg, nil
 }
 
@@ -173,7 +432,7 @@ func LoadLayered(cli CLIOverrides, embedded []byte, configPath ...string) (*Conf
 
 	// Layer 1: embedded config (lowest priority data layer)
 	if len(embedded) > 0 {
-		if err := yaml.Unmarshal(embedded, cfg); err != nil {
+		if err := unmarshalLayer(embedded, cfg); err != nil {
 			return nil, fmt.Errorf("parsing embedded config: %w", err)
 		}
 	}
@@ -188,7 +447,7 @@ func LoadLayered(cli CLIOverrides, embedded []byte, configPath ...string) (*Conf
 	if filePath != "" {
 		data, err := os.ReadFile(filePath)
 		if err == nil {
-			if err := yaml.Unmarshal(data, cfg); err != nil {
+			if err := unmarshalLayer(data, cfg); err != nil {
 				return nil, fmt.Errorf("parsing config file %s: %w", filePath, err)
 			}
 		}
@@ -205,9 +464,27 @@ func LoadLayered(cli CLIOverrides, embedded []byte, configPath ...string) (*Conf
 		cfg.Server.MachineToken = cli.Token
 	}
 
+	// Secrets referenced from any layer are read last
+	if err := resolveSecrets(cfg); err != nil {
+		return nil, fmt.Errorf("resolving secrets: %w", err)
+	}
 	return cfg, nil
 }
 
+// unmarshalLayer merges one YAML layer into cfg. A machine_token_file
+// set by the layer replaces a machine_token from the layers below it, so
+// the file is not ignored in favour of a token it was meant to override.
+func unmarshalLayer(data []byte, cfg *Config) error {
+	token, tokenFile := cfg.Server.MachineToken, cfg.Server.MachineTokenFile
+	if err := yaml.Unmarshal(data, cfg); err != nil {
+		return err
+	}
+	if cfg.Server.MachineTokenFile != tokenFile && cfg.Server.MachineToken == token {
+		cfg.Server.MachineToken = ""
+	}
+	return nil
+}
+
 // WriteConfig serializes the config to a YAML file at the given path.
 // Creates parent directories if needed.
 func WriteConfig(cfg *Config, path string) error {
@@ -230,6 +507,9 @@ func applyEnvOverrides(cfg *Config) {
 	if token := os.Getenv("SA_MACHINE_TOKEN"); token != "" {
 		cfg.Server.MachineToken = token
 	}
+	if code := os.Getenv("SA_ENROLLMENT_CODE"); code != "" {
+		cfg.Server.EnrollmentCode = code
+	}
 	if level := os.Getenv("SA_LOG_LEVEL"); level != "" {
 		cfg.Logging.Level = level
 	}
@@ -239,17 +519,198 @@ func applyEnvOverrides(cfg *Config) {
 // Returns an error if required fields are missing or if HTTPS is not used
 // for non-localhost server URLs (MEDIUM-6).
 func (c *Config) Validate() error {
-	if c.Server.URL == "" {
-		return fmt.Errorf("server URL is required")
+	if c.Server.Disabled {
+		if !c.FileOutput.Enabled && !c.MQTT.Enabled {
+			return fmt.Errorf("server is disabled and no other output is enabled")
+		}
+	} else {
+		if err := validateServerURL(c.Server.URL); err != nil {
+			return err
+		}
+		if c.Server.MachineToken == "" && c.Server.EnrollmentCode == "" {
+			return fmt.Errorf("machine token or enrollment code is required")
+		}
+		if c.Server.Mode != "failover" && c.Server.Mode != "fanout" {
+			return fmt.Errorf("server mode must be failover or fanout (got: %s)", c.Server.Mode)
+		}
+		names := map[string]bool{}
+		for i, ep := range c.Server.Servers {
+			if err := validateServerURL(ep.URL); err != nil {
+				return fmt.Errorf("server servers[%d]: %w", i, err)
+			}
+			if ep.MachineToken == "" && ep.EnrollmentCode == "" {
+				return fmt.Errorf("server servers[%d]: machine token or enrollment code is required", i)
+			}
+			if ep.SigningSecret != "" && len(ep.SigningSecret) < 16 {
+				return fmt.Errorf("server servers[%d]: signing secret must be at least 16 characters", i)
+			}
+			if ep.TLS != nil && (ep.TLS.CertFile == "") != (ep.TLS.KeyFile == "") {
+				return fmt.Errorf("server servers[%d]: tls cert_file and key_file must be set together", i)
+			}
+			name := serverName(ep.URL)
+			if names[name] || name == serverName(c.Server.URL) {
+				return fmt.Errorf("server servers[%d]: %s is listed more than once", i, ep.URL)
+			}
+			names[name] = true
+		}
+		if c.Server.Stream.Enabled && len(c.Server.Servers) > 0 {
+			return fmt.Errorf("server stream is only supported with a single server")
+		}
+		switch c.Server.CredentialStore {
+		case "", "file", "keyring":
+		default:
+			return fmt.Errorf("server credential_store must be file or keyring (got: %s)", c.Server.CredentialStore)
+		}
+		if c.Server.SigningSecret != "" && len(c.Server.SigningSecret) < 16 {
+			return fmt.Errorf("server signing secret must be at least 16 characters")
+		}
+		if c.Server.RateLimit.Requests <= 0 || c.Server.RateLimit.Window.Duration <= 0 {
+			return fmt.Errorf("server rate limit must allow at least one request per window")
+		}
+		if cb := c.Server.CircuitBreaker; cb.FailureThreshold <= 0 || cb.OpenTimeout.Duration <= 0 || cb.MaxOpenTimeout.Duration < cb.OpenTimeout.Duration {
+			return fmt.Errorf("server circuit_breaker needs a positive failure_threshold and open_timeout, and max_open_timeout of at least open_timeout")
+		}
+		if c.Server.Queue.Size <= 0 || c.Server.Queue.DrainTimeout.Duration < 0 {
+			return fmt.Errorf("server queue size must be positive and drain_timeout not negative")
+		}
+		if c.Server.RemoteConfig.Enabled && c.Server.RemoteConfig.PollInterval.Duration < 10*time.Second {
+			return fmt.Errorf("server remote_config poll_interval must be at least 10s")
+		}
+		if c.Server.Commands.Enabled {
+			// Commands are signed with the signing secret; a bearer token
+			// that leaked must not be enough to run them
+			if c.Server.SigningSecret == "" {
+				return fmt.Errorf("server commands require server.signing_secret (see \"Request Signing\")")
+			}
+			if c.Server.Commands.PollInterval.Duration < 10*time.Second {
+				return fmt.Errorf("server commands poll_interval must be at least 10s")
+			}
+			for _, name := range c.Server.Commands.Allow {
+				if !slices.Contains(AgentCommands, name) {
+					return fmt.Errorf("server commands allow: unknown command %q (known: %s)", name, strings.Join(AgentCommands, ", "))
+				}
+			}
+		}
+		if c.Server.Stream.Enabled && (c.Server.Stream.Heartbeat.Duration <= 0 || c.Server.Stream.MaxBackoff.Duration <= 0) {
+			return fmt.Errorf("server stream heartbeat and max_backoff must be positive")
+		}
+		if c.Server.Encoding != "json" && c.Server.Encoding != "msgpack" {
+			return fmt.Errorf("server encoding must be json or msgpack (got: %s)", c.Server.Encoding)
+		}
+		if c.Server.Compression != "gzip" && c.Server.Compression != "zstd" {
+			return fmt.Errorf("server compression must be gzip or zstd (got: %s)", c.Server.Compression)
+		}
+		if (c.Server.TLS.CertFile == "") != (c.Server.TLS.KeyFile == "") {
+			return fmt.Errorf("server tls cert_file and key_file must be set together")
+		}
+		switch c.Server.TLS.MinVersion {
+		case "", "1.2", "1.3":
+		default:
+			return fmt.Errorf("server tls min_version must be 1.2 or 1.3 (got: %s)", c.Server.TLS.MinVersion)
+		}
+		if c.Server.Proxy.URL != "" {
+			u, err := url.Parse(c.Server.Proxy.URL)
+			if err != nil {
+				// The parse error repeats the URL, which may hold credentials.
+				return fmt.Errorf("server proxy url is not a valid URL")
+			}
+			switch u.Scheme {
+			case "http", "https", "socks5", "socks5h":
+			default:
+				return fmt.Errorf("server proxy url must use http, https, socks5 or socks5h (got: %s)", u.Redacted())
+			}
+			if u.Host == "" {
+				return fmt.Errorf("server proxy url must include a host (got: %s)", u.Redacted())
+			}
+		}
+		if c.Server.Proxy.Password != "" && c.Server.Proxy.PasswordFile != "" {
+			return fmt.Errorf("server proxy password and password_file are mutually exclusive")
+		}
 	}
-	if c.Server.MachineToken == "" {
-		return fmt.Errorf("machine token is required")
+	if c.Buffer.MaxAge.Duration < 0 || c.Buffer.Downsample < 0 {
+		return fmt.Errorf("buffer max_age and downsample must not be negative")
 	}
-	if !strings.HasPrefix(c.Server.URL, "https://") {
+	if c.Buffer.Encryption.Enabled && c.Buffer.Encryption.Secret != "" && len(c.Buffer.Encryption.Secret) < 16 {
+		return fmt.Errorf("buffer encryption secret must be at least 16 characters")
+	}
+
+	if c.MQTT.Enabled {
+		if c.MQTT.Broker == "" {
+			return fmt.Errorf("mqtt broker is required when mqtt is enabled")
+		}
+		if c.MQTT.TopicPrefix == "" {
+			return fmt.Errorf("mqtt topic prefix must not be empty")
+		}
+		if strings.ContainsAny(c.MQTT.TopicPrefix, "+#") {
+			return fmt.Errorf("mqtt topic prefix must not contain wildcards (got: %s)", c.MQTT.TopicPrefix)
+		}
+	}
+	if c.FileOutput.Enabled {
+		if c.FileOutput.Path == "" {
+			return fmt.Errorf("file output path is required when file output is enabled")
+		}
+		if c.FileOutput.MaxSizeMB < 0 || c.FileOutput.MaxFiles < 0 || c.FileOutput.MaxAge.Duration < 0 {
+			return fmt.Errorf("file output rotation limits must not be negative")
+		}
+	}
+	if c.Reload.WatchFile && c.Reload.WatchInterval.Duration < time.Second {
+		return fmt.Errorf("reload watch_interval must be at least 1s")
+	}
+	return nil
+}
+
+// validateServerURL checks that a server URL is set and uses HTTPS, except
+// for localhost during development.
+func validateServerURL(u string) error {
+	if u == "" {
+		return fmt.Errorf("server URL is required")
+	}
+	if !strings.HasPrefix(u, "https://") {
 		// Allow localhost for development
-		if !strings.Contains(c.Server.URL, "localhost") && !strings.Contains(c.Server.URL, "127.0.0.1") {
-			return fmt.Errorf("server URL must use HTTPS (got: %s)", c.Server.URL)
+		if !strings.Contains(u, "localhost") && !strings.Contains(u, "127.0.0.1") {
+			return fmt.Errorf("server URL must use HTTPS (got: %s)", u)
 		}
 	}
 	return nil
 }
+
+// Targets returns one configuration per server to send to: c itself for
+// the primary server, then a copy for each of Server.Servers with that
+// server's URL and credentials, and its buffer (with its own cursor and
+// sequence numbers) in <db_path>/servers/<name>.
+func (c *Config) Targets() []*Config {
+	targets := []*Config{c}
+	for _, ep := range c.Server.Servers {
+		t := *c
+		t.Server.URL = ep.URL
+		t.Server.MachineToken = ep.MachineToken
+		t.Server.MachineTokenFile = ep.MachineTokenFile
+		t.Server.EnrollmentCode = ep.EnrollmentCode
+		t.Server.SigningSecret = ep.SigningSecret
+		if ep.TLS != nil {
+			t.Server.TLS = *ep.TLS
+		}
+		t.Server.Servers = nil
+		t.Server.Name = serverName(ep.URL)
+		t.Buffer.DBPath = filepath.Join(c.Buffer.DBPath, "servers", t.Server.Name)
+		targets = append(targets, &t)
+	}
+	return targets
+}
+
+// serverName derives a file-name-safe name from a server URL's host and
+// path, e.g. "metrics.example.com_8443" for https://metrics.example.com:8443/.
+func serverName(serverURL string) string {
+	name := serverURL
+	if u, err := url.Parse(serverURL); err == nil && u.Host != "" {
+		name = u.Host + u.Path
+	}
+	name = strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '.', r == '-':
+			return r
+		}
+		return '_'
+	}, strings.ToLower(name))
+	return strings.Trim(name, "_")
+}
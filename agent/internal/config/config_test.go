@@ -3,6 +3,7 @@ package config
 import (
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 )
 
@@ -68,3 +69,65 @@ func TestWriteConfig_CreatesFile(t *testing.T) {
 		t.Error("config file is empty")
 	}
 }
+
+func TestTargets_OwnCredentialsAndBuffer(t *testing.T) {
+	t.Setenv("TEST_NEW_TOKEN", "mtoken_new")
+	embedded := []byte(`
+server:
+  url: "https://old.example.com"
+  machine_token: "mtoken_old"
+  signing_secret: "old-signing-secret"
+  mode: fanout
+  servers:
+    - url: "https://new.example.com:8443/"
+      machine_token: "${env:TEST_NEW_TOKEN}"
+buffer:
+  db_path: "/var/lib/vitalis/buffer"
+`)
+	cfg, err := LoadLayered(CLIOverrides{}, embedded, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	targets := cfg.Targets()
+	if len(targets) != 2 || targets[0] != cfg {
+		t.Fatalf("Targets() = %d configs, want the primary config and one more", len(targets))
+	}
+	second := targets[1]
+	if second.Server.URL != "https://new.example.com:8443/" || second.Server.MachineToken != "mtoken_new" {
+		t.Errorf("second server = %s with token %q, want its own URL and resolved token", second.Server.URL, second.Server.MachineToken)
+	}
+	if second.Server.SigningSecret != "" {
+		t.Error("second server inherited the primary server's signing secret")
+	}
+	if want := filepath.Join("/var/lib/vitalis/buffer", "servers", "new.example.com_8443"); second.Buffer.DBPath != want {
+		t.Errorf("second buffer = %s, want %s", second.Buffer.DBPath, want)
+	}
+	if cfg.Server.URL != "https://old.example.com" || cfg.Buffer.DBPath != "/var/lib/vitalis/buffer" {
+		t.Error("Targets() modified the primary config")
+	}
+
+	// The same server may not be listed twice.
+	cfg.Server.Servers = append(cfg.Server.Servers, ServerEndpoint{URL: "https://NEW.example.com:8443", MachineToken: "x"})
+	if err := cfg.Validate(); err == nil {
+		t.Error("Validate() accepted a duplicate server")
+	}
+}
+
+func TestValidate_CommandsRequireSigningSecret(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Server.URL = "https://example.com"
+	cfg.Server.MachineToken = "mtoken_test"
+	cfg.Server.Commands.Enabled = true
+	if err := cfg.Validate(); err == nil || !strings.Contains(err.Error(), "signing_secret") {
+		t.Errorf("Validate() = %v, want the missing signing secret reported", err)
+	}
+
+	cfg.Server.SigningSecret = "msecret_0123456789abcdef"
+	if err := cfg.Validate(); err != nil {
+		t.Errorf("Validate() = %v, want nil with a signing secret", err)
+	}
+}
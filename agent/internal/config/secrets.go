@@ -0,0 +1,165 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/Guliveer/vitalis/agent/internal/keyring"
+)
+
+// secretRef matches a reference to a secret kept outside the config file:
+// ${env:NAME}, ${file:/path/to/file} or ${keyring:name}.
+var secretRef = regexp.MustCompile(`\$\{(env|file|keyring):([^}]+)\}`)
+
+// openKeyring returns the keyring ${keyring:...} references are read from;
+// tests replace it with an in-memory one.
+var openKeyring = keyring.System
+
+// secretField is a config field that may hold a secret.
+type secretField struct {
+	name  string
+	value *string
+}
+
+// secretFields returns the secret-bearing fields of cfg.
+func secretFields(cfg *Config) []secretField {
+	fields := []secretField{
+		{"server.machine_token", &cfg.Server.MachineToken},
+		{"server.enrollment_code", &cfg.Server.EnrollmentCode},
+		{"server.signing_secret", &cfg.Server.SigningSecret},
+		{"server.proxy.url", &cfg.Server.Proxy.URL},
+		{"server.proxy.password", &cfg.Server.Proxy.Password},
+		{"buffer.encryption.secret", &cfg.Buffer.Encryption.Secret},
+		{"mqtt.password", &cfg.MQTT.Password},
+	}
+	for i := range cfg.Server.Servers {
+		ep := &cfg.Server.Servers[i]
+		prefix := fmt.Sprintf("server.servers[%d].", i)
+		fields = append(fields, []secretField{
+			{prefix + "machine_token", &ep.MachineToken},
+			{prefix + "enrollment_code", &ep.EnrollmentCode},
+			{prefix + "signing_secret", &ep.SigningSecret},
+		}...)
+	}
+	return fields
+}
+
+// Redacted returns a copy of the config with its secrets replaced by
+// "[redacted]", and the password removed from the proxy URL, for showing
+// the config to someone (e.g. in a diagnostics bundle).
+func (c *Config) Redacted() *Config {
+	out := *c
+	out.Server.Servers = append([]ServerEndpoint(nil), c.Server.Servers...)
+	for _, f := range secretFields(&out) {
+		switch {
+		case *f.value == "":
+		case f.value == &out.Server.Proxy.URL:
+			if u, err := url.Parse(*f.value); err == nil {
+				*f.value = u.Redacted()
+			} else {
+				*f.value = "[redacted]"
+			}
+		default:
+			*f.value = "[redacted]"
+		}
+	}
+	return &out
+}
+
+// resolveSecrets replaces secret references in the secret-bearing fields
+// with the values they point to, then reads machine_token_file if no token
+// is set otherwise. Errors name the field, never the secret.
+func resolveSecrets(cfg *Config) error {
+	fields := secretFields(cfg)
+	for _, f := range fields {
+		v, err := expandSecrets(*f.value)
+		if err != nil {
+			return fmt.Errorf("%s: %w", f.name, err)
+		}
+		*f.value = v
+	}
+
+	if err := readTokenFile("server.machine_token_file", &cfg.Server.MachineToken, cfg.Server.MachineTokenFile); err != nil {
+		return err
+	}
+	for i := range cfg.Server.Servers {
+		ep := &cfg.Server.Servers[i]
+		if err := readTokenFile(fmt.Sprintf("server.servers[%d].machine_token_file", i), &ep.MachineToken, ep.MachineTokenFile); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readTokenFile sets *token from path if no token is set otherwise.
+func readTokenFile(name string, token *string, path string) error {
+	if *token != "" || path == "" {
+		return nil
+	}
+	v, err := readSecretFile(path)
+	if err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	if v == "" {
+		return fmt.Errorf("%s: %s is empty", name, path)
+	}
+	*token = v
+	return nil
+}
+
+// expandSecrets replaces every secret reference in s.
+func expandSecrets(s string) (string, error) {
+	if !strings.Contains(s, "${") {
+		return s, nil
+	}
+	var firstErr error
+	out := secretRef.ReplaceAllStringFunc(s, func(ref string) string {
+		m := secretRef.FindStringSubmatch(ref)
+		v, err := lookupSecret(m[1], strings.TrimSpace(m[2]))
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+		return v
+	})
+	if firstErr != nil {
+		return "", firstErr
+	}
+	return out, nil
+}
+
+// lookupSecret returns the secret a reference of the given kind points to.
+func lookupSecret(kind, name string) (string, error) {
+	switch kind {
+	case "env":
+		v, ok := os.LookupEnv(name)
+		if !ok {
+			return "", fmt.Errorf("environment variable %s is not set", name)
+		}
+		return v, nil
+	case "file":
+		return readSecretFile(name)
+	default: // keyring
+		v, err := openKeyring().Get(name)
+		if errors.Is(err, keyring.ErrNotFound) {
+			return "", fmt.Errorf("secret %q not found in the OS keyring", name)
+		}
+		if err != nil {
+			return "", fmt.Errorf("read secret %q from the OS keyring: %w", name, err)
+		}
+		return v, nil
+	}
+}
+
+// readSecretFile reads a secret from a file, without the trailing newline
+// editors and `echo` add.
+func readSecretFile(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("read secret file: %w", err)
+	}
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
@@ -0,0 +1,463 @@
+// Package credential manages the agent's machine token. A token set in the
+// config file is used as is. Otherwise the agent enrolls with a one-time
+// enrollment code, keeps the token it receives in the data directory (or the
+// OS keyring) and rotates it before it expires, or as soon as the server
+// answers 401 with a rotation hint.
+package credential
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/Guliveer/vitalis/agent/internal/config"
+	"github.com/Guliveer/vitalis/agent/internal/httpclient"
+	"github.com/Guliveer/vitalis/agent/internal/keyring"
+	"github.com/Guliveer/vitalis/agent/internal/signing"
+)
+
+const (
+	// fileName is the credential file in the data directory.
+	fileName = "credential.json"
+
+	// keyringName is the name of the credential in the OS keyring, with
+	// credential_store: keyring. Additional servers append ":<name>".
+	keyringName = "machine-credential"
+
+	// RotationHeader is set to "rotate" on a 401 when the server wants the
+	// agent to rotate its token.
+	RotationHeader = "X-Vitalis-Token"
+
+	// requestTimeout bounds enrollment and rotation requests.
+	requestTimeout = 30 * time.Second
+
+	// maxResponseSize bounds how much of a response is read.
+	maxResponseSize = 64 * 1024
+
+	// maxRetryDelay bounds the delay between enrollment or rotation attempts.
+	maxRetryDelay = 10 * time.Minute
+)
+
+// openKeyring returns the OS keyring; tests replace it with an in-memory one.
+var openKeyring = keyring.System
+
+// retryDelay is the first delay after a failed enrollment or rotation; it
+// doubles up to maxRetryDelay. Tests shorten it.
+var retryDelay = 10 * time.Second
+
+// ErrRejected is returned when the server refuses an enrollment code or a
+// token for rotation. Retrying does not help; the agent needs a new code.
+var ErrRejected = errors.New("rejected by the server")
+
+// credential is the token as issued by the server and saved to the file.
+type credential struct {
+	MachineID string    `json:"machine_id,omitempty"`
+	Token     string    `json:"machine_token"`
+	ExpiresAt time.Time `json:"expires_at"`
+	RotateAt  time.Time `json:"rotate_at"`
+}
+
+// Store holds the current machine token. It is safe for concurrent use.
+type Store struct {
+	url    string
+	secret string
+	path   string          // credential file; empty with a keyring or a config token
+	kr     keyring.Keyring // nil unless credential_store is keyring
+	krName string          // name of the credential in kr
+	client *http.Client
+	logger *zap.Logger
+
+	mu   sync.Mutex
+	cred credential
+
+	rotateMu sync.Mutex // serializes rotations
+	rotated  chan struct{}
+}
+
+// Open returns the store for cfg. With a machine token in the config, that
+// token is used. Otherwise the token saved by an earlier enrollment is
+// loaded, or the agent enrolls with the configured enrollment code,
+// retrying until the server is reachable or ctx is cancelled.
+func Open(ctx context.Context, cfg *config.Config, logger *zap.Logger) (*Store, error) {
+	client, err := httpclient.New(cfg.Server, requestTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("create http client: %w", err)
+	}
+	s := &Store{
+		url:     cfg.Server.URL,
+		secret:  cfg.Server.SigningSecret,
+		client:  client,
+		logger:  logger,
+		rotated: make(chan struct{}, 1),
+	}
+	if cfg.Server.MachineToken != "" {
+		s.cred.Token = cfg.Server.MachineToken
+		return s, nil
+	}
+
+	if cfg.Server.CredentialStore == "keyring" {
+		s.kr = openKeyring()
+		s.krName = keyringName
+		if cfg.Server.Name != "" {
+			s.krName += ":" + cfg.Server.Name
+		}
+	} else {
+		s.path = filepath.Join(cfg.Buffer.DBPath, fileName)
+	}
+	data, err := s.load()
+	if err == nil {
+		if err := json.Unmarshal(data, &s.cred); err != nil || s.cred.Token == "" {
+			return nil, fmt.Errorf("saved credential in %s is corrupt; remove it to enroll again", s.location())
+		}
+		return s, nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("read credential: %w", err)
+	}
+	if cfg.Server.EnrollmentCode == "" {
+		return nil, fmt.Errorf("no machine token or enrollment code configured")
+	}
+
+	// The server spends the code on the first request. The nonce lets it
+	// recognize a retry from this agent whose response was lost, and
+	// answer it with a token again.
+	nonce, err := newNonce()
+	if err != nil {
+		return nil, fmt.Errorf("create enrollment nonce: %w", err)
+	}
+	cred, err := retry(ctx, logger, "Enrollment", func() (credential, error) {
+		return s.enroll(ctx, cfg.Server.EnrollmentCode, nonce)
+	})
+	if errors.Is(err, ErrRejected) {
+		return nil, fmt.Errorf("enrollment code is used, expired or unknown; create a new code and set it as enrollment_code: %w", err)
+	}
+	if err != nil {
+		return nil, err
+	}
+	s.cred = cred
+	if err := s.save(cred); err != nil {
+		// The token works for this run; without the file the next start
+		// cannot enroll again with the same code.
+		return nil, fmt.Errorf("save credential: %w", err)
+	}
+	logger.Info("Enrolled with the server", zap.String("machine_id", cred.MachineID))
+	return s, nil
+}
+
+// Token returns the current machine token.
+func (s *Store) Token() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.cred.Token
+}
+
+// SetServer points enrollment and rotation requests at url and, for a
+// token from the config, replaces it with token. An enrolled token is kept.
+func (s *Store) SetServer(url, token string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.url = url
+	if !s.rotatable() && token != "" {
+		s.cred.Token = token
+	}
+}
+
+// Run rotates the token when the server's rotation time comes, until ctx
+// is cancelled. It returns at once for a token from the config.
+func (s *Store) Run(ctx context.Context) {
+	if !s.rotatable() {
+		return
+	}
+	for {
+		s.mu.Lock()
+		rotateAt, token := s.cred.RotateAt, s.cred.Token
+		s.mu.Unlock()
+
+		var due <-chan time.Time
+		var timer *time.Timer
+		if !rotateAt.IsZero() {
+			timer = time.NewTimer(time.Until(rotateAt))
+			due = timer.C
+		}
+		rotated := false
+		select {
+		case <-ctx.Done():
+		case <-s.rotated:
+			// Rotated (on a hint from the server or below); wait for the
+			// new rotation time.
+			rotated = true
+		case <-due:
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		if rotated {
+			continue
+		}
+
+		if _, err := retry(ctx, s.logger, "Token rotation", func() (struct{}, error) {
+			return struct{}{}, s.Rotate(ctx, token)
+		}); err != nil && ctx.Err() == nil {
+			s.logger.Error("Machine token can no longer be rotated; enroll the agent again with a new code",
+				zap.Error(err))
+			return
+		}
+	}
+}
+
+// Rotate replaces token with a new one from the server. If token has
+// already been replaced (by a concurrent rotation), it does nothing. A token
+// from the config cannot be rotated.
+func (s *Store) Rotate(ctx context.Context, token string) error {
+	if !s.rotatable() {
+		return errors.New("machine token from the config file cannot be rotated")
+	}
+	s.rotateMu.Lock()
+	defer s.rotateMu.Unlock()
+	if s.Token() != token {
+		return nil
+	}
+
+	cred, err := s.request(ctx, "/api/rotate", token, nil)
+	if err != nil {
+		return err
+	}
+	// Save before switching: if the file cannot be written, the new token
+	// still works for this run, and after a restart the old one can
+	// rotate again.
+	if err := s.save(cred); err != nil {
+		s.logger.Error("Failed to save rotated machine token", zap.String("store", s.location()), zap.Error(err))
+	}
+	s.mu.Lock()
+	cred.MachineID = s.cred.MachineID
+	s.cred = cred
+	s.mu.Unlock()
+
+	select {
+	case s.rotated <- struct{}{}:
+	default:
+	}
+	s.logger.Info("Rotated machine token", zap.Time("expires_at", cred.ExpiresAt))
+	return nil
+}
+
+// Transport returns a RoundTripper that authenticates requests with the
+// current token. When the server answers 401 with the rotation hint, it
+// rotates the token and sends the request once more if its body can be
+// replayed.
+func (s *Store) Transport(base http.RoundTripper) http.RoundTripper {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return &transport{store: s, base: base}
+}
+
+type transport struct {
+	store *Store
+	base  http.RoundTripper
+}
+
+func (t *transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	token := t.store.Token()
+	resp, err := t.base.RoundTrip(withToken(req, token))
+	if err != nil || resp.StatusCode != http.StatusUnauthorized || resp.Header.Get(RotationHeader) != "rotate" {
+		return resp, err
+	}
+
+	t.store.logger.Info("Server asked to rotate the machine token")
+	if err := t.store.Rotate(req.Context(), token); err != nil {
+		t.store.logger.Warn("Token rotation failed", zap.Error(err))
+		return resp, nil
+	}
+	if req.Body != nil && req.GetBody == nil {
+		return resp, nil
+	}
+	retry := withToken(req, t.store.Token())
+	if req.GetBody != nil {
+		body, err := req.GetBody()
+		if err != nil {
+			return resp, nil
+		}
+		retry.Body = body
+	}
+	io.Copy(io.Discard, io.LimitReader(resp.Body, maxResponseSize))
+	resp.Body.Close()
+	return t.base.RoundTrip(retry)
+}
+
+// withToken returns a copy of req carrying token in its Authorization
+// header. A RoundTripper must not modify the request it is given.
+func withToken(req *http.Request, token string) *http.Request {
+	r := req.Clone(req.Context())
+	r.Header.Set("Authorization", "Bearer "+token)
+	return r
+}
+
+// enroll exchanges an enrollment code for a credential. Retries of one
+// enrollment send the same nonce.
+func (s *Store) enroll(ctx context.Context, code, nonce string) (credential, error) {
+	hostname, _ := os.Hostname()
+	body, err := json.Marshal(map[string]string{
+		"code":  code,
+		"nonce": nonce,
+		"name":  hostname,
+		"os":    runtime.GOOS,
+		"arch":  runtime.GOARCH,
+	})
+	if err != nil {
+		return credential{}, fmt.Errorf("encode enrollment request: %w", err)
+	}
+	return s.request(ctx, "/api/enroll", "", body)
+}
+
+// newNonce returns 128 random bits, hex encoded.
+func newNonce() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// request POSTs to an enrollment endpoint and decodes the credential in
+// the response. token, if set, authenticates the request.
+func (s *Store) request(ctx context.Context, path, token string, body []byte) (credential, error) {
+	ctx, cancel := context.WithTimeout(ctx, requestTimeout)
+	defer cancel()
+	s.mu.Lock()
+	url := s.url
+	s.mu.Unlock()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url+path, bytes.NewReader(body))
+	if err != nil {
+		return credential{}, fmt.Errorf("create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+		if s.secret != "" {
+			if err := signing.Sign(req, s.secret, path, body); err != nil {
+				return credential{}, fmt.Errorf("sign request: %w", err)
+			}
+		}
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return credential{}, fmt.Errorf("send request: %w", err)
+	}
+	defer resp.Body.Close()
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, maxResponseSize))
+
+	switch {
+	case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusUnprocessableEntity:
+		return credential{}, fmt.Errorf("%s: %w", path, ErrRejected)
+	case resp.StatusCode < 200 || resp.StatusCode >= 300:
+		return credential{}, fmt.Errorf("server returned %d", resp.StatusCode)
+	}
+
+	var parsed struct {
+		Data credential `json:"data"`
+	}
+	if err := json.Unmarshal(data, &parsed); err != nil || parsed.Data.Token == "" {
+		return credential{}, fmt.Errorf("invalid response from %s", path)
+	}
+	return parsed.Data, nil
+}
+
+// rotatable reports whether the token was enrolled, rather than set in the
+// config, and can be rotated.
+func (s *Store) rotatable() bool {
+	return s.path != "" || s.kr != nil
+}
+
+// location describes where the credential is kept, for messages.
+func (s *Store) location() string {
+	if s.kr != nil {
+		return "the OS keyring"
+	}
+	return s.path
+}
+
+// load reads the saved credential. It returns an error matching
+// os.ErrNotExist if there is none.
+func (s *Store) load() ([]byte, error) {
+	if s.kr != nil {
+		v, err := s.kr.Get(s.krName)
+		if errors.Is(err, keyring.ErrNotFound) {
+			return nil, os.ErrNotExist
+		}
+		return []byte(v), err
+	}
+	return os.ReadFile(s.path)
+}
+
+// save stores the credential in the keyring, or atomically writes the
+// credential file, readable only by the agent.
+func (s *Store) save(cred credential) error {
+	data, err := json.MarshalIndent(cred, "", "  ")
+	if err != nil {
+		return err
+	}
+	if s.kr != nil {
+		return s.kr.Set(s.krName, string(data))
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0700); err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+// retry calls fn with exponential backoff until it succeeds, the server
+// rejects the request (ErrRejected) or ctx is cancelled.
+func retry[T any](ctx context.Context, logger *zap.Logger, what string, fn func() (T, error)) (T, error) {
+	delay := retryDelay
+	for {
+		v, err := fn()
+		if err == nil || errors.Is(err, ErrRejected) {
+			return v, err
+		}
+		logger.Warn(what+" failed, retrying",
+			zap.Error(err),
+			zap.Duration("delay", delay))
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return v, ctx.Err()
+		}
+		if delay *= 2; delay > maxRetryDelay {
+			delay = maxRetryDelay
+		}
+	}
+}
@@ -0,0 +1,328 @@
+package credential
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/Guliveer/vitalis/agent/internal/config"
+	"github.com/Guliveer/vitalis/agent/internal/keyring"
+)
+
+// fakeServer issues tokens for enrollment code "enr_good" and rotates
+// them. Once the code is spent, only the nonce that spent it enrolls
+// again. "/api/ingest" answers 401 with the rotation hint for expired
+// tokens.
+type fakeServer struct {
+	mu       sync.Mutex
+	current  string
+	issued   int
+	rotateAt time.Time
+	expired  map[string]bool
+	ingested []string
+	nonce    string // nonce of the enrollment that spent the code
+	lose     int    // enrollment responses to drop
+}
+
+func (f *fakeServer) handler(t *testing.T) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+
+		switch r.URL.Path {
+		case "/api/enroll":
+			var body struct{ Code, Nonce, OS string }
+			json.NewDecoder(r.Body).Decode(&body)
+			if body.Code != "enr_good" || body.OS == "" || (f.nonce != "" && body.Nonce != f.nonce) {
+				http.Error(w, `{"error":"Invalid enrollment code"}`, http.StatusUnauthorized)
+				return
+			}
+			f.nonce = body.Nonce
+			if f.lose > 0 {
+				f.lose--
+				f.issued++
+				conn, _, _ := w.(http.Hijacker).Hijack()
+				conn.Close()
+				return
+			}
+		case "/api/rotate":
+			if token != f.current {
+				http.Error(w, `{"error":"Invalid machine token"}`, http.StatusUnauthorized)
+				return
+			}
+		case "/api/ingest":
+			data, _ := io.ReadAll(r.Body)
+			if f.expired[token] {
+				w.Header().Set(RotationHeader, "rotate")
+				http.Error(w, `{"error":"Machine token must be rotated"}`, http.StatusUnauthorized)
+				return
+			}
+			if token != f.current {
+				http.Error(w, `{"error":"Invalid machine token"}`, http.StatusUnauthorized)
+				return
+			}
+			f.ingested = append(f.ingested, string(data))
+			return
+		default:
+			t.Errorf("unexpected request to %s", r.URL.Path)
+			return
+		}
+
+		f.issued++
+		f.current = fmt.Sprintf("mtoken_%d", f.issued)
+		rotateAt := f.rotateAt
+		if rotateAt.IsZero() {
+			rotateAt = time.Now().Add(time.Hour)
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"data": map[string]interface{}{
+				"machine_id":    "machine-1",
+				"machine_token": f.current,
+				"expires_at":    time.Now().Add(2 * time.Hour),
+				"rotate_at":     rotateAt,
+			},
+		})
+	})
+}
+
+func (f *fakeServer) token() string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.current
+}
+
+func testConfig(url, dir string) *config.Config {
+	cfg := config.DefaultConfig()
+	cfg.Server.URL = url
+	cfg.Server.EnrollmentCode = "enr_good"
+	cfg.Buffer.DBPath = dir
+	return cfg
+}
+
+func TestOpen_EnrollsAndPersists(t *testing.T) {
+	fake := &fakeServer{}
+	srv := httptest.NewServer(fake.handler(t))
+	defer srv.Close()
+	dir := t.TempDir()
+
+	store, err := Open(context.Background(), testConfig(srv.URL, dir), zap.NewNop())
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	if store.Token() != "mtoken_1" {
+		t.Fatalf("Token = %q, want mtoken_1", store.Token())
+	}
+
+	info, err := os.Stat(filepath.Join(dir, fileName))
+	if err != nil {
+		t.Fatalf("credential file: %v", err)
+	}
+	if perm := info.Mode().Perm(); perm != 0600 && os.PathSeparator == '/' {
+		t.Errorf("credential file mode = %v, want 0600", perm)
+	}
+
+	// The next start uses the saved token; the code is not used again.
+	srv.Close()
+	store, err = Open(context.Background(), testConfig(srv.URL, dir), zap.NewNop())
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	if store.Token() != "mtoken_1" {
+		t.Errorf("Token after reopen = %q, want mtoken_1", store.Token())
+	}
+}
+
+func TestOpen_KeyringStore(t *testing.T) {
+	kr := keyring.NewMemory()
+	openKeyring = func() keyring.Keyring { return kr }
+	defer func() { openKeyring = keyring.System }()
+	srv := httptest.NewServer((&fakeServer{}).handler(t))
+	defer srv.Close()
+	dir := t.TempDir()
+	cfg := testConfig(srv.URL, dir)
+	cfg.Server.CredentialStore = "keyring"
+
+	if _, err := Open(context.Background(), cfg, zap.NewNop()); err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	saved, err := kr.Get(keyringName)
+	if err != nil || !strings.Contains(saved, "mtoken_1") {
+		t.Fatalf("keyring holds %q (%v), want the enrolled token", saved, err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, fileName)); !os.IsNotExist(err) {
+		t.Errorf("credential file written despite credential_store: keyring (%v)", err)
+	}
+
+	srv.Close()
+	store, err := Open(context.Background(), cfg, zap.NewNop())
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	if store.Token() != "mtoken_1" {
+		t.Errorf("Token after reopen = %q, want mtoken_1", store.Token())
+	}
+}
+
+func TestOpen_RejectedCode(t *testing.T) {
+	srv := httptest.NewServer((&fakeServer{}).handler(t))
+	defer srv.Close()
+	cfg := testConfig(srv.URL, t.TempDir())
+	cfg.Server.EnrollmentCode = "enr_bad"
+
+	if _, err := Open(context.Background(), cfg, zap.NewNop()); err == nil || !strings.Contains(err.Error(), ErrRejected.Error()) {
+		t.Fatalf("Open error = %v, want rejection", err)
+	}
+}
+
+func TestOpen_EnrollmentResponseLost(t *testing.T) {
+	retryDelay = 10 * time.Millisecond
+	defer func() { retryDelay = 10 * time.Second }()
+	fake := &fakeServer{lose: 1}
+	srv := httptest.NewServer(fake.handler(t))
+	defer srv.Close()
+
+	// The retry carries the nonce that spent the code and gets a token.
+	store, err := Open(context.Background(), testConfig(srv.URL, t.TempDir()), zap.NewNop())
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	if store.Token() != "mtoken_2" {
+		t.Errorf("Token = %q, want mtoken_2", store.Token())
+	}
+
+	// Another agent with the same code is still rejected.
+	_, err = Open(context.Background(), testConfig(srv.URL, t.TempDir()), zap.NewNop())
+	if err == nil || !strings.Contains(err.Error(), "create a new code") {
+		t.Errorf("Open error = %v, want rejection with instructions", err)
+	}
+}
+
+func TestOpen_ConfigToken(t *testing.T) {
+	cfg := testConfig("http://127.0.0.1:1", t.TempDir())
+	cfg.Server.MachineToken = "mtoken_static"
+
+	store, err := Open(context.Background(), cfg, zap.NewNop())
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	if store.Token() != "mtoken_static" {
+		t.Errorf("Token = %q, want mtoken_static", store.Token())
+	}
+	if err := store.Rotate(context.Background(), "mtoken_static"); err == nil {
+		t.Error("Rotate succeeded for a token from the config")
+	}
+}
+
+func TestSetServer(t *testing.T) {
+	// A token from the config is replaced along with the URL.
+	cfg := testConfig("http://127.0.0.1:1", t.TempDir())
+	cfg.Server.MachineToken = "mtoken_static"
+	store, err := Open(context.Background(), cfg, zap.NewNop())
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	store.SetServer("http://127.0.0.1:2", "mtoken_new")
+	if store.Token() != "mtoken_new" {
+		t.Errorf("config token after SetServer = %q, want mtoken_new", store.Token())
+	}
+
+	// An enrolled token is kept, and rotated at the new URL.
+	fake := &fakeServer{}
+	srv := httptest.NewServer(fake.handler(t))
+	defer srv.Close()
+	store, err = Open(context.Background(), testConfig(srv.URL, t.TempDir()), zap.NewNop())
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	moved := httptest.NewServer(fake.handler(t))
+	defer moved.Close()
+	srv.Close()
+	store.SetServer(moved.URL, "")
+	if store.Token() != "mtoken_1" {
+		t.Fatalf("enrolled token after SetServer = %q, want mtoken_1", store.Token())
+	}
+	if err := store.Rotate(context.Background(), "mtoken_1"); err != nil {
+		t.Fatalf("Rotate at the new URL: %v", err)
+	}
+	if store.Token() != "mtoken_2" {
+		t.Errorf("Token = %q, want mtoken_2", store.Token())
+	}
+}
+
+func TestTransport_RotatesOnHint(t *testing.T) {
+	fake := &fakeServer{expired: make(map[string]bool)}
+	srv := httptest.NewServer(fake.handler(t))
+	defer srv.Close()
+	dir := t.TempDir()
+
+	store, err := Open(context.Background(), testConfig(srv.URL, dir), zap.NewNop())
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	fake.mu.Lock()
+	fake.expired["mtoken_1"] = true
+	fake.mu.Unlock()
+
+	client := &http.Client{Transport: store.Transport(nil)}
+	req, _ := http.NewRequest(http.MethodPost, srv.URL+"/api/ingest", strings.NewReader(`{"metrics":[]}`))
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("Do: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want 200 after rotation", resp.StatusCode)
+	}
+	if store.Token() != "mtoken_2" {
+		t.Errorf("Token = %q, want mtoken_2", store.Token())
+	}
+	if len(fake.ingested) != 1 || fake.ingested[0] != `{"metrics":[]}` {
+		t.Errorf("ingested = %q, want the request body once", fake.ingested)
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, fileName))
+	if err != nil || !strings.Contains(string(data), "mtoken_2") {
+		t.Errorf("credential file does not hold the rotated token: %s (%v)", data, err)
+	}
+}
+
+func TestRun_RotatesOnSchedule(t *testing.T) {
+	fake := &fakeServer{rotateAt: time.Now().Add(50 * time.Millisecond)}
+	srv := httptest.NewServer(fake.handler(t))
+	defer srv.Close()
+
+	store, err := Open(context.Background(), testConfig(srv.URL, t.TempDir()), zap.NewNop())
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	fake.mu.Lock()
+	fake.rotateAt = time.Time{}
+	fake.mu.Unlock()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go store.Run(ctx)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for store.Token() != "mtoken_2" {
+		if time.Now().After(deadline) {
+			t.Fatalf("Token = %q, want mtoken_2 after the rotation time", store.Token())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if fake.token() != "mtoken_2" {
+		t.Errorf("server token = %q, want mtoken_2", fake.token())
+	}
+}
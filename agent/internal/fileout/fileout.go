@@ -0,0 +1,282 @@
+// Package fileout writes metric batches as newline-delimited JSON to stdout
+// or to a local file with size/time based rotation. Each line is a
+// models.MetricBatch, so exported files can later be replayed to a server.
+package fileout
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/Guliveer/vitalis/agent/internal/config"
+	"github.com/Guliveer/vitalis/agent/internal/models"
+)
+
+// rotatedTimeFormat is the timestamp embedded in rotated file names.
+// It sorts lexically in chronological order.
+const rotatedTimeFormat = "20060102T150405.000"
+
+// Writer appends batches to an NDJSON stream. It is safe for concurrent use.
+type Writer struct {
+	path     string
+	maxBytes int64
+	maxAge   time.Duration
+	maxFiles int
+	compress bool
+	logger   *zap.Logger
+	now      func() time.Time
+
+	mu       sync.Mutex
+	out      io.Writer
+	file     *os.File
+	size     int64
+	openedAt time.Time
+}
+
+// New creates a Writer from the file output configuration. A path of "-"
+// or "stdout" writes to standard output and disables rotation.
+func New(cfg config.FileOutputConfig, logger *zap.Logger) (*Writer, error) {
+	w := &Writer{
+		path:     cfg.Path,
+		maxBytes: int64(cfg.MaxSizeMB) * 1024 * 1024,
+		maxAge:   cfg.MaxAge.Duration,
+		maxFiles: cfg.MaxFiles,
+		compress: cfg.Compress,
+		logger:   logger.Named("fileout"),
+		now:      time.Now,
+	}
+
+	if IsStdout(cfg.Path) {
+		w.out = os.Stdout
+		return w, nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(cfg.Path), 0750); err != nil {
+		return nil, fmt.Errorf("create output directory: %w", err)
+	}
+	if err := w.openFile(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// Write appends the batch as a single JSON line, rotating the file first if
+// it has exceeded the configured size or age. The line carries the batch ID
+// the sender gives the same snapshots, so importing the file later does not
+// duplicate batches the server already has.
+func (w *Writer) Write(metrics []models.MetricSnapshot) error {
+	line, err := json.Marshal(models.MetricBatch{BatchID: models.NewBatchID(metrics), Metrics: metrics})
+	if err != nil {
+		return fmt.Errorf("marshal batch: %w", err)
+	}
+	line = append(line, '\n')
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.file != nil && w.shouldRotate(int64(len(line))) {
+		if _, err := w.rotate(); err != nil {
+			return err
+		}
+	}
+
+	n, err := w.out.Write(line)
+	w.size += int64(n)
+	if err != nil {
+		return fmt.Errorf("write batch: %w", err)
+	}
+	if w.file != nil {
+		return w.file.Sync()
+	}
+	return nil
+}
+
+// Rotate rotates the active file now, regardless of its size and age, and
+// returns the name it was rotated to. It does nothing when writing to
+// stdout or while the file is empty.
+func (w *Writer) Rotate() (string, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.file == nil || w.size == 0 {
+		return "", nil
+	}
+	return w.rotate()
+}
+
+// Close closes the underlying file. Writing to stdout needs no cleanup.
+func (w *Writer) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.file == nil {
+		return nil
+	}
+	err := w.file.Close()
+	w.file = nil
+	return err
+}
+
+// shouldRotate reports whether appending n bytes requires a new file.
+// Must be called with w.mu held.
+func (w *Writer) shouldRotate(n int64) bool {
+	if w.size == 0 {
+		return false
+	}
+	if w.maxBytes > 0 && w.size+n > w.maxBytes {
+		return true
+	}
+	if w.maxAge > 0 && w.now().Sub(w.openedAt) >= w.maxAge {
+		return true
+	}
+	return false
+}
+
+// rotate renames the active file with a timestamp suffix, optionally
+// compresses it, prunes old files and opens a fresh active file. Returns
+// the name of the rotated file.
+// Must be called with w.mu held.
+func (w *Writer) rotate() (string, error) {
+	if err := w.file.Close(); err != nil {
+		w.logger.Warn("Failed to close output file", zap.Error(err))
+	}
+	w.file = nil
+
+	rotated := w.rotatedName(w.now())
+	if err := os.Rename(w.path, rotated); err != nil {
+		return "", fmt.Errorf("rotate output file: %w", err)
+	}
+
+	if w.compress {
+		if err := gzipFile(rotated); err != nil {
+			w.logger.Warn("Failed to compress rotated file",
+				zap.String("file", rotated),
+				zap.Error(err))
+		} else {
+			rotated += ".gz"
+		}
+	}
+
+	w.logger.Info("Rotated output file", zap.String("file", rotated))
+	w.prune()
+
+	return rotated, w.openFile()
+}
+
+// openFile opens (or creates) the active output file for appending.
+// Must be called with w.mu held or before the Writer is shared.
+func (w *Writer) openFile() error {
+	f, err := os.OpenFile(w.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0640)
+	if err != nil {
+		return fmt.Errorf("open output file: %w", err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("stat output file: %w", err)
+	}
+
+	w.file = f
+	w.out = f
+	w.size = info.Size()
+	w.openedAt = w.now()
+	return nil
+}
+
+// rotatedName returns the archive name for the active file, e.g.
+// "metrics.ndjson" → "metrics-20240101T120000.000.ndjson".
+func (w *Writer) rotatedName(t time.Time) string {
+	ext := filepath.Ext(w.path)
+	base := strings.TrimSuffix(w.path, ext)
+	return fmt.Sprintf("%s-%s%s", base, t.UTC().Format(rotatedTimeFormat), ext)
+}
+
+// prune removes the oldest rotated files beyond the retention count.
+// Must be called with w.mu held.
+func (w *Writer) prune() {
+	if w.maxFiles <= 0 {
+		return
+	}
+
+	files, err := w.rotatedFiles()
+	if err != nil {
+		w.logger.Warn("Failed to list rotated files", zap.Error(err))
+		return
+	}
+
+	for len(files) > w.maxFiles {
+		if err := os.Remove(files[0]); err != nil {
+			w.logger.Warn("Failed to remove old output file",
+				zap.String("file", files[0]),
+				zap.Error(err))
+		}
+		files = files[1:]
+	}
+}
+
+// rotatedFiles returns all rotated files (compressed or not), oldest first.
+func (w *Writer) rotatedFiles() ([]string, error) {
+	ext := filepath.Ext(w.path)
+	base := strings.TrimSuffix(w.path, ext)
+
+	matches, err := filepath.Glob(base + "-*" + ext + "*")
+	if err != nil {
+		return nil, err
+	}
+
+	var files []string
+	for _, m := range matches {
+		if strings.HasSuffix(m, ext) || strings.HasSuffix(m, ext+".gz") {
+			files = append(files, m)
+		}
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// gzipFile compresses path to path.gz and removes the original.
+func gzipFile(path string) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(path+".gz", os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0640)
+	if err != nil {
+		return err
+	}
+
+	gz := gzip.NewWriter(out)
+	if _, err := io.Copy(gz, in); err != nil {
+		out.Close()
+		os.Remove(path + ".gz")
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		out.Close()
+		os.Remove(path + ".gz")
+		return err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(path + ".gz")
+		return err
+	}
+
+	in.Close()
+	return os.Remove(path)
+}
+
+// IsStdout reports whether path selects standard output.
+func IsStdout(path string) bool {
+	return path == "-" || path == "stdout"
+}
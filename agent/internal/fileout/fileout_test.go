@@ -0,0 +1,143 @@
+package fileout
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/Guliveer/vitalis/agent/internal/config"
+	"github.com/Guliveer/vitalis/agent/internal/models"
+)
+
+func newTestWriter(t *testing.T, mutate func(*config.FileOutputConfig)) (*Writer, string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "metrics.ndjson")
+	cfg := config.DefaultConfig().FileOutput
+	cfg.Enabled = true
+	cfg.Path = path
+	if mutate != nil {
+		mutate(&cfg)
+	}
+	w, err := New(cfg, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { w.Close() })
+	return w, path
+}
+
+func batch(cpu float64) []models.MetricSnapshot {
+	return []models.MetricSnapshot{{Timestamp: time.Unix(1700000000, 0).UTC(), CPUOverall: cpu}}
+}
+
+func TestWriter_WritesNDJSON(t *testing.T) {
+	w, path := newTestWriter(t, nil)
+
+	for i := 0; i < 3; i++ {
+		if err := w.Write(batch(float64(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var lines int
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var b models.MetricBatch
+		if err := json.Unmarshal(scanner.Bytes(), &b); err != nil {
+			t.Fatalf("line %d is not a MetricBatch: %v", lines, err)
+		}
+		if len(b.Metrics) != 1 || b.Metrics[0].CPUOverall != float64(lines) {
+			t.Errorf("line %d = %+v", lines, b)
+		}
+		if b.BatchID != models.NewBatchID(b.Metrics) {
+			t.Errorf("line %d has batch ID %q, want the one the sender uses", lines, b.BatchID)
+		}
+		lines++
+	}
+	if lines != 3 {
+		t.Errorf("got %d lines, want 3", lines)
+	}
+}
+
+func TestWriter_RotatesBySizeAndPrunes(t *testing.T) {
+	w, path := newTestWriter(t, func(c *config.FileOutputConfig) { c.MaxFiles = 2 })
+	w.maxBytes = 1 // every write after the first rotates
+
+	clock := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	w.now = func() time.Time {
+		clock = clock.Add(time.Second)
+		return clock
+	}
+
+	for i := 0; i < 5; i++ {
+		if err := w.Write(batch(float64(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rotated, err := w.rotatedFiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rotated) != 2 {
+		t.Fatalf("got %d rotated files, want 2: %v", len(rotated), rotated)
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("active file missing: %v", err)
+	}
+}
+
+func TestWriter_RotatesByAgeWithGzip(t *testing.T) {
+	w, _ := newTestWriter(t, func(c *config.FileOutputConfig) {
+		c.MaxAge = config.Duration{Duration: time.Hour}
+		c.Compress = true
+	})
+
+	clock := time.Now()
+	w.now = func() time.Time { return clock }
+
+	if err := w.Write(batch(1)); err != nil {
+		t.Fatal(err)
+	}
+	clock = clock.Add(2 * time.Hour)
+	if err := w.Write(batch(2)); err != nil {
+		t.Fatal(err)
+	}
+
+	rotated, err := w.rotatedFiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rotated) != 1 || filepath.Ext(rotated[0]) != ".gz" {
+		t.Fatalf("want one gzipped rotated file, got %v", rotated)
+	}
+
+	f, err := os.Open(rotated[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var b models.MetricBatch
+	if err := json.NewDecoder(gz).Decode(&b); err != nil {
+		t.Fatal(err)
+	}
+	if b.Metrics[0].CPUOverall != 1 {
+		t.Errorf("rotated file holds wrong batch: %+v", b)
+	}
+}
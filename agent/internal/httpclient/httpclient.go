@@ -0,0 +1,139 @@
+// Package httpclient builds the HTTP clients the agent uses to reach the
+// server and the update host, applying the configured TLS settings (custom
+// CA bundles, client certificates for mutual TLS and public key pinning)
+// and proxy.
+package httpclient
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/Guliveer/vitalis/agent/internal/config"
+)
+
+// New returns a client for the server. A timeout of 0 means none, for
+// long-lived requests such as the live stream.
+func New(server config.ServerConfig, timeout time.Duration) (*http.Client, error) {
+	tlsConfig, err := serverTLS(server.TLS)
+	if err != nil {
+		return nil, err
+	}
+	return newClient(tlsConfig, server.Proxy, timeout)
+}
+
+// NewForUpdates returns a client for the update host. It trusts the
+// configured CA bundle in addition to the system roots, so a TLS-inspecting
+// gateway with an internal CA works, but does not pin or present the
+// server's client certificate. The proxy settings apply as for the server.
+func NewForUpdates(server config.ServerConfig, timeout time.Duration) (*http.Client, error) {
+	tlsConfig := &tls.Config{MinVersion: minVersion(server.TLS.MinVersion)}
+	if server.TLS.CAFile != "" {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if err := appendCAFile(pool, server.TLS.CAFile); err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = pool
+	}
+	return newClient(tlsConfig, server.Proxy, timeout)
+}
+
+func newClient(tlsConfig *tls.Config, proxy config.ProxyConfig, timeout time.Duration) (*http.Client, error) {
+	proxyFn, err := proxyFunc(proxy)
+	if err != nil {
+		return nil, err
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	transport.Proxy = proxyFn
+	transport.OnProxyConnectResponse = proxyConnectError
+	return &http.Client{Transport: &proxyTransport{base: transport, proxy: proxyFn}, Timeout: timeout}, nil
+}
+
+// serverTLS builds the TLS configuration for connections to the server.
+func serverTLS(cfg config.TLSConfig) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		MinVersion: minVersion(cfg.MinVersion),
+		ServerName: cfg.ServerName,
+	}
+
+	if cfg.CAFile != "" {
+		pool := x509.NewCertPool()
+		if err := appendCAFile(pool, cfg.CAFile); err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if cfg.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("load client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	if len(cfg.PinnedSHA256) > 0 {
+		pins := make([][]byte, 0, len(cfg.PinnedSHA256))
+		for _, p := range cfg.PinnedSHA256 {
+			pin, err := base64.StdEncoding.DecodeString(p)
+			if err != nil || len(pin) != sha256.Size {
+				return nil, fmt.Errorf("invalid pinned_sha256 %q: want a base64-encoded SHA-256 digest", p)
+			}
+			pins = append(pins, pin)
+		}
+		tlsConfig.VerifyConnection = verifyPins(pins)
+	}
+	return tlsConfig, nil
+}
+
+// verifyPins accepts a connection only if a certificate in a verified
+// chain has one of the pinned public keys. Pinning a CA or intermediate
+// key therefore survives renewal of the server certificate. Only verified
+// chains count: a certificate merely sent along by the server proves
+// nothing.
+func verifyPins(pins [][]byte) func(tls.ConnectionState) error {
+	return func(cs tls.ConnectionState) error {
+		for _, chain := range cs.VerifiedChains {
+			for _, cert := range chain {
+				sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+				for _, pin := range pins {
+					if bytes.Equal(sum[:], pin) {
+						return nil
+					}
+				}
+			}
+		}
+		return errors.New("server certificate does not match any pinned key")
+	}
+}
+
+// appendCAFile adds the certificates of a PEM bundle to pool.
+func appendCAFile(pool *x509.CertPool, path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("read CA file: %w", err)
+	}
+	if !pool.AppendCertsFromPEM(data) {
+		return fmt.Errorf("no certificates found in CA file %s", path)
+	}
+	return nil
+}
+
+// minVersion maps the configured minimum TLS version to its constant.
+func minVersion(v string) uint16 {
+	if v == "1.3" {
+		return tls.VersionTLS13
+	}
+	return tls.VersionTLS12
+}
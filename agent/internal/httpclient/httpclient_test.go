@@ -0,0 +1,169 @@
+package httpclient
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Guliveer/vitalis/agent/internal/config"
+)
+
+// testCert is a certificate and key, signed by parent (self-signed if nil).
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	der  []byte
+}
+
+func newCert(t *testing.T, name string, parent *testCert, usage x509.ExtKeyUsage) *testCert {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{name},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+	}
+	signer, signerKey := tmpl, key
+	if parent == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+		tmpl.KeyUsage = x509.KeyUsageCertSign
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCert{cert: cert, key: key, der: der}
+}
+
+// write stores the certificate and key as PEM files and returns their paths.
+func (c *testCert) write(t *testing.T, dir, name string) (certFile, keyFile string) {
+	t.Helper()
+	keyDER, err := x509.MarshalECPrivateKey(c.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile = filepath.Join(dir, name+".crt")
+	keyFile = filepath.Join(dir, name+".key")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func (c *testCert) pin() string {
+	sum := sha256.Sum256(c.cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+func TestNew_MutualTLSWithPrivateCA(t *testing.T) {
+	dir := t.TempDir()
+	ca := newCert(t, "Test CA", nil, x509.ExtKeyUsageAny)
+	server := newCert(t, "vitalis.internal", ca, x509.ExtKeyUsageServerAuth)
+	client := newCert(t, "agent", ca, x509.ExtKeyUsageClientAuth)
+	other := newCert(t, "Other CA", nil, x509.ExtKeyUsageAny)
+	caFile, _ := ca.write(t, dir, "ca")
+	certFile, keyFile := client.write(t, dir, "client")
+
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(ca.cert)
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	srv.TLS = &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{server.der}, PrivateKey: server.key}},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    clientCAs,
+	}
+	srv.StartTLS()
+	defer srv.Close()
+
+	full := config.TLSConfig{CAFile: caFile, CertFile: certFile, KeyFile: keyFile, ServerName: "vitalis.internal"}
+	for _, tc := range []struct {
+		name    string
+		modify  func(*config.TLSConfig)
+		wantErr string
+	}{
+		{"private CA and client certificate", func(*config.TLSConfig) {}, ""},
+		{"pinned CA key", func(c *config.TLSConfig) { c.PinnedSHA256 = []string{other.pin(), ca.pin()} }, ""},
+		{"pinned server key", func(c *config.TLSConfig) { c.PinnedSHA256 = []string{server.pin()} }, ""},
+		{"pin mismatch", func(c *config.TLSConfig) { c.PinnedSHA256 = []string{other.pin()} }, "pinned key"},
+		{"no client certificate", func(c *config.TLSConfig) { c.CertFile, c.KeyFile = "", "" }, "certificate"},
+		{"system roots only", func(c *config.TLSConfig) { c.CAFile = "" }, "certificate"},
+		{"wrong server name", func(c *config.TLSConfig) { c.ServerName = "other.internal" }, "certificate"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := full
+			tc.modify(&cfg)
+			client, err := New(config.ServerConfig{TLS: cfg}, 5*time.Second)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			resp, err := client.Get(srv.URL)
+			if err == nil {
+				resp.Body.Close()
+			}
+			switch {
+			case tc.wantErr == "" && err != nil:
+				t.Errorf("request failed: %v", err)
+			case tc.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tc.wantErr)):
+				t.Errorf("request error = %v, want one mentioning %q", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestNew_RejectsInvalidSettings(t *testing.T) {
+	dir := t.TempDir()
+	empty := filepath.Join(dir, "empty.pem")
+	if err := os.WriteFile(empty, []byte("not a certificate"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, cfg := range map[string]config.TLSConfig{
+		"missing CA file":  {CAFile: filepath.Join(dir, "missing.pem")},
+		"empty CA file":    {CAFile: empty},
+		"bad client cert":  {CertFile: empty, KeyFile: empty},
+		"pin not base64":   {PinnedSHA256: []string{"not base64!"}},
+		"pin wrong length": {PinnedSHA256: []string{base64.StdEncoding.EncodeToString([]byte("short"))}},
+	} {
+		if _, err := New(config.ServerConfig{TLS: cfg}, time.Second); err == nil {
+			t.Errorf("%s: New succeeded, want error", name)
+		}
+	}
+	if _, err := NewForUpdates(config.ServerConfig{TLS: config.TLSConfig{CAFile: empty}}, time.Second); err == nil {
+		t.Error("empty CA file: NewForUpdates succeeded, want error")
+	}
+}
@@ -0,0 +1,131 @@
+package httpclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/Guliveer/vitalis/agent/internal/config"
+)
+
+// ProxyError reports that a request failed at the proxy rather than at the
+// destination: the proxy was unreachable, refused the credentials or could
+// not open a tunnel.
+type ProxyError struct {
+	Proxy string // proxy URL with the password redacted
+	Err   error
+}
+
+func (e *ProxyError) Error() string {
+	return fmt.Sprintf("proxy %s failed: %v", e.Proxy, e.Err)
+}
+
+func (e *ProxyError) Unwrap() error { return e.Err }
+
+// IsProxyError reports whether err was caused by the proxy.
+func IsProxyError(err error) bool {
+	var pe *ProxyError
+	return errors.As(err, &pe)
+}
+
+// proxyFunc returns the transport's Proxy function for cfg. Without a URL
+// the environment variables apply, as for http.DefaultTransport.
+func proxyFunc(cfg config.ProxyConfig) (func(*http.Request) (*url.URL, error), error) {
+	if cfg.URL == "" {
+		return http.ProxyFromEnvironment, nil
+	}
+
+	proxyURL, err := url.Parse(cfg.URL)
+	if err != nil {
+		return nil, fmt.Errorf("server proxy url is not a valid URL")
+	}
+	password := cfg.Password
+	if cfg.PasswordFile != "" {
+		data, err := os.ReadFile(cfg.PasswordFile)
+		if err != nil {
+			return nil, fmt.Errorf("read proxy password file: %w", err)
+		}
+		password = strings.TrimRight(string(data), "\r\n")
+	}
+	if cfg.Username != "" {
+		proxyURL.User = url.UserPassword(cfg.Username, password)
+	}
+
+	return func(req *http.Request) (*url.URL, error) {
+		if bypassProxy(req.URL.Hostname(), cfg.NoProxy) {
+			return nil, nil
+		}
+		return proxyURL, nil
+	}, nil
+}
+
+// bypassProxy reports whether host matches a no_proxy entry: "*", an exact
+// host name or IP, a domain (with or without a leading dot) covering its
+// subdomains, or a CIDR range.
+func bypassProxy(host string, noProxy []string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	ip := net.ParseIP(host)
+	for _, entry := range noProxy {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		switch {
+		case entry == "":
+		case entry == "*":
+			return true
+		case strings.Contains(entry, "/"):
+			if _, cidr, err := net.ParseCIDR(entry); err == nil && ip != nil && cidr.Contains(ip) {
+				return true
+			}
+		case ip != nil:
+			if entryIP := net.ParseIP(entry); entryIP != nil && entryIP.Equal(ip) {
+				return true
+			}
+		default:
+			domain := strings.TrimPrefix(entry, ".")
+			if host == domain || strings.HasSuffix(host, "."+domain) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// proxyTransport turns proxy failures into ProxyErrors. Without it they
+// surface as a bare status text or a dial error that does not say which hop
+// failed, and a 407 for a plain-HTTP request would look like a response
+// from the server.
+type proxyTransport struct {
+	base  *http.Transport
+	proxy func(*http.Request) (*url.URL, error)
+}
+
+func (t *proxyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.base.RoundTrip(req)
+
+	proxyURL, _ := t.proxy(req)
+	if proxyURL == nil {
+		return resp, err
+	}
+	var opErr *net.OpError
+	if err != nil && !IsProxyError(err) && errors.As(err, &opErr) && (opErr.Op == "proxyconnect" || opErr.Op == "socks connect") {
+		err = &ProxyError{Proxy: proxyURL.Redacted(), Err: err}
+	}
+	if err == nil && resp.StatusCode == http.StatusProxyAuthRequired {
+		resp.Body.Close()
+		return nil, &ProxyError{Proxy: proxyURL.Redacted(), Err: errors.New(resp.Status)}
+	}
+	return resp, err
+}
+
+// proxyConnectError is the transport's OnProxyConnectResponse hook: a
+// CONNECT refused by an HTTP proxy becomes a ProxyError naming the status.
+func proxyConnectError(_ context.Context, proxyURL *url.URL, _ *http.Request, resp *http.Response) error {
+	if resp.StatusCode == http.StatusOK {
+		return nil
+	}
+	return &ProxyError{Proxy: proxyURL.Redacted(), Err: fmt.Errorf("CONNECT: %s", resp.Status)}
+}
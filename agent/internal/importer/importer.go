@@ -0,0 +1,268 @@
+// Package importer replays exported metric files to the server. It reads
+// NDJSON files written by the file output (one MetricBatch per line, plain
+// or gzipped) as well as offline buffer files (a JSON array of snapshots),
+// validates every snapshot, and records progress in a state file so an
+// interrupted import resumes where it stopped.
+package importer
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"go.uber.org/zap"
+
+	"github.com/Guliveer/vitalis/agent/internal/buffer"
+	"github.com/Guliveer/vitalis/agent/internal/models"
+)
+
+// stateSuffix is appended to an input file name to form its state file.
+const stateSuffix = ".import-state"
+
+// SendFunc delivers one batch; it must block until the server has accepted
+// the batch or return an error.
+type SendFunc func(ctx context.Context, batch models.MetricBatch) error
+
+// State records how far an input file has been imported.
+type State struct {
+	// Records is the number of fully imported records (lines or buffer files).
+	Records int `json:"records"`
+	// Offset is the number of snapshots already sent from the next record
+	// when it had to be split into several requests.
+	Offset int `json:"offset"`
+	// Size is the input size when the state was written, used to detect a
+	// file that was replaced rather than appended to.
+	Size int64 `json:"size"`
+}
+
+// Stats summarizes the outcome of importing a single file.
+type Stats struct {
+	Records int // records read, including previously imported ones
+	Resumed int // records skipped because an earlier run imported them
+	Sent    int // snapshots sent in this run
+	Invalid int // snapshots dropped by validation
+}
+
+// Importer replays files through a SendFunc.
+type Importer struct {
+	send     SendFunc
+	logger   *zap.Logger
+	stateDir string
+
+	// OnProgress, if set, is called after each batch is delivered.
+	OnProgress func(file string, stats Stats)
+
+	// BufferKey decrypts encrypted buffer segments (see buffer.LoadKey).
+	BufferKey *buffer.Key
+}
+
+// New creates an Importer. If stateDir is empty, state files are written
+// next to the input files.
+func New(send SendFunc, stateDir string, logger *zap.Logger) *Importer {
+	return &Importer{
+		send:     send,
+		logger:   logger,
+		stateDir: stateDir,
+	}
+}
+
+// ImportFile imports a single file, resuming from its state file if present.
+// Progress is persisted after every delivered batch, so cancelling ctx (or a
+// crash) loses at most the batch in flight.
+func (im *Importer) ImportFile(ctx context.Context, path string) (Stats, error) {
+	var stats Stats
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return stats, err
+	}
+
+	statePath := im.statePath(path)
+	state, err := loadState(statePath)
+	if err != nil {
+		return stats, fmt.Errorf("load import state: %w", err)
+	}
+	if state.Size > info.Size() {
+		im.logger.Warn("Input file shrank since the last import, starting over",
+			zap.String("file", path))
+		state = State{}
+	}
+
+	src, err := Open(path, im.BufferKey)
+	if err != nil {
+		return stats, err
+	}
+	defer src.Close()
+
+	for {
+		record, err := src.Next()
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return stats, err
+		}
+		stats.Records++
+
+		if stats.Records <= state.Records {
+			stats.Resumed++
+			continue
+		}
+
+		valid := im.validate(path, stats.Records, record.Metrics)
+		stats.Invalid += len(record.Metrics) - len(valid)
+
+		// A record sent unchanged keeps its batch ID, so the server can
+		// recognise batches it already received live. Anything trimmed or
+		// split gets IDs derived from the snapshots actually sent.
+		whole := len(valid) == len(record.Metrics) && len(valid) <= models.MaxBatchSize
+
+		for state.Offset < len(valid) {
+			end := state.Offset + models.MaxBatchSize
+			if end > len(valid) {
+				end = len(valid)
+			}
+			chunk := models.MetricBatch{Metrics: valid[state.Offset:end]}
+			if whole {
+				chunk.BatchID = record.BatchID
+				chunk.Sequence = record.Sequence
+			}
+			if chunk.BatchID == "" {
+				chunk.BatchID = models.NewBatchID(chunk.Metrics)
+			}
+
+			if err := im.send(ctx, chunk); err != nil {
+				return stats, fmt.Errorf("send record %d: %w", stats.Records, err)
+			}
+
+			stats.Sent += len(chunk.Metrics)
+			state.Offset = end
+			state.Size = info.Size()
+			if err := saveState(statePath, state); err != nil {
+				return stats, fmt.Errorf("save import state: %w", err)
+			}
+			if im.OnProgress != nil {
+				im.OnProgress(path, stats)
+			}
+		}
+
+		state.Records = stats.Records
+		state.Offset = 0
+		state.Size = info.Size()
+		if err := saveState(statePath, state); err != nil {
+			return stats, fmt.Errorf("save import state: %w", err)
+		}
+	}
+
+	return stats, nil
+}
+
+// validate drops snapshots that the server would reject and logs why.
+func (im *Importer) validate(path string, record int, metrics []models.MetricSnapshot) []models.MetricSnapshot {
+	valid := make([]models.MetricSnapshot, 0, len(metrics))
+	for i, m := range metrics {
+		if err := m.Validate(); err != nil {
+			im.logger.Warn("Skipping invalid snapshot",
+				zap.String("file", path),
+				zap.Int("record", record),
+				zap.Int("snapshot", i),
+				zap.Error(err))
+			continue
+		}
+		valid = append(valid, m)
+	}
+	return valid
+}
+
+// statePath returns the state file location for an input file.
+func (im *Importer) statePath(input string) string {
+	if im.stateDir == "" {
+		return input + stateSuffix
+	}
+	abs, err := filepath.Abs(input)
+	if err != nil {
+		abs = input
+	}
+	// Flatten the absolute path so inputs with the same base name in
+	// different directories do not share a state file.
+	name := strings.NewReplacer("/", "_", "\\", "_", ":", "_").Replace(abs)
+	return filepath.Join(im.stateDir, name+stateSuffix)
+}
+
+// ExpandInputs turns the given paths into an ordered list of files to
+// import. Directories are expanded to the importable files they contain,
+// sorted by name, which keeps rotated files in chronological order.
+func ExpandInputs(paths []string) ([]string, error) {
+	var files []string
+	for _, p := range paths {
+		info, err := os.Stat(p)
+		if err != nil {
+			return nil, err
+		}
+		if !info.IsDir() {
+			files = append(files, p)
+			continue
+		}
+
+		entries, err := os.ReadDir(p)
+		if err != nil {
+			return nil, err
+		}
+		var dirFiles []string
+		for _, e := range entries {
+			if !e.IsDir() && isImportable(e.Name()) {
+				dirFiles = append(dirFiles, filepath.Join(p, e.Name()))
+			}
+		}
+		sort.Strings(dirFiles)
+		files = append(files, dirFiles...)
+	}
+	return files, nil
+}
+
+// isImportable reports whether a file name looks like an export or buffer file.
+func isImportable(name string) bool {
+	if name == buffer.CursorFile {
+		return false
+	}
+	name = strings.TrimSuffix(name, ".gz")
+	switch filepath.Ext(name) {
+	case ".ndjson", ".jsonl", ".json", ".wal":
+		return true
+	}
+	return false
+}
+
+// loadState reads a state file; a missing file yields the zero State.
+func loadState(path string) (State, error) {
+	var state State
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return state, nil
+		}
+		return state, err
+	}
+	if err := json.Unmarshal(data, &state); err != nil {
+		return state, fmt.Errorf("parse %s: %w", path, err)
+	}
+	return state, nil
+}
+
+// saveState atomically replaces the state file.
+func saveState(path string, state State) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0640); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
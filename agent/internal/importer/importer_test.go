@@ -0,0 +1,239 @@
+package importer
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/Guliveer/vitalis/agent/internal/buffer"
+	"github.com/Guliveer/vitalis/agent/internal/config"
+	"github.com/Guliveer/vitalis/agent/internal/models"
+)
+
+func snapshot(cpu float64) models.MetricSnapshot {
+	return models.MetricSnapshot{
+		Timestamp:  time.Unix(1700000000, 0).UTC(),
+		CPUOverall: cpu,
+		RAMTotal:   1024,
+	}
+}
+
+func writeNDJSON(t *testing.T, path string, gz bool, batches ...[]models.MetricSnapshot) {
+	t.Helper()
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var w interface {
+		Write([]byte) (int, error)
+	} = f
+	if gz {
+		zw := gzip.NewWriter(f)
+		defer zw.Close()
+		w = zw
+	}
+
+	enc := json.NewEncoder(w)
+	for _, b := range batches {
+		if err := enc.Encode(models.MetricBatch{Metrics: b}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// recorder is a SendFunc that records delivered snapshots and batch IDs
+// and can be told to fail after a number of successful calls.
+type recorder struct {
+	sent      []float64
+	ids       []string
+	failAfter int
+	calls     int
+}
+
+func (r *recorder) send(_ context.Context, batch models.MetricBatch) error {
+	r.calls++
+	if r.failAfter > 0 && r.calls > r.failAfter {
+		return errors.New("server unavailable")
+	}
+	for _, m := range batch.Metrics {
+		r.sent = append(r.sent, m.CPUOverall)
+	}
+	r.ids = append(r.ids, batch.BatchID)
+	return nil
+}
+
+func TestImportFile_NDJSONSkipsInvalid(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metrics.ndjson")
+	writeNDJSON(t, path, false,
+		[]models.MetricSnapshot{snapshot(1), snapshot(2)},
+		[]models.MetricSnapshot{snapshot(150)}, // cpu out of range
+		[]models.MetricSnapshot{snapshot(3)},
+	)
+
+	rec := &recorder{}
+	stats, err := New(rec.send, "", zap.NewNop()).ImportFile(context.Background(), path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if stats.Records != 3 || stats.Sent != 3 || stats.Invalid != 1 {
+		t.Errorf("stats = %+v", stats)
+	}
+	if len(rec.sent) != 3 || rec.sent[2] != 3 {
+		t.Errorf("sent = %v", rec.sent)
+	}
+}
+
+func TestImportFile_ResumesAfterFailure(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metrics.ndjson.gz")
+	writeNDJSON(t, path, true,
+		[]models.MetricSnapshot{snapshot(1)},
+		[]models.MetricSnapshot{snapshot(2)},
+		[]models.MetricSnapshot{snapshot(3)},
+	)
+
+	first := &recorder{failAfter: 1}
+	if _, err := New(first.send, "", zap.NewNop()).ImportFile(context.Background(), path); err == nil {
+		t.Fatal("expected error from failing sender")
+	}
+
+	second := &recorder{}
+	stats, err := New(second.send, "", zap.NewNop()).ImportFile(context.Background(), path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Resumed != 1 {
+		t.Errorf("resumed = %d, want 1", stats.Resumed)
+	}
+	if len(second.sent) != 2 || second.sent[0] != 2 {
+		t.Errorf("second run sent %v, want [2 3]", second.sent)
+	}
+
+	// A completed import is a no-op when run again.
+	third := &recorder{}
+	if _, err := New(third.send, "", zap.NewNop()).ImportFile(context.Background(), path); err != nil {
+		t.Fatal(err)
+	}
+	if len(third.sent) != 0 {
+		t.Errorf("completed import re-sent %v", third.sent)
+	}
+}
+
+func TestImportFile_BufferFileAndChunking(t *testing.T) {
+	dir := t.TempDir()
+	metrics := make([]models.MetricSnapshot, models.MaxBatchSize+5)
+	for i := range metrics {
+		metrics[i] = snapshot(1)
+	}
+	data, err := json.Marshal(metrics)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "20240101T000000.000.json")
+	if err := os.WriteFile(path, data, 0640); err != nil {
+		t.Fatal(err)
+	}
+
+	stateDir := filepath.Join(dir, "state")
+	if err := os.Mkdir(stateDir, 0750); err != nil {
+		t.Fatal(err)
+	}
+
+	rec := &recorder{}
+	stats, err := New(rec.send, stateDir, zap.NewNop()).ImportFile(context.Background(), path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec.calls != 2 {
+		t.Errorf("calls = %d, want 2 chunks", rec.calls)
+	}
+	if stats.Sent != len(metrics) {
+		t.Errorf("sent = %d, want %d", stats.Sent, len(metrics))
+	}
+}
+
+func TestImportFile_BufferSegment(t *testing.T) {
+	dir := t.TempDir()
+	buf, err := buffer.New(config.BufferConfig{DBPath: dir, MaxSizeMB: 10}, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, cpu := range []float64{1, 2} {
+		if err := buf.Store(models.MetricBatch{Metrics: []models.MetricSnapshot{snapshot(cpu)}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	buf.Close()
+
+	files, err := ExpandInputs([]string{dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 {
+		t.Fatalf("files = %v, want the single segment", files)
+	}
+
+	rec := &recorder{}
+	if _, err := New(rec.send, "", zap.NewNop()).ImportFile(context.Background(), files[0]); err != nil {
+		t.Fatal(err)
+	}
+	if len(rec.sent) != 2 || rec.sent[1] != 2 {
+		t.Errorf("sent = %v, want [1 2]", rec.sent)
+	}
+}
+
+func TestImportFile_BatchIDs(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metrics.ndjson")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	enc := json.NewEncoder(f)
+	enc.Encode(models.MetricBatch{BatchID: "6f1c2d3e-4a5b-4c6d-8e7f-901234567890", Metrics: []models.MetricSnapshot{snapshot(1)}})
+	enc.Encode(models.MetricBatch{Metrics: []models.MetricSnapshot{snapshot(2)}})
+	f.Close()
+
+	rec := &recorder{}
+	if _, err := New(rec.send, "", zap.NewNop()).ImportFile(context.Background(), path); err != nil {
+		t.Fatal(err)
+	}
+
+	// An existing ID is kept; a missing one is derived from the snapshots,
+	// matching the ID the live sender would have used.
+	want := []string{"6f1c2d3e-4a5b-4c6d-8e7f-901234567890", models.NewBatchID([]models.MetricSnapshot{snapshot(2)})}
+	if len(rec.ids) != 2 || rec.ids[0] != want[0] || rec.ids[1] != want[1] {
+		t.Errorf("batch IDs = %v, want %v", rec.ids, want)
+	}
+}
+
+func TestExpandInputs_SortsDirectory(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"metrics.ndjson", "metrics-20240102T000000.000.ndjson.gz", "metrics-20240101T000000.000.ndjson", "notes.txt", "metrics.ndjson.import-state"} {
+		if err := os.WriteFile(filepath.Join(dir, name), nil, 0640); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	files, err := ExpandInputs([]string{dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"metrics-20240101T000000.000.ndjson", "metrics-20240102T000000.000.ndjson.gz", "metrics.ndjson"}
+	if len(files) != len(want) {
+		t.Fatalf("files = %v", files)
+	}
+	for i, f := range files {
+		if filepath.Base(f) != want[i] {
+			t.Errorf("files[%d] = %s, want %s", i, filepath.Base(f), want[i])
+		}
+	}
+}
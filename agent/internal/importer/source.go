@@ -0,0 +1,149 @@
+package importer
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/Guliveer/vitalis/agent/internal/buffer"
+	"github.com/Guliveer/vitalis/agent/internal/models"
+)
+
+// maxLineSize bounds a single NDJSON line (a batch with full process lists
+// on a many-core machine is well under this).
+const maxLineSize = 16 * 1024 * 1024
+
+// Source iterates over the records of an input file. A record is one NDJSON
+// line (a MetricBatch), one buffer segment record or, for buffer files
+// written by older agents, the whole JSON array.
+type Source struct {
+	file    *os.File
+	segment *buffer.SegmentReader
+	gz      *gzip.Reader
+	scanner *bufio.Scanner
+	array   []models.MetricSnapshot
+	line    int
+	done    bool
+}
+
+// Open opens an input file, transparently decompressing gzip and detecting
+// whether it holds NDJSON batches, a buffer segment or a single buffered
+// JSON array. key decrypts encrypted buffer segments and may be nil.
+func Open(path string, key *buffer.Key) (*Source, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	src := &Source{file: f}
+
+	br := bufio.NewReader(f)
+	if head, _ := br.Peek(16); buffer.IsSegment(head) {
+		f.Close()
+		seg, err := buffer.OpenSegment(path, key)
+		if err != nil {
+			return nil, err
+		}
+		return &Source{segment: seg}, nil
+	}
+
+	var r io.Reader = br
+	if magic, err := br.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			f.Close()
+			return nil, fmt.Errorf("open gzip stream: %w", err)
+		}
+		src.gz = gz
+		r = gz
+	}
+
+	br = bufio.NewReader(r)
+	first, err := firstNonSpace(br)
+	if err != nil {
+		if err == io.EOF {
+			src.done = true
+			return src, nil
+		}
+		src.Close()
+		return nil, err
+	}
+
+	if first == '[' {
+		// Buffer file: a single JSON array of snapshots.
+		if err := json.NewDecoder(br).Decode(&src.array); err != nil {
+			src.Close()
+			return nil, fmt.Errorf("parse buffer file %s: %w", path, err)
+		}
+		return src, nil
+	}
+
+	src.scanner = bufio.NewScanner(br)
+	src.scanner.Buffer(make([]byte, 0, 64*1024), maxLineSize)
+	return src, nil
+}
+
+// Next returns the batch in the next record, or io.EOF when the input is
+// exhausted. Records without a batch ID (older files and buffered arrays)
+// are returned with an empty BatchID.
+func (s *Source) Next() (models.MetricBatch, error) {
+	if s.done {
+		return models.MetricBatch{}, io.EOF
+	}
+	if s.segment != nil {
+		return s.segment.Next()
+	}
+
+	if s.scanner == nil {
+		s.done = true
+		return models.MetricBatch{Metrics: s.array}, nil
+	}
+
+	for s.scanner.Scan() {
+		s.line++
+		line := bytes.TrimSpace(s.scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		var batch models.MetricBatch
+		if err := json.Unmarshal(line, &batch); err != nil {
+			return batch, fmt.Errorf("parse line %d: %w", s.line, err)
+		}
+		batch.MachineToken = ""
+		return batch, nil
+	}
+	if err := s.scanner.Err(); err != nil {
+		return models.MetricBatch{}, fmt.Errorf("read line %d: %w", s.line+1, err)
+	}
+	s.done = true
+	return models.MetricBatch{}, io.EOF
+}
+
+// Close releases the underlying file.
+func (s *Source) Close() error {
+	if s.segment != nil {
+		return s.segment.Close()
+	}
+	if s.gz != nil {
+		s.gz.Close()
+	}
+	return s.file.Close()
+}
+
+// firstNonSpace peeks at the first non-whitespace byte without consuming it.
+func firstNonSpace(r *bufio.Reader) (byte, error) {
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		switch b {
+		case ' ', '\t', '\r', '\n':
+			continue
+		}
+		return b, r.UnreadByte()
+	}
+}
@@ -0,0 +1,85 @@
+// Package keyring stores agent secrets in the operating system's credential
+// store, so they need not appear in config files. Secrets are kept under
+// the service name "vitalis-agent" and looked up by name.
+//
+// Only the Secret Service (GNOME Keyring, KWallet) on Linux is supported,
+// through the secret-tool command from libsecret. It needs a session bus
+// with an unlocked collection, which system services usually lack; user
+// installs are the intended use.
+package keyring
+
+import (
+	"errors"
+	"sync"
+)
+
+// Service is the service attribute secrets are stored under.
+const Service = "vitalis-agent"
+
+var (
+	// ErrNotFound is returned by Get when there is no secret by that name.
+	ErrNotFound = errors.New("secret not found in keyring")
+
+	// ErrUnsupported is returned when no credential store is available
+	// on this system.
+	ErrUnsupported = errors.New("no OS keyring available on this system")
+)
+
+// Keyring reads and writes named secrets.
+type Keyring interface {
+	Get(name string) (string, error)
+	Set(name, secret string) error
+	Delete(name string) error
+}
+
+// System returns the operating system's keyring. On systems without one,
+// every method returns ErrUnsupported.
+func System() Keyring {
+	return system()
+}
+
+// Memory is an in-memory Keyring for tests.
+type Memory struct {
+	mu      sync.Mutex
+	secrets map[string]string
+}
+
+// NewMemory returns an empty in-memory keyring.
+func NewMemory() *Memory {
+	return &Memory{secrets: make(map[string]string)}
+}
+
+// Get returns the named secret.
+func (m *Memory) Get(name string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	secret, ok := m.secrets[name]
+	if !ok {
+		return "", ErrNotFound
+	}
+	return secret, nil
+}
+
+// Set stores a secret, replacing any secret by the same name.
+func (m *Memory) Set(name, secret string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.secrets[name] = secret
+	return nil
+}
+
+// Delete removes the named secret. Deleting a missing secret is not an
+// error.
+func (m *Memory) Delete(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.secrets, name)
+	return nil
+}
+
+// unsupported is the Keyring of systems without a credential store.
+type unsupported struct{}
+
+func (unsupported) Get(string) (string, error) { return "", ErrUnsupported }
+func (unsupported) Set(string, string) error   { return ErrUnsupported }
+func (unsupported) Delete(string) error        { return ErrUnsupported }
@@ -0,0 +1,88 @@
+//go:build linux
+
+package keyring
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"strings"
+)
+
+// lookPath finds the secret-tool binary. Replaced in tests.
+var lookPath = exec.LookPath
+
+func system() Keyring {
+	if _, err := lookPath("secret-tool"); err != nil {
+		return unsupported{}
+	}
+	return secretTool{run: runSecretTool}
+}
+
+// runFunc runs secret-tool with the given arguments and stdin, returning
+// what it wrote to stdout and stderr.
+type runFunc func(stdin io.Reader, args ...string) (stdout, stderr []byte, err error)
+
+// runSecretTool runs the secret-tool binary.
+func runSecretTool(stdin io.Reader, args ...string) ([]byte, []byte, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command("secret-tool", args...)
+	cmd.Stdin = stdin
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	err := cmd.Run()
+	return stdout.Bytes(), stderr.Bytes(), err
+}
+
+// secretTool talks to the Secret Service through libsecret's secret-tool.
+// Secrets are passed on stdin and stdout, never as arguments.
+type secretTool struct {
+	run runFunc
+}
+
+func (s secretTool) Get(name string) (string, error) {
+	stdout, stderr, err := s.run(nil, "lookup", "service", Service, "account", name)
+	if err != nil {
+		// secret-tool exits 1 without output when nothing matches.
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) && len(stdout) == 0 && len(stderr) == 0 {
+			return "", ErrNotFound
+		}
+		return "", commandError("lookup", err, stderr)
+	}
+	// Secrets are never stored empty, so no output means no secret.
+	if len(stdout) == 0 {
+		return "", ErrNotFound
+	}
+	return string(stdout), nil
+}
+
+func (s secretTool) Set(name, secret string) error {
+	_, stderr, err := s.run(strings.NewReader(secret), "store", "--label", "Vitalis agent: "+name, "service", Service, "account", name)
+	if err != nil {
+		return commandError("store", err, stderr)
+	}
+	return nil
+}
+
+func (s secretTool) Delete(name string) error {
+	_, stderr, err := s.run(nil, "clear", "service", Service, "account", name)
+	if err != nil {
+		return commandError("clear", err, stderr)
+	}
+	return nil
+}
+
+// commandError reports a failed secret-tool command with its message,
+// e.g. when no session bus or keyring daemon is running. A secret-tool
+// binary that disappeared since startup is reported as ErrUnsupported.
+func commandError(op string, err error, stderr []byte) error {
+	if errors.Is(err, exec.ErrNotFound) {
+		return fmt.Errorf("secret-tool %s: %w", op, ErrUnsupported)
+	}
+	if msg := strings.TrimSpace(string(stderr)); msg != "" {
+		return fmt.Errorf("secret-tool %s: %s", op, msg)
+	}
+	return fmt.Errorf("secret-tool %s: %w", op, err)
+}
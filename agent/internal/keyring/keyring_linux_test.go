@@ -0,0 +1,120 @@
+//go:build linux
+
+package keyring
+
+import (
+	"errors"
+	"io"
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+// exitError returns the error of a command that exits with status 1.
+func exitError(t *testing.T) error {
+	t.Helper()
+	err := exec.Command("sh", "-c", "exit 1").Run()
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) {
+		t.Skipf("cannot produce an exit error: %v", err)
+	}
+	return err
+}
+
+func TestSystem_WithoutSecretTool(t *testing.T) {
+	lookPath = func(string) (string, error) { return "", exec.ErrNotFound }
+	defer func() { lookPath = exec.LookPath }()
+
+	kr := System()
+	if _, err := kr.Get("token"); !errors.Is(err, ErrUnsupported) {
+		t.Errorf("Get = %v, want ErrUnsupported", err)
+	}
+	if err := kr.Set("token", "mtoken_test"); !errors.Is(err, ErrUnsupported) {
+		t.Errorf("Set = %v, want ErrUnsupported", err)
+	}
+}
+
+func TestSecretTool_Get(t *testing.T) {
+	exit1 := exitError(t)
+	tests := []struct {
+		name    string
+		stdout  string
+		stderr  string
+		err     error
+		want    string
+		wantErr error
+		errText string
+	}{
+		{name: "found", stdout: "mtoken_test", want: "mtoken_test"},
+		{name: "no match", err: exit1, wantErr: ErrNotFound},
+		{name: "empty output", wantErr: ErrNotFound},
+		{name: "binary missing", err: &exec.Error{Name: "secret-tool", Err: exec.ErrNotFound}, wantErr: ErrUnsupported},
+		{name: "non-zero exit", stderr: "Cannot autolaunch D-Bus without X11 $DISPLAY\n", err: exit1, errText: "secret-tool lookup: Cannot autolaunch D-Bus without X11 $DISPLAY"},
+		{name: "non-zero exit with partial output", stdout: "mtoken", err: exit1, errText: "secret-tool lookup: exit status 1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var args []string
+			kr := secretTool{run: func(stdin io.Reader, a ...string) ([]byte, []byte, error) {
+				args = a
+				return []byte(tt.stdout), []byte(tt.stderr), tt.err
+			}}
+
+			got, err := kr.Get("token")
+			if want := "lookup service vitalis-agent account token"; strings.Join(args, " ") != want {
+				t.Errorf("args = %q, want %q", args, want)
+			}
+			switch {
+			case tt.wantErr != nil:
+				if !errors.Is(err, tt.wantErr) {
+					t.Errorf("Get error = %v, want %v", err, tt.wantErr)
+				}
+			case tt.errText != "":
+				if err == nil || err.Error() != tt.errText || errors.Is(err, ErrNotFound) {
+					t.Errorf("Get error = %v, want %q", err, tt.errText)
+				}
+			default:
+				if err != nil || got != tt.want {
+					t.Errorf("Get = %q, %v, want %q", got, err, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestSecretTool_SetPassesSecretOnStdin(t *testing.T) {
+	var args []string
+	var stdin string
+	kr := secretTool{run: func(in io.Reader, a ...string) ([]byte, []byte, error) {
+		args = a
+		data, _ := io.ReadAll(in)
+		stdin = string(data)
+		return nil, nil, nil
+	}}
+
+	if err := kr.Set("token", "mtoken_test"); err != nil {
+		t.Fatal(err)
+	}
+	if stdin != "mtoken_test" {
+		t.Errorf("stdin = %q, want the secret", stdin)
+	}
+	for _, a := range args {
+		if strings.Contains(a, "mtoken_test") {
+			t.Errorf("secret passed as an argument: %q", args)
+		}
+	}
+}
+
+func TestSecretTool_CommandErrors(t *testing.T) {
+	exit1 := exitError(t)
+	kr := secretTool{run: func(io.Reader, ...string) ([]byte, []byte, error) {
+		return nil, []byte("No such secret collection at path: /\n"), exit1
+	}}
+
+	if err := kr.Set("token", "mtoken_test"); err == nil || err.Error() != "secret-tool store: No such secret collection at path: /" {
+		t.Errorf("Set error = %v", err)
+	}
+	if err := kr.Delete("token"); err == nil || err.Error() != "secret-tool clear: No such secret collection at path: /" {
+		t.Errorf("Delete error = %v", err)
+	}
+}
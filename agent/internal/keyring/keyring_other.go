@@ -0,0 +1,7 @@
+//go:build !linux
+
+package keyring
+
+func system() Keyring {
+	return unsupported{}
+}
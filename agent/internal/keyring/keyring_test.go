@@ -0,0 +1,29 @@
+package keyring
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestMemory(t *testing.T) {
+	kr := NewMemory()
+	if _, err := kr.Get("token"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Get on an empty keyring = %v, want ErrNotFound", err)
+	}
+
+	kr.Set("token", "mtoken_first")
+	kr.Set("token", "mtoken_second")
+	if got, err := kr.Get("token"); err != nil || got != "mtoken_second" {
+		t.Errorf("Get = %q, %v, want the last secret set", got, err)
+	}
+
+	if err := kr.Delete("token"); err != nil {
+		t.Fatal(err)
+	}
+	if err := kr.Delete("token"); err != nil {
+		t.Errorf("Delete of a missing secret = %v, want nil", err)
+	}
+	if _, err := kr.Get("token"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Get after Delete = %v, want ErrNotFound", err)
+	}
+}
@@ -0,0 +1,34 @@
+package models
+
+import (
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+)
+
+// batchNamespace is the UUID namespace batch IDs are derived in.
+var batchNamespace = [16]byte{
+	0x3b, 0x6e, 0x0a, 0x52, 0x8d, 0x41, 0x4c, 0x1f,
+	0x9a, 0x27, 0x5e, 0x60, 0xc4, 0x13, 0x7d, 0x88,
+}
+
+// NewBatchID returns the batch ID for a set of snapshots: a name-based
+// (version 5) UUID of their JSON encoding. Deriving the ID from the content
+// means the same snapshots get the same ID whether they are sent live,
+// replayed from the offline buffer, or imported from an exported file.
+func NewBatchID(metrics []MetricSnapshot) string {
+	data, err := json.Marshal(metrics)
+	if err != nil {
+		// MetricSnapshot always marshals; fall back to the namespace alone.
+		data = nil
+	}
+
+	h := sha1.New()
+	h.Write(batchNamespace[:])
+	h.Write(data)
+	sum := h.Sum(nil)
+
+	sum[6] = sum[6]&0x0f | 0x50 // version 5
+	sum[8] = sum[8]&0x3f | 0x80 // RFC 4122 variant
+	return fmt.Sprintf("%x-%x-%x-%x-%x", sum[0:4], sum[4:6], sum[6:8], sum[8:10], sum[10:16])
+}
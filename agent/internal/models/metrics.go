@@ -20,6 +20,14 @@ type MetricSnapshot struct {
 	Processes     []ProcessInfo `json:"processes"`
 	OSVersion     string        `json:"os_version,omitempty"`
 	OSName        string        `json:"os_name,omitempty"`
+	Agent         *AgentStats   `json:"agent,omitempty"`
+}
+
+// AgentStats describes the agent's own health at collection time.
+type AgentStats struct {
+	SenderState     string `json:"sender_state"`     // circuit breaker: closed, open or half_open
+	SendFailures    int    `json:"send_failures"`    // consecutive failed send attempts
+	BufferedBatches int    `json:"buffered_batches"` // batches waiting in the offline buffer
 }
 
 // DiskInfo represents usage for a single disk/partition.
@@ -41,8 +49,12 @@ type ProcessInfo struct {
 }
 
 // MetricBatch is the payload sent to the API via POST /api/ingest.
+// BatchID and Sequence stay the same when a batch is buffered and replayed,
+// so the server can recognise a batch it has already ingested.
 type MetricBatch struct {
-	MachineToken string           `json:"machine_token"`
+	MachineToken string           `json:"machine_token,omitempty"`
+	BatchID      string           `json:"batch_id,omitempty"`
+	Sequence     uint64           `json:"sequence,omitempty"`
 	Metrics      []MetricSnapshot `json:"metrics"`
 }
 
@@ -0,0 +1,76 @@
+package models
+
+import (
+	"fmt"
+)
+
+// Limits mirrored from the ingest endpoint's validation schema
+// (web/src/lib/validation/metrics.ts). Snapshots outside these bounds are
+// rejected by the server with a 422, failing the whole batch.
+const (
+	// MaxBatchSize is the maximum number of snapshots per ingest request.
+	MaxBatchSize = 120
+
+	maxCores     = 256
+	maxDisks     = 50
+	maxProcesses = 50
+	maxNameLen   = 255
+	maxOSLen     = 100
+)
+
+// Validate checks that the snapshot would be accepted by the ingest
+// endpoint. It is used to vet data that did not come straight from the
+// collectors, such as files imported from another machine.
+func (s MetricSnapshot) Validate() error {
+	if s.Timestamp.IsZero() {
+		return fmt.Errorf("timestamp is required")
+	}
+	if !validPercent(s.CPUOverall) {
+		return fmt.Errorf("cpu_overall out of range: %v", s.CPUOverall)
+	}
+	if len(s.CPUCores) > maxCores {
+		return fmt.Errorf("too many cpu_cores: %d (max %d)", len(s.CPUCores), maxCores)
+	}
+	for i, c := range s.CPUCores {
+		if !validPercent(c) {
+			return fmt.Errorf("cpu_cores[%d] out of range: %v", i, c)
+		}
+	}
+	if s.RAMTotal == 0 {
+		return fmt.Errorf("ram_total must be positive")
+	}
+	if len(s.DiskUsage) > maxDisks {
+		return fmt.Errorf("too many disk_usage entries: %d (max %d)", len(s.DiskUsage), maxDisks)
+	}
+	for i, d := range s.DiskUsage {
+		if len(d.Mount) > maxNameLen {
+			return fmt.Errorf("disk_usage[%d].mount too long", i)
+		}
+	}
+	if len(s.Processes) > maxProcesses {
+		return fmt.Errorf("too many processes: %d (max %d)", len(s.Processes), maxProcesses)
+	}
+	for i, p := range s.Processes {
+		if p.PID < 0 {
+			return fmt.Errorf("processes[%d].pid must not be negative", i)
+		}
+		if len(p.Name) > maxNameLen {
+			return fmt.Errorf("processes[%d].name too long", i)
+		}
+		if !validPercent(p.CPU) {
+			return fmt.Errorf("processes[%d].cpu out of range: %v", i, p.CPU)
+		}
+		if p.Memory < 0 {
+			return fmt.Errorf("processes[%d].memory must not be negative", i)
+		}
+	}
+	if len(s.OSName) > maxOSLen || len(s.OSVersion) > maxOSLen {
+		return fmt.Errorf("os_name/os_version too long")
+	}
+	return nil
+}
+
+// validPercent reports whether v is a percentage in [0, 100].
+func validPercent(v float64) bool {
+	return v >= 0 && v <= 100
+}
@@ -0,0 +1,244 @@
+// Package mqtt implements a minimal MQTT 3.1.1 publisher for exposing agent
+// metrics to home-automation brokers such as Mosquitto or Home Assistant.
+// Only the subset needed to publish is supported: CONNECT with a Last Will,
+// QoS 0 PUBLISH (optionally retained), keep-alive pings and DISCONNECT.
+package mqtt
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// dialTimeout bounds the TCP/TLS dial and the CONNECT/CONNACK handshake.
+const dialTimeout = 5 * time.Second
+
+// ErrNotConnected is returned by Publish when the client has no live session.
+var ErrNotConnected = errors.New("mqtt: not connected")
+
+// Message is a single application message to publish.
+type Message struct {
+	Topic   string
+	Payload []byte
+	Retain  bool
+}
+
+// Options configures the broker connection.
+type Options struct {
+	// Broker is the broker address, e.g. "tcp://localhost:1883" or
+	// "ssl://broker:8883". Supported schemes: tcp, mqtt, ssl, tls, mqtts.
+	Broker    string
+	ClientID  string
+	Username  string
+	Password  string
+	KeepAlive time.Duration
+	// Will is published by the broker if the connection drops uncleanly.
+	Will *Message
+}
+
+// Client is a publish-only MQTT client. It is safe for concurrent use.
+type Client struct {
+	opts Options
+
+	mu   sync.Mutex
+	conn net.Conn
+	done chan struct{}
+}
+
+// NewClient creates a client for the given options. No connection is made
+// until Connect is called.
+func NewClient(opts Options) *Client {
+	return &Client{opts: opts}
+}
+
+// Connect dials the broker and performs the CONNECT/CONNACK handshake.
+// Any existing connection is closed first.
+func (c *Client) Connect(ctx context.Context) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.closeLocked()
+
+	conn, err := dialBroker(ctx, c.opts.Broker)
+	if err != nil {
+		return fmt.Errorf("dial broker: %w", err)
+	}
+
+	conn.SetDeadline(time.Now().Add(dialTimeout))
+	if _, err := conn.Write(encodeConnect(c.opts)); err != nil {
+		conn.Close()
+		return fmt.Errorf("send connect: %w", err)
+	}
+
+	reader := bufio.NewReader(conn)
+	ack, err := readPacket(reader)
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("read connack: %w", err)
+	}
+	if ack.kind() != packetConnack || len(ack.body) != 2 {
+		conn.Close()
+		return fmt.Errorf("unexpected packet type %d while waiting for connack", ack.kind())
+	}
+	if code := ack.body[1]; code != 0 {
+		conn.Close()
+		if reason, ok := connackCodes[code]; ok {
+			return fmt.Errorf("connection refused: %s", reason)
+		}
+		return fmt.Errorf("connection refused: code %d", code)
+	}
+	conn.SetDeadline(time.Time{})
+
+	c.conn = conn
+	c.done = make(chan struct{})
+	go c.readLoop(conn, reader, c.done)
+	if c.opts.KeepAlive > 0 {
+		go c.pingLoop(conn, c.done)
+	}
+	return nil
+}
+
+// Connected reports whether the client currently holds a live session.
+func (c *Client) Connected() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.conn != nil
+}
+
+// Publish sends a QoS 0 message. It returns ErrNotConnected if there is no
+// live session; on a write error the session is torn down.
+func (c *Client) Publish(msg Message) error {
+	if len(msg.Topic) == 0 {
+		return errors.New("mqtt: empty topic")
+	}
+	if len(msg.Topic)+len(msg.Payload)+2 > maxRemainingLength {
+		return fmt.Errorf("mqtt: message too large (%d bytes)", len(msg.Payload))
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.conn == nil {
+		return ErrNotConnected
+	}
+	if err := c.writeLocked(encodePublish(msg)); err != nil {
+		c.closeLocked()
+		return fmt.Errorf("publish %s: %w", msg.Topic, err)
+	}
+	return nil
+}
+
+// Disconnect sends DISCONNECT and closes the connection. A clean disconnect
+// tells the broker to discard the Last Will, so callers that want an
+// "offline" status should publish it explicitly first.
+func (c *Client) Disconnect() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.conn == nil {
+		return nil
+	}
+	err := c.writeLocked(encodePacket(packetDisconnect<<4, nil))
+	c.closeLocked()
+	return err
+}
+
+// writeLocked writes raw bytes with a bounded deadline.
+// Must be called with c.mu held.
+func (c *Client) writeLocked(data []byte) error {
+	c.conn.SetWriteDeadline(time.Now().Add(dialTimeout))
+	_, err := c.conn.Write(data)
+	return err
+}
+
+// closeLocked tears down the current connection, if any.
+// Must be called with c.mu held.
+func (c *Client) closeLocked() {
+	if c.conn == nil {
+		return
+	}
+	close(c.done)
+	c.conn.Close()
+	c.conn = nil
+	c.done = nil
+}
+
+// readLoop drains inbound packets (PINGRESP and any unsolicited traffic)
+// and drops the session when the broker closes the connection.
+func (c *Client) readLoop(conn net.Conn, reader *bufio.Reader, done chan struct{}) {
+	for {
+		if _, err := readPacket(reader); err != nil {
+			c.mu.Lock()
+			if c.conn == conn {
+				c.closeLocked()
+			}
+			c.mu.Unlock()
+			return
+		}
+		select {
+		case <-done:
+			return
+		default:
+		}
+	}
+}
+
+// pingLoop sends PINGREQ at half the keep-alive interval so the broker does
+// not consider the session dead between batches.
+func (c *Client) pingLoop(conn net.Conn, done chan struct{}) {
+	ticker := time.NewTicker(c.opts.KeepAlive / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			c.mu.Lock()
+			if c.conn != conn {
+				c.mu.Unlock()
+				return
+			}
+			if err := c.writeLocked(encodePacket(packetPingreq<<4, nil)); err != nil {
+				c.closeLocked()
+			}
+			c.mu.Unlock()
+		}
+	}
+}
+
+// dialBroker opens a TCP or TLS connection based on the broker URL scheme.
+func dialBroker(ctx context.Context, broker string) (net.Conn, error) {
+	u, err := url.Parse(broker)
+	if err != nil {
+		return nil, fmt.Errorf("invalid broker URL %q: %w", broker, err)
+	}
+
+	dialer := &net.Dialer{Timeout: dialTimeout}
+	switch u.Scheme {
+	case "tcp", "mqtt":
+		return dialer.DialContext(ctx, "tcp", hostPort(u, "1883"))
+	case "ssl", "tls", "mqtts":
+		tlsDialer := &tls.Dialer{
+			NetDialer: dialer,
+			Config:    &tls.Config{ServerName: u.Hostname(), MinVersion: tls.VersionTLS12},
+		}
+		return tlsDialer.DialContext(ctx, "tcp", hostPort(u, "8883"))
+	default:
+		return nil, fmt.Errorf("unsupported broker scheme %q", u.Scheme)
+	}
+}
+
+// hostPort returns host:port from u, falling back to the default port.
+func hostPort(u *url.URL, defaultPort string) string {
+	if u.Port() != "" {
+		return u.Host
+	}
+	return net.JoinHostPort(u.Hostname(), defaultPort)
+}
@@ -0,0 +1,161 @@
+package mqtt
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// MQTT 3.1.1 control packet types (upper nibble of the fixed header).
+const (
+	packetConnect    byte = 1
+	packetConnack    byte = 2
+	packetPublish    byte = 3
+	packetPingreq    byte = 12
+	packetPingresp   byte = 13
+	packetDisconnect byte = 14
+)
+
+// protocolLevel is the MQTT 3.1.1 protocol level sent in CONNECT.
+const protocolLevel byte = 4
+
+// maxRemainingLength is the largest remaining length MQTT can encode (256 MB).
+const maxRemainingLength = 268435455
+
+// packet is a decoded MQTT control packet: the fixed header byte and the
+// raw remaining bytes (variable header + payload).
+type packet struct {
+	header byte
+	body   []byte
+}
+
+// kind returns the control packet type of the packet.
+func (p packet) kind() byte {
+	return p.header >> 4
+}
+
+// connackCodes maps CONNACK return codes to human-readable reasons.
+var connackCodes = map[byte]string{
+	1: "unacceptable protocol version",
+	2: "identifier rejected",
+	3: "server unavailable",
+	4: "bad user name or password",
+	5: "not authorized",
+}
+
+// encodeConnect builds a CONNECT packet for the given options.
+func encodeConnect(opts Options) []byte {
+	var flags byte = 0x02 // clean session
+	if opts.Will != nil {
+		flags |= 0x04
+		if opts.Will.Retain {
+			flags |= 0x20
+		}
+	}
+	if opts.Username != "" {
+		flags |= 0x80
+	}
+	if opts.Password != "" {
+		flags |= 0x40
+	}
+
+	var body []byte
+	body = appendString(body, "MQTT")
+	body = append(body, protocolLevel, flags)
+	body = binary.BigEndian.AppendUint16(body, uint16(opts.KeepAlive.Seconds()))
+	body = appendString(body, opts.ClientID)
+	if opts.Will != nil {
+		body = appendString(body, opts.Will.Topic)
+		body = appendBytes(body, opts.Will.Payload)
+	}
+	if opts.Username != "" {
+		body = appendString(body, opts.Username)
+	}
+	if opts.Password != "" {
+		body = appendString(body, opts.Password)
+	}
+
+	return encodePacket(packetConnect<<4, body)
+}
+
+// encodePublish builds a QoS 0 PUBLISH packet for the given message.
+func encodePublish(msg Message) []byte {
+	header := packetPublish << 4
+	if msg.Retain {
+		header |= 0x01
+	}
+	body := appendString(nil, msg.Topic)
+	body = append(body, msg.Payload...)
+	return encodePacket(header, body)
+}
+
+// encodePacket prefixes body with a fixed header and remaining length.
+func encodePacket(header byte, body []byte) []byte {
+	out := make([]byte, 0, len(body)+5)
+	out = append(out, header)
+	out = appendRemainingLength(out, len(body))
+	return append(out, body...)
+}
+
+// readPacket reads a single control packet from r.
+func readPacket(r *bufio.Reader) (packet, error) {
+	header, err := r.ReadByte()
+	if err != nil {
+		return packet{}, err
+	}
+
+	length, err := readRemainingLength(r)
+	if err != nil {
+		return packet{}, err
+	}
+
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return packet{}, err
+	}
+	return packet{header: header, body: body}, nil
+}
+
+// appendRemainingLength appends n using the MQTT variable-length encoding.
+func appendRemainingLength(b []byte, n int) []byte {
+	for {
+		digit := byte(n % 128)
+		n /= 128
+		if n > 0 {
+			digit |= 0x80
+		}
+		b = append(b, digit)
+		if n == 0 {
+			return b
+		}
+	}
+}
+
+// readRemainingLength decodes an MQTT variable-length integer.
+func readRemainingLength(r *bufio.Reader) (int, error) {
+	var value, multiplier int = 0, 1
+	for i := 0; i < 4; i++ {
+		digit, err := r.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		value += int(digit&0x7f) * multiplier
+		if digit&0x80 == 0 {
+			return value, nil
+		}
+		multiplier *= 128
+	}
+	return 0, errors.New("malformed remaining length")
+}
+
+// appendString appends a length-prefixed UTF-8 string.
+func appendString(b []byte, s string) []byte {
+	return appendBytes(b, []byte(s))
+}
+
+// appendBytes appends length-prefixed binary data.
+func appendBytes(b []byte, data []byte) []byte {
+	b = binary.BigEndian.AppendUint16(b, uint16(len(data)))
+	return append(b, data...)
+}
@@ -0,0 +1,300 @@
+package mqtt
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"go.uber.org/zap"
+
+	"github.com/Guliveer/vitalis/agent/internal/config"
+	"github.com/Guliveer/vitalis/agent/internal/models"
+)
+
+const (
+	statusOnline  = "online"
+	statusOffline = "offline"
+)
+
+// sensor describes a single published value and its Home Assistant metadata.
+type sensor struct {
+	key         string // topic suffix, e.g. "cpu/overall"
+	name        string
+	value       string
+	unit        string
+	deviceClass string
+}
+
+// Publisher maps metric snapshots onto MQTT topics of the form
+// <topic_prefix>/<host>/<metric>, e.g. "vitalis/nas/cpu/overall".
+// A retained "online" status is published on connect and the broker is
+// asked (via Last Will) to replace it with "offline" if the agent vanishes.
+type Publisher struct {
+	cfg    config.MQTTConfig
+	client *Client
+	logger *zap.Logger
+	host   string
+	base   string
+
+	mu        sync.Mutex
+	announced map[string]bool
+}
+
+// NewPublisher creates a Publisher for the given configuration. The
+// connection is established lazily on the first Publish.
+func NewPublisher(cfg config.MQTTConfig, logger *zap.Logger) *Publisher {
+	host := cfg.Hostname
+	if host == "" {
+		host, _ = os.Hostname()
+	}
+	host = topicSafe(host)
+
+	base := strings.TrimSuffix(cfg.TopicPrefix, "/") + "/" + host
+
+	clientID := cfg.ClientID
+	if clientID == "" {
+		clientID = "vitalis-" + host
+	}
+
+	client := NewClient(Options{
+		Broker:    cfg.Broker,
+		ClientID:  clientID,
+		Username:  cfg.Username,
+		Password:  cfg.Password,
+		KeepAlive: cfg.KeepAlive.Duration,
+		Will: &Message{
+			Topic:   base + "/status",
+			Payload: []byte(statusOffline),
+			Retain:  true,
+		},
+	})
+
+	return &Publisher{
+		cfg:       cfg,
+		client:    client,
+		logger:    logger.Named("mqtt"),
+		host:      host,
+		base:      base,
+		announced: make(map[string]bool),
+	}
+}
+
+// Publish sends the most recent snapshot in the batch to the broker.
+// Connection failures are logged and the batch is skipped; MQTT carries
+// "last value" state only, so there is nothing to buffer.
+func (p *Publisher) Publish(ctx context.Context, batch []models.MetricSnapshot) {
+	if len(batch) == 0 {
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if err := p.ensureConnected(ctx); err != nil {
+		p.logger.Warn("MQTT broker unavailable, skipping publish",
+			zap.String("broker", p.cfg.Broker),
+			zap.Error(err))
+		return
+	}
+
+	sensors := snapshotSensors(batch[len(batch)-1])
+
+	if p.cfg.Discovery {
+		for _, s := range sensors {
+			if p.announced[s.key] {
+				continue
+			}
+			if err := p.publishDiscovery(s); err != nil {
+				p.logger.Warn("Failed to publish discovery config",
+					zap.String("sensor", s.key),
+					zap.Error(err))
+				return
+			}
+			p.announced[s.key] = true
+		}
+	}
+
+	for _, s := range sensors {
+		err := p.client.Publish(Message{
+			Topic:   p.base + "/" + s.key,
+			Payload: []byte(s.value),
+			Retain:  p.cfg.Retain,
+		})
+		if err != nil {
+			p.logger.Warn("MQTT publish failed", zap.Error(err))
+			return
+		}
+	}
+
+	p.logger.Debug("Published snapshot to MQTT",
+		zap.String("topic", p.base),
+		zap.Int("sensors", len(sensors)))
+}
+
+// Close publishes a retained "offline" status and disconnects cleanly.
+func (p *Publisher) Close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if !p.client.Connected() {
+		return
+	}
+	if err := p.client.Publish(Message{
+		Topic:   p.base + "/status",
+		Payload: []byte(statusOffline),
+		Retain:  true,
+	}); err != nil {
+		p.logger.Warn("Failed to publish offline status", zap.Error(err))
+	}
+	p.client.Disconnect()
+}
+
+// ensureConnected (re)connects to the broker and announces "online".
+// Must be called with p.mu held.
+func (p *Publisher) ensureConnected(ctx context.Context) error {
+	if p.client.Connected() {
+		return nil
+	}
+	if err := p.client.Connect(ctx); err != nil {
+		return err
+	}
+
+	p.logger.Info("Connected to MQTT broker", zap.String("broker", p.cfg.Broker))
+
+	// Discovery configs are retained by the broker, but re-announce after a
+	// reconnect in case it was restarted without persistence.
+	p.announced = make(map[string]bool)
+
+	return p.client.Publish(Message{
+		Topic:   p.base + "/status",
+		Payload: []byte(statusOnline),
+		Retain:  true,
+	})
+}
+
+// publishDiscovery publishes a retained Home Assistant MQTT discovery
+// config for a single sensor.
+// Must be called with p.mu held.
+func (p *Publisher) publishDiscovery(s sensor) error {
+	objectID := "vitalis_" + p.host + "_" + strings.ReplaceAll(s.key, "/", "_")
+
+	payload := map[string]interface{}{
+		"name":               s.name,
+		"unique_id":          objectID,
+		"object_id":          objectID,
+		"state_topic":        p.base + "/" + s.key,
+		"availability_topic": p.base + "/status",
+		"device": map[string]interface{}{
+			"identifiers":  []string{"vitalis_" + p.host},
+			"name":         p.host,
+			"manufacturer": "Vitalis",
+		},
+	}
+	if s.unit != "" {
+		payload["unit_of_measurement"] = s.unit
+		payload["state_class"] = "measurement"
+	}
+	if s.deviceClass != "" {
+		payload["device_class"] = s.deviceClass
+	}
+
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	topic := fmt.Sprintf("%s/sensor/%s/config",
+		strings.TrimSuffix(p.cfg.DiscoveryPrefix, "/"), objectID)
+	return p.client.Publish(Message{Topic: topic, Payload: data, Retain: true})
+}
+
+// snapshotSensors flattens a snapshot into the list of published sensors.
+// Values that were not collected (nil temperatures) are omitted.
+func snapshotSensors(s models.MetricSnapshot) []sensor {
+	sensors := []sensor{
+		{key: "cpu/overall", name: "CPU usage", value: formatFloat(s.CPUOverall), unit: "%"},
+		{key: "memory/used", name: "Memory used", value: formatUint(s.RAMUsed), unit: "B", deviceClass: "data_size"},
+		{key: "memory/total", name: "Memory total", value: formatUint(s.RAMTotal), unit: "B", deviceClass: "data_size"},
+		{key: "network/rx", name: "Network received", value: formatUint(s.NetworkRx), unit: "B", deviceClass: "data_size"},
+		{key: "network/tx", name: "Network sent", value: formatUint(s.NetworkTx), unit: "B", deviceClass: "data_size"},
+		{key: "uptime", name: "Uptime", value: strconv.Itoa(s.UptimeSeconds), unit: "s", deviceClass: "duration"},
+	}
+
+	if s.RAMTotal > 0 {
+		sensors = append(sensors, sensor{
+			key: "memory/percent", name: "Memory usage",
+			value: formatFloat(float64(s.RAMUsed) / float64(s.RAMTotal) * 100), unit: "%",
+		})
+	}
+	if s.CPUTemp != nil {
+		sensors = append(sensors, sensor{
+			key: "cpu/temp", name: "CPU temperature",
+			value: formatFloat(*s.CPUTemp), unit: "°C", deviceClass: "temperature",
+		})
+	}
+	if s.GPUTemp != nil {
+		sensors = append(sensors, sensor{
+			key: "gpu/temp", name: "GPU temperature",
+			value: formatFloat(*s.GPUTemp), unit: "°C", deviceClass: "temperature",
+		})
+	}
+
+	if s.Agent != nil {
+		sensors = append(sensors,
+			sensor{key: "agent/sender_state", name: "Agent sender state", value: s.Agent.SenderState},
+			sensor{key: "agent/buffered_batches", name: "Agent buffered batches", value: strconv.Itoa(s.Agent.BufferedBatches)},
+		)
+	}
+
+	for _, d := range s.DiskUsage {
+		slug := diskSlug(d.Mount)
+		sensors = append(sensors,
+			sensor{key: "disk/" + slug + "/used", name: "Disk " + d.Mount + " used",
+				value: formatUint(d.Used), unit: "B", deviceClass: "data_size"},
+			sensor{key: "disk/" + slug + "/free", name: "Disk " + d.Mount + " free",
+				value: formatUint(d.Free), unit: "B", deviceClass: "data_size"},
+		)
+		if d.Total > 0 {
+			sensors = append(sensors, sensor{
+				key: "disk/" + slug + "/percent", name: "Disk " + d.Mount + " usage",
+				value: formatFloat(float64(d.Used) / float64(d.Total) * 100), unit: "%",
+			})
+		}
+	}
+
+	return sensors
+}
+
+// diskSlug turns a mount point ("/", "/home", "C:\") into a topic level.
+func diskSlug(mount string) string {
+	trimmed := strings.Trim(mount, `/\:`)
+	if trimmed == "" {
+		return "root"
+	}
+	return topicSafe(trimmed)
+}
+
+// topicSafe lowercases s and replaces characters that are not valid (or not
+// convenient) in a single MQTT topic level.
+func topicSafe(s string) string {
+	s = strings.ToLower(strings.TrimSpace(s))
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case '/', '\\', '+', '#', ' ', ':', '.':
+			return '_'
+		}
+		return r
+	}, s)
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'f', 2, 64)
+}
+
+func formatUint(v uint64) string {
+	return strconv.FormatUint(v, 10)
+}
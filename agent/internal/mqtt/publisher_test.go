@@ -0,0 +1,244 @@
+package mqtt
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/Guliveer/vitalis/agent/internal/config"
+	"github.com/Guliveer/vitalis/agent/internal/models"
+)
+
+// fakeBroker is an in-process MQTT broker that accepts a single client and
+// records the CONNECT will and every PUBLISH it receives.
+type fakeBroker struct {
+	ln net.Listener
+
+	mu        sync.Mutex
+	clientID  string
+	willTopic string
+	willMsg   string
+	published map[string]publishedMsg
+}
+
+type publishedMsg struct {
+	payload string
+	retain  bool
+}
+
+func newFakeBroker(t *testing.T) *fakeBroker {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &fakeBroker{ln: ln, published: make(map[string]publishedMsg)}
+	t.Cleanup(func() { ln.Close() })
+	go b.serve()
+	return b
+}
+
+func (b *fakeBroker) url() string {
+	return "tcp://" + b.ln.Addr().String()
+}
+
+func (b *fakeBroker) serve() {
+	for {
+		conn, err := b.ln.Accept()
+		if err != nil {
+			return
+		}
+		go b.handle(conn)
+	}
+}
+
+func (b *fakeBroker) handle(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for {
+		p, err := readPacket(r)
+		if err != nil {
+			return
+		}
+		switch p.kind() {
+		case packetConnect:
+			b.recordConnect(p.body)
+			conn.Write([]byte{packetConnack << 4, 2, 0, 0})
+		case packetPublish:
+			topic, payload := splitString(p.body)
+			b.mu.Lock()
+			b.published[string(topic)] = publishedMsg{payload: string(payload), retain: p.header&0x01 != 0}
+			b.mu.Unlock()
+		case packetPingreq:
+			conn.Write([]byte{packetPingresp << 4, 0})
+		case packetDisconnect:
+			return
+		}
+	}
+}
+
+func (b *fakeBroker) recordConnect(body []byte) {
+	_, rest := splitString(body) // protocol name
+	flags := rest[1]
+	rest = rest[4:] // level, flags, keep-alive
+	clientID, rest := splitString(rest)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.clientID = string(clientID)
+	if flags&0x04 != 0 {
+		topic, rest := splitString(rest)
+		msg, _ := splitString(rest)
+		b.willTopic = string(topic)
+		b.willMsg = string(msg)
+	}
+}
+
+func (b *fakeBroker) get(topic string) (publishedMsg, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	m, ok := b.published[topic]
+	return m, ok
+}
+
+// waitFor polls until topic holds the given payload.
+func (b *fakeBroker) waitFor(t *testing.T, topic, payload string) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if m, ok := b.get(topic); ok && m.payload == payload {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("timed out waiting for %s = %q", topic, payload)
+}
+
+func splitString(b []byte) ([]byte, []byte) {
+	n := int(binary.BigEndian.Uint16(b))
+	return b[2 : 2+n], b[2+n:]
+}
+
+func testConfig(broker string) config.MQTTConfig {
+	cfg := config.DefaultConfig().MQTT
+	cfg.Enabled = true
+	cfg.Broker = broker
+	cfg.Hostname = "Home Server"
+	return cfg
+}
+
+func TestPublisher_PublishesRetainedState(t *testing.T) {
+	broker := newFakeBroker(t)
+	pub := NewPublisher(testConfig(broker.url()), zap.NewNop())
+
+	temp := 55.5
+	pub.Publish(context.Background(), []models.MetricSnapshot{
+		{CPUOverall: 10},
+		{
+			CPUOverall: 42.126,
+			RAMUsed:    1024,
+			RAMTotal:   4096,
+			CPUTemp:    &temp,
+			DiskUsage:  []models.DiskInfo{{Mount: "/", Total: 100, Used: 25, Free: 75}},
+		},
+	})
+	pub.Close()
+	broker.waitFor(t, "vitalis/home_server/status", statusOffline)
+
+	tests := map[string]string{
+		"vitalis/home_server/cpu/overall":       "42.13",
+		"vitalis/home_server/memory/percent":    "25.00",
+		"vitalis/home_server/cpu/temp":          "55.50",
+		"vitalis/home_server/disk/root/percent": "25.00",
+		"vitalis/home_server/status":            statusOffline,
+	}
+	for topic, want := range tests {
+		got, ok := broker.get(topic)
+		if !ok {
+			t.Errorf("topic %s not published", topic)
+			continue
+		}
+		if got.payload != want {
+			t.Errorf("%s = %q, want %q", topic, got.payload, want)
+		}
+		if !got.retain {
+			t.Errorf("%s should be retained", topic)
+		}
+	}
+
+	if _, ok := broker.get("vitalis/home_server/gpu/temp"); ok {
+		t.Error("nil GPU temperature should not be published")
+	}
+}
+
+func TestPublisher_LastWill(t *testing.T) {
+	broker := newFakeBroker(t)
+	pub := NewPublisher(testConfig(broker.url()), zap.NewNop())
+
+	pub.Publish(context.Background(), []models.MetricSnapshot{{CPUOverall: 1}})
+	broker.waitFor(t, "vitalis/home_server/status", statusOnline)
+	defer pub.Close()
+
+	broker.mu.Lock()
+	defer broker.mu.Unlock()
+	if broker.willTopic != "vitalis/home_server/status" {
+		t.Errorf("will topic = %q", broker.willTopic)
+	}
+	if broker.willMsg != statusOffline {
+		t.Errorf("will message = %q, want %q", broker.willMsg, statusOffline)
+	}
+	if broker.clientID != "vitalis-home_server" {
+		t.Errorf("client id = %q", broker.clientID)
+	}
+}
+
+func TestPublisher_Discovery(t *testing.T) {
+	broker := newFakeBroker(t)
+	cfg := testConfig(broker.url())
+	cfg.Discovery = true
+	pub := NewPublisher(cfg, zap.NewNop())
+
+	pub.Publish(context.Background(), []models.MetricSnapshot{{CPUOverall: 1}})
+	pub.Close()
+	broker.waitFor(t, "vitalis/home_server/status", statusOffline)
+
+	got, ok := broker.get("homeassistant/sensor/vitalis_home_server_cpu_overall/config")
+	if !ok {
+		t.Fatal("discovery config not published")
+	}
+	if !strings.Contains(got.payload, `"state_topic":"vitalis/home_server/cpu/overall"`) {
+		t.Errorf("discovery payload missing state topic: %s", got.payload)
+	}
+	if !got.retain {
+		t.Error("discovery config should be retained")
+	}
+}
+
+func TestPublisher_BrokerDown(t *testing.T) {
+	pub := NewPublisher(testConfig("tcp://127.0.0.1:1"), zap.NewNop())
+	// Must not panic or block beyond the dial timeout.
+	pub.Publish(context.Background(), []models.MetricSnapshot{{CPUOverall: 1}})
+	pub.Close()
+}
+
+func TestDiskSlug(t *testing.T) {
+	tests := map[string]string{
+		"/":            "root",
+		"/home":        "home",
+		"/mnt/data":    "mnt_data",
+		`C:\`:          "c",
+		"/Volumes/USB": "volumes_usb",
+	}
+	for mount, want := range tests {
+		if got := diskSlug(mount); got != want {
+			t.Errorf("diskSlug(%q) = %q, want %q", mount, got, want)
+		}
+	}
+}
@@ -0,0 +1,349 @@
+// Package remoteconfig fetches configuration overrides set for this machine
+// on the dashboard, so that e.g. debug logging or faster collection can be
+// turned on without access to the machine.
+//
+// The agent polls GET /api/agent/config with the ETag of the overrides it
+// has, and the server answers 304 while they are unchanged. Ingest
+// responses carry the current ETag in the X-Config-ETag header, so a change
+// is picked up with the next batch instead of the next poll. Overrides are
+// validated before they are applied, and saved in the data directory so
+// they stay in effect across restarts, including ones without a network.
+package remoteconfig
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/Guliveer/vitalis/agent/internal/config"
+	"github.com/Guliveer/vitalis/agent/internal/credential"
+	"github.com/Guliveer/vitalis/agent/internal/httpclient"
+	"github.com/Guliveer/vitalis/agent/internal/signing"
+)
+
+const (
+	// ETagHeader is the ingest response header carrying the ETag of the
+	// machine's current overrides.
+	ETagHeader = "X-Config-ETag"
+
+	// endpoint serves the machine's overrides.
+	endpoint = "/api/agent/config"
+
+	// fileName is the file in the data directory the applied overrides
+	// are saved to.
+	fileName = "overrides.json"
+
+	requestTimeout  = 30 * time.Second
+	maxResponseSize = 64 * 1024
+)
+
+// Overrides are settings the server overrides for this machine. Unset
+// fields leave the value from the agent's own configuration in effect, so
+// clearing an override on the dashboard reverts to it.
+type Overrides struct {
+	Interval      int      `json:"interval_seconds,omitempty"`
+	BatchInterval int      `json:"batch_interval_seconds,omitempty"`
+	TopProcesses  *int     `json:"top_processes,omitempty"`
+	Collectors    []string `json:"collectors,omitempty"` // collectors to run; empty runs all
+	LogLevel      string   `json:"log_level,omitempty"`
+}
+
+// Collection returns base with the overridden intervals and process count.
+func (o Overrides) Collection(base config.CollectionConfig) config.CollectionConfig {
+	if o.Interval > 0 {
+		base.Interval = config.Duration{Duration: time.Duration(o.Interval) * time.Second}
+	}
+	if o.BatchInterval > 0 {
+		base.BatchInterval = config.Duration{Duration: time.Duration(o.BatchInterval) * time.Second}
+	}
+	if o.TopProcesses != nil {
+		base.TopProcesses = *o.TopProcesses
+	}
+	return base
+}
+
+// Logging returns base with the overridden log level.
+func (o Overrides) Logging(base config.LoggingConfig) config.LoggingConfig {
+	if o.LogLevel != "" {
+		base.Level = o.LogLevel
+	}
+	return base
+}
+
+// Validate checks that the overrides, applied to base, make a usable
+// collection configuration. Collector names are checked when they are
+// applied, against the collectors the agent has.
+func (o Overrides) Validate(base config.CollectionConfig) error {
+	if o.Interval < 0 || o.Interval > 3600 {
+		return fmt.Errorf("interval_seconds must be between 1 and 3600 (got: %d)", o.Interval)
+	}
+	if o.BatchInterval < 0 || o.BatchInterval > 86400 {
+		return fmt.Errorf("batch_interval_seconds must be between 1 and 86400 (got: %d)", o.BatchInterval)
+	}
+	if c := o.Collection(base); c.BatchInterval.Duration < c.Interval.Duration {
+		return fmt.Errorf("batch interval %s is shorter than the collection interval %s", c.BatchInterval, c.Interval)
+	}
+	if o.TopProcesses != nil && (*o.TopProcesses < 0 || *o.TopProcesses > 100) {
+		return fmt.Errorf("top_processes must be between 0 and 100 (got: %d)", *o.TopProcesses)
+	}
+	switch o.LogLevel {
+	case "", "debug", "info", "warn", "error":
+	default:
+		return fmt.Errorf("log_level must be debug, info, warn or error (got: %s)", o.LogLevel)
+	}
+	return nil
+}
+
+// saved is the content of the overrides file.
+type saved struct {
+	ETag      string    `json:"etag"`
+	Overrides Overrides `json:"overrides"`
+}
+
+// Poller fetches the machine's overrides and applies them through the
+// OnChange callback. It is safe for concurrent use.
+type Poller struct {
+	token    string
+	secret   string
+	interval time.Duration
+	path     string
+	client   *http.Client
+	logger   *zap.Logger
+
+	onChange func(Overrides) error
+	wake     chan struct{}
+
+	mu   sync.Mutex
+	url  string
+	etag string                  // of the overrides last fetched, applied or not
+	base config.CollectionConfig // overrides are validated against
+}
+
+// New creates a Poller for the primary server in cfg.
+func New(cfg *config.Config, logger *zap.Logger) (*Poller, error) {
+	client, err := httpclient.New(cfg.Server, requestTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("create http client: %w", err)
+	}
+	return &Poller{
+		url:      cfg.Server.URL,
+		token:    cfg.Server.MachineToken,
+		secret:   cfg.Server.SigningSecret,
+		interval: cfg.Server.RemoteConfig.PollInterval.Duration,
+		base:     cfg.Collection,
+		path:     filepath.Join(cfg.Buffer.DBPath, fileName),
+		client:   client,
+		logger:   logger,
+		wake:     make(chan struct{}, 1),
+	}, nil
+}
+
+// SetCredential makes the poller authenticate with the store's token.
+// Call it before Run.
+func (p *Poller) SetCredential(store *credential.Store) {
+	p.client.Transport = store.Transport(p.client.Transport)
+}
+
+// SetURL points the poller at another server, e.g. after the config file
+// was reloaded. The overrides are fetched again in full from it.
+func (p *Poller) SetURL(url string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if url != p.url {
+		p.url = url
+		p.etag = ""
+	}
+}
+
+// SetBase sets the collection settings overrides are validated against,
+// after the config file was reloaded.
+func (p *Poller) SetBase(base config.CollectionConfig) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.base = base
+}
+
+// OnChange sets the callback that applies validated overrides. It returns
+// an error, and changes nothing, if the overrides cannot be applied (e.g.
+// an unknown collector); the previous overrides then stay in effect.
+func (p *Poller) OnChange(fn func(Overrides) error) {
+	p.onChange = fn
+}
+
+// Load applies the overrides saved by an earlier run, if any. Call it
+// before Run.
+func (p *Poller) Load() {
+	data, err := os.ReadFile(p.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return
+	}
+	var s saved
+	if err == nil {
+		err = json.Unmarshal(data, &s)
+	}
+	if err != nil {
+		p.logger.Warn("Failed to read saved config overrides, ignoring them", zap.Error(err))
+		return
+	}
+	if err := p.apply(s.Overrides); err != nil {
+		p.logger.Warn("Saved config overrides are invalid, ignoring them", zap.Error(err))
+		return
+	}
+	p.mu.Lock()
+	p.etag = s.ETag
+	p.mu.Unlock()
+	p.logger.Info("Applied saved config overrides", zap.Any("overrides", s.Overrides))
+}
+
+// Notify tells the poller the ETag of the current overrides, as reported
+// in an ingest response. If it differs from the one the poller has, the
+// overrides are fetched at once.
+func (p *Poller) Notify(etag string) {
+	p.mu.Lock()
+	changed := etag != p.etag
+	p.mu.Unlock()
+	if !changed {
+		return
+	}
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Run fetches the overrides at startup, every poll interval and when
+// Notify reports a change, until ctx is cancelled.
+func (p *Poller) Run(ctx context.Context) {
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+
+	for {
+		if err := p.fetch(ctx); err != nil && ctx.Err() == nil {
+			p.logger.Debug("Failed to fetch config overrides", zap.Error(err))
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-p.wake:
+		}
+	}
+}
+
+// fetch requests the overrides and applies them if they changed.
+func (p *Poller) fetch(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, requestTimeout)
+	defer cancel()
+	p.mu.Lock()
+	url, known := p.url, p.etag
+	p.mu.Unlock()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url+endpoint, nil)
+	if err != nil {
+		return fmt.Errorf("create request: %w", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+p.token)
+	if known != "" {
+		req.Header.Set("If-None-Match", known)
+	}
+	if p.secret != "" {
+		if err := signing.Sign(req, p.secret, endpoint, nil); err != nil {
+			return fmt.Errorf("sign request: %w", err)
+		}
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("send request: %w", err)
+	}
+	defer resp.Body.Close()
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, maxResponseSize))
+
+	switch {
+	case resp.StatusCode == http.StatusNotModified:
+		return nil
+	case resp.StatusCode != http.StatusOK:
+		return fmt.Errorf("server returned %d", resp.StatusCode)
+	}
+	var parsed struct {
+		Data struct {
+			Overrides *Overrides `json:"overrides"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(data, &parsed); err != nil {
+		return fmt.Errorf("decode response: %w", err)
+	}
+	var o Overrides
+	if parsed.Data.Overrides != nil {
+		o = *parsed.Data.Overrides
+	}
+	etag := resp.Header.Get("ETag")
+
+	// Remember the ETag even if the overrides are rejected, so they are
+	// not fetched again until they change.
+	p.mu.Lock()
+	p.etag = etag
+	p.mu.Unlock()
+	if err := p.apply(o); err != nil {
+		p.logger.Error("Rejected config overrides from the server", zap.Error(err))
+		return nil
+	}
+	p.logger.Info("Applied config overrides from the server", zap.Any("overrides", o))
+	if err := p.save(saved{ETag: etag, Overrides: o}); err != nil {
+		p.logger.Warn("Failed to save config overrides", zap.String("path", p.path), zap.Error(err))
+	}
+	return nil
+}
+
+// apply validates the overrides and passes them to the OnChange callback.
+func (p *Poller) apply(o Overrides) error {
+	p.mu.Lock()
+	base := p.base
+	p.mu.Unlock()
+	if err := o.Validate(base); err != nil {
+		return err
+	}
+	if p.onChange == nil {
+		return nil
+	}
+	return p.onChange(o)
+}
+
+// save atomically writes the applied overrides to the data directory.
+func (p *Poller) save(s saved) error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(p.path), 0700); err != nil {
+		return err
+	}
+	tmp := p.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, p.path)
+}
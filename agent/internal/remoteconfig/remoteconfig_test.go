@@ -0,0 +1,200 @@
+package remoteconfig
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/Guliveer/vitalis/agent/internal/config"
+)
+
+// configServer is a fake /api/agent/config endpoint.
+type configServer struct {
+	mu       sync.Mutex
+	body     string // response data
+	etag     string
+	requests int
+	notMod   int // requests answered with 304
+}
+
+func (s *configServer) set(body, etag string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.body, s.etag = body, etag
+}
+
+func (s *configServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if r.URL.Path != endpoint || r.Header.Get("Authorization") != "Bearer test" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	s.requests++
+	if r.Header.Get("If-None-Match") == s.etag {
+		s.notMod++
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("ETag", s.etag)
+	w.Write([]byte(`{"success":true,"data":{"overrides":` + s.body + `}}`))
+}
+
+func (s *configServer) counts() (int, int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests, s.notMod
+}
+
+func newTestPoller(t *testing.T, url, dir string) (*Poller, chan Overrides) {
+	t.Helper()
+	cfg := config.DefaultConfig()
+	cfg.Server.URL = url
+	cfg.Server.MachineToken = "test"
+	cfg.Buffer.DBPath = dir
+	p, err := New(cfg, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	applied := make(chan Overrides, 10)
+	p.OnChange(func(o Overrides) error {
+		applied <- o
+		return nil
+	})
+	return p, applied
+}
+
+func TestPoller_AppliesValidatesAndPersists(t *testing.T) {
+	srv := &configServer{}
+	srv.set(`{"interval_seconds":5,"log_level":"debug"}`, `"v1"`)
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+	dir := t.TempDir()
+
+	p, applied := newTestPoller(t, ts.URL, dir)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go p.Run(ctx)
+
+	o := receive(t, applied)
+	if o.Interval != 5 || o.LogLevel != "debug" {
+		t.Fatalf("applied %+v, want the server's overrides", o)
+	}
+	if c := o.Collection(config.DefaultConfig().Collection); c.Interval.Duration != 5*time.Second || c.BatchInterval.Duration != 30*time.Second {
+		t.Errorf("collection = %s/%s, want 5s with the configured 30s batch interval", c.Interval, c.BatchInterval)
+	}
+
+	// An ingest response with the same ETag does not trigger a fetch; a
+	// new one does, and invalid overrides are not applied.
+	p.Notify(`"v1"`)
+	srv.set(`{"interval_seconds":60,"batch_interval_seconds":10}`, `"v2"`)
+	p.Notify(`"v2"`)
+	for {
+		if requests, _ := srv.counts(); requests >= 2 {
+			break
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	select {
+	case o := <-applied:
+		t.Fatalf("applied invalid overrides %+v", o)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// A restarted agent applies the saved overrides before the first
+	// fetch, and the server answers that fetch with 304.
+	cancel()
+	srv.set(`{"interval_seconds":5,"log_level":"debug"}`, `"v1"`)
+	p, applied = newTestPoller(t, ts.URL, dir)
+	p.Load()
+	if o := receive(t, applied); o.Interval != 5 {
+		t.Errorf("loaded %+v, want the saved overrides", o)
+	}
+	if err := p.fetch(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if _, notMod := srv.counts(); notMod != 1 {
+		t.Errorf("server answered %d requests with 304, want 1", notMod)
+	}
+}
+
+func TestOverrides_Validate(t *testing.T) {
+	base := config.DefaultConfig().Collection
+	negative := -1
+	for _, o := range []Overrides{
+		{Interval: 7200},
+		{BatchInterval: 5}, // shorter than the 15s collection interval
+		{TopProcesses: &negative},
+		{LogLevel: "trace"},
+	} {
+		if err := o.Validate(base); err == nil {
+			t.Errorf("Validate(%+v) = nil, want an error", o)
+		}
+	}
+	if err := (Overrides{Interval: 5, BatchInterval: 5, LogLevel: "warn"}).Validate(base); err != nil {
+		t.Errorf("Validate() = %v for valid overrides", err)
+	}
+}
+
+func TestPoller_SetBase(t *testing.T) {
+	p, applied := newTestPoller(t, "https://example.com", t.TempDir())
+
+	// Valid only on top of a batch interval of at least 60s
+	o := Overrides{Interval: 60}
+	if err := p.apply(o); err == nil {
+		t.Fatal("apply() = nil with the default 30s batch interval, want an error")
+	}
+	base := config.DefaultConfig().Collection
+	base.BatchInterval = config.Duration{Duration: 2 * time.Minute}
+	p.SetBase(base)
+	if err := p.apply(o); err != nil {
+		t.Fatalf("apply() = %v after a reload raised the batch interval", err)
+	}
+	if got := receive(t, applied); got.Interval != 60 {
+		t.Errorf("applied %+v, want %+v", got, o)
+	}
+}
+
+func TestPoller_SetURL(t *testing.T) {
+	first, second := &configServer{}, &configServer{}
+	first.set(`{"interval_seconds":5}`, `"v1"`)
+	second.set(`{"interval_seconds":10}`, `"v1"`)
+	ts1, ts2 := httptest.NewServer(first), httptest.NewServer(second)
+	defer ts1.Close()
+	defer ts2.Close()
+
+	p, applied := newTestPoller(t, ts1.URL, t.TempDir())
+	if err := p.fetch(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	receive(t, applied)
+
+	// The new server's overrides are fetched in full, even with an ETag
+	// that matches the old server's.
+	p.SetURL(ts2.URL)
+	if err := p.fetch(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if o := receive(t, applied); o.Interval != 10 {
+		t.Errorf("applied %+v, want the new server's overrides", o)
+	}
+	if requests, notMod := second.counts(); requests != 1 || notMod != 0 {
+		t.Errorf("new server got %d requests, %d answered with 304; want 1 and 0", requests, notMod)
+	}
+}
+
+func receive(t *testing.T, ch chan Overrides) Overrides {
+	t.Helper()
+	select {
+	case o := <-ch:
+		return o
+	case <-time.After(5 * time.Second):
+		t.Fatal("overrides were not applied")
+		return Overrides{}
+	}
+}
@@ -26,6 +26,14 @@ type Scheduler struct {
 	batchMu      sync.Mutex
 
 	onBatchReady func([]models.MetricSnapshot)
+	onSnapshot   func(models.MetricSnapshot)
+	agentStats   func() models.AgentStats
+
+	intervalMu      sync.Mutex
+	collectInterval time.Duration
+	batchInterval   time.Duration
+	reset           chan struct{}
+	now             chan chan struct{}
 }
 
 // New creates a new Scheduler with the given registry, config, and logger.
@@ -35,6 +43,11 @@ func New(registry *collector.Registry, cfg *config.Config, logger *zap.Logger) *
 		cfg:      cfg,
 		logger:   logger,
 		batch:    make([]models.MetricSnapshot, 0),
+
+		collectInterval: cfg.Collection.Interval.Duration,
+		batchInterval:   cfg.Collection.BatchInterval.Duration,
+		reset:           make(chan struct{}, 1),
+		now:             make(chan chan struct{}),
 	}
 }
 
@@ -44,11 +57,66 @@ func (s *Scheduler) OnBatchReady(fn func([]models.MetricSnapshot)) {
 	s.onBatchReady = fn
 }
 
+// OnSnapshot sets a callback invoked with every snapshot as soon as it is
+// collected, before it is added to the batch. It must not block.
+func (s *Scheduler) OnSnapshot(fn func(models.MetricSnapshot)) {
+	s.onSnapshot = fn
+}
+
+// AgentStats sets a function that reports the agent's own health, which is
+// added to every snapshot.
+func (s *Scheduler) AgentStats(fn func() models.AgentStats) {
+	s.agentStats = fn
+}
+
+// SetIntervals changes the collection and batch intervals of a running
+// scheduler. The new intervals start counting from the call.
+func (s *Scheduler) SetIntervals(collect, batch time.Duration) {
+	s.intervalMu.Lock()
+	changed := collect != s.collectInterval || batch != s.batchInterval
+	s.collectInterval = collect
+	s.batchInterval = batch
+	s.intervalMu.Unlock()
+	if !changed {
+		return
+	}
+	select {
+	case s.reset <- struct{}{}:
+	default:
+	}
+}
+
+// CollectNow makes a running scheduler collect a snapshot and flush the
+// batch at once, and waits until it has. The intervals keep counting from
+// their last tick.
+func (s *Scheduler) CollectNow(ctx context.Context) error {
+	done := make(chan struct{})
+	select {
+	case s.now <- done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// intervals returns the current collection and batch intervals.
+func (s *Scheduler) intervals() (time.Duration, time.Duration) {
+	s.intervalMu.Lock()
+	defer s.intervalMu.Unlock()
+	return s.collectInterval, s.batchInterval
+}
+
 // Start begins the collection and batching loops. It blocks until the context
 // is cancelled. On shutdown, it flushes any remaining batch.
 func (s *Scheduler) Start(ctx context.Context) {
-	collectTicker := time.NewTicker(s.cfg.Collection.Interval.Duration)
-	batchTicker := time.NewTicker(s.cfg.Collection.BatchInterval.Duration)
+	collect, batch := s.intervals()
+	collectTicker := time.NewTicker(collect)
+	batchTicker := time.NewTicker(batch)
 
 	defer collectTicker.Stop()
 	defer batchTicker.Stop()
@@ -66,6 +134,17 @@ func (s *Scheduler) Start(ctx context.Context) {
 			s.collect(ctx)
 		case <-batchTicker.C:
 			s.flushBatch()
+		case done := <-s.now:
+			s.collect(ctx)
+			s.flushBatch()
+			close(done)
+		case <-s.reset:
+			collect, batch := s.intervals()
+			collectTicker.Reset(collect)
+			batchTicker.Reset(batch)
+			s.logger.Info("Collection intervals changed",
+				zap.Duration("collect_interval", collect),
+				zap.Duration("batch_interval", batch))
 		}
 	}
 }
@@ -83,6 +162,10 @@ func (s *Scheduler) collect(ctx context.Context) {
 	s.batchMu.Unlock()
 
 	s.logger.Debug("Collected metrics", zap.Time("timestamp", snapshot.Timestamp))
+
+	if s.onSnapshot != nil {
+		s.onSnapshot(snapshot)
+	}
 }
 
 // flushBatch sends the current batch via the callback and resets the buffer.
@@ -170,5 +253,11 @@ func (s *Scheduler) assembleSnapshot(results map[string]interface{}) models.Metr
 		}
 	}
 
+	// Agent self-metrics
+	if s.agentStats != nil {
+		stats := s.agentStats()
+		snapshot.Agent = &stats
+	}
+
 	return snapshot
 }
@@ -0,0 +1,115 @@
+package sender
+
+import (
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Circuit breaker states, as reported in logs and agent self-metrics.
+const (
+	stateClosed   = "closed"    // sending normally
+	stateOpen     = "open"      // server failing; batches go to the buffer
+	stateHalfOpen = "half_open" // probing whether the server has recovered
+)
+
+// breaker is a circuit breaker for sends to the server. It opens after
+// threshold consecutive failed attempts, so batches are buffered at once
+// instead of waiting out retries against a server that is down. Once the
+// open timeout has passed, a single probe may run; its success closes the
+// circuit, its failure opens it again for twice as long (up to maxTimeout).
+type breaker struct {
+	threshold  int
+	timeout    time.Duration
+	maxTimeout time.Duration
+	logger     *zap.Logger
+
+	mu          sync.Mutex
+	state       string
+	failures    int           // consecutive failed attempts
+	openTimeout time.Duration // current open period
+	retryAt     time.Time     // when the open circuit may be probed
+}
+
+func newBreaker(threshold int, timeout, maxTimeout time.Duration, logger *zap.Logger) *breaker {
+	return &breaker{
+		threshold:   threshold,
+		timeout:     timeout,
+		maxTimeout:  maxTimeout,
+		logger:      logger,
+		state:       stateClosed,
+		openTimeout: timeout,
+	}
+}
+
+// Closed reports whether sends may go to the server.
+func (b *breaker) Closed() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state == stateClosed
+}
+
+// State returns the current state and the number of consecutive failures.
+func (b *breaker) State() (string, int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state, b.failures
+}
+
+// ProbeIn returns how long until the open circuit may be probed, or 0 if it
+// is not open.
+func (b *breaker) ProbeIn() time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state != stateOpen {
+		return 0
+	}
+	return max(time.Until(b.retryAt), time.Millisecond)
+}
+
+// BeginProbe moves an open circuit whose timeout has passed to half-open
+// and reports whether the caller should probe the server.
+func (b *breaker) BeginProbe() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state != stateOpen || time.Now().Before(b.retryAt) {
+		return false
+	}
+	b.state = stateHalfOpen
+	b.logger.Info("Circuit breaker half-open, probing server")
+	return true
+}
+
+// Success records that the server answered; it closes the circuit.
+func (b *breaker) Success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state != stateClosed {
+		b.logger.Info("Circuit breaker closed, server recovered",
+			zap.Int("failures", b.failures))
+	}
+	b.state = stateClosed
+	b.failures = 0
+	b.openTimeout = b.timeout
+}
+
+// Failure records a failed attempt. It opens the circuit after threshold
+// consecutive failures, or at once if a probe failed.
+func (b *breaker) Failure() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures++
+	switch {
+	case b.state == stateHalfOpen:
+		b.openTimeout = min(2*b.openTimeout, b.maxTimeout)
+	case b.state == stateClosed && b.failures >= b.threshold:
+	default:
+		return
+	}
+	b.state = stateOpen
+	b.retryAt = time.Now().Add(b.openTimeout)
+	b.logger.Warn("Circuit breaker open, buffering batches until the server recovers",
+		zap.Int("failures", b.failures),
+		zap.Duration("probe_in", b.openTimeout))
+}
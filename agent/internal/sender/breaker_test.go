@@ -0,0 +1,128 @@
+package sender
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/Guliveer/vitalis/agent/internal/buffer"
+	"github.com/Guliveer/vitalis/agent/internal/config"
+	"github.com/Guliveer/vitalis/agent/internal/models"
+)
+
+func TestBreaker_Transitions(t *testing.T) {
+	b := newBreaker(2, 20*time.Millisecond, 50*time.Millisecond, zap.NewNop())
+
+	b.Failure()
+	if !b.Closed() {
+		t.Fatal("breaker opened before reaching the threshold")
+	}
+	b.Success()
+	b.Failure()
+	if !b.Closed() {
+		t.Fatal("a success did not reset the failure count")
+	}
+	b.Failure()
+	if state, failures := b.State(); state != stateOpen || failures != 2 {
+		t.Fatalf("state = %s with %d failures, want open with 2", state, failures)
+	}
+	if b.BeginProbe() {
+		t.Fatal("probe allowed before the open timeout")
+	}
+
+	time.Sleep(b.ProbeIn())
+	if !b.BeginProbe() {
+		t.Fatal("probe not allowed after the open timeout")
+	}
+	if state, _ := b.State(); state != stateHalfOpen || b.BeginProbe() {
+		t.Fatalf("state = %s, want a single half-open probe", state)
+	}
+
+	// A failed probe opens the circuit for twice as long, up to the maximum.
+	b.Failure()
+	if d := b.ProbeIn(); d <= 20*time.Millisecond || d > 40*time.Millisecond {
+		t.Errorf("open timeout after failed probe = %s, want 40ms", d)
+	}
+	time.Sleep(b.ProbeIn())
+	b.BeginProbe()
+	b.Failure()
+	if d := b.ProbeIn(); d > 50*time.Millisecond {
+		t.Errorf("open timeout = %s, want at most 50ms", d)
+	}
+
+	time.Sleep(b.ProbeIn())
+	b.BeginProbe()
+	b.Success()
+	if state, failures := b.State(); state != stateClosed || failures != 0 {
+		t.Errorf("state = %s with %d failures after a successful probe, want closed with 0", state, failures)
+	}
+}
+
+func TestSend_BuffersWhileCircuitOpen(t *testing.T) {
+	var down atomic.Bool
+	var posts atomic.Int32
+	rec := &ingestRecorder{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if down.Load() {
+			if r.Method == http.MethodPost {
+				posts.Add(1)
+			}
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		if r.Method == http.MethodGet {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		rec.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+
+	cfg := config.DefaultConfig()
+	cfg.Server.URL = srv.URL
+	cfg.Server.MachineToken = "test"
+	cfg.Server.RateLimit.Requests = 100
+	cfg.Server.CircuitBreaker.FailureThreshold = 1
+	cfg.Server.CircuitBreaker.OpenTimeout = config.Duration{Duration: 50 * time.Millisecond}
+	cfg.Buffer.DBPath = t.TempDir()
+	buf, err := buffer.New(cfg.Buffer, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newSender(t, cfg, buf)
+
+	// The first failure opens the circuit; the batch is buffered without
+	// waiting out the retries, and the next one is not even attempted.
+	down.Store(true)
+	start := time.Now()
+	s.Send([]models.MetricSnapshot{{CPUOverall: 1}})
+	s.Send([]models.MetricSnapshot{{CPUOverall: 2}})
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("sends took %s with the circuit open", elapsed)
+	}
+	if n := posts.Load(); n != 1 {
+		t.Errorf("server received %d posts, want 1", n)
+	}
+	if buf.Count() != 2 {
+		t.Errorf("buffered %d batches, want 2", buf.Count())
+	}
+	if stats := s.Stats(); stats.SenderState != stateOpen || stats.BufferedBatches != 2 {
+		t.Errorf("Stats = %+v, want open with 2 buffered batches", stats)
+	}
+
+	// Once the server is back, a probe closes the circuit and the buffer
+	// is drained.
+	down.Store(false)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.RunDrainer(ctx)
+	waitReceived(t, rec, 2)
+	if stats := s.Stats(); stats.SenderState != stateClosed {
+		t.Errorf("state after recovery = %s, want closed", stats.SenderState)
+	}
+}
@@ -0,0 +1,107 @@
+package sender
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	// drainProbeInterval is how often the drainer retries a non-empty buffer
+	// when no live send has succeeded in the meantime (e.g. when the server
+	// answers replays but live batches are being rate limited).
+	drainProbeInterval = time.Minute
+
+	// liveReserve is the number of rate limiter tokens a drain leaves unused
+	// so live batches interleave with buffered ones instead of queueing
+	// behind the whole backlog.
+	liveReserve = 1
+)
+
+// RunDrainer replays the offline buffer in the background until ctx is
+// cancelled. It drains once at startup, again whenever a live send succeeds
+// (the server is reachable again) or a batch is buffered because of a rate
+// limit, and periodically while the buffer is non-empty. While the circuit
+// breaker is open it does not drain, unless another server takes the batches
+// in failover mode (see Group), but probes the server when the open
+// timeout has passed and drains once the probe succeeds. A drain in progress
+// stops at the next batch boundary when ctx is cancelled; unsent batches stay
+// in the buffer.
+func (s *Sender) RunDrainer(ctx context.Context) {
+	if s.buf == nil {
+		return
+	}
+
+	ticker := time.NewTicker(drainProbeInterval)
+	defer ticker.Stop()
+
+	for {
+		if s.breaker.BeginProbe() {
+			s.probe(ctx)
+		}
+		// In failover mode the buffer drains to another server while this
+		// one is down
+		if s.buf.Count() > 0 && (s.breaker.Closed() || s.group != nil) {
+			s.FlushBuffer(ctx)
+		}
+
+		var probe <-chan time.Time
+		var timer *time.Timer
+		if d := s.breaker.ProbeIn(); d > 0 {
+			timer = time.NewTimer(d)
+			probe = timer.C
+		}
+		select {
+		case <-ctx.Done():
+		case <-s.drainCh:
+		case <-ticker.C:
+		case <-probe:
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		if ctx.Err() != nil {
+			return
+		}
+	}
+}
+
+// probe checks whether the server is reachable again with a capability
+// request to the ingest endpoint, and records the outcome with the circuit
+// breaker. Any answer but a 5xx counts as recovered.
+func (s *Sender) probe(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, requestTimeout)
+	defer cancel()
+	url, token := s.server()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url+"/api/ingest", nil)
+	if err != nil {
+		s.breaker.Failure()
+		return
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		s.logger.Debug("Server probe failed", zap.Error(err))
+		s.breaker.Failure()
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 500 {
+		s.logger.Debug("Server probe failed", zap.Int("status", resp.StatusCode))
+		s.breaker.Failure()
+		return
+	}
+	s.breaker.Success()
+}
+
+// requestDrain wakes the drainer without blocking. Requests made while a
+// drain is already pending are coalesced.
+func (s *Sender) requestDrain() {
+	select {
+	case s.drainCh <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,173 @@
+package sender
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/Guliveer/vitalis/agent/internal/buffer"
+	"github.com/Guliveer/vitalis/agent/internal/config"
+	"github.com/Guliveer/vitalis/agent/internal/models"
+)
+
+// ingestRecorder is a fake ingest endpoint that records the CPU value of
+// every snapshot it receives, in arrival order. Batches with a snapshot
+// whose CPU value is reject are answered with 422 and not recorded.
+type ingestRecorder struct {
+	reject float64
+
+	mu       sync.Mutex
+	cpu      []float64
+	rejected int
+}
+
+func (r *ingestRecorder) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	gz, err := gzip.NewReader(req.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	var batch models.MetricBatch
+	if err := json.NewDecoder(gz).Decode(&batch); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, m := range batch.Metrics {
+		if r.reject != 0 && m.CPUOverall == r.reject {
+			r.rejected++
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			return
+		}
+	}
+	for _, m := range batch.Metrics {
+		r.cpu = append(r.cpu, m.CPUOverall)
+	}
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (r *ingestRecorder) received() []float64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]float64(nil), r.cpu...)
+}
+
+func TestRunDrainer_ReplaysOldestFirstAndOnRecovery(t *testing.T) {
+	rec := &ingestRecorder{}
+	srv := httptest.NewServer(rec)
+	defer srv.Close()
+
+	cfg := config.DefaultConfig()
+	cfg.Server.URL = srv.URL
+	cfg.Server.MachineToken = "test"
+	cfg.Server.RateLimit.Requests = 100
+	cfg.Buffer.DBPath = t.TempDir()
+
+	buf, err := buffer.New(cfg.Buffer, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, cpu := range []float64{1, 2} {
+		if err := buf.Store(models.MetricBatch{Metrics: []models.MetricSnapshot{{CPUOverall: cpu}}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s := newSender(t, cfg, buf)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		s.RunDrainer(ctx)
+		close(done)
+	}()
+
+	waitReceived(t, rec, 2)
+
+	// A batch buffered during a later outage is drained as soon as a live
+	// send succeeds, without waiting for the probe interval.
+	if err := buf.Store(models.MetricBatch{Metrics: []models.MetricSnapshot{{CPUOverall: 3}}}); err != nil {
+		t.Fatal(err)
+	}
+	s.Send([]models.MetricSnapshot{{CPUOverall: 4}})
+	waitReceived(t, rec, 4)
+
+	got := rec.received()
+	want := []float64{1, 2, 4, 3}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("received %v, want %v", got, want)
+		}
+	}
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("drainer did not stop on context cancellation")
+	}
+}
+
+func waitReceived(t *testing.T, rec *ingestRecorder, n int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for len(rec.received()) < n {
+		if time.Now().After(deadline) {
+			t.Fatalf("received %v, want %d snapshots", rec.received(), n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestFlushBuffer_RemovesRejectedBatch(t *testing.T) {
+	rec := &ingestRecorder{reject: 2}
+	srv := httptest.NewServer(rec)
+	defer srv.Close()
+
+	cfg := config.DefaultConfig()
+	cfg.Server.URL = srv.URL
+	cfg.Server.MachineToken = "test"
+	cfg.Server.RateLimit.Requests = 100
+	cfg.Buffer.DBPath = t.TempDir()
+
+	buf, err := buffer.New(cfg.Buffer, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, cpu := range []float64{1, 2, 3} {
+		if err := buf.Store(models.MetricBatch{Metrics: []models.MetricSnapshot{{CPUOverall: cpu}}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s := newSender(t, cfg, buf)
+	start := time.Now()
+	if sent := s.FlushBuffer(context.Background()); sent != 2 {
+		t.Errorf("FlushBuffer = %d, want 2", sent)
+	}
+	// The rejected batch is neither retried nor left at the head of the
+	// buffer.
+	if elapsed := time.Since(start); elapsed > baseRetryDelay {
+		t.Errorf("flush took %s, want no retry delay", elapsed)
+	}
+	if got := rec.received(); len(got) != 2 || got[0] != 1 || got[1] != 3 {
+		t.Errorf("received %v, want [1 3]", got)
+	}
+	rec.mu.Lock()
+	rejected := rec.rejected
+	rec.mu.Unlock()
+	if rejected != 1 {
+		t.Errorf("rejected batch sent %d times, want 1", rejected)
+	}
+	if n := buf.Count(); n != 0 {
+		t.Errorf("%d batches still buffered, want 0", n)
+	}
+}
@@ -0,0 +1,154 @@
+package sender
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/Guliveer/vitalis/agent/internal/models"
+)
+
+// Group sends batches to several servers (see config.Config.Targets), each
+// through its own Sender with its own token, queue, buffer and sequence
+// numbers.
+//
+// In fanout mode every server gets every batch, and a batch buffered for one
+// server is only ever replayed to that server, so an outage on one server
+// neither loses nor duplicates data on the others.
+//
+// In failover mode every batch is numbered and queued by the primary
+// server's sender. Each batch that the primary server does not take is
+// offered to the other servers in order, and buffered by the primary only
+// if none of them takes it. The primary's buffer likewise drains to the
+// first server that takes its batches.
+type Group struct {
+	senders []*Sender
+	fanout  bool
+	logger  *zap.Logger
+
+	mu     sync.Mutex
+	active int // failover: index of the server the last batch went to
+}
+
+// NewGroup creates a Group over senders, the primary server first. mode is
+// "fanout" to send every batch to every server, or "failover" to send each
+// batch to the first server that takes it.
+func NewGroup(mode string, senders []*Sender, logger *zap.Logger) *Group {
+	g := &Group{
+		senders: senders,
+		fanout:  mode == "fanout",
+		logger:  logger,
+	}
+	if !g.fanout && len(senders) > 1 {
+		senders[0].group = g
+	}
+	return g
+}
+
+// Enqueue hands a batch to the send queue of every server (fanout) or of
+// the primary server (failover), which passes it on to the other servers
+// if it cannot send it itself.
+func (g *Group) Enqueue(metrics []models.MetricSnapshot) {
+	if g.fanout {
+		for _, s := range g.senders {
+			s.Enqueue(metrics)
+		}
+		return
+	}
+	g.senders[0].Enqueue(metrics)
+}
+
+// failover delivers a batch the primary server did not take to the first
+// other server that takes it, returning the last error if none does. live
+// batches are sent as by Sender.Send, buffered ones as replays that leave
+// room for live batches.
+func (g *Group) failover(ctx context.Context, batch models.MetricBatch, live bool) error {
+	var err error
+	for i := 1; i < len(g.senders); i++ {
+		s := g.senders[i]
+		if live {
+			err = s.deliver(ctx, batch)
+		} else {
+			err = s.replay(ctx, batch, liveReserve)
+		}
+		if err == nil {
+			g.setActive(i)
+			if live {
+				// Another server is up, so the primary's buffer can drain to it
+				g.senders[0].requestDrain()
+			}
+			return nil
+		}
+		if ctx.Err() != nil {
+			return err
+		}
+	}
+	return err
+}
+
+// setActive records the server a batch went to, logging every switch.
+func (g *Group) setActive(i int) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if i == g.active {
+		return
+	}
+	to, _ := g.senders[i].server()
+	from, _ := g.senders[g.active].server()
+	g.logger.Info("Switching to server", zap.String("url", to), zap.String("from", from))
+	g.active = i
+}
+
+// Stats reports the health of all servers: the worst circuit breaker
+// state, and the send failures and buffered batches summed over servers.
+func (g *Group) Stats() models.AgentStats {
+	var stats models.AgentStats
+	for _, s := range g.senders {
+		st := s.Stats()
+		if stats.SenderState == "" || stateRank(st.SenderState) > stateRank(stats.SenderState) {
+			stats.SenderState = st.SenderState
+		}
+		stats.SendFailures += st.SendFailures
+		stats.BufferedBatches += st.BufferedBatches
+	}
+	return stats
+}
+
+// FlushBuffer sends every server's buffered batches now (see
+// Sender.FlushBuffer), one server after another, and returns the number of
+// batches delivered.
+func (g *Group) FlushBuffer(ctx context.Context) int {
+	sent := 0
+	for _, s := range g.senders {
+		sent += s.FlushBuffer(ctx)
+	}
+	return sent
+}
+
+// CloseQueue closes every server's send queue (see Sender.CloseQueue) in
+// parallel, so shutdown takes at most timeout in total.
+func (g *Group) CloseQueue(timeout time.Duration) {
+	var wg sync.WaitGroup
+	for _, s := range g.senders {
+		wg.Add(1)
+		go func(s *Sender) {
+			defer wg.Done()
+			s.CloseQueue(timeout)
+		}(s)
+	}
+	wg.Wait()
+}
+
+// stateRank orders circuit breaker states from healthy to failing.
+func stateRank(state string) int {
+	switch state {
+	case stateOpen:
+		return 2
+	case stateHalfOpen:
+		return 1
+	default:
+		return 0
+	}
+}
@@ -0,0 +1,130 @@
+package sender
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/Guliveer/vitalis/agent/internal/buffer"
+	"github.com/Guliveer/vitalis/agent/internal/config"
+	"github.com/Guliveer/vitalis/agent/internal/models"
+)
+
+func TestGroup_FailoverAndFanout(t *testing.T) {
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer down.Close()
+
+	for _, tt := range []struct {
+		mode       string
+		want       []float64 // received by the second server
+		wantBuffer [2]int    // batches buffered for each server
+	}{
+		// The first batch fails on the primary server and goes to the
+		// second; the circuit opens and the rest go there at once.
+		{"failover", []float64{1, 2, 3}, [2]int{0, 0}},
+		// Every batch goes to both; only the primary server buffers.
+		{"fanout", []float64{1, 2, 3}, [2]int{3, 0}},
+	} {
+		t.Run(tt.mode, func(t *testing.T) {
+			rec := &ingestRecorder{}
+			up := httptest.NewServer(rec)
+			defer up.Close()
+
+			cfg := config.DefaultConfig()
+			cfg.Server.URL = down.URL
+			cfg.Server.MachineToken = "primary"
+			cfg.Server.Mode = tt.mode
+			cfg.Server.Servers = []config.ServerEndpoint{{URL: up.URL, MachineToken: "second"}}
+			cfg.Server.RateLimit.Requests = 100
+			cfg.Server.CircuitBreaker.FailureThreshold = 1
+			cfg.Server.CircuitBreaker.OpenTimeout = config.Duration{Duration: time.Minute}
+			cfg.Buffer.DBPath = t.TempDir()
+
+			g, senders, bufs := newGroup(t, cfg)
+			for _, s := range senders {
+				go s.RunQueue()
+			}
+
+			g.Enqueue([]models.MetricSnapshot{{CPUOverall: 1}})
+			for senders[0].breaker.Closed() {
+				time.Sleep(time.Millisecond)
+			}
+			g.Enqueue([]models.MetricSnapshot{{CPUOverall: 2}})
+			g.Enqueue([]models.MetricSnapshot{{CPUOverall: 3}})
+			g.CloseQueue(5 * time.Second)
+
+			if got := rec.received(); !slices.Equal(got, tt.want) {
+				t.Errorf("second server received %v, want %v", got, tt.want)
+			}
+			for i, buf := range bufs {
+				if buf.Count() != tt.wantBuffer[i] {
+					t.Errorf("server %d buffered %d batches, want %d", i, buf.Count(), tt.wantBuffer[i])
+				}
+			}
+			if stats := g.Stats(); stats.SenderState != stateOpen || stats.BufferedBatches != tt.wantBuffer[0] {
+				t.Errorf("Stats = %+v, want open with %d buffered batches", stats, tt.wantBuffer[0])
+			}
+		})
+	}
+}
+
+func TestGroup_FailoverDrainsBufferToHealthyServer(t *testing.T) {
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer down.Close()
+	rec := &ingestRecorder{}
+	up := httptest.NewServer(rec)
+	defer up.Close()
+
+	cfg := config.DefaultConfig()
+	cfg.Server.URL = down.URL
+	cfg.Server.MachineToken = "primary"
+	cfg.Server.Servers = []config.ServerEndpoint{{URL: up.URL, MachineToken: "second"}}
+	cfg.Server.RateLimit.Requests = 100
+	cfg.Server.CircuitBreaker.FailureThreshold = 1
+	cfg.Server.CircuitBreaker.OpenTimeout = config.Duration{Duration: time.Minute}
+	cfg.Buffer.DBPath = t.TempDir()
+
+	_, senders, bufs := newGroup(t, cfg)
+	for i := 1; i <= 3; i++ {
+		if err := bufs[0].Store(senders[0].newBatch([]models.MetricSnapshot{{CPUOverall: float64(i)}})); err != nil {
+			t.Fatal(err)
+		}
+	}
+	senders[0].breaker.Failure()
+
+	if sent := senders[0].FlushBuffer(context.Background()); sent != 3 {
+		t.Errorf("FlushBuffer sent %d batches, want 3", sent)
+	}
+	if got := rec.received(); !slices.Equal(got, []float64{1, 2, 3}) {
+		t.Errorf("second server received %v, want the buffered batches in order", got)
+	}
+	if bufs[0].Count() != 0 {
+		t.Errorf("primary server still buffers %d batches", bufs[0].Count())
+	}
+}
+
+// newGroup creates a Group over the servers in cfg, each with its own buffer.
+func newGroup(t *testing.T, cfg *config.Config) (*Group, []*Sender, []*buffer.Buffer) {
+	t.Helper()
+	var senders []*Sender
+	var bufs []*buffer.Buffer
+	for _, target := range cfg.Targets() {
+		buf, err := buffer.New(target.Buffer, zap.NewNop())
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { buf.Close() })
+		senders = append(senders, newSender(t, target, buf))
+		bufs = append(bufs, buf)
+	}
+	return NewGroup(cfg.Server.Mode, senders, zap.NewNop()), senders, bufs
+}
@@ -0,0 +1,194 @@
+package sender
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/Guliveer/vitalis/agent/internal/wire"
+)
+
+const (
+	// rediscoverInterval is how long the agent keeps using a fallback
+	// format before asking the server for its capabilities again.
+	rediscoverInterval = time.Hour
+
+	// minDiscoveryBackoff is how long the agent waits before asking again
+	// after a discovery request failed; the wait doubles with each failure
+	// up to rediscoverInterval.
+	minDiscoveryBackoff = 30 * time.Second
+)
+
+// errUnsupportedFormat is returned when the server answers 415 Unsupported
+// Media Type.
+var errUnsupportedFormat = errors.New("server does not accept the payload format")
+
+// capabilities is the ingest endpoint's answer to a GET request.
+type capabilities struct {
+	ContentTypes     []string `json:"content_types"`
+	ContentEncodings []string `json:"content_encodings"`
+	BatchFormats     []string `json:"batch_formats"`
+}
+
+// negotiator picks the payload format for ingest requests. The configured
+// format is used only once the server has advertised support for it;
+// servers without capability discovery get JSON with gzip. Sends never
+// wait for discovery: while it runs, they use the current format.
+type negotiator struct {
+	preferred wire.Format
+	client    *http.Client
+	logger    *zap.Logger
+
+	mu          sync.Mutex
+	url         string
+	token       string
+	server      int // incremented by SetServer; a discovery for an older server is ignored
+	current     wire.Format
+	checked     time.Time // zero until the server answered a discovery request
+	discovering bool      // a discovery request is in flight
+	backoff     time.Duration
+	retryAt     time.Time // no discovery before, after a failed one
+}
+
+func newNegotiator(preferred wire.Format, url, token string, client *http.Client, logger *zap.Logger) *negotiator {
+	return &negotiator{
+		preferred: preferred,
+		url:       url,
+		token:     token,
+		client:    client,
+		logger:    logger,
+		current:   wire.Default,
+	}
+}
+
+// Format returns the format to encode the next request in, asking the
+// server for its capabilities on first use and again rediscoverInterval
+// after falling back. Only one caller runs a discovery request, outside
+// the lock; the others get the current format without waiting. A failed
+// discovery is retried after a growing backoff.
+func (n *negotiator) Format(ctx context.Context) wire.Format {
+	if n.preferred == wire.Default {
+		return wire.Default
+	}
+
+	n.mu.Lock()
+	if n.discovering || time.Now().Before(n.retryAt) ||
+		!n.checked.IsZero() && (n.current == n.preferred || time.Since(n.checked) < rediscoverInterval) {
+		defer n.mu.Unlock()
+		return n.current
+	}
+	n.discovering = true
+	url, token, server := n.url, n.token, n.server
+	n.mu.Unlock()
+
+	caps, err := n.discover(ctx, url, token)
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.discovering = false
+	if server != n.server {
+		// The server changed meanwhile; the next call asks the new one
+		return n.current
+	}
+	if err != nil {
+		// Unreachable: keep the current format until the backoff passes
+		n.backoff = min(max(2*n.backoff, minDiscoveryBackoff), rediscoverInterval)
+		n.retryAt = time.Now().Add(n.backoff)
+		n.logger.Debug("Capability discovery failed",
+			zap.Duration("retry_in", n.backoff),
+			zap.Error(err))
+		return n.current
+	}
+	n.backoff = 0
+	n.retryAt = time.Time{}
+	n.checked = time.Now()
+
+	format := wire.Default
+	if slices.Contains(caps.ContentTypes, n.preferred.ContentType) {
+		format.ContentType = n.preferred.ContentType
+	}
+	if slices.Contains(caps.ContentEncodings, n.preferred.ContentEncoding) {
+		format.ContentEncoding = n.preferred.ContentEncoding
+	}
+	if slices.Contains(caps.BatchFormats, wire.DeltaFormat) {
+		format.Delta = n.preferred.Delta
+	}
+	if format != n.current || format != n.preferred {
+		n.logger.Info("Negotiated ingest payload format",
+			zap.Stringer("format", format),
+			zap.Stringer("preferred", n.preferred))
+	}
+	n.current = format
+	return format
+}
+
+// SetServer points discovery at another server, which has to advertise
+// the preferred format again before it is used.
+func (n *negotiator) SetServer(url, token string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if url != n.url {
+		n.current = wire.Default
+		n.checked = time.Time{}
+		n.backoff = 0
+		n.retryAt = time.Time{}
+	}
+	n.url, n.token = url, token
+	n.server++
+}
+
+// Reject records that the server refused a format it had advertised, so
+// later requests fall back to JSON with gzip. Returns false if f is
+// already the fallback.
+func (n *negotiator) Reject(f wire.Format) bool {
+	if f == wire.Default {
+		return false
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.logger.Warn("Server rejected payload format, falling back to JSON",
+		zap.Stringer("format", f))
+	n.current = wire.Default
+	n.checked = time.Now()
+	return true
+}
+
+// discover asks the ingest endpoint which formats it accepts. A server
+// without capability discovery is reported as accepting none, not as an
+// error.
+func (n *negotiator) discover(ctx context.Context, url, token string) (capabilities, error) {
+	var caps capabilities
+
+	ctx, cancel := context.WithTimeout(ctx, requestTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url+"/api/ingest", nil)
+	if err != nil {
+		return caps, fmt.Errorf("create request: %w", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return caps, fmt.Errorf("send request: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return caps, nil
+	}
+
+	var body struct {
+		Data capabilities `json:"data"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxResponseSize)).Decode(&body); err != nil {
+		return caps, nil
+	}
+	return body.Data, nil
+}
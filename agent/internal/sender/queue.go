@@ -0,0 +1,117 @@
+package sender
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/Guliveer/vitalis/agent/internal/models"
+)
+
+// sendQueue is the bounded queue between Enqueue and the send worker.
+type sendQueue struct {
+	mu      sync.Mutex
+	ch      chan models.MetricBatch
+	closed  bool
+	started bool // RunQueue has been called
+
+	ctx    context.Context // cancelled at the drain deadline
+	cancel context.CancelFunc
+	done   chan struct{} // closed when the worker has finished
+}
+
+func newSendQueue(size int) sendQueue {
+	ctx, cancel := context.WithCancel(context.Background())
+	return sendQueue{
+		ch:     make(chan models.MetricBatch, size),
+		ctx:    ctx,
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+}
+
+// Enqueue hands a batch of snapshots to the send worker started by
+// RunQueue and returns at once, so the caller never waits for the network.
+// The batch gets its batch ID and sequence number here. If the queue is
+// full, or already closed, the batch is buffered instead.
+func (s *Sender) Enqueue(metrics []models.MetricSnapshot) {
+	batch := s.newBatch(metrics)
+
+	s.queue.mu.Lock()
+	defer s.queue.mu.Unlock()
+	if s.queue.closed {
+		s.bufferBatch(batch)
+		return
+	}
+	select {
+	case s.queue.ch <- batch:
+	default:
+		s.logger.Warn("Send queue full, buffering batch",
+			zap.Int("queued", len(s.queue.ch)))
+		s.bufferBatch(batch)
+	}
+}
+
+// RunQueue sends queued batches one at a time until CloseQueue is called.
+// It blocks, so run it in its own goroutine.
+func (s *Sender) RunQueue() {
+	s.queue.mu.Lock()
+	s.queue.started = true
+	s.queue.mu.Unlock()
+	defer close(s.queue.done)
+
+	ctx := s.queue.ctx
+	for batch := range s.queue.ch {
+		if ctx.Err() != nil {
+			// Past the drain deadline; keep the rest for the next start.
+			s.bufferBatch(batch)
+			continue
+		}
+		s.send(ctx, batch)
+	}
+}
+
+// CloseQueue stops accepting batches and waits for the worker to send
+// those already queued. After timeout, the send in progress is abandoned
+// and everything left is buffered. It returns once the queue is empty.
+func (s *Sender) CloseQueue(timeout time.Duration) {
+	s.queue.mu.Lock()
+	if s.queue.closed {
+		s.queue.mu.Unlock()
+		return
+	}
+	s.queue.closed = true
+	pending := len(s.queue.ch)
+	close(s.queue.ch)
+	s.queue.mu.Unlock()
+
+	if pending > 0 {
+		s.logger.Info("Sending queued batches before shutdown",
+			zap.Int("batches", pending),
+			zap.Duration("timeout", timeout))
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-s.queue.done:
+		return
+	case <-timer.C:
+	}
+	s.logger.Warn("Send queue not drained in time, buffering the rest")
+	s.queue.cancel()
+
+	s.queue.mu.Lock()
+	started := s.queue.started
+	s.queue.mu.Unlock()
+	if !started {
+		// No worker is running; buffer what was queued ourselves.
+		for batch := range s.queue.ch {
+			s.bufferBatch(batch)
+		}
+		return
+	}
+	<-s.queue.done
+}
@@ -0,0 +1,97 @@
+package sender
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/Guliveer/vitalis/agent/internal/buffer"
+	"github.com/Guliveer/vitalis/agent/internal/config"
+	"github.com/Guliveer/vitalis/agent/internal/models"
+)
+
+func TestQueue_SendsQueuedBatchesOnClose(t *testing.T) {
+	rec := &ingestRecorder{}
+	srv := httptest.NewServer(rec)
+	defer srv.Close()
+
+	cfg := config.DefaultConfig()
+	cfg.Server.URL = srv.URL
+	cfg.Server.MachineToken = "test"
+	cfg.Server.RateLimit.Requests = 100
+	cfg.Buffer.DBPath = t.TempDir()
+	buf, err := buffer.New(cfg.Buffer, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newSender(t, cfg, buf)
+
+	s.Enqueue([]models.MetricSnapshot{{CPUOverall: 1}})
+	s.Enqueue([]models.MetricSnapshot{{CPUOverall: 2}})
+	go s.RunQueue()
+	s.CloseQueue(5 * time.Second)
+
+	if got := rec.received(); len(got) != 2 || got[0] != 1 || got[1] != 2 {
+		t.Errorf("received %v, want [1 2]", got)
+	}
+	if buf.Count() != 0 {
+		t.Errorf("buffered %d batches, want 0", buf.Count())
+	}
+}
+
+func TestQueue_SpillsToBufferWhenServerIsSlow(t *testing.T) {
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer srv.Close()
+	defer close(release)
+
+	cfg := config.DefaultConfig()
+	cfg.Server.URL = srv.URL
+	cfg.Server.MachineToken = "test"
+	cfg.Server.RateLimit.Requests = 100
+	cfg.Server.Queue.Size = 1
+	cfg.Buffer.DBPath = t.TempDir()
+	buf, err := buffer.New(cfg.Buffer, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newSender(t, cfg, buf)
+	go s.RunQueue()
+
+	// The worker is stuck on the first batch, the second fills the queue
+	// and the rest overflow to the buffer without blocking the caller.
+	start := time.Now()
+	s.Enqueue([]models.MetricSnapshot{{CPUOverall: 1}})
+	for len(s.queue.ch) > 0 {
+		time.Sleep(time.Millisecond)
+	}
+	for i := 2; i <= 4; i++ {
+		s.Enqueue([]models.MetricSnapshot{{CPUOverall: float64(i)}})
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Enqueue blocked for %s", elapsed)
+	}
+	if buf.Count() != 2 {
+		t.Errorf("buffered %d batches on overflow, want 2", buf.Count())
+	}
+
+	// At the drain deadline the send in progress is abandoned and the
+	// queued batch is buffered too.
+	s.CloseQueue(50 * time.Millisecond)
+	if buf.Count() != 4 {
+		t.Errorf("buffered %d batches after close, want 4", buf.Count())
+	}
+	s.Enqueue([]models.MetricSnapshot{{CPUOverall: 5}})
+	if buf.Count() != 5 {
+		t.Errorf("buffered %d batches after enqueue on a closed queue, want 5", buf.Count())
+	}
+}
@@ -0,0 +1,198 @@
+package sender
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// rateLimitInfo holds the rate limit state reported by the server in
+// response headers. Zero values mean "not reported".
+type rateLimitInfo struct {
+	limit      int           // X-RateLimit-Limit: requests per window
+	remaining  int           // X-RateLimit-Remaining (-1 if absent)
+	reset      time.Time     // X-RateLimit-Reset: when the window reopens
+	retryAfter time.Duration // Retry-After on 429/503 responses
+}
+
+// parseRateLimitHeaders extracts Retry-After and X-RateLimit-* headers.
+func parseRateLimitHeaders(h http.Header, now time.Time) rateLimitInfo {
+	info := rateLimitInfo{remaining: -1}
+
+	if v, err := strconv.Atoi(h.Get("X-RateLimit-Limit")); err == nil && v > 0 {
+		info.limit = v
+	}
+	if v, err := strconv.Atoi(h.Get("X-RateLimit-Remaining")); err == nil && v >= 0 {
+		info.remaining = v
+	}
+	if v, err := strconv.ParseInt(h.Get("X-RateLimit-Reset"), 10, 64); err == nil && v > 0 {
+		info.reset = parseReset(v, now)
+	}
+	if v := h.Get("Retry-After"); v != "" {
+		if secs, err := strconv.Atoi(v); err == nil && secs >= 0 {
+			info.retryAfter = time.Duration(secs) * time.Second
+		} else if t, err := http.ParseTime(v); err == nil {
+			info.retryAfter = t.Sub(now)
+		}
+	}
+	return info
+}
+
+// parseReset interprets X-RateLimit-Reset, which servers send either as a
+// Unix timestamp (seconds or milliseconds) or as seconds until the reset.
+func parseReset(v int64, now time.Time) time.Time {
+	switch {
+	case v > 1e12:
+		return time.UnixMilli(v)
+	case v > 1e9:
+		return time.Unix(v, 0)
+	default:
+		return now.Add(time.Duration(v) * time.Second)
+	}
+}
+
+// rateLimiter is a token bucket that paces requests to the ingest endpoint.
+// It starts from the configured limit and adapts whenever the server
+// reports its own limits, so changing the server's rate limit does not
+// require rebuilding or reconfiguring the agent.
+type rateLimiter struct {
+	mu           sync.Mutex
+	limit        int
+	window       time.Duration
+	tokens       float64
+	last         time.Time
+	blockedUntil time.Time
+	now          func() time.Time
+}
+
+// newRateLimiter creates a full bucket allowing limit requests per window.
+func newRateLimiter(limit int, window time.Duration) *rateLimiter {
+	if limit <= 0 {
+		limit = 1
+	}
+	if window <= 0 {
+		window = time.Minute
+	}
+	l := &rateLimiter{
+		limit:  limit,
+		window: window,
+		tokens: float64(limit),
+		now:    time.Now,
+	}
+	l.last = l.now()
+	return l
+}
+
+// Wait blocks until a request may be sent, then consumes a token.
+func (l *rateLimiter) Wait(ctx context.Context) error {
+	return l.WaitKeep(ctx, 0)
+}
+
+// WaitKeep is like Wait but only consumes a token while at least keep more
+// remain in the bucket afterwards. Background work uses it to leave headroom
+// for live batches so they are not delayed behind a buffer drain.
+func (l *rateLimiter) WaitKeep(ctx context.Context, keep int) error {
+	for {
+		delay := l.reserve(keep)
+		if delay <= 0 {
+			return nil
+		}
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		}
+	}
+}
+
+// Delay returns how long a request would currently have to wait, without
+// consuming a token.
+func (l *rateLimiter) Delay() time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.delayLocked(l.now(), 1)
+}
+
+// reserve consumes a token if one is available (keeping keep in reserve) and
+// returns 0, otherwise it returns how long to wait before trying again.
+func (l *rateLimiter) reserve(keep int) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	// Never reserve the whole bucket, or the caller could wait forever.
+	if keep >= l.limit {
+		keep = l.limit - 1
+	}
+
+	now := l.now()
+	if d := l.delayLocked(now, float64(1+keep)); d > 0 {
+		return d
+	}
+	l.tokens--
+	return 0
+}
+
+// delayLocked refills the bucket and computes the wait until it holds at
+// least need tokens.
+// Must be called with l.mu held.
+func (l *rateLimiter) delayLocked(now time.Time, need float64) time.Duration {
+	if now.Before(l.blockedUntil) {
+		return l.blockedUntil.Sub(now)
+	}
+
+	rate := float64(l.limit) / l.window.Seconds() // tokens per second
+	if now.After(l.last) {
+		l.tokens += now.Sub(l.last).Seconds() * rate
+		if l.tokens > float64(l.limit) {
+			l.tokens = float64(l.limit)
+		}
+		l.last = now
+	}
+
+	if l.tokens >= need {
+		return 0
+	}
+	return time.Duration((need - l.tokens) / rate * float64(time.Second))
+}
+
+// Observe adapts the bucket to the limits reported by the server.
+// Returns true if the server reported a different requests-per-window limit.
+func (l *rateLimiter) Observe(info rateLimitInfo) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	l.delayLocked(now, 1) // settle refill at the old rate first
+
+	changed := false
+	if info.limit > 0 && info.limit != l.limit {
+		l.limit = info.limit
+		changed = true
+		if l.tokens > float64(l.limit) {
+			l.tokens = float64(l.limit)
+		}
+	}
+
+	// Trust the server's view of what is left in the current window.
+	if info.remaining >= 0 && float64(info.remaining) < l.tokens {
+		l.tokens = float64(info.remaining)
+	}
+
+	var until time.Time
+	if info.retryAfter > 0 {
+		until = now.Add(info.retryAfter)
+	} else if info.remaining == 0 && info.reset.After(now) {
+		until = info.reset
+	}
+	if until.After(l.blockedUntil) {
+		l.blockedUntil = until
+		// Allow one request when the window reopens, then pace from there.
+		l.tokens = 1
+		l.last = until
+	}
+	return changed
+}
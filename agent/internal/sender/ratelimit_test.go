@@ -0,0 +1,137 @@
+package sender
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/Guliveer/vitalis/agent/internal/config"
+	"github.com/Guliveer/vitalis/agent/internal/models"
+)
+
+func TestParseRateLimitHeaders(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+
+	h := http.Header{}
+	h.Set("Retry-After", "30")
+	h.Set("X-RateLimit-Limit", "20")
+	h.Set("X-RateLimit-Remaining", "0")
+	h.Set("X-RateLimit-Reset", strconv.FormatInt(now.Add(45*time.Second).Unix(), 10))
+
+	info := parseRateLimitHeaders(h, now)
+	if info.retryAfter != 30*time.Second {
+		t.Errorf("retryAfter = %v, want 30s", info.retryAfter)
+	}
+	if info.limit != 20 || info.remaining != 0 {
+		t.Errorf("limit/remaining = %d/%d, want 20/0", info.limit, info.remaining)
+	}
+	if !info.reset.Equal(now.Add(45 * time.Second)) {
+		t.Errorf("reset = %v", info.reset)
+	}
+
+	// Relative reset and HTTP-date Retry-After.
+	h = http.Header{}
+	h.Set("X-RateLimit-Reset", "12")
+	h.Set("Retry-After", now.Add(time.Minute).UTC().Format(http.TimeFormat))
+	info = parseRateLimitHeaders(h, now)
+	if !info.reset.Equal(now.Add(12 * time.Second)) {
+		t.Errorf("relative reset = %v", info.reset)
+	}
+	if info.retryAfter != time.Minute {
+		t.Errorf("HTTP-date retryAfter = %v, want 1m", info.retryAfter)
+	}
+	if info.remaining != -1 {
+		t.Errorf("absent remaining = %d, want -1", info.remaining)
+	}
+}
+
+func TestRateLimiter_PacesAndAdapts(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	l := newRateLimiter(2, time.Minute)
+	l.now = func() time.Time { return now }
+	l.last = now
+
+	// Full bucket: two immediate requests, then one every 30s.
+	for i := 0; i < 2; i++ {
+		if d := l.reserve(0); d != 0 {
+			t.Fatalf("request %d delayed by %v", i, d)
+		}
+	}
+	if d := l.Delay(); d != 30*time.Second {
+		t.Errorf("delay = %v, want 30s", d)
+	}
+
+	// Server raises the limit to 60/min: next token in 1s.
+	if !l.Observe(rateLimitInfo{limit: 60, remaining: -1}) {
+		t.Error("Observe should report a changed limit")
+	}
+	if d := l.Delay(); d != time.Second {
+		t.Errorf("delay after raise = %v, want 1s", d)
+	}
+
+	// Retry-After blocks until the window reopens, then allows one request.
+	l.Observe(rateLimitInfo{remaining: -1, retryAfter: 10 * time.Second})
+	if d := l.Delay(); d != 10*time.Second {
+		t.Errorf("delay after Retry-After = %v, want 10s", d)
+	}
+	now = now.Add(10 * time.Second)
+	if d := l.reserve(0); d != 0 {
+		t.Errorf("request after window reopened delayed by %v", d)
+	}
+}
+
+func TestRateLimiter_WaitKeepLeavesHeadroom(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	l := newRateLimiter(3, time.Minute)
+	l.now = func() time.Time { return now }
+	l.last = now
+
+	// Background work keeping one token back can take two of three.
+	for i := 0; i < 2; i++ {
+		if d := l.reserve(1); d != 0 {
+			t.Fatalf("background request %d delayed by %v", i, d)
+		}
+	}
+	if d := l.reserve(1); d == 0 {
+		t.Error("background request consumed the live reserve")
+	}
+	// The live reserve is still available.
+	if d := l.reserve(0); d != 0 {
+		t.Errorf("live request delayed by %v", d)
+	}
+}
+
+func TestReplay_RetriesAfterRateLimit(t *testing.T) {
+	calls := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls == 1 {
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		w.Header().Set("X-RateLimit-Limit", "100")
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer srv.Close()
+
+	cfg := config.DefaultConfig()
+	cfg.Server.URL = srv.URL
+	cfg.Server.MachineToken = "test"
+	s := newSender(t, cfg, nil)
+
+	start := time.Now()
+	err := s.Replay(context.Background(), models.MetricBatch{Metrics: []models.MetricSnapshot{{CPUOverall: 1}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if calls != 2 {
+		t.Errorf("calls = %d, want 2", calls)
+	}
+	if elapsed := time.Since(start); elapsed < time.Second {
+		t.Errorf("retry did not honour Retry-After (elapsed %v)", elapsed)
+	}
+}
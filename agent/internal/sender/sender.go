@@ -1,24 +1,35 @@
 // Package sender implements the HTTP batch sender with retry logic.
-// It marshals metric batches to JSON, compresses with gzip, and POSTs
-// them to the API ingestion endpoint with exponential backoff on failure.
+// It encodes metric batches in the negotiated wire format (JSON with gzip
+// by default) and POSTs them to the API ingestion endpoint with
+// exponential backoff on failure.
 package sender
 
 import (
 	"bytes"
-	"compress/gzip"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"math"
 	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"go.uber.org/zap"
 
 	"github.com/Guliveer/vitalis/agent/internal/buffer"
+	"github.com/Guliveer/vitalis/agent/internal/command"
 	"github.com/Guliveer/vitalis/agent/internal/config"
+	"github.com/Guliveer/vitalis/agent/internal/credential"
+	"github.com/Guliveer/vitalis/agent/internal/httpclient"
 	"github.com/Guliveer/vitalis/agent/internal/models"
+	"github.com/Guliveer/vitalis/agent/internal/remoteconfig"
+	"github.com/Guliveer/vitalis/agent/internal/signing"
+	"github.com/Guliveer/vitalis/agent/internal/wire"
 )
 
 const (
@@ -31,9 +42,12 @@ const (
 	// requestTimeout is the HTTP request timeout for each send attempt.
 	requestTimeout = 10 * time.Second
 
-	// flushThrottleDelay is the delay between consecutive sends during a buffer flush
-	// to stay under the server's rate limit of 10 requests per minute.
-	flushThrottleDelay = 7 * time.Second
+	// maxResponseSize bounds how much of an ingest response is read.
+	maxResponseSize = 64 * 1024
+
+	// maxLiveWait is the longest a live batch waits for the rate limiter
+	// before it is buffered instead, so collection is not held up.
+	maxLiveWait = 5 * time.Second
 )
 
 // Sender handles batch transmission of metrics to the API with retry logic
@@ -43,185 +57,574 @@ type Sender struct {
 	cfg    *config.Config
 	logger *zap.Logger
 	buf    *buffer.Buffer
+	seq    *sequencer
+	format *negotiator
+	cred   *credential.Store // nil: the machine token from the config
+
+	limiter  *rateLimiter
+	breaker  *breaker
+	flushing atomic.Bool
+	drainCh  chan struct{}
+	queue    sendQueue
+
+	onConfigETag      func(string)
+	onCommandsPending func()
+
+	// group, in failover mode, is the group whose other servers take the
+	// batches this (primary) server does not. Set by NewGroup.
+	group *Group
+
+	serverMu sync.Mutex
+	url      string // the server's base URL; see SetServer
+	token    string // the machine token from the config
 }
 
 // New creates a new Sender with the given configuration, logger, and buffer.
-func New(cfg *config.Config, logger *zap.Logger, buf *buffer.Buffer) *Sender {
-	return &Sender{
-		client: &http.Client{
-			Timeout: requestTimeout,
-		},
-		cfg:    cfg,
-		logger: logger,
-		buf:    buf,
+// It fails if the TLS settings cannot be loaded.
+func New(cfg *config.Config, logger *zap.Logger, buf *buffer.Buffer) (*Sender, error) {
+	client, err := httpclient.New(cfg.Server, requestTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("create http client: %w", err)
+	}
+	preferred := wire.Default
+	if cfg.Server.Encoding == "msgpack" {
+		preferred.ContentType = wire.Msgpack
 	}
+	if cfg.Server.Compression == "zstd" {
+		preferred.ContentEncoding = wire.Zstd
+	}
+	preferred.Delta = cfg.Server.Delta
+
+	return &Sender{
+		client:  client,
+		cfg:     cfg,
+		logger:  logger,
+		buf:     buf,
+		seq:     newSequencer(cfg.Buffer.DBPath, logger),
+		format:  newNegotiator(preferred, cfg.Server.URL, cfg.Server.MachineToken, client, logger),
+		limiter: newRateLimiter(cfg.Server.RateLimit.Requests, cfg.Server.RateLimit.Window.Duration),
+		breaker: newBreaker(cfg.Server.CircuitBreaker.FailureThreshold, cfg.Server.CircuitBreaker.OpenTimeout.Duration,
+			cfg.Server.CircuitBreaker.MaxOpenTimeout.Duration, logger),
+		drainCh: make(chan struct{}, 1),
+		queue:   newSendQueue(cfg.Server.Queue.Size),
+		url:     cfg.Server.URL,
+		token:   cfg.Server.MachineToken,
+	}, nil
+}
+
+// SetServer makes the sender send to url with token (the machine token from
+// the config), e.g. after the config file was reloaded. Requests in flight
+// finish with the old values; buffered batches go to the new server.
+func (s *Sender) SetServer(url, token string) {
+	s.serverMu.Lock()
+	s.url, s.token = url, token
+	s.serverMu.Unlock()
+	s.format.SetServer(url, token)
+}
+
+// server returns the server's base URL and the machine token from the
+// config.
+func (s *Sender) server() (url, token string) {
+	s.serverMu.Lock()
+	defer s.serverMu.Unlock()
+	return s.url, s.token
+}
+
+// SetCredential makes the sender authenticate with the store's token,
+// which is rotated when the server asks for it. Call it before sending.
+func (s *Sender) SetCredential(store *credential.Store) {
+	s.cred = store
+	s.client.Transport = store.Transport(s.client.Transport)
+}
+
+// OnConfigETag sets a callback invoked with the ETag of the machine's
+// config overrides whenever an ingest response reports it (see package
+// remoteconfig). Call it before sending.
+func (s *Sender) OnConfigETag(fn func(string)) {
+	s.onConfigETag = fn
+}
+
+// OnCommandsPending sets a callback invoked whenever an ingest response
+// reports that commands are waiting for the agent (see package command).
+// Call it before sending.
+func (s *Sender) OnCommandsPending(fn func()) {
+	s.onCommandsPending = fn
 }
 
 // Send attempts to send a batch of metrics to the API.
-// On failure after all retries, the batch is buffered locally for later transmission.
-// Returns true if the server responded with a 429 rate limit, allowing callers
-// (e.g., FlushBuffer) to stop sending further batches.
+// The batch is given its batch ID and the next sequence number, which it
+// keeps if it is buffered and replayed later.
+// On failure after all retries, the batch is buffered locally for later
+// transmission. While the circuit breaker is open, it is buffered at once.
+// Returns true if the server responded with a 429 rate limit (or the local
+// rate limiter is closed for longer than maxLiveWait); the batch is then
+// buffered and retried automatically once the rate limit window reopens.
 func (s *Sender) Send(metrics []models.MetricSnapshot) bool {
-	batch := models.MetricBatch{
-		MachineToken: s.cfg.Server.MachineToken,
-		Metrics:      metrics,
+	return s.send(context.Background(), s.newBatch(metrics))
+}
+
+// newBatch wraps snapshots in a batch with its batch ID and the next
+// sequence number.
+func (s *Sender) newBatch(metrics []models.MetricSnapshot) models.MetricBatch {
+	return models.MetricBatch{
+		BatchID:  models.NewBatchID(metrics),
+		Sequence: s.seq.Next(),
+		Metrics:  metrics,
 	}
+}
 
-	data, err := json.Marshal(batch)
-	if err != nil {
-		s.logger.Error("Failed to marshal batch", zap.Error(err))
+// send implements Send for a numbered batch. A batch this server does not
+// take is handed to the other servers in failover mode (see Group), and
+// buffered if none takes it either. If ctx is cancelled, the batch is
+// buffered.
+func (s *Sender) send(ctx context.Context, batch models.MetricBatch) bool {
+	err := s.deliver(ctx, batch)
+	if err == nil {
+		s.logger.Debug("Batch sent successfully", zap.Int("metrics", len(batch.Metrics)))
+		if s.group != nil {
+			s.group.setActive(0)
+		}
 		return false
 	}
 
-	// Compress with gzip
-	var compressed bytes.Buffer
-	gz := gzip.NewWriter(&compressed)
-	if _, err := gz.Write(data); err != nil {
-		s.logger.Error("Failed to compress batch", zap.Error(err))
-		s.bufferBatch(metrics)
+	// Rate limited — buffer and retry once the window reopens
+	if isRateLimited(err) {
+		s.logger.Warn("Rate limited, buffering batch", zap.Error(err))
+		s.bufferBatch(batch)
+		s.requestDrain()
+		return true
+	}
+
+	// Sending a batch the server refused again cannot succeed
+	if isRejected(err) {
+		s.logger.Error("Server rejected batch, dropping it",
+			zap.String("batch_id", batch.BatchID),
+			zap.Int("metrics", len(batch.Metrics)),
+			zap.Error(err))
 		return false
 	}
-	if err := gz.Close(); err != nil {
-		s.logger.Error("Failed to finalize gzip compression", zap.Error(err))
-		s.bufferBatch(metrics)
+
+	if s.group != nil && ctx.Err() == nil && s.group.failover(ctx, batch, true) == nil {
 		return false
 	}
 
-	// Retry loop with exponential backoff
+	// The circuit breaker is open, all retries are exhausted or ctx
+	// ended — buffer locally
+	switch {
+	case errors.Is(err, errCircuitOpen):
+		s.logger.Debug("Server unavailable, buffering batch", zap.Int("metrics", len(batch.Metrics)))
+	case ctx.Err() != nil:
+		s.logger.Warn("Send interrupted, buffering batch")
+	default:
+		s.logger.Error("Failed to send batch, buffering it", zap.Error(err))
+	}
+	s.bufferBatch(batch)
+	return false
+}
+
+// deliver sends a numbered batch, with retries, but never buffers it. A
+// batch the rate limiter would hold up for longer than maxLiveWait is not
+// sent and reported as rate limited.
+func (s *Sender) deliver(ctx context.Context, batch models.MetricBatch) error {
+	if !s.breaker.Closed() {
+		return errCircuitOpen
+	}
+	req, err := s.encode(batch, s.format.Format(ctx))
+	if err != nil {
+		return err
+	}
+	if delay := s.limiter.Delay(); delay > maxLiveWait {
+		return &rateLimitError{retryAfter: delay}
+	}
+	if err := s.limiter.Wait(ctx); err != nil {
+		return err
+	}
+	if err := s.sendWithRetry(ctx, req); err != nil {
+		return err
+	}
+	// The server is reachable — let the drainer catch up on anything
+	// buffered during an earlier outage.
+	s.requestDrain()
+	return nil
+}
+
+// Stats returns the sender's health for the agent's self-metrics.
+func (s *Sender) Stats() models.AgentStats {
+	state, failures := s.breaker.State()
+	stats := models.AgentStats{SenderState: state, SendFailures: failures}
+	if s.buf != nil {
+		stats.BufferedBatches = s.buf.Count()
+	}
+	return stats
+}
+
+// Replay sends a batch without falling back to the local buffer, for callers
+// that track delivery themselves (e.g., the import command). Sends are paced
+// by the rate limiter, and a rate-limited batch is retried once the window
+// reported by the server reopens. Returns the last error if the batch could
+// not be delivered, or ctx.Err() if the context is cancelled while waiting.
+// A batch without a batch ID is given one derived from its snapshots.
+func (s *Sender) Replay(ctx context.Context, batch models.MetricBatch) error {
+	return s.replay(ctx, batch, 0)
+}
+
+// replay implements Replay, leaving keep rate limiter tokens unused so that
+// background replays do not starve live batches.
+func (s *Sender) replay(ctx context.Context, batch models.MetricBatch, keep int) error {
+	// Not even format discovery goes to a server known to be down
+	if !s.breaker.Closed() {
+		return errCircuitOpen
+	}
+	req, err := s.encode(batch, s.format.Format(ctx))
+	if err != nil {
+		return err
+	}
+
+	for {
+		if err := s.limiter.WaitKeep(ctx, keep); err != nil {
+			return err
+		}
+
+		err := s.sendWithRetry(ctx, req)
+		if err == nil || !isRateLimited(err) {
+			return err
+		}
+
+		s.logger.Warn("Rate limited during replay, waiting for the window to reopen",
+			zap.Duration("delay", s.limiter.Delay()))
+	}
+}
+
+// request is an encoded batch ready to be POSTed.
+type request struct {
+	batch   models.MetricBatch
+	format  wire.Format
+	payload []byte
+}
+
+// encode marshals and compresses a batch in the given format. Signed
+// requests, and requests whose token may be rotated, leave the machine token
+// out of the payload.
+func (s *Sender) encode(batch models.MetricBatch, format wire.Format) (*request, error) {
+	batch.MachineToken = ""
+	if s.cfg.Server.SigningSecret == "" && s.cred == nil {
+		_, batch.MachineToken = s.server()
+	}
+	if batch.BatchID == "" {
+		batch.BatchID = models.NewBatchID(batch.Metrics)
+	}
+
+	var body interface{} = batch
+	if format.Delta {
+		body = wire.NewDeltaBatch(batch)
+	}
+	payload, err := wire.Encode(body, format)
+	if err != nil {
+		return nil, fmt.Errorf("encode batch: %w", err)
+	}
+	return &request{batch: batch, format: format, payload: payload}, nil
+}
+
+// sendWithRetry POSTs an encoded batch with exponential backoff.
+// A rate limit response and a client error (see isClientError) are returned
+// immediately without further retries, and errCircuitOpen once the circuit
+// breaker is open. Every attempt is
+// recorded with the breaker.
+func (s *Sender) sendWithRetry(ctx context.Context, req *request) error {
+	var err error
 	for attempt := 0; attempt <= maxRetries; attempt++ {
+		if !s.breaker.Closed() {
+			return errCircuitOpen
+		}
 		if attempt > 0 {
 			delay := time.Duration(math.Pow(2, float64(attempt-1))) * baseRetryDelay
 			s.logger.Warn("Retrying send",
 				zap.Int("attempt", attempt),
 				zap.Duration("delay", delay))
-			time.Sleep(delay)
+			select {
+			case <-time.After(delay):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
 		}
 
-		err := s.doSend(compressed.Bytes())
-		if err == nil {
-			s.logger.Debug("Batch sent successfully", zap.Int("metrics", len(metrics)))
-			return false
+		err = s.doSend(ctx, req)
+		if errors.Is(err, errUnsupportedFormat) && s.format.Reject(req.format) {
+			// The server no longer accepts the negotiated format; send the
+			// batch again as JSON right away.
+			if req, err = s.encode(req.batch, wire.Default); err != nil {
+				return err
+			}
+			err = s.doSend(ctx, req)
 		}
-
-		// Rate limited — buffer immediately without further retries
-		if isRateLimited(err) {
-			s.logger.Warn("Rate limited by server, buffering batch", zap.Error(err))
-			s.bufferBatch(metrics)
-			return true
+		if ctx.Err() == nil {
+			if isServerFailure(err) {
+				s.breaker.Failure()
+			} else {
+				s.breaker.Success()
+			}
+		}
+		if err == nil || isRateLimited(err) || isClientError(err) {
+			return err
 		}
 
-		s.logger.Warn("Send failed",
+		msg := "Send failed"
+		if httpclient.IsProxyError(err) {
+			msg = "Send failed at the proxy"
+		}
+		s.logger.Warn(msg,
 			zap.Int("attempt", attempt),
 			zap.Error(err))
 	}
-
-	// All retries exhausted — buffer locally
-	s.logger.Error("All retries exhausted, buffering batch")
-	s.bufferBatch(metrics)
-	return false
+	return err
 }
 
-// doSend performs a single HTTP POST to the ingest endpoint.
-func (s *Sender) doSend(compressedData []byte) error {
-	url := fmt.Sprintf("%s/api/ingest", s.cfg.Server.URL)
+// doSend performs a single HTTP POST to the ingest endpoint. The batch ID
+// and sequence number are also sent as headers, so the server can spot a
+// retried batch without parsing the body. With a signing secret, every
+// attempt is signed afresh, including replays of buffered batches. A batch
+// the server reports as already ingested counts as delivered.
+func (s *Sender) doSend(ctx context.Context, r *request) error {
+	base, token := s.server()
+	url := fmt.Sprintf("%s/api/ingest", base)
 
 	req, err := http.NewRequestWithContext(
-		context.Background(),
+		ctx,
 		http.MethodPost,
 		url,
-		bytes.NewReader(compressedData),
+		bytes.NewReader(r.payload),
 	)
 	if err != nil {
 		return fmt.Errorf("create request: %w", err)
 	}
 
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Content-Encoding", "gzip")
-	req.Header.Set("Authorization", "Bearer "+s.cfg.Server.MachineToken)
+	req.Header.Set("Content-Type", r.format.ContentType)
+	req.Header.Set("Content-Encoding", r.format.ContentEncoding)
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Idempotency-Key", r.batch.BatchID)
+	if r.batch.Sequence > 0 {
+		req.Header.Set("X-Batch-Seq", strconv.FormatUint(r.batch.Sequence, 10))
+	}
+	if secret := s.cfg.Server.SigningSecret; secret != "" {
+		if err := signing.Sign(req, secret, "/api/ingest", r.payload); err != nil {
+			return fmt.Errorf("sign request: %w", err)
+		}
+	}
 
 	resp, err := s.client.Do(req)
 	if err != nil {
 		return fmt.Errorf("send request: %w", err)
 	}
 	defer resp.Body.Close()
-	io.Copy(io.Discard, resp.Body)
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, maxResponseSize))
+
+	info := parseRateLimitHeaders(resp.Header, time.Now())
+	if resp.StatusCode == http.StatusTooManyRequests && info.retryAfter <= 0 && info.reset.IsZero() {
+		// No hint from the server — assume a full window must pass.
+		info.retryAfter = s.cfg.Server.RateLimit.Window.Duration
+	}
+	if etag := resp.Header.Get(remoteconfig.ETagHeader); etag != "" && s.onConfigETag != nil {
+		s.onConfigETag(etag)
+	}
+	if resp.Header.Get(command.PendingHeader) != "" && s.onCommandsPending != nil {
+		s.onCommandsPending()
+	}
+	if s.limiter.Observe(info) {
+		s.logger.Info("Server rate limit changed",
+			zap.Int("requests", info.limit),
+			zap.Duration("window", s.cfg.Server.RateLimit.Window.Duration))
+	}
 
-	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
-		return nil
+	// Only the explicit duplicate marker means the server has the batch;
+	// any other conflict is a failure like other unexpected statuses.
+	if (resp.StatusCode >= 200 && resp.StatusCode < 300) || resp.StatusCode == http.StatusConflict {
+		if isDuplicate(body) {
+			s.logger.Debug("Server already has batch, treating as delivered",
+				zap.String("batch_id", r.batch.BatchID))
+			return nil
+		}
+		if resp.StatusCode != http.StatusConflict {
+			return nil
+		}
 	}
 
-	if resp.StatusCode == 429 {
-		return &rateLimitError{statusCode: resp.StatusCode}
+	switch resp.StatusCode {
+	case http.StatusTooManyRequests:
+		return &rateLimitError{statusCode: resp.StatusCode, retryAfter: info.retryAfter}
+	case http.StatusUnsupportedMediaType:
+		return errUnsupportedFormat
 	}
 
-	return fmt.Errorf("server returned %d", resp.StatusCode)
+	return &statusError{statusCode: resp.StatusCode}
 }
 
 // bufferBatch stores a failed batch in the local file buffer.
-func (s *Sender) bufferBatch(metrics []models.MetricSnapshot) {
+func (s *Sender) bufferBatch(batch models.MetricBatch) {
 	if s.buf == nil {
 		s.logger.Warn("No buffer available, dropping metrics",
-			zap.Int("count", len(metrics)))
+			zap.Int("count", len(batch.Metrics)))
 		return
 	}
-	if err := s.buf.Store(metrics); err != nil {
+	if err := s.buf.Store(batch); err != nil {
 		s.logger.Error("Failed to buffer metrics", zap.Error(err))
 	}
 }
 
-// FlushBuffer attempts to send all previously buffered metrics.
-// Called on startup to drain any batches that were stored during prior outages.
-// Sends are throttled with a delay between consecutive batches to stay under
-// the server's rate limit. If a 429 is received, the flush stops early.
-func (s *Sender) FlushBuffer() {
-	if s.buf == nil {
-		return
+// FlushBuffer attempts to send all previously buffered metrics, oldest first.
+// Sends are paced by the rate limiter, keeping headroom for live batches; a
+// 429 pauses the flush until the window reopens. Each batch is removed from
+// the buffer only after the server accepted it, so an interrupted flush (the
+// server becoming unreachable, ctx being cancelled, or a crash) leaves the
+// unsent batches in place. A batch the server rejects (see isRejected) is
+// logged and removed. Returns the number of batches delivered.
+func (s *Sender) FlushBuffer(ctx context.Context) int {
+	if s.buf == nil || !s.flushing.CompareAndSwap(false, true) {
+		return 0
 	}
+	defer s.flushing.Store(false)
 
-	batches, err := s.buf.RetrieveAll()
-	if err != nil {
-		s.logger.Error("Failed to retrieve buffered metrics", zap.Error(err))
-		return
+	sent := 0
+	for ctx.Err() == nil {
+		entries, err := s.buf.Peek(1)
+		if err != nil {
+			s.logger.Error("Failed to read buffered metrics", zap.Error(err))
+			break
+		}
+		if len(entries) == 0 {
+			break
+		}
+		entry := entries[0]
+
+		if sent == 0 {
+			s.logger.Info("Flushing buffered metrics", zap.Int("batches", s.buf.Count()))
+		}
+
+		err = s.replay(ctx, entry.Batch, liveReserve)
+		if isRejected(err) {
+			// Left in place, the batch would hold up every batch behind it
+			s.logger.Error("Server rejected buffered batch, removing it from the buffer",
+				zap.String("batch_id", entry.Batch.BatchID),
+				zap.Int("metrics", len(entry.Batch.Metrics)),
+				zap.Error(err))
+			if err := s.buf.Ack(entry.ID); err != nil {
+				s.logger.Error("Failed to remove rejected batch from buffer",
+					zap.String("batch", entry.ID),
+					zap.Error(err))
+				return sent
+			}
+			continue
+		}
+		if err != nil && !isRateLimited(err) && s.group != nil && ctx.Err() == nil {
+			err = s.group.failover(ctx, entry.Batch, false)
+		}
+		if err != nil {
+			s.buf.Nack(entry.ID)
+			s.logger.Warn("Buffer flush interrupted, unsent batches remain buffered",
+				zap.Int("sent", sent),
+				zap.Int("remaining", s.buf.Count()),
+				zap.Error(err))
+			return sent
+		}
+		if err := s.buf.Ack(entry.ID); err != nil {
+			// The batch would be sent again on the next flush.
+			s.logger.Error("Failed to remove flushed batch from buffer",
+				zap.String("batch", entry.ID),
+				zap.Error(err))
+			return sent
+		}
+		sent++
+		s.logger.Debug("Flushed buffered batch", zap.String("batch", entry.ID))
 	}
 
-	if len(batches) == 0 {
-		return
+	if sent > 0 {
+		s.logger.Info("Buffer flush complete", zap.Int("batches", sent))
 	}
+	return sent
+}
 
-	s.logger.Info("Flushing buffered metrics", zap.Int("batches", len(batches)))
+// isDuplicate reports whether an ingest response says the batch had
+// already been ingested.
+func isDuplicate(body []byte) bool {
+	var resp struct {
+		Data struct {
+			Duplicate bool `json:"duplicate"`
+		} `json:"data"`
+	}
+	return json.Unmarshal(body, &resp) == nil && resp.Data.Duplicate
+}
 
-	for i, batch := range batches {
-		// Throttle between consecutive sends to avoid hitting the rate limit
-		if i > 0 {
-			s.logger.Info("Throttling buffer flush",
-				zap.Int("batch", i+1),
-				zap.Int("total", len(batches)),
-				zap.Duration("delay", flushThrottleDelay))
-			time.Sleep(flushThrottleDelay)
-		}
+// errCircuitOpen is returned instead of sending while the circuit breaker
+// is open.
+var errCircuitOpen = errors.New("circuit breaker open, server unavailable")
 
-		rateLimited := s.Send(batch)
-		if rateLimited {
-			remaining := len(batches) - i - 1
-			s.logger.Warn("Rate limited during buffer flush, stopping early",
-				zap.Int("sent", i+1),
-				zap.Int("remaining", remaining))
-			break
-		}
+// statusError is an unexpected HTTP status from the ingest endpoint.
+type statusError struct {
+	statusCode int
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("server returned %d", e.statusCode)
+}
+
+// isServerFailure reports whether err means the server is unreachable or
+// failing (a network error or a 5xx), as opposed to refusing this request.
+func isServerFailure(err error) bool {
+	var status *statusError
+	if errors.As(err, &status) {
+		return status.statusCode >= 500
+	}
+	var netErr *url.Error
+	return errors.As(err, &netErr)
+}
+
+// isClientError reports whether err is a 4xx response that repeating the
+// same request will not change. 408 and 409 (e.g. the machine being
+// updated) are temporary; 429 is a rateLimitError.
+func isClientError(err error) bool {
+	var status *statusError
+	if !errors.As(err, &status) || status.statusCode < 400 || status.statusCode >= 500 {
+		return false
+	}
+	return status.statusCode != http.StatusRequestTimeout && status.statusCode != http.StatusConflict
+}
+
+// isRejected reports whether the server refused the batch itself, e.g. as
+// malformed (400), too large (413) or invalid (422). A client error about
+// the machine's credentials or the endpoint (401, 403, 404) applies to
+// every batch alike, so it is not a rejection of this one.
+func isRejected(err error) bool {
+	if !isClientError(err) {
+		return false
 	}
+	var status *statusError
+	errors.As(err, &status)
+	switch status.statusCode {
+	case http.StatusUnauthorized, http.StatusForbidden, http.StatusNotFound:
+		return false
+	}
+	return true
 }
 
-// rateLimitError indicates the server returned HTTP 429.
+// rateLimitError indicates the server returned HTTP 429, or (with no status
+// code) that the local rate limiter held a live batch back.
 type rateLimitError struct {
 	statusCode int
+	retryAfter time.Duration
 }
 
 func (e *rateLimitError) Error() string {
+	if e.statusCode == 0 {
+		// Held back by the local rate limiter
+		return fmt.Sprintf("rate limit window closed, reopens in %s", e.retryAfter)
+	}
+	if e.retryAfter > 0 {
+		return fmt.Sprintf("rate limited (%d), retry after %s", e.statusCode, e.retryAfter)
+	}
 	return fmt.Sprintf("rate limited (%d)", e.statusCode)
 }
 
 // isRateLimited checks whether an error is a rate limit response.
 func isRateLimited(err error) bool {
-	_, ok := err.(*rateLimitError)
-	return ok
+	var rl *rateLimitError
+	return errors.As(err, &rl)
 }
@@ -0,0 +1,398 @@
+package sender
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/Guliveer/vitalis/agent/internal/buffer"
+	"github.com/Guliveer/vitalis/agent/internal/config"
+	"github.com/Guliveer/vitalis/agent/internal/models"
+	"github.com/Guliveer/vitalis/agent/internal/signing"
+	"github.com/Guliveer/vitalis/agent/internal/wire"
+)
+
+func TestSend_AttachesBatchIDAndSequence(t *testing.T) {
+	type received struct {
+		key, seq string
+		batch    models.MetricBatch
+	}
+	var got []received
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gz, err := gzip.NewReader(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		var batch models.MetricBatch
+		if err := json.NewDecoder(gz).Decode(&batch); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		got = append(got, received{r.Header.Get("Idempotency-Key"), r.Header.Get("X-Batch-Seq"), batch})
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer srv.Close()
+
+	cfg := config.DefaultConfig()
+	cfg.Server.URL = srv.URL
+	cfg.Server.MachineToken = "test"
+	cfg.Buffer.DBPath = t.TempDir()
+
+	metrics := []models.MetricSnapshot{{CPUOverall: 1}}
+	newSender(t, cfg, nil).Send(metrics)
+	newSender(t, cfg, nil).Send(metrics) // a restarted agent
+
+	if len(got) != 2 {
+		t.Fatalf("server received %d batches, want 2", len(got))
+	}
+	first, second := got[0], got[1]
+	if first.batch.BatchID != models.NewBatchID(metrics) || first.key != first.batch.BatchID {
+		t.Errorf("batch ID = %q, header %q; want %q", first.batch.BatchID, first.key, models.NewBatchID(metrics))
+	}
+	if first.batch.Sequence != 1 || first.seq != "1" {
+		t.Errorf("first sequence = %d, header %q; want 1", first.batch.Sequence, first.seq)
+	}
+	// Sequence numbers keep increasing across restarts.
+	if second.batch.Sequence <= first.batch.Sequence {
+		t.Errorf("sequence after restart = %d, want > %d", second.batch.Sequence, first.batch.Sequence)
+	}
+}
+
+func TestReplay_DuplicateCountsAsDelivered(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		status int
+		body   string
+	}{
+		{"duplicate flag", http.StatusOK, `{"success":true,"data":{"inserted":0,"duplicate":true}}`},
+		{"conflict with duplicate flag", http.StatusConflict, `{"success":false,"data":{"duplicate":true}}`},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			calls := 0
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				calls++
+				w.WriteHeader(tc.status)
+				w.Write([]byte(tc.body))
+			}))
+			defer srv.Close()
+
+			cfg := config.DefaultConfig()
+			cfg.Server.URL = srv.URL
+			cfg.Server.MachineToken = "test"
+			s := newSender(t, cfg, nil)
+
+			batch := models.MetricBatch{BatchID: "6f1c2d3e-4a5b-4c6d-8e7f-901234567890", Metrics: []models.MetricSnapshot{{CPUOverall: 1}}}
+			if err := s.Replay(context.Background(), batch); err != nil {
+				t.Fatalf("Replay = %v, want success", err)
+			}
+			if calls != 1 {
+				t.Errorf("calls = %d, want 1 (no retries)", calls)
+			}
+		})
+	}
+}
+
+func TestReplay_ConflictWithoutDuplicateFlagFails(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusConflict)
+		w.Write([]byte(`{"success":false,"error":"Machine is being updated"}`))
+	}))
+	defer srv.Close()
+
+	cfg := config.DefaultConfig()
+	cfg.Server.URL = srv.URL
+	cfg.Server.MachineToken = "test"
+	s := newSender(t, cfg, nil)
+
+	batch := models.MetricBatch{BatchID: "6f1c2d3e-4a5b-4c6d-8e7f-901234567890", Metrics: []models.MetricSnapshot{{CPUOverall: 1}}}
+	var status *statusError
+	if err := s.Replay(context.Background(), batch); !errors.As(err, &status) || status.statusCode != http.StatusConflict {
+		t.Errorf("Replay = %v, want a 409 status error", err)
+	}
+}
+
+func TestSequencer_SkipsReservedBlockAfterRestart(t *testing.T) {
+	dir := t.TempDir()
+	q := newSequencer(dir, zap.NewNop())
+	for i := uint64(1); i <= 3; i++ {
+		if n := q.Next(); n != i {
+			t.Fatalf("Next = %d, want %d", n, i)
+		}
+	}
+
+	// Without a clean shutdown the rest of the reserved block is skipped.
+	if n := newSequencer(dir, zap.NewNop()).Next(); n != 1+sequenceBlock {
+		t.Errorf("Next after restart = %d, want %d", n, 1+sequenceBlock)
+	}
+}
+
+func TestSend_NegotiatesFormat(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		caps       string // GET /api/ingest response; empty for a server without discovery
+		reject     string // content type answered with 415
+		wantFormat []string
+	}{
+		{"advertised", `{"success":true,"data":{"content_types":["application/json","application/msgpack"],"content_encodings":["gzip","zstd"]}}`, "",
+			[]string{"application/msgpack+zstd"}},
+		{"partially advertised", `{"success":true,"data":{"content_types":["application/json","application/msgpack"],"content_encodings":["gzip"]}}`, "",
+			[]string{"application/msgpack+gzip"}},
+		{"no discovery", "", "",
+			[]string{"application/json+gzip"}},
+		{"rejected", `{"success":true,"data":{"content_types":["application/msgpack"],"content_encodings":["zstd"]}}`, "application/msgpack",
+			[]string{"application/msgpack+zstd", "application/json+gzip", "application/json+gzip"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var got []string
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Method == http.MethodGet {
+					if tc.caps == "" {
+						w.WriteHeader(http.StatusMethodNotAllowed)
+						return
+					}
+					w.Write([]byte(tc.caps))
+					return
+				}
+				got = append(got, r.Header.Get("Content-Type")+"+"+r.Header.Get("Content-Encoding"))
+				if r.Header.Get("Content-Type") == tc.reject {
+					w.WriteHeader(http.StatusUnsupportedMediaType)
+					return
+				}
+				w.WriteHeader(http.StatusCreated)
+			}))
+			defer srv.Close()
+
+			cfg := config.DefaultConfig()
+			cfg.Server.URL = srv.URL
+			cfg.Server.MachineToken = "test"
+			cfg.Server.Encoding = "msgpack"
+			cfg.Server.Compression = "zstd"
+			cfg.Buffer.DBPath = t.TempDir()
+			s := newSender(t, cfg, nil)
+
+			// The batch after a rejection is sent as JSON straight away.
+			s.Send([]models.MetricSnapshot{{CPUOverall: 1}})
+			if tc.reject != "" {
+				s.Send([]models.MetricSnapshot{{CPUOverall: 2}})
+			}
+
+			if !slices.Equal(got, tc.wantFormat) {
+				t.Errorf("formats = %v, want %v", got, tc.wantFormat)
+			}
+		})
+	}
+}
+
+func TestSetServer_SendsToNewServer(t *testing.T) {
+	var old, moved atomic.Int32
+	oldSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			w.Write([]byte(`{"success":true,"data":{"content_types":["application/msgpack"],"content_encodings":["zstd"]}}`))
+			return
+		}
+		old.Add(1)
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer oldSrv.Close()
+	var auth, format string
+	newSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			// No discovery: the new server only takes the default format.
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		moved.Add(1)
+		auth, format = r.Header.Get("Authorization"), r.Header.Get("Content-Type")
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer newSrv.Close()
+
+	cfg := config.DefaultConfig()
+	cfg.Server.URL = oldSrv.URL
+	cfg.Server.MachineToken = "test"
+	cfg.Server.Encoding = "msgpack"
+	cfg.Server.Compression = "zstd"
+	cfg.Buffer.DBPath = t.TempDir()
+	s := newSender(t, cfg, nil)
+
+	s.Send([]models.MetricSnapshot{{CPUOverall: 1}})
+	s.SetServer(newSrv.URL, "test-new")
+	s.Send([]models.MetricSnapshot{{CPUOverall: 2}})
+
+	if old.Load() != 1 || moved.Load() != 1 {
+		t.Fatalf("old server got %d batches, new server %d; want 1 each", old.Load(), moved.Load())
+	}
+	if auth != "Bearer test-new" {
+		t.Errorf("Authorization = %q, want the new token", auth)
+	}
+	// The format advertised by the old server is not assumed for the new one.
+	if format != "application/json" {
+		t.Errorf("Content-Type = %q, want application/json", format)
+	}
+}
+
+// roundTripFunc is an http.RoundTripper backed by a function.
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) { return f(r) }
+
+func TestNegotiator_DiscoversOnceWithoutBlocking(t *testing.T) {
+	preferred := wire.Format{ContentType: wire.Msgpack, ContentEncoding: wire.Zstd}
+	var requests atomic.Int32
+	release := make(chan struct{})
+	client := &http.Client{Transport: roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		requests.Add(1)
+		<-release
+		return nil, errors.New("connection refused")
+	})}
+	n := newNegotiator(preferred, "https://example.com", "test", client, zap.NewNop())
+
+	// While one discovery is in flight, other sends get the current format
+	// at once instead of queueing behind it
+	done := make(chan wire.Format)
+	go func() { done <- n.Format(context.Background()) }()
+	for requests.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	if f := n.Format(context.Background()); f != wire.Default {
+		t.Errorf("Format during discovery = %s, want %s", f, wire.Default)
+	}
+	close(release)
+	if f := <-done; f != wire.Default {
+		t.Errorf("Format after failed discovery = %s, want %s", f, wire.Default)
+	}
+
+	// A failed discovery is not retried until the backoff has passed
+	n.Format(context.Background())
+	if got := requests.Load(); got != 1 {
+		t.Errorf("discovery requests = %d, want 1", got)
+	}
+	n.mu.Lock()
+	n.retryAt = time.Now()
+	n.mu.Unlock()
+	n.Format(context.Background())
+	if got := requests.Load(); got != 2 {
+		t.Errorf("discovery requests after the backoff = %d, want 2", got)
+	}
+	if n.backoff != 2*minDiscoveryBackoff {
+		t.Errorf("backoff after two failures = %s, want %s", n.backoff, 2*minDiscoveryBackoff)
+	}
+}
+
+func TestSend_DeltaBatchOnlyWhenAdvertised(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		caps string
+		want string
+	}{
+		{"advertised", `{"success":true,"data":{"content_types":["application/json"],"content_encodings":["gzip"],"batch_formats":["full","delta"]}}`, "delta"},
+		{"not advertised", `{"success":true,"data":{"content_types":["application/json"],"content_encodings":["gzip"]}}`, ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var format *string
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Method == http.MethodGet {
+					w.Write([]byte(tc.caps))
+					return
+				}
+				gz, err := gzip.NewReader(r.Body)
+				if err != nil {
+					w.WriteHeader(http.StatusBadRequest)
+					return
+				}
+				var body struct {
+					Format string `json:"format"`
+				}
+				if err := json.NewDecoder(gz).Decode(&body); err != nil {
+					w.WriteHeader(http.StatusBadRequest)
+					return
+				}
+				format = &body.Format
+				w.WriteHeader(http.StatusCreated)
+			}))
+			defer srv.Close()
+
+			cfg := config.DefaultConfig()
+			cfg.Server.URL = srv.URL
+			cfg.Server.MachineToken = "test"
+			cfg.Server.Delta = true
+			cfg.Buffer.DBPath = t.TempDir()
+			newSender(t, cfg, nil).Send([]models.MetricSnapshot{{CPUOverall: 1}, {CPUOverall: 2}})
+
+			if format == nil || *format != tc.want {
+				t.Errorf("batch format = %v, want %q", format, tc.want)
+			}
+		})
+	}
+}
+
+func TestSend_SignsEveryAttempt(t *testing.T) {
+	const secret = "msecret_0123456789abcdef"
+	var nonces []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		raw, _ := io.ReadAll(r.Body)
+		sum := sha256.Sum256(raw)
+		ts, nonce := r.Header.Get(signing.HeaderTimestamp), r.Header.Get(signing.HeaderNonce)
+		want := signing.Signature(secret, r.Method, "/api/ingest", ts, nonce, hex.EncodeToString(sum[:]))
+		if r.Header.Get(signing.HeaderSignature) != want {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		gz, err := gzip.NewReader(bytes.NewReader(raw))
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		var batch models.MetricBatch
+		if err := json.NewDecoder(gz).Decode(&batch); err != nil || batch.MachineToken != "" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		nonces = append(nonces, nonce)
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer srv.Close()
+
+	cfg := config.DefaultConfig()
+	cfg.Server.URL = srv.URL
+	cfg.Server.MachineToken = "test"
+	cfg.Server.SigningSecret = secret
+	cfg.Buffer.DBPath = t.TempDir()
+	s := newSender(t, cfg, nil)
+
+	metrics := []models.MetricSnapshot{{CPUOverall: 1}}
+	s.Send(metrics)
+	// A buffered batch replayed later is signed again, not with the
+	// headers of its first attempt.
+	if err := s.Replay(context.Background(), models.MetricBatch{Metrics: metrics}); err != nil {
+		t.Fatalf("Replay: %v", err)
+	}
+
+	if len(nonces) != 2 || nonces[0] == nonces[1] {
+		t.Errorf("accepted signed requests with nonces %q, want 2 distinct", nonces)
+	}
+}
+
+// newSender creates a Sender with a no-op logger.
+func newSender(t *testing.T, cfg *config.Config, buf *buffer.Buffer) *Sender {
+	t.Helper()
+	s, err := New(cfg, zap.NewNop(), buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
@@ -0,0 +1,96 @@
+package sender
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"go.uber.org/zap"
+)
+
+const (
+	// sequenceFile holds the sequence number reservation, next to the
+	// buffer so it survives restarts.
+	sequenceFile = "sequence"
+
+	// sequenceBlock is how many sequence numbers are reserved per write of
+	// the sequence file. After a crash the unused rest of a block is
+	// skipped, so numbers always increase but may have gaps.
+	sequenceBlock = 100
+)
+
+// sequencer hands out per-agent batch sequence numbers. The file is read on
+// first use, so senders that only replay existing batches never touch it.
+type sequencer struct {
+	path   string
+	logger *zap.Logger
+
+	mu       sync.Mutex
+	loaded   bool
+	next     uint64
+	reserved uint64 // numbers below this are covered by the file
+}
+
+// newSequencer creates a sequencer persisting to dir.
+func newSequencer(dir string, logger *zap.Logger) *sequencer {
+	return &sequencer{path: filepath.Join(dir, sequenceFile), logger: logger}
+}
+
+// Next returns the next sequence number, starting at 1.
+func (q *sequencer) Next() uint64 {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if !q.loaded {
+		q.loaded = true
+		q.next = 1
+		if data, err := os.ReadFile(q.path); err == nil {
+			n, err := strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+			if err != nil {
+				q.logger.Warn("Failed to parse sequence file, starting over",
+					zap.String("path", q.path), zap.Error(err))
+			} else {
+				q.next = n
+			}
+		}
+		q.reserved = q.next
+	}
+
+	n := q.next
+	q.next++
+	if n >= q.reserved {
+		if err := q.save(n + sequenceBlock); err != nil {
+			// Keep counting in memory; numbers may repeat after a restart.
+			q.logger.Warn("Failed to save sequence file", zap.String("path", q.path), zap.Error(err))
+		}
+		q.reserved = n + sequenceBlock
+	}
+	return n
+}
+
+// save atomically writes the first unreserved sequence number.
+func (q *sequencer) save(reserved uint64) error {
+	if err := os.MkdirAll(filepath.Dir(q.path), 0750); err != nil {
+		return err
+	}
+	tmp := q.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0640)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(f, "%d\n", reserved); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, q.path)
+}
@@ -17,6 +17,10 @@ type Options struct {
 	Mode  string // "system", "user", or "" (interactive)
 	URL   string // Server URL or "" (interactive)
 	Token string // Machine token or "" (interactive)
+
+	// EnrollmentCode is a one-time code the agent exchanges for a machine
+	// token on its first start. Either it or Token is needed.
+	EnrollmentCode string
 }
 
 // Run executes the setup wizard. If all Options are provided, runs non-interactively.
@@ -46,9 +50,17 @@ func Run(version string, opts Options) error {
 	if err != nil {
 		return err
 	}
-	token, err := resolveValue(opts.Token, "Machine token", "", reader)
-	if err != nil {
-		return err
+	token, code := opts.Token, opts.EnrollmentCode
+	if token == "" && code == "" {
+		value, err := resolveValue("", "Enrollment code or machine token", "", reader)
+		if err != nil {
+			return err
+		}
+		if strings.HasPrefix(value, "mtoken_") {
+			token = value
+		} else {
+			code = value
+		}
 	}
 
 	fmt.Println("\nInstalling...")
@@ -71,6 +83,7 @@ func Run(version string, opts Options) error {
 	cfg := config.DefaultConfig()
 	cfg.Server.URL = url
 	cfg.Server.MachineToken = token
+	cfg.Server.EnrollmentCode = code
 	cfg.Buffer.DBPath = paths.DataDir
 	cfg.Logging.File = "" // Use system journal/stdout when running as service
 
@@ -0,0 +1,54 @@
+package signing
+
+import (
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// The same vector is checked by the server's tests (tests/auth/signature.test.ts).
+func TestSignature_KnownVector(t *testing.T) {
+	got := Signature("msecret_test", "post", "/api/ingest", "1771455600", "00112233445566778899aabbccddeeff",
+		"a69e56a23ab5bff43021c11840a51cac0a306b8e77e0eafefcd7e658aae21ffe") // SHA-256 of {"metrics":[]}
+	if want := "6968ce3ff8c3de9b047e7fbc30d1735366dec71e928ec8ec416779cae886707a"; got != want {
+		t.Errorf("Signature = %s, want %s", got, want)
+	}
+}
+
+func TestSign_FreshTimestampAndNonce(t *testing.T) {
+	body := []byte(`{"metrics":[]}`)
+	var nonces []string
+	for i := 0; i < 2; i++ {
+		req, _ := http.NewRequest(http.MethodPost, "https://vitalis.example.com/prefix/api/ingest", nil)
+		if err := Sign(req, "msecret_test", "/api/ingest", body); err != nil {
+			t.Fatal(err)
+		}
+
+		ts := req.Header.Get(HeaderTimestamp)
+		if sec, err := strconv.ParseInt(ts, 10, 64); err != nil || time.Since(time.Unix(sec, 0)).Abs() > time.Minute {
+			t.Errorf("timestamp = %q, want the current Unix time", ts)
+		}
+		nonce := req.Header.Get(HeaderNonce)
+		want := Signature("msecret_test", http.MethodPost, "/api/ingest", ts, nonce,
+			"a69e56a23ab5bff43021c11840a51cac0a306b8e77e0eafefcd7e658aae21ffe")
+		if got := req.Header.Get(HeaderSignature); got != want {
+			t.Errorf("signature = %s, want %s", got, want)
+		}
+		nonces = append(nonces, nonce)
+	}
+	if len(nonces[0]) != 32 || nonces[0] == nonces[1] {
+		t.Errorf("nonces = %q, want two distinct 32-character hex strings", nonces)
+	}
+}
+
+func TestSignStream_DoesNotCoverBody(t *testing.T) {
+	req, _ := http.NewRequest(http.MethodPost, "https://vitalis.example.com/api/stream", nil)
+	if err := SignStream(req, "msecret_test", "/api/stream"); err != nil {
+		t.Fatal(err)
+	}
+	want := Signature("msecret_test", http.MethodPost, "/api/stream", req.Header.Get(HeaderTimestamp), req.Header.Get(HeaderNonce), UnsignedPayload)
+	if got := req.Header.Get(HeaderSignature); got != want {
+		t.Errorf("signature = %s, want %s", got, want)
+	}
+}
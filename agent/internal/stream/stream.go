@@ -0,0 +1,387 @@
+// Package stream implements the live streaming transport. Snapshots are
+// pushed to the server as they are collected over a single long-lived HTTP
+// request whose body is an NDJSON stream; the server acknowledges every
+// snapshot it stored on the response stream. Snapshots that were not
+// acknowledged are left to the regular batch POST, so the batch path and
+// the offline buffer still guarantee delivery when the stream is down.
+package stream
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/Guliveer/vitalis/agent/internal/config"
+	"github.com/Guliveer/vitalis/agent/internal/credential"
+	"github.com/Guliveer/vitalis/agent/internal/httpclient"
+	"github.com/Guliveer/vitalis/agent/internal/models"
+	"github.com/Guliveer/vitalis/agent/internal/signing"
+)
+
+const (
+	// streamPath is the streaming endpoint, relative to the server URL.
+	streamPath = "/api/stream"
+
+	// connectTimeout bounds the wait for the server's first reply. Hosts
+	// that buffer the whole request body never answer a stream.
+	connectTimeout = 10 * time.Second
+
+	// minBackoff is the first reconnection delay.
+	minBackoff = time.Second
+
+	// queueSize is the number of snapshots waiting to be written. Snapshots
+	// pushed while the queue is full go out with the next batch instead.
+	queueSize = 64
+
+	// idleHeartbeats is how many heartbeat intervals may pass without any
+	// reply before the connection is considered dead.
+	idleHeartbeats = 3
+)
+
+// errNotSupported is returned when the server has no streaming endpoint.
+var errNotSupported = errors.New("server does not support streaming")
+
+// message is one line sent to the server.
+type message struct {
+	Type     string                 `json:"type"` // "snapshot" or "heartbeat"
+	Seq      uint64                 `json:"seq,omitempty"`
+	Snapshot *models.MetricSnapshot `json:"snapshot,omitempty"`
+}
+
+// reply is one line received from the server.
+type reply struct {
+	Ready     bool    `json:"ready"`
+	Ack       *uint64 `json:"ack"`
+	Nack      *uint64 `json:"nack"`
+	Heartbeat bool    `json:"heartbeat"`
+	Error     string  `json:"error"`
+}
+
+// Streamer keeps a streaming connection to the server open, reconnecting
+// with exponential backoff, and tracks which snapshots the server has
+// acknowledged.
+type Streamer struct {
+	cfg    config.StreamConfig
+	token  string
+	secret string // signing secret; empty if requests are not signed
+	client *http.Client
+	logger *zap.Logger
+
+	mu      sync.Mutex
+	url     string
+	hangUp  context.CancelFunc         // ends the current session; nil between sessions
+	queue   chan models.MetricSnapshot // nil while disconnected
+	nextSeq uint64
+	sent    map[uint64]int64 // sequence number → snapshot timestamp, awaiting ack
+	acked   map[int64]bool   // acknowledged snapshot timestamps, not yet settled
+}
+
+// New creates a Streamer for the configured server. It fails if the TLS
+// settings cannot be loaded.
+func New(cfg *config.Config, logger *zap.Logger) (*Streamer, error) {
+	// No timeout: the request lives as long as the stream.
+	client, err := httpclient.New(cfg.Server, 0)
+	if err != nil {
+		return nil, fmt.Errorf("create http client: %w", err)
+	}
+	return &Streamer{
+		cfg:    cfg.Server.Stream,
+		url:    cfg.Server.URL,
+		token:  cfg.Server.MachineToken,
+		secret: cfg.Server.SigningSecret,
+		client: client,
+		logger: logger,
+		sent:   make(map[uint64]int64),
+		acked:  make(map[int64]bool),
+	}, nil
+}
+
+// SetCredential makes the streamer authenticate with the store's token,
+// which is rotated when the server asks for it. Call it before Run.
+func (s *Streamer) SetCredential(store *credential.Store) {
+	s.client.Transport = store.Transport(s.client.Transport)
+}
+
+// SetURL points the streamer at another server, e.g. after the config file
+// was reloaded. An open stream to the old server is closed, and the
+// streamer reconnects to the new one.
+func (s *Streamer) SetURL(url string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if url == s.url {
+		return
+	}
+	s.url = url
+	if s.hangUp != nil {
+		s.hangUp()
+	}
+}
+
+// Connected reports whether a stream is currently open.
+func (s *Streamer) Connected() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.queue != nil
+}
+
+// Push queues a snapshot for the stream. It never blocks: while the stream
+// is down or backed up the snapshot is skipped and goes out with the next
+// batch instead.
+func (s *Streamer) Push(snapshot models.MetricSnapshot) {
+	s.mu.Lock()
+	queue := s.queue
+	s.mu.Unlock()
+	if queue == nil {
+		return
+	}
+	select {
+	case queue <- snapshot:
+	default:
+		s.logger.Debug("Stream queue full, snapshot left to the next batch")
+	}
+}
+
+// Settle returns the snapshots of a batch the server has not acknowledged
+// over the stream, which still have to be sent with the batch POST.
+// Acknowledgements arriving for these snapshots afterwards are ignored.
+func (s *Streamer) Settle(batch []models.MetricSnapshot) []models.MetricSnapshot {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var newest int64
+	rest := make([]models.MetricSnapshot, 0, len(batch))
+	for _, m := range batch {
+		ts := m.Timestamp.UnixNano()
+		if ts > newest {
+			newest = ts
+		}
+		if s.acked[ts] {
+			continue
+		}
+		rest = append(rest, m)
+	}
+
+	// Everything up to the newest snapshot of the batch is settled now.
+	for ts := range s.acked {
+		if ts <= newest {
+			delete(s.acked, ts)
+		}
+	}
+	for seq, ts := range s.sent {
+		if ts <= newest {
+			delete(s.sent, seq)
+		}
+	}
+	return rest
+}
+
+// Run keeps the stream connected until ctx is cancelled, reconnecting with
+// exponential backoff (up to max_backoff) whenever it drops.
+func (s *Streamer) Run(ctx context.Context) {
+	backoff := minBackoff
+	for {
+		start := time.Now()
+		err := s.session(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+
+		// A connection that stayed up for a while was healthy; start over.
+		if time.Since(start) > s.cfg.MaxBackoff.Duration {
+			backoff = minBackoff
+		}
+		delay := backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+		if errors.Is(err, errNotSupported) {
+			delay = s.cfg.MaxBackoff.Duration
+		}
+		s.logger.Warn("Stream disconnected, falling back to batch sends",
+			zap.Error(err),
+			zap.Duration("reconnect_in", delay))
+
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return
+		}
+		if backoff *= 2; backoff > s.cfg.MaxBackoff.Duration {
+			backoff = s.cfg.MaxBackoff.Duration
+		}
+	}
+}
+
+// session runs a single streaming connection until it fails or ctx is
+// cancelled.
+func (s *Streamer) session(parent context.Context) error {
+	ctx, cancel := context.WithCancel(parent)
+	defer cancel()
+	s.mu.Lock()
+	url := s.url
+	s.hangUp = cancel
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		s.hangUp = nil
+		s.mu.Unlock()
+	}()
+
+	pr, pw := io.Pipe()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url+streamPath, pr)
+	if err != nil {
+		return fmt.Errorf("create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	req.Header.Set("Authorization", "Bearer "+s.token)
+	if s.secret != "" {
+		if err := signing.SignStream(req, s.secret, streamPath); err != nil {
+			return fmt.Errorf("sign request: %w", err)
+		}
+	}
+
+	queue := make(chan models.MetricSnapshot, queueSize)
+	writeErr := make(chan error, 1)
+	go func() { writeErr <- s.writeLoop(ctx, pw, queue) }()
+	defer func() {
+		cancel()
+		pr.Close()
+		<-writeErr
+	}()
+
+	handshake := time.AfterFunc(connectTimeout, cancel)
+	defer handshake.Stop()
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("connect: %w", err)
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusMethodNotAllowed:
+		return errNotSupported
+	case resp.StatusCode != http.StatusOK:
+		return fmt.Errorf("server returned %d", resp.StatusCode)
+	}
+
+	scanner := bufio.NewScanner(resp.Body)
+	var r reply
+	if !scanner.Scan() || json.Unmarshal(scanner.Bytes(), &r) != nil || !r.Ready {
+		return fmt.Errorf("no ready message from server: %w", errOr(scanner.Err(), io.ErrUnexpectedEOF))
+	}
+	handshake.Stop()
+
+	s.attach(queue)
+	defer s.detach()
+	s.logger.Info("Stream connected", zap.String("server", url))
+
+	idle := idleHeartbeats * s.cfg.Heartbeat.Duration
+	watchdog := time.AfterFunc(idle, cancel)
+	defer watchdog.Stop()
+
+	for scanner.Scan() {
+		watchdog.Reset(idle)
+
+		var r reply
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			s.logger.Warn("Invalid stream reply", zap.Error(err))
+			continue
+		}
+		switch {
+		case r.Ack != nil:
+			s.ack(*r.Ack)
+		case r.Nack != nil:
+			s.logger.Warn("Server rejected streamed snapshot, leaving it to the next batch",
+				zap.Uint64("seq", *r.Nack),
+				zap.String("error", r.Error))
+		case r.Error != "":
+			s.logger.Warn("Stream error from server", zap.String("error", r.Error))
+		}
+	}
+	if parent.Err() != nil {
+		return parent.Err()
+	}
+	return errOr(scanner.Err(), errors.New("server closed the stream"))
+}
+
+// writeLoop writes queued snapshots and periodic heartbeats to the request
+// body until ctx is cancelled or a write fails.
+func (s *Streamer) writeLoop(ctx context.Context, w *io.PipeWriter, queue <-chan models.MetricSnapshot) error {
+	defer w.Close()
+	enc := json.NewEncoder(w)
+
+	// Start the body right away so the request reaches the server.
+	if err := enc.Encode(message{Type: "heartbeat"}); err != nil {
+		return err
+	}
+
+	heartbeat := time.NewTicker(s.cfg.Heartbeat.Duration)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case snapshot := <-queue:
+			seq := s.track(snapshot)
+			if err := enc.Encode(message{Type: "snapshot", Seq: seq, Snapshot: &snapshot}); err != nil {
+				return err
+			}
+			heartbeat.Reset(s.cfg.Heartbeat.Duration)
+		case <-heartbeat.C:
+			if err := enc.Encode(message{Type: "heartbeat"}); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// attach makes queue the destination of Push.
+func (s *Streamer) attach(queue chan models.MetricSnapshot) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.queue = queue
+}
+
+// detach stops accepting snapshots. Snapshots still awaiting an ack are
+// forgotten, so they are sent with the next batch.
+func (s *Streamer) detach() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.queue = nil
+	s.sent = make(map[uint64]int64)
+}
+
+// track assigns the next sequence number to a snapshot being written.
+func (s *Streamer) track(snapshot models.MetricSnapshot) uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.nextSeq++
+	s.sent[s.nextSeq] = snapshot.Timestamp.UnixNano()
+	return s.nextSeq
+}
+
+// ack records the server's acknowledgement of a streamed snapshot.
+func (s *Streamer) ack(seq uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if ts, ok := s.sent[seq]; ok {
+		delete(s.sent, seq)
+		s.acked[ts] = true
+	}
+}
+
+// errOr returns err, or fallback if err is nil.
+func errOr(err, fallback error) error {
+	if err != nil {
+		return err
+	}
+	return fallback
+}
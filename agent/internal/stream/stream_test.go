@@ -0,0 +1,189 @@
+package stream
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/Guliveer/vitalis/agent/internal/config"
+	"github.com/Guliveer/vitalis/agent/internal/models"
+)
+
+// fakeServer implements the streaming endpoint, acknowledging every
+// snapshot except those with the given CPU value.
+func fakeServer(t *testing.T, reject float64) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != streamPath || r.Header.Get("Authorization") != "Bearer test" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		rc := http.NewResponseController(w)
+		if err := rc.EnableFullDuplex(); err != nil {
+			t.Error(err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		fmt.Fprintln(w, `{"ready":true}`)
+		rc.Flush()
+
+		scanner := bufio.NewScanner(r.Body)
+		for scanner.Scan() {
+			var m message
+			if err := json.Unmarshal(scanner.Bytes(), &m); err != nil {
+				t.Errorf("invalid line %q", scanner.Text())
+				return
+			}
+			switch {
+			case m.Type == "heartbeat":
+				fmt.Fprintln(w, `{"heartbeat":true}`)
+			case m.Snapshot.CPUOverall == reject:
+				fmt.Fprintf(w, `{"nack":%d,"error":"Invalid snapshot"}`+"\n", m.Seq)
+			default:
+				fmt.Fprintf(w, `{"ack":%d}`+"\n", m.Seq)
+			}
+			rc.Flush()
+		}
+	}))
+}
+
+// newHTTP2Server starts a TLS test server speaking HTTP/2, where a handler
+// returning ends the stream (an HTTP/1 test server would instead wait for
+// the never-ending request body).
+func newHTTP2Server(h http.Handler) *httptest.Server {
+	srv := httptest.NewUnstartedServer(h)
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	return srv
+}
+
+func newTestStreamer(url string) *Streamer {
+	cfg := config.DefaultConfig()
+	cfg.Server.URL = url
+	cfg.Server.MachineToken = "test"
+	cfg.Server.Stream.Enabled = true
+	cfg.Server.Stream.MaxBackoff = config.Duration{Duration: 2 * time.Second}
+	s, err := New(cfg, zap.NewNop())
+	if err != nil {
+		panic(err)
+	}
+	return s
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func snapshotAt(sec int64, cpu float64) models.MetricSnapshot {
+	return models.MetricSnapshot{Timestamp: time.Unix(1700000000+sec, 0).UTC(), CPUOverall: cpu}
+}
+
+func TestStreamer_SettleLeavesUnacknowledgedSnapshots(t *testing.T) {
+	srv := fakeServer(t, 99)
+	defer srv.Close()
+
+	s := newTestStreamer(srv.URL)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.Run(ctx)
+	waitFor(t, "stream to connect", s.Connected)
+
+	batch := []models.MetricSnapshot{snapshotAt(0, 1), snapshotAt(1, 99), snapshotAt(2, 3)}
+	for _, m := range batch {
+		s.Push(m)
+	}
+	waitFor(t, "acks", func() bool {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return len(s.acked) == 2
+	})
+
+	// The rejected snapshot and one collected while disconnected go with the batch.
+	batch = append(batch, snapshotAt(3, 4))
+	rest := s.Settle(batch)
+	if len(rest) != 2 || rest[0].CPUOverall != 99 || rest[1].CPUOverall != 4 {
+		t.Errorf("Settle = %+v, want the rejected and the unstreamed snapshot", rest)
+	}
+}
+
+func TestStreamer_FallsBackWhenUnsupported(t *testing.T) {
+	srv := newHTTP2Server(http.NotFoundHandler())
+	defer srv.Close()
+
+	s := newTestStreamer(srv.URL)
+	s.client = srv.Client()
+	if err := s.session(context.Background()); err != errNotSupported {
+		t.Fatalf("session = %v, want errNotSupported", err)
+	}
+
+	// Without a stream, pushes are dropped and the whole batch is left to
+	// the batch POST.
+	batch := []models.MetricSnapshot{snapshotAt(0, 1), snapshotAt(1, 2)}
+	for _, m := range batch {
+		s.Push(m)
+	}
+	if rest := s.Settle(batch); len(rest) != len(batch) {
+		t.Errorf("Settle = %d snapshots, want %d", len(rest), len(batch))
+	}
+}
+
+func TestStreamer_ReconnectsAfterServerCloses(t *testing.T) {
+	connects := make(chan struct{}, 10)
+	srv := newHTTP2Server(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		connects <- struct{}{}
+		fmt.Fprintln(w, `{"ready":true}`)
+		// End the stream immediately, as the server does at its deadline.
+	}))
+	defer srv.Close()
+
+	s := newTestStreamer(srv.URL)
+	s.client = srv.Client()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.Run(ctx)
+
+	for i := 0; i < 2; i++ {
+		select {
+		case <-connects:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("connection %d not attempted", i+1)
+		}
+	}
+}
+
+func TestStreamer_SetURLReconnects(t *testing.T) {
+	// Only the new server acknowledges snapshots with CPU 7.
+	old, moved := fakeServer(t, 7), fakeServer(t, 99)
+	defer old.Close()
+	defer moved.Close()
+
+	s := newTestStreamer(old.URL)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.Run(ctx)
+	waitFor(t, "stream to connect", s.Connected)
+
+	s.SetURL(moved.URL)
+	var sec int64
+	waitFor(t, "an ack from the new server", func() bool {
+		sec++
+		s.Push(snapshotAt(sec, 7))
+		time.Sleep(20 * time.Millisecond)
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return len(s.acked) > 0
+	})
+}
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"os"
 	"os/exec"
+	"syscall"
 
 	"go.uber.org/zap"
 )
@@ -80,3 +81,40 @@ func (u *Updater) restartService() error {
 
 	return fmt.Errorf("no supported service manager found")
 }
+
+func (u *Updater) requestRestart() error {
+	// systemd queues the restart and returns at once with --no-block.
+	if _, err := exec.LookPath("systemctl"); err == nil {
+		u.logger.Info("requesting restart via systemctl")
+		out, err := exec.Command("systemctl", "--no-block", "restart", "vitalis-agent").CombinedOutput()
+		if err != nil {
+			u.logger.Debug("system service restart failed, trying user service", zap.Error(err), zap.ByteString("output", out))
+			out, err = exec.Command("systemctl", "--user", "--no-block", "restart", "vitalis-agent").CombinedOutput()
+			if err != nil {
+				return fmt.Errorf("systemctl restart failed: %w: %s", err, out)
+			}
+		}
+		return nil
+	}
+
+	// launchctl kickstart -k kills the agent before it returns, so find the
+	// job first and kick it from a separate process a moment later.
+	if _, err := exec.LookPath("launchctl"); err == nil {
+		u.logger.Info("requesting restart via launchctl")
+		target := "system/com.vitalis.agent"
+		if err := exec.Command("launchctl", "print", target).Run(); err != nil {
+			target = fmt.Sprintf("gui/%d/com.vitalis.agent", os.Getuid())
+			if err := exec.Command("launchctl", "print", target).Run(); err != nil {
+				return fmt.Errorf("launchd job not found: %w", err)
+			}
+		}
+		cmd := exec.Command("/bin/sh", "-c", "sleep 2; exec launchctl kickstart -k "+target)
+		cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+		if err := cmd.Start(); err != nil {
+			return fmt.Errorf("launchctl restart failed: %w", err)
+		}
+		return cmd.Process.Release()
+	}
+
+	return fmt.Errorf("no supported service manager found")
+}
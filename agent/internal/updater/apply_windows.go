@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"os"
 	"os/exec"
+	"syscall"
 	"time"
 
 	"go.uber.org/zap"
@@ -95,3 +96,31 @@ func (u *Updater) restartScheduledTask() error {
 
 	return nil
 }
+
+func (u *Updater) requestRestart() error {
+	serviceName := "VitalisAgent"
+	taskName := "VitalisAgent"
+
+	// Stopping the service ends the agent, so the stop and start run from a
+	// detached process once the service manager knows the service (or the
+	// task scheduler the task).
+	var script string
+	if err := exec.Command("sc", "query", serviceName).Run(); err == nil {
+		script = fmt.Sprintf("ping -n 3 127.0.0.1 >nul & sc stop %[1]s & ping -n 6 127.0.0.1 >nul & sc start %[1]s", serviceName)
+	} else if err := exec.Command("schtasks", "/Query", "/TN", taskName).Run(); err == nil {
+		script = fmt.Sprintf("ping -n 3 127.0.0.1 >nul & schtasks /End /TN %[1]s & ping -n 3 127.0.0.1 >nul & schtasks /Run /TN %[1]s", taskName)
+	} else {
+		return fmt.Errorf("no Windows service or scheduled task named %s found", serviceName)
+	}
+
+	u.logger.Info("requesting restart", zap.String("service", serviceName))
+	cmd := exec.Command("cmd", "/C", script)
+	cmd.SysProcAttr = &syscall.SysProcAttr{CreationFlags: detachedProcess | syscall.CREATE_NEW_PROCESS_GROUP}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("start restart: %w", err)
+	}
+	return cmd.Process.Release()
+}
+
+// detachedProcess is the DETACHED_PROCESS process creation flag.
+const detachedProcess = 0x00000008
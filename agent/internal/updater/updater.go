@@ -25,6 +25,9 @@ import (
 type Config struct {
 	Enabled       bool          `yaml:"enabled"`
 	CheckInterval time.Duration `yaml:"check_interval"`
+	// HTTPClient is used for all requests if set; by default a plain
+	// client with a 60s timeout.
+	HTTPClient *http.Client `yaml:"-"`
 }
 
 // DefaultConfig returns the default update configuration.
@@ -57,7 +60,11 @@ type Updater struct {
 	repoOwner      string
 	repoName       string
 
-	mu      sync.Mutex
+	mu sync.Mutex // guards config and httpClient, and is held during a check
+
+	// runMu guards the running loop's cancel and stopped. It is separate
+	// from mu so that Stop need not wait for a check in progress.
+	runMu   sync.Mutex
 	cancel  context.CancelFunc
 	stopped chan struct{}
 }
@@ -70,22 +77,30 @@ const (
 
 // New creates a new Updater instance.
 func New(currentVersion string, cfg Config, logger *zap.Logger) *Updater {
+	client := cfg.HTTPClient
+	if client == nil {
+		client = &http.Client{
+			Timeout: 60 * time.Second,
+		}
+	}
 	return &Updater{
 		currentVersion: currentVersion,
 		config:         cfg,
 		logger:         logger.Named("updater"),
-		httpClient: &http.Client{
-			Timeout: 60 * time.Second,
-		},
-		repoOwner: "vitalis-app",
-		repoName:  "vitalis",
-		stopped:   make(chan struct{}),
+		httpClient:     client,
+		repoOwner:      "vitalis-app",
+		repoName:       "vitalis",
 	}
 }
 
-// Start begins the periodic update check loop.
+// Start begins the periodic update check loop. It does nothing if the loop
+// is already running.
 func (u *Updater) Start(ctx context.Context) {
-	if !u.config.Enabled {
+	u.mu.Lock()
+	cfg := u.config
+	u.mu.Unlock()
+
+	if !cfg.Enabled {
 		u.logger.Info("auto-update is disabled")
 		return
 	}
@@ -95,25 +110,36 @@ func (u *Updater) Start(ctx context.Context) {
 		return
 	}
 
+	u.runMu.Lock()
+	defer u.runMu.Unlock()
+	if u.cancel != nil {
+		return
+	}
 	ctx, u.cancel = context.WithCancel(ctx)
+	u.stopped = make(chan struct{})
 
-	go u.loop(ctx)
+	go u.loop(ctx, cfg.CheckInterval, u.stopped)
 	u.logger.Info("auto-update started",
 		zap.String("current_version", u.currentVersion),
-		zap.Duration("check_interval", u.config.CheckInterval),
+		zap.Duration("check_interval", cfg.CheckInterval),
 	)
 }
 
 // Stop gracefully stops the update loop.
 func (u *Updater) Stop() {
-	if u.cancel != nil {
-		u.cancel()
-		<-u.stopped
+	u.runMu.Lock()
+	cancel, stopped := u.cancel, u.stopped
+	u.cancel, u.stopped = nil, nil
+	u.runMu.Unlock()
+
+	if cancel != nil {
+		cancel()
+		<-stopped
 	}
 }
 
-func (u *Updater) loop(ctx context.Context) {
-	defer close(u.stopped)
+func (u *Updater) loop(ctx context.Context, interval time.Duration, stopped chan struct{}) {
+	defer close(stopped)
 
 	// Initial delay to let the agent fully start.
 	select {
@@ -122,7 +148,7 @@ func (u *Updater) loop(ctx context.Context) {
 		return
 	}
 
-	ticker := time.NewTicker(u.config.CheckInterval)
+	ticker := time.NewTicker(interval)
 	defer ticker.Stop()
 
 	// Check immediately after the initial delay, then on interval.
@@ -139,6 +165,51 @@ func (u *Updater) loop(ctx context.Context) {
 }
 
 func (u *Updater) checkAndUpdate(ctx context.Context) {
+	if _, err := u.check(ctx); err != nil {
+		u.logger.Warn("update check failed", zap.Error(err))
+	}
+}
+
+// CheckNow checks for a new release at once, outside the check interval,
+// and installs it if there is one. It returns what it did. Auto-update must
+// be enabled; dev builds are never updated.
+func (u *Updater) CheckNow(ctx context.Context) (string, error) {
+	u.mu.Lock()
+	enabled := u.config.Enabled
+	u.mu.Unlock()
+	if !enabled {
+		return "", fmt.Errorf("auto-update is disabled")
+	}
+	if u.currentVersion == "dev" {
+		return "", fmt.Errorf("dev builds are not updated")
+	}
+	return u.check(ctx)
+}
+
+// Reconfigure stops the update loop and starts it again with cfg, e.g.
+// after the config file was reloaded. The HTTP client is kept unless cfg
+// sets one.
+func (u *Updater) Reconfigure(ctx context.Context, cfg Config) {
+	u.Stop()
+	u.mu.Lock()
+	if cfg.HTTPClient != nil {
+		u.httpClient = cfg.HTTPClient
+	}
+	u.config = cfg
+	u.mu.Unlock()
+	u.Start(ctx)
+}
+
+// RequestRestart asks the service manager the agent was installed with to
+// restart it, and returns once the service manager has accepted the
+// request. The restart itself follows shortly after, so the caller can
+// still report that it is coming.
+func (u *Updater) RequestRestart() error {
+	return u.requestRestart()
+}
+
+// check looks for a new release and installs it.
+func (u *Updater) check(ctx context.Context) (string, error) {
 	u.mu.Lock()
 	defer u.mu.Unlock()
 
@@ -146,8 +217,7 @@ func (u *Updater) checkAndUpdate(ctx context.Context) {
 
 	release, err := u.fetchLatestRelease(ctx)
 	if err != nil {
-		u.logger.Warn("failed to check for updates", zap.Error(err))
-		return
+		return "", fmt.Errorf("check for updates: %w", err)
 	}
 
 	if !isNewer(release.TagName, u.currentVersion) {
@@ -155,7 +225,7 @@ func (u *Updater) checkAndUpdate(ctx context.Context) {
 			zap.String("current", u.currentVersion),
 			zap.String("latest", release.TagName),
 		)
-		return
+		return fmt.Sprintf("already up to date (%s)", u.currentVersion), nil
 	}
 
 	u.logger.Info("new version available",
@@ -164,9 +234,9 @@ func (u *Updater) checkAndUpdate(ctx context.Context) {
 	)
 
 	if err := u.performUpdate(ctx, release); err != nil {
-		u.logger.Error("update failed", zap.Error(err))
-		return
+		return "", fmt.Errorf("update to %s: %w", release.TagName, err)
 	}
+	return fmt.Sprintf("updated from %s to %s", u.currentVersion, release.TagName), nil
 }
 
 func (u *Updater) fetchLatestRelease(ctx context.Context) (*githubRelease, error) {
@@ -1,7 +1,12 @@
 package updater
 
 import (
+	"context"
+	"sync"
 	"testing"
+	"time"
+
+	"go.uber.org/zap"
 )
 
 func TestIsNewer(t *testing.T) {
@@ -93,3 +98,37 @@ func TestDefaultConfig(t *testing.T) {
 		t.Errorf("default check interval should be 1h, got %v", cfg.CheckInterval)
 	}
 }
+
+func TestReconfigure_ConcurrentWithStop(t *testing.T) {
+	u := New("1.0.0", Config{Enabled: true, CheckInterval: time.Hour}, zap.NewNop())
+	ctx := context.Background()
+	u.Start(ctx)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			u.Reconfigure(ctx, Config{Enabled: true, CheckInterval: time.Hour})
+		}()
+		go func() {
+			defer wg.Done()
+			u.Stop()
+		}()
+	}
+	wg.Wait()
+
+	u.Reconfigure(ctx, Config{Enabled: true, CheckInterval: 2 * time.Hour})
+	u.runMu.Lock()
+	running := u.cancel != nil
+	u.runMu.Unlock()
+	if !running {
+		t.Error("loop not running after Reconfigure")
+	}
+
+	u.Stop()
+	u.Stop() // stopping twice is fine
+	if u.cancel != nil || u.stopped != nil {
+		t.Error("Stop left the loop's state behind")
+	}
+}
@@ -0,0 +1,117 @@
+package wire
+
+import (
+	"slices"
+
+	"github.com/Guliveer/vitalis/agent/internal/models"
+)
+
+// DeltaFormat is the batch format name of delta batches.
+const DeltaFormat = "delta"
+
+// DeltaBatch is a MetricBatch whose first snapshot is sent in full and
+// every later one as a frame holding only what changed. The server rebuilds
+// snapshot i from snapshot i-1 and frame i:
+//
+//   - a field missing from the frame has the previous snapshot's value;
+//   - timestamp, ram_used and uptime_seconds hold the difference from the
+//     previous value (for timestamp, in nanoseconds);
+//   - any other field present holds its new value.
+//
+// Host-level fields such as os_name, ram_total and disk_usage are therefore
+// sent once per batch, and again only when they change.
+type DeltaBatch struct {
+	MachineToken string        `json:"machine_token,omitempty"`
+	BatchID      string        `json:"batch_id,omitempty"`
+	Sequence     uint64        `json:"sequence,omitempty"`
+	Format       string        `json:"format"`
+	Metrics      []interface{} `json:"metrics"` // the first snapshot, then frames
+}
+
+// NewDeltaBatch delta-encodes a batch.
+func NewDeltaBatch(batch models.MetricBatch) DeltaBatch {
+	d := DeltaBatch{
+		MachineToken: batch.MachineToken,
+		BatchID:      batch.BatchID,
+		Sequence:     batch.Sequence,
+		Format:       DeltaFormat,
+		Metrics:      make([]interface{}, len(batch.Metrics)),
+	}
+	for i := range batch.Metrics {
+		if i == 0 {
+			d.Metrics[i] = batch.Metrics[i]
+			continue
+		}
+		d.Metrics[i] = deltaFrame(&batch.Metrics[i-1], &batch.Metrics[i])
+	}
+	return d
+}
+
+// deltaFrame holds the fields of cur that differ from prev.
+func deltaFrame(prev, cur *models.MetricSnapshot) map[string]interface{} {
+	f := make(map[string]interface{})
+
+	// Differences; uint64 subtraction wraps, so a decrease comes out negative.
+	if d := cur.Timestamp.Sub(prev.Timestamp).Nanoseconds(); d != 0 {
+		f["timestamp"] = d
+	}
+	if d := int64(cur.RAMUsed - prev.RAMUsed); d != 0 {
+		f["ram_used"] = d
+	}
+	if d := cur.UptimeSeconds - prev.UptimeSeconds; d != 0 {
+		f["uptime_seconds"] = d
+	}
+
+	// New values of changed fields.
+	if cur.CPUOverall != prev.CPUOverall {
+		f["cpu_overall"] = cur.CPUOverall
+	}
+	if !sameSlice(cur.CPUCores, prev.CPUCores) {
+		f["cpu_cores"] = cur.CPUCores
+	}
+	if cur.RAMTotal != prev.RAMTotal {
+		f["ram_total"] = cur.RAMTotal
+	}
+	if !sameSlice(cur.DiskUsage, prev.DiskUsage) {
+		f["disk_usage"] = cur.DiskUsage
+	}
+	if cur.NetworkRx != prev.NetworkRx {
+		f["network_rx"] = cur.NetworkRx
+	}
+	if cur.NetworkTx != prev.NetworkTx {
+		f["network_tx"] = cur.NetworkTx
+	}
+	if !samePointer(cur.CPUTemp, prev.CPUTemp) {
+		f["cpu_temp"] = cur.CPUTemp
+	}
+	if !samePointer(cur.GPUTemp, prev.GPUTemp) {
+		f["gpu_temp"] = cur.GPUTemp
+	}
+	if !sameSlice(cur.Processes, prev.Processes) {
+		f["processes"] = cur.Processes
+	}
+	if cur.OSVersion != prev.OSVersion {
+		f["os_version"] = cur.OSVersion
+	}
+	if cur.OSName != prev.OSName {
+		f["os_name"] = cur.OSName
+	}
+	if (cur.Agent == nil) != (prev.Agent == nil) || (cur.Agent != nil && *cur.Agent != *prev.Agent) {
+		f["agent"] = cur.Agent
+	}
+	return f
+}
+
+// sameSlice reports whether a and b have equal elements and encode the same
+// way (a nil slice is null, an empty one []).
+func sameSlice[T comparable](a, b []T) bool {
+	return (a == nil) == (b == nil) && slices.Equal(a, b)
+}
+
+// samePointer reports whether a and b are both nil or point to equal values.
+func samePointer(a, b *float64) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
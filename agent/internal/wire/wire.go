@@ -0,0 +1,90 @@
+// Package wire encodes ingest payloads for the wire: JSON or MessagePack,
+// compressed with gzip or zstd. The agent picks a format the server
+// advertises and falls back to JSON with gzip, which every server accepts.
+package wire
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Content types.
+const (
+	JSON    = "application/json"
+	Msgpack = "application/msgpack"
+)
+
+// Content encodings.
+const (
+	Gzip = "gzip"
+	Zstd = "zstd"
+)
+
+// zstdEncoder is shared by all payloads; EncodeAll is safe for concurrent use.
+var zstdEncoder = sync.OnceValues(func() (*zstd.Encoder, error) {
+	return zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+})
+
+// Format is a content type and content encoding pair, and whether batches
+// are delta-encoded (see DeltaBatch).
+type Format struct {
+	ContentType     string
+	ContentEncoding string
+	Delta           bool
+}
+
+// Default is the format every server accepts.
+var Default = Format{ContentType: JSON, ContentEncoding: Gzip}
+
+// String returns the format as "type+encoding", e.g. "application/json+gzip",
+// with "+delta" appended for delta batches.
+func (f Format) String() string {
+	if f.Delta {
+		return f.ContentType + "+" + f.ContentEncoding + "+" + DeltaFormat
+	}
+	return f.ContentType + "+" + f.ContentEncoding
+}
+
+// Encode marshals v in the format's content type and compresses it with
+// the format's content encoding.
+func Encode(v interface{}, f Format) ([]byte, error) {
+	var data []byte
+	var err error
+	switch f.ContentType {
+	case JSON:
+		data, err = json.Marshal(v)
+	case Msgpack:
+		data, err = MarshalMsgpack(v)
+	default:
+		return nil, fmt.Errorf("unsupported content type %q", f.ContentType)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("marshal payload: %w", err)
+	}
+
+	var compressed bytes.Buffer
+	switch f.ContentEncoding {
+	case Gzip:
+		gz := gzip.NewWriter(&compressed)
+		if _, err := gz.Write(data); err != nil {
+			return nil, fmt.Errorf("compress payload: %w", err)
+		}
+		if err := gz.Close(); err != nil {
+			return nil, fmt.Errorf("finalize gzip compression: %w", err)
+		}
+	case Zstd:
+		enc, err := zstdEncoder()
+		if err != nil {
+			return nil, fmt.Errorf("create zstd encoder: %w", err)
+		}
+		return enc.EncodeAll(data, nil), nil
+	default:
+		return nil, fmt.Errorf("unsupported content encoding %q", f.ContentEncoding)
+	}
+	return compressed.Bytes(), nil
+}
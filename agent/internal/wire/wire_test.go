@@ -0,0 +1,185 @@
+package wire
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"math"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+
+	"github.com/Guliveer/vitalis/agent/internal/models"
+)
+
+func TestMarshalMsgpack_FollowsJSONShape(t *testing.T) {
+	type sample struct {
+		Name    string    `json:"name"`
+		Count   int       `json:"n"`
+		Neg     int       `json:"neg"`
+		Ratio   float64   `json:"r"`
+		Pi      float64   `json:"pi"`
+		Whole   float64   `json:"w"`
+		Temp    *float64  `json:"temp"`
+		Skipped string    `json:"skipped,omitempty"`
+		Hidden  string    `json:"-"`
+		At      time.Time `json:"at"`
+		List    []uint64  `json:"list"`
+	}
+	got, err := MarshalMsgpack(sample{
+		Name:   "a",
+		Count:  300,
+		Neg:    -2,
+		Ratio:  0.5,
+		Pi:     math.Pi,
+		Whole:  -3,
+		Hidden: "x",
+		At:     time.Unix(0, 0).UTC(),
+		List:   []uint64{1, 1 << 32},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []byte{0x89,
+		0xa4, 'n', 'a', 'm', 'e', 0xa1, 'a',
+		0xa1, 'n', 0xcd, 0x01, 0x2c,
+		0xa3, 'n', 'e', 'g', 0xfe,
+		0xa1, 'r', 0xca, 0x3f, 0, 0, 0,
+		0xa2, 'p', 'i', 0xcb, 0x40, 0x09, 0x21, 0xfb, 0x54, 0x44, 0x2d, 0x18,
+		0xa1, 'w', 0xfd,
+		0xa4, 't', 'e', 'm', 'p', 0xc0,
+		0xa2, 'a', 't', 0xb4}
+	want = append(want, "1970-01-01T00:00:00Z"...)
+	want = append(want, 0xa4, 'l', 'i', 's', 't', 0x92, 0x01, 0xcf, 0, 0, 0, 1, 0, 0, 0, 0)
+	if !bytes.Equal(got, want) {
+		t.Errorf("MarshalMsgpack =\n% x\nwant\n% x", got, want)
+	}
+}
+
+func TestEncode_RoundTrip(t *testing.T) {
+	batch := models.MetricBatch{
+		BatchID: "id",
+		Metrics: []models.MetricSnapshot{{Timestamp: time.Unix(1700000000, 0).UTC(), CPUCores: make([]float64, 64)}},
+	}
+	jsonData, err := json.Marshal(batch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msgpackData, err := MarshalMsgpack(batch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgpackData) >= len(jsonData) {
+		t.Errorf("msgpack payload is %d bytes, JSON %d", len(msgpackData), len(jsonData))
+	}
+
+	for _, tc := range []struct {
+		format     Format
+		want       []byte
+		decompress func(io.Reader) (io.Reader, error)
+	}{
+		{Default, jsonData, func(r io.Reader) (io.Reader, error) { return gzip.NewReader(r) }},
+		{Format{ContentType: Msgpack, ContentEncoding: Zstd}, msgpackData, func(r io.Reader) (io.Reader, error) { return zstd.NewReader(r) }},
+	} {
+		payload, err := Encode(batch, tc.format)
+		if err != nil {
+			t.Fatalf("Encode(%s): %v", tc.format, err)
+		}
+		r, err := tc.decompress(bytes.NewReader(payload))
+		if err != nil {
+			t.Fatalf("%s: %v", tc.format, err)
+		}
+		got, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.format, err)
+		}
+		if !bytes.Equal(got, tc.want) {
+			t.Errorf("%s payload does not decompress to the marshalled batch", tc.format)
+		}
+	}
+}
+
+func TestNewDeltaBatch_RebuildsAndShrinks(t *testing.T) {
+	temp := 51.0
+	base := models.MetricSnapshot{
+		Timestamp:     time.Unix(1700000000, 0).UTC(),
+		CPUOverall:    10,
+		CPUCores:      []float64{10, 10},
+		RAMUsed:       4 << 30,
+		RAMTotal:      16 << 30,
+		DiskUsage:     []models.DiskInfo{{Mount: "/", Total: 500 << 30, Used: 200 << 30, Free: 300 << 30}},
+		UptimeSeconds: 3600,
+		CPUTemp:       &temp,
+		OSName:        "linux",
+		OSVersion:     "Ubuntu 24.04",
+	}
+	batch := models.MetricBatch{BatchID: "id", Metrics: []models.MetricSnapshot{base}}
+	for i := 1; i < 8; i++ {
+		m := base
+		m.Timestamp = base.Timestamp.Add(time.Duration(i) * 15 * time.Second)
+		m.UptimeSeconds = base.UptimeSeconds + 15*i
+		m.RAMUsed = base.RAMUsed - uint64(i)<<20 // decreasing: negative deltas
+		m.CPUOverall = float64(10 + i)
+		if i >= 5 {
+			m.CPUTemp = nil
+			m.DiskUsage = []models.DiskInfo{{Mount: "/", Total: 500 << 30, Used: 201 << 30, Free: 299 << 30}}
+		}
+		batch.Metrics = append(batch.Metrics, m)
+	}
+
+	full, err := json.Marshal(batch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	delta, err := json.Marshal(NewDeltaBatch(batch))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(delta) >= len(full)/2 {
+		t.Errorf("delta batch is %d bytes, full batch %d", len(delta), len(full))
+	}
+
+	// Apply the reconstruction rule documented on DeltaBatch.
+	var decoded struct {
+		Format  string                   `json:"format"`
+		Metrics []map[string]interface{} `json:"metrics"`
+	}
+	if err := json.Unmarshal(delta, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Format != DeltaFormat {
+		t.Fatalf("format = %q, want %q", decoded.Format, DeltaFormat)
+	}
+	prev := decoded.Metrics[0]
+	for i, frame := range decoded.Metrics[1:] {
+		m := make(map[string]interface{}, len(prev))
+		for k, v := range prev {
+			m[k] = v
+		}
+		for k, v := range frame {
+			switch k {
+			case "timestamp":
+				ts, _ := time.Parse(time.RFC3339Nano, prev[k].(string))
+				m[k] = ts.Add(time.Duration(v.(float64))).Format(time.RFC3339Nano)
+			case "ram_used", "uptime_seconds":
+				m[k] = prev[k].(float64) + v.(float64)
+			default:
+				m[k] = v
+			}
+		}
+
+		want, _ := json.Marshal(batch.Metrics[i+1])
+		got, _ := json.Marshal(m)
+		var wantMap, gotMap map[string]interface{}
+		json.Unmarshal(want, &wantMap)
+		json.Unmarshal(got, &gotMap)
+		if !reflect.DeepEqual(gotMap, wantMap) {
+			t.Errorf("snapshot %d rebuilt as\n%s\nwant\n%s", i+1, got, want)
+		}
+		prev = m
+	}
+}
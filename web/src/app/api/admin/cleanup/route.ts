@@ -116,6 +116,30 @@ async function handleCleanup(request: NextRequest) {
     `;
     summary.dailyMetricsDeleted = deletedDaily.length ?? 0;
 
+    // Step 7: Forget ingested batch IDs older than 30 days (deduplication window)
+    const deletedBatches = await sql`
+      DELETE FROM ingested_batches WHERE received_at < NOW() - INTERVAL '30 days'
+    `;
+    summary.ingestedBatchesDeleted = deletedBatches.length ?? 0;
+
+    // Step 8: Forget request nonces older than 1 day (far outside the signature window)
+    const deletedNonces = await sql`
+      DELETE FROM request_nonces WHERE received_at < NOW() - INTERVAL '1 day'
+    `;
+    summary.requestNoncesDeleted = deletedNonces.length ?? 0;
+
+    // Step 9: Delete enrollment codes that expired more than 7 days ago
+    const deletedCodes = await sql`
+      DELETE FROM enrollment_codes WHERE expires_at < NOW() - INTERVAL '7 days'
+    `;
+    summary.enrollmentCodesDeleted = deletedCodes.length ?? 0;
+
+    // Step 10: Delete agent commands (and their results) older than 30 days
+    const deletedCommands = await sql`
+      DELETE FROM agent_commands WHERE created_at < NOW() - INTERVAL '30 days'
+    `;
+    summary.agentCommandsDeleted = deletedCommands.length ?? 0;
+
     return successResponse({ summary, completedAt: new Date().toISOString() });
   } catch (error) {
     console.error("Cleanup error:", error);
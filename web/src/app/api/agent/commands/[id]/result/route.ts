@@ -0,0 +1,86 @@
+// POST /api/agent/commands/[id]/result — result of a command the agent ran
+//
+// Accepts { status: "succeeded" | "failed", output?, truncated?, error? }
+// for a command delivered to the calling machine, once. truncated is set
+// when the agent cut the output to fit the size limit. Diagnostics bundles
+// arrive as the output of the diagnostics command. Machines with a signing secret must
+// sign the request.
+
+import { NextRequest } from "next/server";
+import { getDb } from "@/lib/db";
+import { agentCommands } from "@/lib/db/schema";
+import { findMachineByToken, tokenRotationResponse } from "@/lib/auth/machine-token";
+import { bodyDigest, SignatureError } from "@/lib/auth/signature";
+import { checkSignedRequest } from "@/lib/db/ingest";
+import { commandResultSchema } from "@/lib/validation/machines";
+import { successResponse, errorResponse } from "@/lib/utils/response";
+import { and, eq } from "drizzle-orm";
+
+const UUID_PATTERN = /^[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}$/i;
+
+export async function POST(request: NextRequest, context: { params: Promise<{ id: string }> }) {
+  try {
+    const { id: commandId } = await context.params;
+    if (!UUID_PATTERN.test(commandId)) {
+      return errorResponse("Command not found", 404);
+    }
+
+    const authHeader = request.headers.get("authorization");
+    const token = authHeader?.startsWith("Bearer ") ? authHeader.slice(7).trim() : "";
+    if (!token) {
+      return errorResponse("Machine token is required", 401);
+    }
+
+    const db = getDb();
+    const machine = await findMachineByToken(db, token);
+    if (!machine || machine.revoked) {
+      return errorResponse("Invalid machine token", 401);
+    }
+    if (machine.rotate) {
+      return tokenRotationResponse();
+    }
+
+    const buffer = Buffer.from(await request.arrayBuffer());
+    if (machine.signingSecret) {
+      try {
+        await checkSignedRequest(db, machine.id, machine.signingSecret, request, `/api/agent/commands/${commandId}/result`, bodyDigest(buffer));
+      } catch (error) {
+        if (error instanceof SignatureError) {
+          return errorResponse(error.message, 401);
+        }
+        throw error;
+      }
+    }
+
+    let body: unknown;
+    try {
+      body = JSON.parse(buffer.toString("utf8"));
+    } catch {
+      return errorResponse("Invalid JSON body", 400);
+    }
+    const parsed = commandResultSchema.safeParse(body);
+    if (!parsed.success) {
+      return errorResponse("Invalid command result", 422);
+    }
+
+    const [updated] = await db
+      .update(agentCommands)
+      .set({
+        status: parsed.data.status,
+        output: parsed.data.output ?? null,
+        outputTruncated: parsed.data.truncated ?? false,
+        error: parsed.data.error ?? null,
+        completedAt: new Date(),
+      })
+      .where(and(eq(agentCommands.id, commandId), eq(agentCommands.machineId, machine.id), eq(agentCommands.status, "delivered")))
+      .returning({ id: agentCommands.id });
+    if (!updated) {
+      return errorResponse("Command not found", 404);
+    }
+
+    return successResponse({ id: updated.id, status: parsed.data.status });
+  } catch (error) {
+    console.error("Command result error:", error);
+    return errorResponse("Internal server error", 500);
+  }
+}
@@ -0,0 +1,103 @@
+// GET /api/agent/commands — commands queued for the calling agent
+//
+// Returns the machine's pending, unexpired commands, oldest first, and marks
+// them delivered so each is run at most once. A command whose response is
+// lost is not sent again; the owner sees it as timed out once
+// COMMAND_RESULT_TIMEOUT_MS has passed without a result. Every command carries a
+// signature (see lib/utils/agent-commands) the agent verifies before running
+// it. Agents poll this endpoint when the command channel is enabled, and
+// right away when an ingest response carries X-Pending-Commands. Commands
+// are only delivered to machines with a signing secret, and the request must
+// be signed with it.
+
+import { NextRequest } from "next/server";
+import { getDb } from "@/lib/db";
+import { agentCommands, machines } from "@/lib/db/schema";
+import { findMachineByToken, tokenRotationResponse } from "@/lib/auth/machine-token";
+import { bodyDigest, SignatureError } from "@/lib/auth/signature";
+import { checkSignedRequest } from "@/lib/db/ingest";
+import { signCommand } from "@/lib/utils/agent-commands";
+import { successResponse, errorResponse } from "@/lib/utils/response";
+import { and, asc, eq, gt, inArray } from "drizzle-orm";
+
+/** Most commands delivered per request; the rest stay pending */
+const MAX_COMMANDS = 20;
+
+export async function GET(request: NextRequest) {
+  try {
+    const authHeader = request.headers.get("authorization");
+    const token = authHeader?.startsWith("Bearer ") ? authHeader.slice(7).trim() : "";
+    if (!token) {
+      return errorResponse("Machine token is required", 401);
+    }
+
+    const db = getDb();
+    const machine = await findMachineByToken(db, token);
+    if (!machine || machine.revoked) {
+      return errorResponse("Invalid machine token", 401);
+    }
+    if (machine.rotate) {
+      return tokenRotationResponse();
+    }
+
+    // A bearer token may have leaked, so it is no key for commands
+    if (!machine.signingSecret) {
+      return errorResponse("Request signing must be enabled for this machine to receive commands", 403);
+    }
+    try {
+      await checkSignedRequest(db, machine.id, machine.signingSecret, request, "/api/agent/commands", bodyDigest(Buffer.alloc(0)));
+    } catch (error) {
+      if (error instanceof SignatureError) {
+        return errorResponse(error.message, 401);
+      }
+      throw error;
+    }
+
+    // Clear the ingest hint before reading, so a command queued meanwhile
+    // sets it again instead of waiting for the agent's next poll
+    const now = new Date();
+    if (machine.commandsPending) {
+      await db.update(machines).set({ commandsQueuedAt: null }).where(eq(machines.id, machine.id));
+    }
+
+    const pending = await db
+      .select({ id: agentCommands.id, command: agentCommands.command, expiresAt: agentCommands.expiresAt })
+      .from(agentCommands)
+      .where(and(eq(agentCommands.machineId, machine.id), eq(agentCommands.status, "pending"), gt(agentCommands.expiresAt, now)))
+      .orderBy(asc(agentCommands.createdAt))
+      .limit(MAX_COMMANDS);
+
+    if (pending.length > 0) {
+      await db
+        .update(agentCommands)
+        .set({ status: "delivered", deliveredAt: now })
+        .where(
+          and(
+            inArray(
+              agentCommands.id,
+              pending.map((c) => c.id),
+            ),
+            eq(agentCommands.status, "pending"),
+          ),
+        );
+    }
+    if (pending.length === MAX_COMMANDS) {
+      await db.update(machines).set({ commandsQueuedAt: now }).where(eq(machines.id, machine.id));
+    }
+
+    const key = machine.signingSecret;
+    const commands = pending.map((c) => {
+      const expiresAt = new Date(c.expiresAt);
+      return {
+        id: c.id,
+        command: c.command,
+        expires_at: Math.floor(expiresAt.getTime() / 1000),
+        signature: signCommand(key, c.id, c.command, expiresAt),
+      };
+    });
+    return successResponse({ commands });
+  } catch (error) {
+    console.error("Agent commands error:", error);
+    return errorResponse("Internal server error", 500);
+  }
+}
@@ -0,0 +1,57 @@
+// GET /api/agent/config — configuration overrides for the calling agent
+//
+// Returns the settings set for this machine on the dashboard, which the
+// agent applies on top of its config file (null when none are set). Agents
+// poll with If-None-Match and get 304 while the overrides are unchanged;
+// ingest responses carry the current ETag so a change is fetched with the
+// next batch. Machines with a signing secret must sign the request.
+
+import { NextRequest, NextResponse } from "next/server";
+import { getDb } from "@/lib/db";
+import { findMachineByToken, tokenRotationResponse } from "@/lib/auth/machine-token";
+import { bodyDigest, SignatureError } from "@/lib/auth/signature";
+import { checkSignedRequest } from "@/lib/db/ingest";
+import { configETag } from "@/lib/utils/agent-config";
+import { successResponse, errorResponse } from "@/lib/utils/response";
+
+export async function GET(request: NextRequest) {
+  try {
+    const authHeader = request.headers.get("authorization");
+    const token = authHeader?.startsWith("Bearer ") ? authHeader.slice(7).trim() : "";
+    if (!token) {
+      return errorResponse("Machine token is required", 401);
+    }
+
+    const db = getDb();
+    const machine = await findMachineByToken(db, token);
+    if (!machine || machine.revoked) {
+      return errorResponse("Invalid machine token", 401);
+    }
+    if (machine.rotate) {
+      return tokenRotationResponse();
+    }
+
+    if (machine.signingSecret) {
+      try {
+        await checkSignedRequest(db, machine.id, machine.signingSecret, request, "/api/agent/config", bodyDigest(Buffer.alloc(0)));
+      } catch (error) {
+        if (error instanceof SignatureError) {
+          return errorResponse(error.message, 401);
+        }
+        throw error;
+      }
+    }
+
+    const etag = configETag(machine.configOverrides);
+    if (request.headers.get("if-none-match") === etag) {
+      return new NextResponse(null, { status: 304, headers: { ETag: etag } });
+    }
+
+    const response = successResponse({ overrides: machine.configOverrides });
+    response.headers.set("ETag", etag);
+    return response;
+  } catch (error) {
+    console.error("Agent config error:", error);
+    return errorResponse("Internal server error", 500);
+  }
+}
@@ -0,0 +1,113 @@
+// POST /api/enroll — exchange a one-time enrollment code for a machine token
+//
+// Called by the agent on first start when its config holds an enrollment
+// code instead of a machine token. Registers a new machine for the user who
+// created the code and returns its token, which expires and is rotated by
+// the agent (see lib/auth/machine-token). The code is spent by the first
+// request. An agent that lost the response repeats the request with the same
+// nonce within ENROLLMENT_RETRY_WINDOW_MS and gets a new token for the
+// machine it enrolled.
+
+import { NextRequest } from "next/server";
+import { getDb } from "@/lib/db";
+import { enrollmentCodes, machines } from "@/lib/db/schema";
+import {
+  ENROLLMENT_RETRY_WINDOW_MS,
+  generateMachineToken,
+  hashEnrollmentCode,
+  MACHINE_TOKEN_LIFETIME_MS,
+  ROTATE_AFTER_MS,
+} from "@/lib/auth/machine-token";
+import { enrollSchema } from "@/lib/validation/machines";
+import { successResponse, errorResponse, rateLimitResponse } from "@/lib/utils/response";
+import { checkRateLimit, RATE_LIMITS } from "@/lib/utils/rate-limit";
+import { and, eq, gt, isNotNull, isNull } from "drizzle-orm";
+
+export async function POST(request: NextRequest) {
+  try {
+    // Rate limit by IP: codes are short enough that guessing must stay slow
+    const ip = request.headers.get("x-forwarded-for") ?? "unknown";
+    const rateCheck = checkRateLimit(`enroll:${ip}`, RATE_LIMITS.enroll);
+    if (!rateCheck.allowed) {
+      return rateLimitResponse(rateCheck.retryAfter ?? 60);
+    }
+
+    const parsed = enrollSchema.safeParse(await request.json().catch(() => null));
+    if (!parsed.success) {
+      return errorResponse("Invalid enrollment request", 422);
+    }
+    const { code, nonce, name, os, arch } = parsed.data;
+
+    // Claim the code: the update matches only an unused, unexpired code, so
+    // two agents racing with the same code cannot both enroll
+    const db = getDb();
+    const now = new Date();
+    const codeHash = hashEnrollmentCode(code);
+    const machineToken = generateMachineToken();
+    const tokenExpiresAt = new Date(now.getTime() + MACHINE_TOKEN_LIFETIME_MS);
+    const [claimed] = await db
+      .update(enrollmentCodes)
+      .set({ usedAt: now, enrollmentNonce: nonce ?? null })
+      .where(and(eq(enrollmentCodes.codeHash, codeHash), isNull(enrollmentCodes.usedAt), gt(enrollmentCodes.expiresAt, now)))
+      .returning({ userId: enrollmentCodes.userId, name: enrollmentCodes.name, codeHash: enrollmentCodes.codeHash });
+    if (!claimed) {
+      if (!nonce) {
+        return errorResponse("Invalid or expired enrollment code", 401);
+      }
+      // A repeat from the agent that spent the code: the token it was sent
+      // never arrived, so it is replaced with a new one
+      const [repeated] = await db
+        .select({ machineId: enrollmentCodes.machineId })
+        .from(enrollmentCodes)
+        .where(
+          and(
+            eq(enrollmentCodes.codeHash, codeHash),
+            eq(enrollmentCodes.enrollmentNonce, nonce),
+            gt(enrollmentCodes.usedAt, new Date(now.getTime() - ENROLLMENT_RETRY_WINDOW_MS)),
+            isNotNull(enrollmentCodes.machineId),
+          ),
+        )
+        .limit(1);
+      if (!repeated?.machineId) {
+        return errorResponse("Invalid or expired enrollment code", 401);
+      }
+      await db.update(machines).set({ machineToken, tokenExpiresAt }).where(eq(machines.id, repeated.machineId));
+      return successResponse(
+        {
+          machine_id: repeated.machineId,
+          machine_token: machineToken,
+          expires_at: tokenExpiresAt.toISOString(),
+          rotate_at: new Date(now.getTime() + ROTATE_AFTER_MS).toISOString(),
+        },
+        200,
+      );
+    }
+
+    const [created] = await db
+      .insert(machines)
+      .values({
+        userId: claimed.userId,
+        name: claimed.name ?? name ?? "Unnamed machine",
+        machineToken,
+        tokenExpiresAt,
+        os: os ?? null,
+        arch: arch ?? null,
+      })
+      .returning({ id: machines.id });
+
+    await db.update(enrollmentCodes).set({ machineId: created.id }).where(eq(enrollmentCodes.codeHash, claimed.codeHash));
+
+    return successResponse(
+      {
+        machine_id: created.id,
+        machine_token: machineToken,
+        expires_at: tokenExpiresAt.toISOString(),
+        rotate_at: new Date(now.getTime() + ROTATE_AFTER_MS).toISOString(),
+      },
+      201,
+    );
+  } catch (error) {
+    console.error("Enroll error:", error);
+    return errorResponse("Internal server error", 500);
+  }
+}
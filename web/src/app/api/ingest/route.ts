@@ -1,14 +1,24 @@
 // POST /api/ingest — metric ingestion endpoint for Go agents
-// Accepts JSON batches authenticated via Authorization header or machine_token in body
+// Accepts JSON or MessagePack batches (optionally gzip/zstd-compressed and
+// delta-encoded) authenticated via Authorization header or machine_token in body.
+// Machines with a signing secret must also sign each request (see lib/auth/signature).
+// Accepted batches are answered with X-Config-ETag, the ETag of the machine's
+// config overrides (see GET /api/agent/config), and with X-Pending-Commands
+// while commands are waiting for the agent (see GET /api/agent/commands).
+// GET /api/ingest — lists the payload and batch formats this server accepts
 
 import { NextRequest, NextResponse } from "next/server";
-import { gunzipSync } from "zlib";
 import { getDb } from "@/lib/db";
-import { metrics, processSnapshots, machines } from "@/lib/db/schema";
+import { insertMetrics, checkSignedRequest, DuplicateBatchError } from "@/lib/db/ingest";
+import { bodyDigest, SignatureError } from "@/lib/auth/signature";
+import { findMachineByToken, tokenRotationResponse, type MachineAuth } from "@/lib/auth/machine-token";
 import { metricBatchSchema } from "@/lib/validation/metrics";
-import { successResponse, errorResponse } from "@/lib/utils/response";
-import { checkRateLimit, RATE_LIMITS } from "@/lib/utils/rate-limit";
-import { eq } from "drizzle-orm";
+import { successResponse, errorResponse, rateLimitResponse } from "@/lib/utils/response";
+import { expandDeltaBatch, DeltaError } from "@/lib/utils/delta";
+import { decodeBody, ingestCapabilities, supportedEncodings, UnsupportedEncodingError } from "@/lib/utils/wire";
+import { checkRateLimit, RATE_LIMITS, type RateLimitResult } from "@/lib/utils/rate-limit";
+import { CONFIG_ETAG_HEADER, configETag } from "@/lib/utils/agent-config";
+import { COMMANDS_PENDING_HEADER } from "@/lib/utils/agent-commands";
 
 /**
  * Extract machine token from Authorization header or request body.
@@ -26,22 +36,62 @@ function extractMachineToken(request: NextRequest, bodyToken?: string): string |
   return bodyToken ?? null;
 }
 
+/**
+ * Attach X-RateLimit-* headers so agents can pace themselves to the
+ * server's limit instead of a value compiled into the agent.
+ */
+function withRateLimitHeaders(response: NextResponse, result: RateLimitResult): NextResponse {
+  response.headers.set("X-RateLimit-Limit", String(RATE_LIMITS.ingest.maxRequests));
+  response.headers.set("X-RateLimit-Remaining", String(result.remaining));
+  response.headers.set("X-RateLimit-Reset", String(Math.ceil(result.resetAt / 1000)));
+  return response;
+}
+
+/**
+ * Tell the agent which config overrides are current, so it fetches them
+ * from /api/agent/config as soon as they change on the dashboard, and
+ * whether commands are waiting for it at /api/agent/commands.
+ */
+function withAgentHints(response: NextResponse, machine: MachineAuth): NextResponse {
+  response.headers.set(CONFIG_ETAG_HEADER, configETag(machine.configOverrides));
+  if (machine.commandsPending) {
+    response.headers.set(COMMANDS_PENDING_HEADER, "1");
+  }
+  return response;
+}
+
+/**
+ * Capability discovery: agents ask which content types, encodings and batch
+ * formats are accepted before sending anything but full JSON batches with gzip.
+ */
+export async function GET() {
+  return successResponse(ingestCapabilities());
+}
+
 export async function POST(request: NextRequest) {
   try {
-    // Parse request body, handling gzip-compressed payloads from Go agents
+    // Parse request body, handling compressed and MessagePack payloads from Go agents
     let body: unknown;
-    const contentEncoding = request.headers.get("content-encoding");
+    const buffer = Buffer.from(await request.arrayBuffer());
+    try {
+      body = decodeBody(buffer, request.headers.get("content-type"), request.headers.get("content-encoding"));
+    } catch (error) {
+      if (error instanceof UnsupportedEncodingError) {
+        const response = errorResponse("Unsupported content encoding", 415);
+        response.headers.set("Accept-Encoding", supportedEncodings().join(", "));
+        return response;
+      }
+      return errorResponse("Invalid payload encoding", 400);
+    }
 
-    if (contentEncoding === "gzip") {
-      try {
-        const buffer = Buffer.from(await request.arrayBuffer());
-        const decompressed = gunzipSync(buffer);
-        body = JSON.parse(decompressed.toString("utf-8"));
-      } catch {
-        return errorResponse("Invalid gzip payload", 400);
+    // Rebuild full snapshots from a delta-encoded batch
+    try {
+      body = expandDeltaBatch(body);
+    } catch (error) {
+      if (error instanceof DeltaError) {
+        return errorResponse(`Invalid delta batch: ${error.message}`, 422);
       }
-    } else {
-      body = await request.json();
+      throw error;
     }
 
     // Validate with metricBatchSchema (machine_token is now optional in body)
@@ -52,6 +102,11 @@ export async function POST(request: NextRequest) {
 
     const { machine_token: bodyToken, metrics: metricBatch } = parsed.data;
 
+    // Batch ID from the body or the Idempotency-Key header (agents send both)
+    const batchId = parsed.data.batch_id ?? request.headers.get("idempotency-key") ?? undefined;
+    const sequenceHeader = request.headers.get("x-batch-seq");
+    const sequence = parsed.data.sequence ?? (sequenceHeader && /^\d+$/.test(sequenceHeader) ? Number(sequenceHeader) : undefined);
+
     // Extract token from header or body (MEDIUM-3)
     const machineToken = extractMachineToken(request, bodyToken);
     if (!machineToken) {
@@ -60,68 +115,50 @@ export async function POST(request: NextRequest) {
 
     // Look up machine by token
     const db = getDb();
-    const [machine] = await db.select({ id: machines.id }).from(machines).where(eq(machines.machineToken, machineToken)).limit(1);
+    const machine = await findMachineByToken(db, machineToken);
 
-    if (!machine) {
+    if (!machine || machine.revoked) {
       return errorResponse("Invalid machine token", 401);
     }
-
-    // Rate limit by machine ID
-    const rateCheck = checkRateLimit(`ingest:${machine.id}`, RATE_LIMITS.ingest);
-    if (!rateCheck.allowed) {
-      return errorResponse("Rate limit exceeded", 429);
+    if (machine.rotate) {
+      return tokenRotationResponse();
     }
 
-    // Prepare metric values for bulk insert
-    const metricValues = metricBatch.map((m) => ({
-      machineId: machine.id,
-      timestamp: new Date(m.timestamp),
-      cpuOverall: m.cpu_overall,
-      cpuCores: m.cpu_cores,
-      ramUsed: m.ram_used,
-      ramTotal: m.ram_total,
-      diskUsage: m.disk_usage,
-      networkRx: m.network_rx,
-      networkTx: m.network_tx,
-      uptimeSeconds: m.uptime_seconds,
-      cpuTemp: m.cpu_temp ?? null,
-      gpuTemp: m.gpu_temp ?? null,
-    }));
-
-    // Bulk insert metrics, returning IDs
-    const insertedMetrics = await db.insert(metrics).values(metricValues).returning({ id: metrics.id });
-
-    // Prepare process snapshot values for bulk insert
-    const processValues: { metricId: string; processes: unknown }[] = [];
-    for (let i = 0; i < metricBatch.length; i++) {
-      const m = metricBatch[i];
-      if (m.processes && m.processes.length > 0) {
-        processValues.push({
-          metricId: insertedMetrics[i].id,
-          processes: m.processes,
-        });
+    // A machine with a signing secret must sign every request over the raw body
+    if (machine.signingSecret) {
+      try {
+        await checkSignedRequest(db, machine.id, machine.signingSecret, request, "/api/ingest", bodyDigest(buffer));
+      } catch (error) {
+        if (error instanceof SignatureError) {
+          return errorResponse(error.message, 401);
+        }
+        throw error;
       }
     }
 
-    // Bulk insert process snapshots if any exist
-    if (processValues.length > 0) {
-      await db.insert(processSnapshots).values(processValues);
+    // Rate limit by machine ID
+    const rateCheck = checkRateLimit(`ingest:${machine.id}`, RATE_LIMITS.ingest);
+    if (!rateCheck.allowed) {
+      return withRateLimitHeaders(rateLimitResponse(rateCheck.retryAfter ?? 60), rateCheck);
     }
 
-    // Extract OS info from the latest metric snapshot (if present)
-    const latestSnapshot = metricBatch[metricBatch.length - 1];
-    const machineUpdate: Record<string, unknown> = { lastSeen: new Date() };
-    if (latestSnapshot.os_name) {
-      machineUpdate.osName = latestSnapshot.os_name;
+    // The batch ID is claimed in the same transaction as the metrics. A
+    // retry of a batch that was already written (e.g. the agent timed out
+    // waiting for our response) is acknowledged without inserting its
+    // metrics a second time.
+    if (batchId && !/^[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}$/i.test(batchId)) {
+      return errorResponse("Invalid batch ID", 422);
     }
-    if (latestSnapshot.os_version) {
-      machineUpdate.osVersion = latestSnapshot.os_version;
+    try {
+      const claim = batchId ? { batchId, sequence: sequence ?? null } : undefined;
+      const inserted = await insertMetrics(db, machine.id, metricBatch, claim);
+      return withAgentHints(withRateLimitHeaders(successResponse({ inserted }, 201), rateCheck), machine);
+    } catch (error) {
+      if (error instanceof DuplicateBatchError) {
+        return withAgentHints(withRateLimitHeaders(successResponse({ inserted: 0, duplicate: true }, 200), rateCheck), machine);
+      }
+      throw error;
     }
-
-    // Update machine's last_seen timestamp and OS info
-    await db.update(machines).set(machineUpdate).where(eq(machines.id, machine.id));
-
-    return successResponse({ inserted: insertedMetrics.length }, 201);
   } catch (error) {
     console.error("Ingest error:", error);
     return errorResponse("Internal server error", 500);
@@ -0,0 +1,134 @@
+// GET /api/machines/[id]/commands — recent commands and their results
+// POST /api/machines/[id]/commands — queue a command for the machine's agent
+//
+// Commands can only be queued for machines with a signing secret, which
+// signs them for the agent. The agent runs a command only if its command
+// channel is enabled and the command is in its allowlist; otherwise it
+// reports the command as failed.
+// Commands the agent does not fetch within COMMAND_TTL_MS expire unrun.
+// Delivered commands whose result does not arrive are listed as timed out
+// (see COMMAND_RESULT_TIMEOUT_MS); they are not delivered again.
+
+import { NextRequest, NextResponse } from "next/server";
+import { getDb } from "@/lib/db";
+import { agentCommands, machines, type SelectAgentCommand } from "@/lib/db/schema";
+import { withAuth, type AuthContext } from "@/lib/auth/middleware";
+import { createCommandSchema } from "@/lib/validation/machines";
+import { COMMAND_RESULT_TIMEOUT_MS, COMMAND_TTL_MS } from "@/lib/utils/agent-commands";
+import { successResponse, errorResponse, validationErrorResponse } from "@/lib/utils/response";
+import { desc, eq } from "drizzle-orm";
+
+/** Commands listed per machine */
+const LIST_LIMIT = 50;
+
+/**
+ * The status shown for a command. Pending commands past their expiry will
+ * never be delivered, and delivered ones that never got a result will not
+ * get one.
+ */
+function listedStatus(c: Pick<SelectAgentCommand, "status" | "expiresAt" | "deliveredAt">, now: number): string {
+  const expiresAt = new Date(c.expiresAt).getTime();
+  if (c.status === "pending" && expiresAt <= now) {
+    return "expired";
+  }
+  if (c.status === "delivered" && c.deliveredAt) {
+    const deadline = Math.max(expiresAt, new Date(c.deliveredAt).getTime() + COMMAND_RESULT_TIMEOUT_MS);
+    if (deadline <= now) {
+      return "timed_out";
+    }
+  }
+  return c.status;
+}
+
+/**
+ * Commands run actions on the machine, so only the owner may queue or list
+ * them. With requireSigning, the machine must also have a signing secret.
+ */
+async function checkOwner(machineId: string, userId: string, requireSigning = false): Promise<NextResponse | null> {
+  const db = getDb();
+  const [machine] = await db
+    .select({ userId: machines.userId, signingSecret: machines.signingSecret })
+    .from(machines)
+    .where(eq(machines.id, machineId))
+    .limit(1);
+
+  if (!machine) {
+    return errorResponse("Machine not found", 404);
+  }
+  if (machine.userId !== userId) {
+    return errorResponse("Only the owner can send commands to this machine", 403);
+  }
+  if (requireSigning && !machine.signingSecret) {
+    return errorResponse("Enable request signing for this machine before sending it commands", 409);
+  }
+  return null;
+}
+
+export async function GET(request: NextRequest, context: { params: Promise<{ id: string }> }) {
+  return withAuth(async (_req: NextRequest, { user }: AuthContext): Promise<NextResponse> => {
+    try {
+      const { id: machineId } = await context.params;
+
+      const denied = await checkOwner(machineId, user.sub);
+      if (denied) return denied;
+
+      const commands = await getDb()
+        .select()
+        .from(agentCommands)
+        .where(eq(agentCommands.machineId, machineId))
+        .orderBy(desc(agentCommands.createdAt))
+        .limit(LIST_LIMIT);
+
+      const now = Date.now();
+      return successResponse({
+        commands: commands.map((c) => ({ ...c, status: listedStatus(c, now) })),
+      });
+    } catch (error) {
+      console.error("List commands error:", error);
+      return errorResponse("Internal server error", 500);
+    }
+  })(request);
+}
+
+export async function POST(request: NextRequest, context: { params: Promise<{ id: string }> }) {
+  return withAuth(async (_req: NextRequest, { user }: AuthContext): Promise<NextResponse> => {
+    try {
+      const { id: machineId } = await context.params;
+
+      const denied = await checkOwner(machineId, user.sub, true);
+      if (denied) return denied;
+
+      const body = await _req.json();
+      const parsed = createCommandSchema.safeParse(body);
+      if (!parsed.success) {
+        const fieldErrors: Record<string, string[]> = {};
+        for (const issue of parsed.error.issues) {
+          const field = issue.path.join(".");
+          if (!fieldErrors[field]) fieldErrors[field] = [];
+          fieldErrors[field].push(issue.message);
+        }
+        return validationErrorResponse(fieldErrors);
+      }
+
+      const db = getDb();
+      const now = new Date();
+      const [command] = await db
+        .insert(agentCommands)
+        .values({
+          machineId,
+          command: parsed.data.command,
+          createdBy: user.sub,
+          expiresAt: new Date(now.getTime() + COMMAND_TTL_MS),
+        })
+        .returning();
+
+      // Picked up by the agent with its next batch (see POST /api/ingest)
+      await db.update(machines).set({ commandsQueuedAt: now }).where(eq(machines.id, machineId));
+
+      return successResponse({ command }, 201);
+    } catch (error) {
+      console.error("Create command error:", error);
+      return errorResponse("Internal server error", 500);
+    }
+  })(request);
+}
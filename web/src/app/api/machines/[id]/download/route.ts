@@ -27,14 +27,16 @@ function getAppUrl(): string {
 }
 
 /**
- * Generate the agent.yaml configuration content for a given machine token.
+ * Generate the agent.yaml configuration content for a given machine token
+ * and, if request signing is enabled, signing secret.
  */
-function generateAgentConfig(machineToken: string): string {
+function generateAgentConfig(machineToken: string, signingSecret: string | null): string {
   const serverUrl = getAppUrl();
+  const signing = signingSecret ? `\n  signing_secret: "${signingSecret}"` : "";
 
   return `server:
   url: "${serverUrl}"
-  machine_token: "${machineToken}"
+  machine_token: "${machineToken}"${signing}
 
 collection:
   interval: 15s
@@ -85,7 +87,7 @@ export async function GET(request: NextRequest, context: { params: Promise<{ id:
       }
 
       // Generate the agent config YAML
-      const configContent = generateAgentConfig(machine.machineToken);
+      const configContent = generateAgentConfig(machine.machineToken, machine.signingSecret);
 
       // --- Config-only download ---
       if (downloadType === "config") {
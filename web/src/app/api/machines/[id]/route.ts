@@ -49,9 +49,10 @@ export async function GET(request: NextRequest, context: { params: Promise<{ id:
         return errorResponse("Machine not found", 404);
       }
 
-      // Strip machineToken from response — only shown once at creation (HIGH-2)
-      const { machineToken, ...machineData } = machine;
-      return successResponse({ machine: machineData });
+      // Strip tokens from response — only shown once at creation (HIGH-2)
+      // The signing secret is likewise only shown when generated
+      const { machineToken, previousMachineToken, signingSecret, ...machineData } = machine;
+      return successResponse({ machine: { ...machineData, requestSigning: Boolean(signingSecret) } });
     } catch (error) {
       console.error("Get machine error:", error);
       return errorResponse("Internal server error", 500);
@@ -94,6 +95,8 @@ export async function PUT(request: NextRequest, context: { params: Promise<{ id:
       // Build update object (only include provided fields)
       const updateData: Record<string, unknown> = {};
       if (updates.name !== undefined) updateData.name = updates.name;
+      // Picked up by the agent with its next batch (see GET /api/agent/config)
+      if (updates.config_overrides !== undefined) updateData.configOverrides = updates.config_overrides;
 
       if (Object.keys(updateData).length === 0) {
         return errorResponse("No fields to update", 400);
@@ -101,9 +104,9 @@ export async function PUT(request: NextRequest, context: { params: Promise<{ id:
 
       const [updated] = await db.update(machines).set(updateData).where(eq(machines.id, machineId)).returning();
 
-      // Strip machineToken from response (HIGH-2)
-      const { machineToken: _token, ...updatedData } = updated;
-      return successResponse({ machine: updatedData });
+      // Strip tokens and signing secret from response (HIGH-2)
+      const { machineToken: _token, previousMachineToken: _previous, signingSecret, ...updatedData } = updated;
+      return successResponse({ machine: { ...updatedData, requestSigning: Boolean(signingSecret) } });
     } catch (error) {
       console.error("Update machine error:", error);
       return errorResponse("Internal server error", 500);
@@ -0,0 +1,64 @@
+// POST /api/machines/[id]/signing-secret — enable request signing with a new secret
+// DELETE /api/machines/[id]/signing-secret — disable request signing
+//
+// Once a machine has a signing secret, its agent must sign every ingest and
+// stream request (see lib/auth/signature). The secret is returned only once,
+// like the machine token at creation. Generating a new one replaces the old,
+// so the agent's signing_secret must be updated at the same time.
+
+import { NextRequest, NextResponse } from "next/server";
+import { getDb } from "@/lib/db";
+import { machines } from "@/lib/db/schema";
+import { withAuth, type AuthContext } from "@/lib/auth/middleware";
+import { generateSigningSecret } from "@/lib/auth/signature";
+import { successResponse, errorResponse } from "@/lib/utils/response";
+import { eq } from "drizzle-orm";
+
+/** Set the machine's signing secret (null disables signing). Only the owner may. */
+async function setSigningSecret(machineId: string, userId: string, signingSecret: string | null): Promise<NextResponse | null> {
+  const db = getDb();
+  const [machine] = await db.select({ userId: machines.userId }).from(machines).where(eq(machines.id, machineId)).limit(1);
+
+  if (!machine) {
+    return errorResponse("Machine not found", 404);
+  }
+  if (machine.userId !== userId) {
+    return errorResponse("Only the owner can change request signing", 403);
+  }
+
+  await db.update(machines).set({ signingSecret }).where(eq(machines.id, machineId));
+  return null;
+}
+
+export async function POST(request: NextRequest, context: { params: Promise<{ id: string }> }) {
+  return withAuth(async (_req: NextRequest, { user }: AuthContext): Promise<NextResponse> => {
+    try {
+      const { id: machineId } = await context.params;
+      const signingSecret = generateSigningSecret();
+
+      const denied = await setSigningSecret(machineId, user.sub, signingSecret);
+      if (denied) return denied;
+
+      return successResponse({ signingSecret }, 201);
+    } catch (error) {
+      console.error("Create signing secret error:", error);
+      return errorResponse("Internal server error", 500);
+    }
+  })(request);
+}
+
+export async function DELETE(request: NextRequest, context: { params: Promise<{ id: string }> }) {
+  return withAuth(async (_req: NextRequest, { user }: AuthContext): Promise<NextResponse> => {
+    try {
+      const { id: machineId } = await context.params;
+
+      const denied = await setSigningSecret(machineId, user.sub, null);
+      if (denied) return denied;
+
+      return successResponse({ requestSigning: false });
+    } catch (error) {
+      console.error("Delete signing secret error:", error);
+      return errorResponse("Internal server error", 500);
+    }
+  })(request);
+}
@@ -0,0 +1,46 @@
+// POST /api/machines/enrollment-codes — create a one-time enrollment code
+//
+// An agent configured with the code exchanges it for its own machine token
+// (POST /api/enroll), so tokens never have to be copied by hand. The code is
+// returned only once and expires unused after expires_in_minutes (default 60).
+
+import { NextRequest, NextResponse } from "next/server";
+import { getDb } from "@/lib/db";
+import { enrollmentCodes } from "@/lib/db/schema";
+import { withAuth, type AuthContext } from "@/lib/auth/middleware";
+import { generateEnrollmentCode, hashEnrollmentCode } from "@/lib/auth/machine-token";
+import { createEnrollmentCodeSchema } from "@/lib/validation/machines";
+import { successResponse, errorResponse, validationErrorResponse } from "@/lib/utils/response";
+
+export const POST = withAuth(async (request: NextRequest, { user }: AuthContext): Promise<NextResponse> => {
+  try {
+    const body = await request.json().catch(() => ({}));
+
+    const parsed = createEnrollmentCodeSchema.safeParse(body);
+    if (!parsed.success) {
+      const fieldErrors: Record<string, string[]> = {};
+      for (const issue of parsed.error.issues) {
+        const field = issue.path.join(".");
+        if (!fieldErrors[field]) fieldErrors[field] = [];
+        fieldErrors[field].push(issue.message);
+      }
+      return validationErrorResponse(fieldErrors);
+    }
+
+    const code = generateEnrollmentCode();
+    const expiresAt = new Date(Date.now() + parsed.data.expires_in_minutes * 60 * 1000);
+
+    const db = getDb();
+    await db.insert(enrollmentCodes).values({
+      codeHash: hashEnrollmentCode(code),
+      userId: user.sub,
+      name: parsed.data.name ?? null,
+      expiresAt,
+    });
+
+    return successResponse({ code, expiresAt: expiresAt.toISOString() }, 201);
+  } catch (error) {
+    console.error("Create enrollment code error:", error);
+    return errorResponse("Internal server error", 500);
+  }
+});
@@ -8,7 +8,7 @@ import { withAuth, type AuthContext } from "@/lib/auth/middleware";
 import { createMachineSchema } from "@/lib/validation/machines";
 import { successResponse, errorResponse, validationErrorResponse } from "@/lib/utils/response";
 import { eq, desc, or, sql, type InferSelectModel } from "drizzle-orm";
-import crypto from "crypto";
+import { generateMachineToken } from "@/lib/auth/machine-token";
 
 // Two-minute threshold for online status
 const ONLINE_THRESHOLD_MS = 2 * 60 * 1000;
@@ -127,7 +127,7 @@ export const POST = withAuth(async (request: NextRequest, { user }: AuthContext)
     const { name, os, arch } = parsed.data;
 
     // Generate unique machine token
-    const machineToken = `mtoken_${crypto.randomUUID()}`;
+    const machineToken = generateMachineToken();
 
     const db = getDb();
     const [created] = await db
@@ -0,0 +1,76 @@
+// POST /api/rotate — replace the calling agent's machine token
+//
+// Authenticated with the current token, which may already be expired (within
+// ROTATION_GRACE_MS), or with the token replaced by the last rotation for
+// PREVIOUS_TOKEN_GRACE_MS after it: an agent that never saved its new token
+// can still recover. The old token
+// stops working for ingest and stream requests at once. Machines with a
+// signing secret must sign the request, like their ingest requests.
+
+import { NextRequest } from "next/server";
+import { getDb } from "@/lib/db";
+import { machines } from "@/lib/db/schema";
+import { findMachineByToken, generateMachineToken, MACHINE_TOKEN_LIFETIME_MS, ROTATE_AFTER_MS } from "@/lib/auth/machine-token";
+import { bodyDigest, SignatureError } from "@/lib/auth/signature";
+import { checkSignedRequest } from "@/lib/db/ingest";
+import { successResponse, errorResponse, rateLimitResponse } from "@/lib/utils/response";
+import { checkRateLimit, RATE_LIMITS } from "@/lib/utils/rate-limit";
+import { eq } from "drizzle-orm";
+
+export async function POST(request: NextRequest) {
+  try {
+    const authHeader = request.headers.get("authorization");
+    const token = authHeader?.startsWith("Bearer ") ? authHeader.slice(7).trim() : "";
+    if (!token) {
+      return errorResponse("Machine token is required", 401);
+    }
+
+    const db = getDb();
+    const machine = await findMachineByToken(db, token);
+    if (!machine || machine.revoked) {
+      return errorResponse("Invalid machine token", 401);
+    }
+
+    if (machine.signingSecret) {
+      const buffer = Buffer.from(await request.arrayBuffer());
+      try {
+        await checkSignedRequest(db, machine.id, machine.signingSecret, request, "/api/rotate", bodyDigest(buffer));
+      } catch (error) {
+        if (error instanceof SignatureError) {
+          return errorResponse(error.message, 401);
+        }
+        throw error;
+      }
+    }
+
+    const rateCheck = checkRateLimit(`rotate:${machine.id}`, RATE_LIMITS.enroll);
+    if (!rateCheck.allowed) {
+      return rateLimitResponse(rateCheck.retryAfter ?? 60);
+    }
+
+    const now = Date.now();
+    const machineToken = generateMachineToken();
+    const tokenExpiresAt = new Date(now + MACHINE_TOKEN_LIFETIME_MS);
+
+    // Rotating with the current token keeps it as the previous one; rotating
+    // with the previous token (the agent lost the current one) keeps it there,
+    // without extending its grace window
+    await db
+      .update(machines)
+      .set({
+        machineToken,
+        tokenExpiresAt,
+        ...(machine.replaced ? {} : { previousMachineToken: token, previousTokenReplacedAt: new Date(now) }),
+      })
+      .where(eq(machines.id, machine.id));
+
+    return successResponse({
+      machine_token: machineToken,
+      expires_at: tokenExpiresAt.toISOString(),
+      rotate_at: new Date(now + ROTATE_AFTER_MS).toISOString(),
+    });
+  } catch (error) {
+    console.error("Rotate token error:", error);
+    return errorResponse("Internal server error", 500);
+  }
+}
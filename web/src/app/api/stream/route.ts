@@ -0,0 +1,163 @@
+// POST /api/stream — live snapshot stream from Go agents
+// The request body is an open-ended NDJSON stream of snapshots and heartbeats;
+// the response is an NDJSON stream acknowledging each stored snapshot.
+//
+// Protocol (one JSON object per line):
+//   agent  → {"type":"snapshot","seq":1,"snapshot":{...}}  store, reply {"ack":1}
+//   agent  → {"type":"heartbeat"}                          reply {"heartbeat":true}
+//   server → {"ready":true}                                sent once on connect
+//   server → {"nack":1,"error":"..."}                      snapshot rejected, not stored
+//
+// Snapshots that are not acknowledged are sent again by the agent in its
+// regular batch POST to /api/ingest. The server ends the stream after
+// MAX_STREAM_MS; the agent then reconnects.
+//
+// Machines with a signing secret sign the request that opens the stream
+// (with UNSIGNED-PAYLOAD in place of the body digest, see lib/auth/signature).
+//
+// Streaming request bodies require a Node.js host that does not buffer
+// uploads (e.g. `next start` behind a proxy with request buffering off).
+
+import { NextRequest } from "next/server";
+import { getDb } from "@/lib/db";
+import { insertMetrics, checkSignedRequest } from "@/lib/db/ingest";
+import { SignatureError, UNSIGNED_PAYLOAD } from "@/lib/auth/signature";
+import { findMachineByToken, tokenRotationResponse } from "@/lib/auth/machine-token";
+import { singleMetricSchema } from "@/lib/validation/metrics";
+import { errorResponse, rateLimitResponse } from "@/lib/utils/response";
+import { checkRateLimit, RATE_LIMITS } from "@/lib/utils/rate-limit";
+
+export const runtime = "nodejs";
+export const dynamic = "force-dynamic";
+
+/** Streams are closed after this long so the agent reconnects periodically. */
+const MAX_STREAM_MS = 5 * 60 * 1000;
+
+/** Longest accepted line (a snapshot with full process and core lists). */
+const MAX_LINE_BYTES = 1024 * 1024;
+
+type StreamMessage = { type?: string; seq?: unknown; snapshot?: unknown };
+
+export async function POST(request: NextRequest) {
+  try {
+    const authHeader = request.headers.get("authorization");
+    const machineToken = authHeader?.startsWith("Bearer ") ? authHeader.slice(7).trim() : "";
+    if (!machineToken) {
+      return errorResponse("Machine token is required", 401);
+    }
+
+    const db = getDb();
+    const machine = await findMachineByToken(db, machineToken);
+    if (!machine || machine.revoked) {
+      return errorResponse("Invalid machine token", 401);
+    }
+    if (machine.rotate) {
+      return tokenRotationResponse();
+    }
+    if (machine.signingSecret) {
+      try {
+        await checkSignedRequest(db, machine.id, machine.signingSecret, request, "/api/stream", UNSIGNED_PAYLOAD);
+      } catch (error) {
+        if (error instanceof SignatureError) {
+          return errorResponse(error.message, 401);
+        }
+        throw error;
+      }
+    }
+
+    // Rate limit connection attempts, not snapshots
+    const rateCheck = checkRateLimit(`stream:${machine.id}`, RATE_LIMITS.stream);
+    if (!rateCheck.allowed) {
+      return rateLimitResponse(rateCheck.retryAfter ?? 60);
+    }
+
+    if (!request.body) {
+      return errorResponse("Request body must be a stream", 400);
+    }
+
+    const input = request.body.getReader();
+    const encoder = new TextEncoder();
+    const decoder = new TextDecoder();
+
+    const stream = new ReadableStream<Uint8Array>({
+      async start(controller) {
+        const send = (message: Record<string, unknown>) => controller.enqueue(encoder.encode(JSON.stringify(message) + "\n"));
+        const deadline = setTimeout(() => input.cancel().catch(() => undefined), MAX_STREAM_MS);
+
+        /** Handle one NDJSON line from the agent. */
+        const handleLine = async (line: string) => {
+          let message: StreamMessage;
+          try {
+            message = JSON.parse(line);
+          } catch {
+            send({ error: "Invalid JSON line" });
+            return;
+          }
+
+          if (message.type === "heartbeat") {
+            send({ heartbeat: true });
+            return;
+          }
+          if (message.type !== "snapshot" || typeof message.seq !== "number") {
+            send({ error: "Unknown message" });
+            return;
+          }
+
+          const parsed = singleMetricSchema.safeParse(message.snapshot);
+          if (!parsed.success) {
+            send({ nack: message.seq, error: "Invalid snapshot" });
+            return;
+          }
+          try {
+            await insertMetrics(db, machine.id, [parsed.data]);
+            send({ ack: message.seq });
+          } catch (error) {
+            console.error("Stream insert error:", error);
+            send({ nack: message.seq, error: "Internal server error" });
+          }
+        };
+
+        send({ ready: true });
+
+        let pending = "";
+        try {
+          for (;;) {
+            const { value, done } = await input.read();
+            if (done) break;
+
+            pending += decoder.decode(value, { stream: true });
+            if (pending.length > MAX_LINE_BYTES && !pending.includes("\n")) {
+              send({ error: "Line too long" });
+              break;
+            }
+
+            let newline: number;
+            while ((newline = pending.indexOf("\n")) >= 0) {
+              const line = pending.slice(0, newline).trim();
+              pending = pending.slice(newline + 1);
+              if (line) await handleLine(line);
+            }
+          }
+          if (pending.trim()) await handleLine(pending.trim());
+        } catch {
+          // Agent disconnected or the stream deadline passed
+        } finally {
+          clearTimeout(deadline);
+          controller.close();
+        }
+      },
+    });
+
+    return new Response(stream, {
+      status: 200,
+      headers: {
+        "Content-Type": "application/x-ndjson",
+        "Cache-Control": "no-store",
+        "X-Accel-Buffering": "no",
+      },
+    });
+  } catch (error) {
+    console.error("Stream error:", error);
+    return errorResponse("Internal server error", 500);
+  }
+}
@@ -0,0 +1,112 @@
+// Machine token lookup, enrollment codes and rotation
+// Agents that enroll with a one-time code receive a token that expires after
+// MACHINE_TOKEN_LIFETIME_MS. They rotate it via POST /api/rotate once
+// ROTATE_AFTER_MS has passed, or when an ingest or stream request is answered
+// with 401 and the X-Vitalis-Token: rotate header. That hint is sent for an
+// expired token and for the token replaced by the last rotation (the agent
+// lost the new one, e.g. crashed before saving it). The replaced token is
+// accepted only for PREVIOUS_TOKEN_GRACE_MS after the rotation, and is
+// dropped as soon as the new token is used.
+
+import crypto from "crypto";
+import { NextResponse } from "next/server";
+import { and, or, eq } from "drizzle-orm";
+import { getDb } from "@/lib/db";
+import { machines } from "@/lib/db/schema";
+import type { ConfigOverrides } from "@/lib/validation/machines";
+import { errorResponse } from "@/lib/utils/response";
+
+/** Lifetime of a token issued at enrollment or rotation */
+export const MACHINE_TOKEN_LIFETIME_MS = 30 * 24 * 60 * 60 * 1000;
+
+/** Agents rotate their token once it is this old */
+export const ROTATE_AFTER_MS = 15 * 24 * 60 * 60 * 1000;
+
+/** How long after expiry a token can still be rotated; after that the agent must enroll again */
+export const ROTATION_GRACE_MS = 90 * 24 * 60 * 60 * 1000;
+
+/** How long after a rotation the replaced token can still be rotated, unless the new token is used first */
+export const PREVIOUS_TOKEN_GRACE_MS = 60 * 60 * 1000;
+
+/** How long after enrollment the same agent can repeat it, with the same code and nonce, when it lost the response */
+export const ENROLLMENT_RETRY_WINDOW_MS = 10 * 60 * 1000;
+
+/** Response header telling the agent to rotate its token */
+export const TOKEN_ROTATION_HEADER = "X-Vitalis-Token";
+
+export function generateMachineToken(): string {
+  return `mtoken_${crypto.randomUUID()}`;
+}
+
+/** Generate a one-time enrollment code (96 bits, easy to paste). */
+export function generateEnrollmentCode(): string {
+  return `enr_${crypto.randomBytes(12).toString("hex")}`;
+}
+
+/** Enrollment codes are stored only as their SHA-256. */
+export function hashEnrollmentCode(code: string): string {
+  return crypto.createHash("sha256").update(code.trim()).digest("hex");
+}
+
+export interface MachineAuth {
+  id: string;
+  signingSecret: string | null;
+  /** The token is the one replaced by the last rotation */
+  replaced: boolean;
+  /** The token is expired or was replaced; the agent must rotate it before sending */
+  rotate: boolean;
+  /** An expired token past ROTATION_GRACE_MS, or a replaced one past PREVIOUS_TOKEN_GRACE_MS, that can no longer be rotated either */
+  revoked: boolean;
+  /** Settings set on the dashboard for the agent to apply */
+  configOverrides: ConfigOverrides | null;
+  /** Commands are waiting for the agent (see GET /api/agent/commands) */
+  commandsPending: boolean;
+}
+
+/** Look up the machine a token belongs to, including its replaced token. */
+export async function findMachineByToken(db: ReturnType<typeof getDb>, token: string, now = Date.now()): Promise<MachineAuth | null> {
+  const [machine] = await db
+    .select({
+      id: machines.id,
+      signingSecret: machines.signingSecret,
+      tokenExpiresAt: machines.tokenExpiresAt,
+      previousMachineToken: machines.previousMachineToken,
+      previousTokenReplacedAt: machines.previousTokenReplacedAt,
+      configOverrides: machines.configOverrides,
+      commandsQueuedAt: machines.commandsQueuedAt,
+    })
+    .from(machines)
+    .where(or(eq(machines.machineToken, token), eq(machines.previousMachineToken, token)))
+    .limit(1);
+  if (!machine) return null;
+
+  const expiresAt = machine.tokenExpiresAt ? new Date(machine.tokenExpiresAt).getTime() : Infinity;
+  const replaced = machine.previousMachineToken === token;
+  let revoked = expiresAt + ROTATION_GRACE_MS <= now;
+  if (replaced) {
+    const replacedAt = machine.previousTokenReplacedAt ? new Date(machine.previousTokenReplacedAt).getTime() : -Infinity;
+    revoked ||= replacedAt + PREVIOUS_TOKEN_GRACE_MS <= now;
+  } else if (machine.previousMachineToken) {
+    // The agent has the new token, so the replaced one is no longer needed
+    await db
+      .update(machines)
+      .set({ previousMachineToken: null, previousTokenReplacedAt: null })
+      .where(and(eq(machines.id, machine.id), eq(machines.machineToken, token)));
+  }
+  return {
+    id: machine.id,
+    signingSecret: machine.signingSecret ?? null,
+    replaced,
+    rotate: replaced || expiresAt <= now,
+    revoked,
+    configOverrides: machine.configOverrides ?? null,
+    commandsPending: Boolean(machine.commandsQueuedAt),
+  };
+}
+
+/** 401 asking the agent to rotate its token and retry. */
+export function tokenRotationResponse(): NextResponse {
+  const response = errorResponse("Machine token must be rotated", 401);
+  response.headers.set(TOKEN_ROTATION_HEADER, "rotate");
+  return response;
+}
@@ -0,0 +1,119 @@
+// Shared metric insertion for the ingest and stream endpoints
+
+import crypto from "crypto";
+import { eq } from "drizzle-orm";
+import type { BatchItem } from "drizzle-orm/batch";
+import { getDb } from "@/lib/db";
+import { metrics, processSnapshots, machines, requestNonces, ingestedBatches } from "@/lib/db/schema";
+import type { MetricBatchInput } from "@/lib/validation/metrics";
+import { verifySignature, SignatureError } from "@/lib/auth/signature";
+
+/** Thrown by insertMetrics when the batch ID was already ingested. */
+export class DuplicateBatchError extends Error {
+  constructor() {
+    super("Batch already ingested");
+    this.name = "DuplicateBatchError";
+  }
+}
+
+/** Batch ID (and sequence number) recorded for deduplication. */
+export interface BatchClaim {
+  batchId: string;
+  sequence: number | null;
+}
+
+/** Whether an error is the unique violation of an ingested_batches claim. */
+function isClaimConflict(error: unknown): boolean {
+  for (let e = error as { code?: string; constraint?: string; cause?: unknown } | undefined; e; e = e.cause as typeof e) {
+    if (e.code === "23505" && e.constraint === "ingested_batches_pkey") return true;
+  }
+  return false;
+}
+
+/**
+ * Insert a batch of metrics and process snapshots for a machine and
+ * update its last-seen time and OS info. Returns the number of metrics
+ * inserted.
+ *
+ * With a claim, the batch ID is recorded in the same transaction as the
+ * metrics: either both are written or neither is, so a retry after a
+ * failure is never mistaken for a duplicate, and a duplicate never writes
+ * metrics. Throws DuplicateBatchError if the batch ID was already claimed.
+ */
+export async function insertMetrics(db: ReturnType<typeof getDb>, machineId: string, metricBatch: MetricBatchInput["metrics"], claim?: BatchClaim): Promise<number> {
+  // Prepare metric values for bulk insert. IDs are generated here so the
+  // process snapshots can reference them within the same transaction.
+  const metricValues = metricBatch.map((m) => ({
+    id: crypto.randomUUID(),
+    machineId,
+    timestamp: new Date(m.timestamp),
+    cpuOverall: m.cpu_overall,
+    cpuCores: m.cpu_cores,
+    ramUsed: m.ram_used,
+    ramTotal: m.ram_total,
+    diskUsage: m.disk_usage,
+    networkRx: m.network_rx,
+    networkTx: m.network_tx,
+    uptimeSeconds: m.uptime_seconds,
+    cpuTemp: m.cpu_temp ?? null,
+    gpuTemp: m.gpu_temp ?? null,
+  }));
+
+  // Prepare process snapshot values for bulk insert
+  const processValues: { metricId: string; processes: unknown }[] = [];
+  for (let i = 0; i < metricBatch.length; i++) {
+    const m = metricBatch[i];
+    if (m.processes && m.processes.length > 0) {
+      processValues.push({
+        metricId: metricValues[i].id,
+        processes: m.processes,
+      });
+    }
+  }
+
+  // Extract OS info from the latest metric snapshot (if present)
+  const latestSnapshot = metricBatch[metricBatch.length - 1];
+  const machineUpdate: Record<string, unknown> = { lastSeen: new Date() };
+  if (latestSnapshot.os_name) {
+    machineUpdate.osName = latestSnapshot.os_name;
+  }
+  if (latestSnapshot.os_version) {
+    machineUpdate.osVersion = latestSnapshot.os_version;
+  }
+
+  // Claim, metrics, process snapshots and the machine's last_seen
+  // timestamp and OS info are written in one transaction
+  const queries: [BatchItem<"pg">, ...BatchItem<"pg">[]] = [db.insert(metrics).values(metricValues)];
+  if (claim) {
+    queries.unshift(db.insert(ingestedBatches).values({ machineId, batchId: claim.batchId, sequence: claim.sequence }));
+  }
+  if (processValues.length > 0) {
+    queries.push(db.insert(processSnapshots).values(processValues));
+  }
+  queries.push(db.update(machines).set(machineUpdate).where(eq(machines.id, machineId)));
+
+  try {
+    await db.batch(queries);
+  } catch (error) {
+    if (claim && isClaimConflict(error)) {
+      throw new DuplicateBatchError();
+    }
+    throw error;
+  }
+  return metricValues.length;
+}
+
+/**
+ * Check the signature of a request from a machine with a signing secret and
+ * record its nonce. `path` is the endpoint the agent signed ("/api/ingest"
+ * or "/api/stream"), independent of any prefix a reverse proxy strips.
+ * Throws SignatureError if the request is unsigned, stale, wrongly signed
+ * or a replay of an earlier one.
+ */
+export async function checkSignedRequest(db: ReturnType<typeof getDb>, machineId: string, secret: string, request: Request, path: string, digest: string): Promise<void> {
+  const nonce = verifySignature(request.headers, secret, request.method, path, digest);
+  const claimed = await db.insert(requestNonces).values({ machineId, nonce }).onConflictDoNothing().returning({ nonce: requestNonces.nonce });
+  if (claimed.length === 0) {
+    throw new SignatureError("Replayed request");
+  }
+}
@@ -0,0 +1,19 @@
+-- ============================================================
+-- Migration: Track ingested agent batches for deduplication
+-- ============================================================
+-- Agents attach a stable batch ID (UUID) and a per-agent sequence
+-- number to every batch and keep them across buffering and replay.
+-- A batch retried after a timeout (when the server had already
+-- written it) is recognised here and not inserted twice.
+-- Rows older than 30 days are removed by the cleanup job.
+-- ============================================================
+
+CREATE TABLE IF NOT EXISTS ingested_batches (
+  machine_id UUID NOT NULL REFERENCES machines(id) ON DELETE CASCADE,
+  batch_id UUID NOT NULL,
+  sequence BIGINT,
+  received_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+  PRIMARY KEY (machine_id, batch_id)
+);
+
+CREATE INDEX IF NOT EXISTS "idx_ingested_batches_received_at" ON "ingested_batches" ("received_at");
@@ -0,0 +1,22 @@
+-- ============================================================
+-- Migration: Optional HMAC request signing for agents
+-- ============================================================
+-- A machine with a signing secret must sign every ingest and
+-- stream request (timestamp, nonce and HMAC-SHA256 over the
+-- body); unsigned requests with its token are rejected.
+-- request_nonces remembers the nonces of accepted requests so a
+-- captured request cannot be replayed within the 5-minute
+-- signature window. Rows older than 1 day are removed by the
+-- cleanup job.
+-- ============================================================
+
+ALTER TABLE machines ADD COLUMN IF NOT EXISTS signing_secret VARCHAR(128);
+
+CREATE TABLE IF NOT EXISTS request_nonces (
+  machine_id UUID NOT NULL REFERENCES machines(id) ON DELETE CASCADE,
+  nonce VARCHAR(64) NOT NULL,
+  received_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+  PRIMARY KEY (machine_id, nonce)
+);
+
+CREATE INDEX IF NOT EXISTS "idx_request_nonces_received_at" ON "request_nonces" ("received_at");
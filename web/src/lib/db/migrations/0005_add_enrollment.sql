@@ -0,0 +1,30 @@
+-- ============================================================
+-- Migration: Machine enrollment and token rotation
+-- ============================================================
+-- Agents can enroll with a short-lived one-time code instead of a
+-- pasted machine token. Only the SHA-256 of each code is stored.
+-- Tokens issued at enrollment expire (token_expires_at) and are
+-- rotated by the agent; the replaced token is kept in
+-- previous_machine_token so an agent that lost the new token
+-- before saving it can still rotate again. Tokens created in the
+-- dashboard keep a NULL expiry and never expire.
+-- Used and expired codes older than 7 days are removed by the
+-- cleanup job.
+-- ============================================================
+
+ALTER TABLE machines ADD COLUMN IF NOT EXISTS token_expires_at TIMESTAMPTZ;
+ALTER TABLE machines ADD COLUMN IF NOT EXISTS previous_machine_token VARCHAR(255);
+
+CREATE INDEX IF NOT EXISTS idx_machines_previous_token ON machines (previous_machine_token);
+
+CREATE TABLE IF NOT EXISTS enrollment_codes (
+  code_hash VARCHAR(64) PRIMARY KEY,
+  user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+  name VARCHAR(255),
+  expires_at TIMESTAMPTZ NOT NULL,
+  used_at TIMESTAMPTZ,
+  machine_id UUID REFERENCES machines(id) ON DELETE SET NULL,
+  created_at TIMESTAMPTZ DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS "idx_enrollment_codes_expires_at" ON "enrollment_codes" ("expires_at");
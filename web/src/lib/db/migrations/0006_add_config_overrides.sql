@@ -0,0 +1,12 @@
+-- ============================================================
+-- Migration: Server-driven agent configuration overrides
+-- ============================================================
+-- Settings set for one machine on the dashboard (collection
+-- intervals, top processes, enabled collectors, log level).
+-- Agents fetch them from GET /api/agent/config, polling with the
+-- ETag of the overrides they have; ingest responses carry the
+-- current ETag so a change is picked up with the next batch.
+-- NULL means the agent's own configuration applies.
+-- ============================================================
+
+ALTER TABLE machines ADD COLUMN IF NOT EXISTS config_overrides JSONB;
@@ -0,0 +1,31 @@
+-- ============================================================
+-- Migration: Remote agent commands
+-- ============================================================
+-- Actions queued for one machine on the dashboard (collect now,
+-- flush buffer, check for update, rotate logs, diagnostics,
+-- restart). Agents that enable the command channel fetch pending
+-- commands from GET /api/agent/commands and report each result to
+-- POST /api/agent/commands/[id]/result. Commands not fetched
+-- before expires_at are never delivered.
+-- commands_queued_at is set while a machine has commands waiting,
+-- so ingest responses can tell the agent to fetch them without
+-- querying this table on every batch.
+-- ============================================================
+
+ALTER TABLE machines ADD COLUMN IF NOT EXISTS commands_queued_at TIMESTAMPTZ;
+
+CREATE TABLE IF NOT EXISTS agent_commands (
+  id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+  machine_id UUID NOT NULL REFERENCES machines(id) ON DELETE CASCADE,
+  command VARCHAR(32) NOT NULL,
+  status VARCHAR(16) NOT NULL DEFAULT 'pending',
+  created_by UUID REFERENCES users(id) ON DELETE SET NULL,
+  created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+  expires_at TIMESTAMPTZ NOT NULL,
+  delivered_at TIMESTAMPTZ,
+  completed_at TIMESTAMPTZ,
+  output TEXT,
+  error TEXT
+);
+
+CREATE INDEX IF NOT EXISTS "idx_agent_commands_machine_created" ON "agent_commands" ("machine_id", "created_at");
@@ -0,0 +1,14 @@
+-- ============================================================
+-- Migration: Limit how long a replaced machine token is accepted
+-- ============================================================
+-- previous_token_replaced_at records when the token in
+-- previous_machine_token was replaced. The replaced token can
+-- only be rotated again for a short time after that, and is
+-- cleared as soon as the agent uses its new token. Replaced
+-- tokens kept before this migration have no such time and are
+-- cleared here.
+-- ============================================================
+
+ALTER TABLE machines ADD COLUMN IF NOT EXISTS previous_token_replaced_at TIMESTAMPTZ;
+
+UPDATE machines SET previous_machine_token = NULL WHERE previous_token_replaced_at IS NULL;
@@ -0,0 +1,10 @@
+-- ============================================================
+-- Migration: Mark command output cut to the size limit
+-- ============================================================
+-- Agents cut command output longer than 256 KiB, at a character
+-- boundary, and say so in their result. output_truncated keeps
+-- that, so a partial diagnostics bundle is not mistaken for a
+-- complete one.
+-- ============================================================
+
+ALTER TABLE agent_commands ADD COLUMN IF NOT EXISTS output_truncated BOOLEAN NOT NULL DEFAULT FALSE;
@@ -0,0 +1,11 @@
+-- ============================================================
+-- Migration: Let an agent repeat an enrollment whose response was lost
+-- ============================================================
+-- The agent sends a random nonce with its enrollment request.
+-- enrollment_nonce keeps the nonce of the request that spent the
+-- code. For a short time after that, a request with the same code
+-- and nonce is answered with a new token for the enrolled machine
+-- instead of being rejected.
+-- ============================================================
+
+ALTER TABLE enrollment_codes ADD COLUMN IF NOT EXISTS enrollment_nonce VARCHAR(64);
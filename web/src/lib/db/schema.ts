@@ -2,7 +2,8 @@
 // Mirrors the SQL schema from docs/ARCHITECTURE.md Section 3
 // with refinements from the implementation spec
 
-import { pgTable, uuid, varchar, timestamp, real, bigint, integer, jsonb, date, uniqueIndex, index } from "drizzle-orm/pg-core";
+import { pgTable, uuid, varchar, text, timestamp, real, bigint, integer, jsonb, date, boolean, uniqueIndex, index, primaryKey } from "drizzle-orm/pg-core";
+import type { AgentCommand, ConfigOverrides } from "@/lib/validation/machines";
 
 // ============================================================
 // USERS
@@ -30,6 +31,18 @@ export const machines = pgTable("machines", {
   arch: varchar("arch", { length: 50 }),
   osVersion: varchar("os_version", { length: 100 }),
   osName: varchar("os_name", { length: 100 }),
+  // Set when the agent signs its requests (HMAC); unsigned requests are then rejected
+  signingSecret: varchar("signing_secret", { length: 128 }),
+  // Tokens issued at enrollment expire and are rotated by the agent; null never expires
+  tokenExpiresAt: timestamp("token_expires_at", { withTimezone: true }),
+  // The token replaced by the last rotation, accepted only to rotate again
+  previousMachineToken: varchar("previous_machine_token", { length: 255 }),
+  // When the previous token was replaced; it is accepted only shortly after
+  previousTokenReplacedAt: timestamp("previous_token_replaced_at", { withTimezone: true }),
+  // Settings the agent applies on top of its own config; null leaves it unchanged
+  configOverrides: jsonb("config_overrides").$type<ConfigOverrides>(),
+  // Set while commands are waiting for the agent to fetch them
+  commandsQueuedAt: timestamp("commands_queued_at", { withTimezone: true }),
   lastSeen: timestamp("last_seen", { withTimezone: true }),
   createdAt: timestamp("created_at", { withTimezone: true }).defaultNow(),
 });
@@ -137,6 +150,85 @@ export const metricsDaily = pgTable(
   (table) => [uniqueIndex("uq_metrics_daily_machine_day").on(table.machineId, table.day), index("idx_metrics_daily_machine_day").on(table.machineId, table.day)],
 );
 
+// ============================================================
+// INGESTED BATCHES (deduplication of agent retries, 30-day retention)
+// ============================================================
+export const ingestedBatches = pgTable(
+  "ingested_batches",
+  {
+    machineId: uuid("machine_id")
+      .notNull()
+      .references(() => machines.id, { onDelete: "cascade" }),
+    batchId: uuid("batch_id").notNull(),
+    sequence: bigint("sequence", { mode: "number" }),
+    receivedAt: timestamp("received_at", { withTimezone: true }).notNull().defaultNow(),
+  },
+  (table) => [primaryKey({ columns: [table.machineId, table.batchId] }), index("idx_ingested_batches_received_at").on(table.receivedAt)],
+);
+
+// ============================================================
+// REQUEST NONCES (replay protection for signed agent requests, 1-day retention)
+// ============================================================
+export const requestNonces = pgTable(
+  "request_nonces",
+  {
+    machineId: uuid("machine_id")
+      .notNull()
+      .references(() => machines.id, { onDelete: "cascade" }),
+    nonce: varchar("nonce", { length: 64 }).notNull(),
+    receivedAt: timestamp("received_at", { withTimezone: true }).notNull().defaultNow(),
+  },
+  (table) => [primaryKey({ columns: [table.machineId, table.nonce] }), index("idx_request_nonces_received_at").on(table.receivedAt)],
+);
+
+// ============================================================
+// ENROLLMENT CODES (one-time codes agents exchange for a machine token)
+// ============================================================
+export const enrollmentCodes = pgTable(
+  "enrollment_codes",
+  {
+    // SHA-256 of the code; the code itself is only shown once
+    codeHash: varchar("code_hash", { length: 64 }).primaryKey(),
+    userId: uuid("user_id")
+      .notNull()
+      .references(() => users.id, { onDelete: "cascade" }),
+    name: varchar("name", { length: 255 }),
+    expiresAt: timestamp("expires_at", { withTimezone: true }).notNull(),
+    usedAt: timestamp("used_at", { withTimezone: true }),
+    machineId: uuid("machine_id").references(() => machines.id, { onDelete: "set null" }),
+    // Nonce sent by the agent that spent the code, to recognize its retries
+    enrollmentNonce: varchar("enrollment_nonce", { length: 64 }),
+    createdAt: timestamp("created_at", { withTimezone: true }).defaultNow(),
+  },
+  (table) => [index("idx_enrollment_codes_expires_at").on(table.expiresAt)],
+);
+
+// ============================================================
+// AGENT COMMANDS (actions queued on the dashboard for an agent to run)
+// ============================================================
+export const agentCommands = pgTable(
+  "agent_commands",
+  {
+    id: uuid("id").primaryKey().defaultRandom(),
+    machineId: uuid("machine_id")
+      .notNull()
+      .references(() => machines.id, { onDelete: "cascade" }),
+    command: varchar("command", { length: 32 }).notNull().$type<AgentCommand>(),
+    // pending -> delivered -> succeeded | failed
+    status: varchar("status", { length: 16 }).notNull().default("pending"),
+    createdBy: uuid("created_by").references(() => users.id, { onDelete: "set null" }),
+    createdAt: timestamp("created_at", { withTimezone: true }).notNull().defaultNow(),
+    expiresAt: timestamp("expires_at", { withTimezone: true }).notNull(),
+    deliveredAt: timestamp("delivered_at", { withTimezone: true }),
+    completedAt: timestamp("completed_at", { withTimezone: true }),
+    output: text("output"),
+    // The agent cut the output to fit the size limit
+    outputTruncated: boolean("output_truncated").notNull().default(false),
+    error: text("error"),
+  },
+  (table) => [index("idx_agent_commands_machine_created").on(table.machineId, table.createdAt)],
+);
+
 // ============================================================
 // INFERRED TYPES
 // ============================================================
@@ -168,3 +260,19 @@ export type InsertMetricHourly = typeof metricsHourly.$inferInsert;
 // Metrics Daily
 export type SelectMetricDaily = typeof metricsDaily.$inferSelect;
 export type InsertMetricDaily = typeof metricsDaily.$inferInsert;
+
+// Ingested Batches
+export type SelectIngestedBatch = typeof ingestedBatches.$inferSelect;
+export type InsertIngestedBatch = typeof ingestedBatches.$inferInsert;
+
+// Request Nonces
+export type SelectRequestNonce = typeof requestNonces.$inferSelect;
+export type InsertRequestNonce = typeof requestNonces.$inferInsert;
+
+// Enrollment Codes
+export type SelectEnrollmentCode = typeof enrollmentCodes.$inferSelect;
+export type InsertEnrollmentCode = typeof enrollmentCodes.$inferInsert;
+
+// Agent Commands
+export type SelectAgentCommand = typeof agentCommands.$inferSelect;
+export type InsertAgentCommand = typeof agentCommands.$inferInsert;
@@ -0,0 +1,33 @@
+// Remote agent commands
+// Commands queued on the dashboard are fetched by the agent from
+// GET /api/agent/commands, and ingest responses carry the
+// COMMANDS_PENDING_HEADER while any are waiting. Each delivered command is
+// signed so the agent runs only commands issued by this server for this
+// machine: hex HMAC-SHA256 over the scheme name, the command ID, the command
+// and its expiry (Unix seconds) joined with "\n". The key is the machine's
+// signing secret; machines without one get no commands.
+
+import crypto from "crypto";
+import type { AgentCommand } from "@/lib/validation/machines";
+
+/** Ingest response header telling the agent that commands are waiting */
+export const COMMANDS_PENDING_HEADER = "X-Pending-Commands";
+
+/** Commands the agent has not fetched within this time are never delivered */
+export const COMMAND_TTL_MS = 15 * 60 * 1000;
+
+/**
+ * A delivered command without a result this long after delivery, and past
+ * its expiry, is shown as timed out: the response carrying it was lost, or
+ * the agent could not report the result. Agents stop a command after
+ * 5 minutes.
+ */
+export const COMMAND_RESULT_TIMEOUT_MS = 10 * 60 * 1000;
+
+export const COMMAND_SIGNATURE_SCHEME = "VITALIS-COMMAND-HMAC-SHA256";
+
+/** Sign a command for delivery to the agent. */
+export function signCommand(key: string, id: string, command: AgentCommand, expiresAt: Date): string {
+  const canonical = [COMMAND_SIGNATURE_SCHEME, id, command, String(Math.floor(expiresAt.getTime() / 1000))].join("\n");
+  return crypto.createHmac("sha256", key).update(canonical).digest("hex");
+}
@@ -0,0 +1,18 @@
+// Server-driven agent configuration overrides
+// Agents fetch their machine's overrides from GET /api/agent/config with
+// If-None-Match, and learn about changes from the CONFIG_ETAG_HEADER on
+// ingest responses. The ETag is derived from the overrides themselves, so
+// it changes exactly when they do and needs no version column.
+
+import crypto from "crypto";
+import type { ConfigOverrides } from "@/lib/validation/machines";
+
+/** Ingest response header carrying the ETag of the machine's overrides */
+export const CONFIG_ETAG_HEADER = "X-Config-ETag";
+
+/** Strong ETag of a machine's overrides (null when none are set). */
+export function configETag(overrides: ConfigOverrides | null | undefined): string {
+  const value = overrides ?? null;
+  const canonical = JSON.stringify(value, value ? Object.keys(value).sort() : undefined);
+  return `"${crypto.createHash("sha256").update(canonical).digest("hex").slice(0, 32)}"`;
+}
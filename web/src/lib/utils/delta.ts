@@ -0,0 +1,76 @@
+// Delta batch reconstruction
+// Agents with `delta: true` send the first snapshot of a batch in full and
+// every later one as a frame holding only what changed. Snapshot i is
+// rebuilt from snapshot i-1 and frame i:
+//   - a field missing from the frame keeps the previous snapshot's value;
+//   - timestamp, ram_used and uptime_seconds hold the difference from the
+//     previous value (timestamp in nanoseconds);
+//   - any other field present holds its new value.
+
+/** Fields sent as differences from the previous snapshot */
+const DIFFERENCE_FIELDS = ["ram_used", "uptime_seconds"];
+
+/** Frames beyond this are not expanded; validation rejects the batch */
+const MAX_FRAMES = 120;
+
+const NS_PER_SECOND = BigInt(1_000_000_000);
+
+/** Error for a delta batch that cannot be rebuilt */
+export class DeltaError extends Error {}
+
+const isRecord = (value: unknown): value is Record<string, unknown> => typeof value === "object" && value !== null && !Array.isArray(value);
+
+/**
+ * Rebuild full snapshots from a delta batch (`"format": "delta"`). Any other
+ * body is returned unchanged. Throws DeltaError for malformed frames.
+ */
+export function expandDeltaBatch(body: unknown): unknown {
+  if (!isRecord(body) || body.format !== "delta" || !Array.isArray(body.metrics) || body.metrics.length > MAX_FRAMES) {
+    return body;
+  }
+
+  const metrics: Record<string, unknown>[] = [];
+  for (const frame of body.metrics) {
+    if (!isRecord(frame)) throw new DeltaError("Frame is not an object");
+
+    const prev = metrics[metrics.length - 1];
+    if (!prev) {
+      metrics.push({ ...frame });
+      continue;
+    }
+
+    const snapshot = { ...prev };
+    for (const [key, value] of Object.entries(frame)) {
+      if (key === "timestamp") {
+        snapshot.timestamp = addNanoseconds(prev.timestamp, value);
+      } else if (DIFFERENCE_FIELDS.includes(key)) {
+        if (typeof value !== "number" || typeof prev[key] !== "number") throw new DeltaError(`Invalid ${key} difference`);
+        snapshot[key] = prev[key] + value;
+      } else {
+        snapshot[key] = value;
+      }
+    }
+    metrics.push(snapshot);
+  }
+
+  const expanded: Record<string, unknown> = { ...body, metrics };
+  delete expanded.format;
+  return expanded;
+}
+
+/** Add a nanosecond difference to an RFC 3339 UTC timestamp, keeping nanosecond precision. */
+function addNanoseconds(timestamp: unknown, delta: unknown): string {
+  const match = typeof timestamp === "string" ? /^(\d{4}-\d{2}-\d{2}T\d{2}:\d{2}:\d{2})(?:\.(\d{1,9}))?Z$/.exec(timestamp) : null;
+  if (!match || typeof delta !== "number" || !Number.isSafeInteger(delta)) {
+    throw new DeltaError("Invalid timestamp difference");
+  }
+
+  const seconds = Date.parse(`${match[1]}Z`) / 1000;
+  if (!Number.isFinite(seconds)) throw new DeltaError("Invalid timestamp");
+  const total = BigInt(seconds) * NS_PER_SECOND + BigInt((match[2] ?? "").padEnd(9, "0")) + BigInt(delta);
+  if (total < BigInt(0)) throw new DeltaError("Invalid timestamp difference");
+
+  const whole = new Date(Number(total / NS_PER_SECOND) * 1000).toISOString().slice(0, 19);
+  const fraction = (total % NS_PER_SECOND).toString().padStart(9, "0");
+  return `${whole}.${fraction}Z`;
+}
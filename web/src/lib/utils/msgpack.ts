@@ -0,0 +1,119 @@
+// Minimal MessagePack decoder for agent payloads (https://msgpack.org/)
+// Decodes to the same plain objects JSON.parse would produce, so the result
+// can be validated with the same schemas. Extension types are not supported.
+
+/** Error thrown for malformed or unsupported MessagePack input */
+export class MsgpackError extends Error {}
+
+/** Maximum nesting depth, to bound recursion on hostile input */
+const MAX_DEPTH = 32;
+
+/**
+ * Decode a MessagePack document. Integers beyond Number.MAX_SAFE_INTEGER
+ * lose precision, as they would in JSON.parse.
+ */
+export function decodeMsgpack(input: Uint8Array): unknown {
+  const view = new DataView(input.buffer, input.byteOffset, input.byteLength);
+  const text = new TextDecoder("utf-8", { fatal: true });
+  let pos = 0;
+
+  const need = (n: number) => {
+    if (pos + n > input.byteLength) throw new MsgpackError("Unexpected end of input");
+    const start = pos;
+    pos += n;
+    return start;
+  };
+  const str = (n: number) => {
+    const start = need(n);
+    return text.decode(input.subarray(start, start + n));
+  };
+  const bin = (n: number) => {
+    const start = need(n);
+    return input.slice(start, start + n);
+  };
+
+  const value = (depth: number): unknown => {
+    if (depth > MAX_DEPTH) throw new MsgpackError("Nesting too deep");
+    const type = view.getUint8(need(1));
+
+    if (type <= 0x7f) return type; // positive fixint
+    if (type >= 0xe0) return type - 0x100; // negative fixint
+    if ((type & 0xf0) === 0x80) return map(type & 0x0f, depth);
+    if ((type & 0xf0) === 0x90) return array(type & 0x0f, depth);
+    if ((type & 0xe0) === 0xa0) return str(type & 0x1f);
+
+    switch (type) {
+      case 0xc0:
+        return null;
+      case 0xc2:
+        return false;
+      case 0xc3:
+        return true;
+      case 0xc4:
+        return bin(view.getUint8(need(1)));
+      case 0xc5:
+        return bin(view.getUint16(need(2)));
+      case 0xc6:
+        return bin(view.getUint32(need(4)));
+      case 0xca:
+        return view.getFloat32(need(4));
+      case 0xcb:
+        return view.getFloat64(need(8));
+      case 0xcc:
+        return view.getUint8(need(1));
+      case 0xcd:
+        return view.getUint16(need(2));
+      case 0xce:
+        return view.getUint32(need(4));
+      case 0xcf:
+        return Number(view.getBigUint64(need(8)));
+      case 0xd0:
+        return view.getInt8(need(1));
+      case 0xd1:
+        return view.getInt16(need(2));
+      case 0xd2:
+        return view.getInt32(need(4));
+      case 0xd3:
+        return Number(view.getBigInt64(need(8)));
+      case 0xd9:
+        return str(view.getUint8(need(1)));
+      case 0xda:
+        return str(view.getUint16(need(2)));
+      case 0xdb:
+        return str(view.getUint32(need(4)));
+      case 0xdc:
+        return array(view.getUint16(need(2)), depth);
+      case 0xdd:
+        return array(view.getUint32(need(4)), depth);
+      case 0xde:
+        return map(view.getUint16(need(2)), depth);
+      case 0xdf:
+        return map(view.getUint32(need(4)), depth);
+    }
+    throw new MsgpackError(`Unsupported type 0x${type.toString(16)}`);
+  };
+
+  const array = (n: number, depth: number) => {
+    // Every element takes at least one byte
+    if (pos + n > input.byteLength) throw new MsgpackError("Unexpected end of input");
+    const out: unknown[] = new Array(n);
+    for (let i = 0; i < n; i++) out[i] = value(depth + 1);
+    return out;
+  };
+
+  const map = (n: number, depth: number) => {
+    if (pos + 2 * n > input.byteLength) throw new MsgpackError("Unexpected end of input");
+    const out: Record<string, unknown> = {};
+    for (let i = 0; i < n; i++) {
+      const key = value(depth + 1);
+      if (typeof key !== "string") throw new MsgpackError("Map keys must be strings");
+      // Own data property, so keys like "__proto__" cannot alter the prototype
+      Object.defineProperty(out, key, { value: value(depth + 1), enumerable: true, writable: true, configurable: true });
+    }
+    return out;
+  };
+
+  const result = value(0);
+  if (pos !== input.byteLength) throw new MsgpackError("Trailing bytes after document");
+  return result;
+}
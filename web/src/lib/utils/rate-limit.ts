@@ -87,5 +87,7 @@ export function rateLimit(
 export const RATE_LIMITS = {
   auth: { windowMs: 15 * 60 * 1000, maxRequests: 10 } as RateLimitConfig, // 10 per 15 min
   ingest: { windowMs: 60 * 1000, maxRequests: 10 } as RateLimitConfig, // 10 per minute per machine
+  stream: { windowMs: 60 * 1000, maxRequests: 5 } as RateLimitConfig, // 5 stream connections per minute per machine
+  enroll: { windowMs: 15 * 60 * 1000, maxRequests: 20 } as RateLimitConfig, // 20 enrollments or rotations per 15 min per IP
   api: { windowMs: 60 * 1000, maxRequests: 60 } as RateLimitConfig, // 60 per minute
 } as const;
@@ -0,0 +1,57 @@
+// Ingest payload formats — content types and encodings accepted from agents
+// Agents discover these via GET /api/ingest and fall back to JSON with gzip.
+
+import * as zlib from "zlib";
+import { decodeMsgpack } from "@/lib/utils/msgpack";
+
+/** Content types agents may send; the first MessagePack type is advertised */
+export const MSGPACK_CONTENT_TYPES = ["application/msgpack", "application/vnd.msgpack", "application/x-msgpack"];
+
+// zlib.zstdDecompressSync exists from Node.js 22.15 / 23.8 on
+const zstdDecompressSync = (zlib as unknown as { zstdDecompressSync?: (buf: Buffer) => Buffer }).zstdDecompressSync;
+
+/** Error for a content encoding this server cannot decompress (HTTP 415) */
+export class UnsupportedEncodingError extends Error {}
+
+/** Formats advertised to agents by GET /api/ingest */
+export function ingestCapabilities() {
+  return {
+    content_types: ["application/json", MSGPACK_CONTENT_TYPES[0]],
+    content_encodings: supportedEncodings(),
+    batch_formats: ["full", "delta"],
+  };
+}
+
+/** Content encodings this server can decompress */
+export function supportedEncodings(): string[] {
+  return zstdDecompressSync ? ["gzip", "zstd"] : ["gzip"];
+}
+
+/**
+ * Decompress and parse a request body. MessagePack bodies are recognised by
+ * their content type; anything else is parsed as JSON.
+ * Throws UnsupportedEncodingError for an unknown content encoding.
+ */
+export function decodeBody(raw: Buffer, contentType: string | null, contentEncoding: string | null): unknown {
+  let data: Buffer;
+  switch (contentEncoding?.trim().toLowerCase() || "identity") {
+    case "identity":
+      data = raw;
+      break;
+    case "gzip":
+      data = zlib.gunzipSync(raw);
+      break;
+    case "zstd":
+      if (!zstdDecompressSync) throw new UnsupportedEncodingError("zstd");
+      data = zstdDecompressSync(raw);
+      break;
+    default:
+      throw new UnsupportedEncodingError(contentEncoding ?? "");
+  }
+
+  const mediaType = contentType?.split(";")[0].trim().toLowerCase() ?? "";
+  if (MSGPACK_CONTENT_TYPES.includes(mediaType)) {
+    return decodeMsgpack(data);
+  }
+  return JSON.parse(data.toString("utf-8"));
+}
@@ -8,8 +8,27 @@ export const createMachineSchema = z.object({
   arch: z.string().max(50).optional(),
 });
 
+/** Collectors an agent can be told to run (all run when none are listed) */
+export const AGENT_COLLECTORS = ["cpu", "memory", "disk", "network", "processes", "uptime", "temperature", "shutdown", "osinfo"] as const;
+
+/** Settings pushed to one machine's agent, applied on top of its config file */
+export const configOverridesSchema = z
+  .object({
+    interval_seconds: z.number().int().min(1).max(3600).optional(),
+    batch_interval_seconds: z.number().int().min(1).max(86400).optional(),
+    top_processes: z.number().int().min(0).max(100).optional(),
+    collectors: z.array(z.enum(AGENT_COLLECTORS)).max(AGENT_COLLECTORS.length).optional(),
+    log_level: z.enum(["debug", "info", "warn", "error"]).optional(),
+  })
+  .refine((o) => o.interval_seconds === undefined || o.batch_interval_seconds === undefined || o.batch_interval_seconds >= o.interval_seconds, {
+    message: "batch_interval_seconds must not be shorter than interval_seconds",
+    path: ["batch_interval_seconds"],
+  });
+
 export const updateMachineSchema = z.object({
   name: z.string().min(1).max(255).trim().optional(),
+  // null clears all overrides
+  config_overrides: configOverridesSchema.nullable().optional(),
 });
 
 export const shareMachineSchema = z.object({
@@ -23,10 +42,43 @@ export const metricQuerySchema = z.object({
   resolution: z.enum(["raw", "hourly", "daily"]).default("raw"),
 });
 
+/** Actions an agent can be told to run (see GET /api/agent/commands) */
+export const AGENT_COMMANDS = ["collect_now", "flush_buffer", "check_update", "rotate_logs", "diagnostics", "restart"] as const;
+
+export const createCommandSchema = z.object({
+  command: z.enum(AGENT_COMMANDS),
+});
+
+/** Result an agent reports for a command it ran */
+export const commandResultSchema = z.object({
+  status: z.enum(["succeeded", "failed"]),
+  output: z.string().max(256 * 1024).optional(),
+  truncated: z.boolean().optional(),
+  error: z.string().max(4096).optional(),
+});
+
+export const createEnrollmentCodeSchema = z.object({
+  name: z.string().min(1).max(255).trim().optional(),
+  expires_in_minutes: z.number().int().min(5).max(7 * 24 * 60).default(60),
+});
+
+export const enrollSchema = z.object({
+  code: z.string().min(1).max(64),
+  nonce: z.string().min(16).max(64).optional(),
+  name: z.string().min(1).max(255).trim().optional(),
+  os: z.string().max(50).optional(),
+  arch: z.string().max(50).optional(),
+});
+
 export type CreateMachineInput = z.infer<typeof createMachineSchema>;
 export type UpdateMachineInput = z.infer<typeof updateMachineSchema>;
+export type ConfigOverrides = z.infer<typeof configOverridesSchema>;
+export type AgentCommand = (typeof AGENT_COMMANDS)[number];
+export type CommandResult = z.infer<typeof commandResultSchema>;
 export type ShareMachineInput = z.infer<typeof shareMachineSchema>;
 export type MetricQueryInput = z.infer<typeof metricQuerySchema>;
+export type CreateEnrollmentCodeInput = z.infer<typeof createEnrollmentCodeSchema>;
+export type EnrollInput = z.infer<typeof enrollSchema>;
 
 export const downloadQuerySchema = z.object({
   os: z.enum(["windows", "linux", "darwin"]),
@@ -18,6 +18,13 @@ export const processEntrySchema = z.object({
   status: z.string().max(50),
 });
 
+/** The agent's own health at collection time (sender circuit breaker, offline buffer) */
+export const agentStatsSchema = z.object({
+  sender_state: z.enum(["closed", "open", "half_open"]),
+  send_failures: z.number().int().nonnegative(),
+  buffered_batches: z.number().int().nonnegative(),
+});
+
 export const singleMetricSchema = z.object({
   timestamp: z.string().regex(/^\d{4}-\d{2}-\d{2}T\d{2}:\d{2}:\d{2}(\.\d{1,9})?Z$/, "Invalid ISO 8601 timestamp (expected UTC with optional fractional seconds)"),
   cpu_overall: z.number().min(0).max(100),
@@ -45,10 +52,13 @@ export const singleMetricSchema = z.object({
     .transform((v) => v ?? []),
   os_version: z.string().max(100).optional(),
   os_name: z.string().max(100).optional(),
+  agent: agentStatsSchema.nullable().optional(),
 });
 
 export const metricBatchSchema = z.object({
   machine_token: z.string().min(1).max(255).optional(), // Optional in body — prefer Authorization header (MEDIUM-3)
+  batch_id: z.string().uuid().optional(), // Stable across agent retries, used for deduplication
+  sequence: z.number().int().nonnegative().optional(), // Per-agent batch counter
   metrics: z.array(singleMetricSchema).min(1).max(120), // max ~2 minutes of 15s intervals
 });
 
@@ -0,0 +1,220 @@
+// Integration tests for the agent command channel:
+//   GET  /api/agent/commands — pending commands for the calling agent
+//   POST /api/agent/commands/[id]/result — result of a command the agent ran
+//   GET  /api/machines/[id]/commands — recent commands (owner only)
+//   POST /api/machines/[id]/commands — queue a command (owner only)
+
+import { NextRequest } from "next/server";
+
+// ---------------------------------------------------------------------------
+// Mocks — must be declared before importing the route handlers
+// ---------------------------------------------------------------------------
+
+const mockLimit = jest.fn();
+const mockUpdateSet = jest.fn();
+const mockUpdateReturning = jest.fn();
+const mockNonceReturning = jest.fn();
+const mockDb = {
+  select: jest.fn(() => ({
+    from: jest.fn(() => ({
+      where: jest.fn(() => ({ limit: mockLimit, orderBy: jest.fn(() => ({ limit: mockLimit })) })),
+    })),
+  })),
+  update: jest.fn(() => ({
+    set: mockUpdateSet.mockImplementation(() => ({
+      where: jest.fn(() => Object.assign(Promise.resolve(undefined), { returning: mockUpdateReturning })),
+    })),
+  })),
+  insert: jest.fn(() => ({ values: jest.fn(() => ({ onConflictDoNothing: jest.fn(() => ({ returning: mockNonceReturning })) })) })),
+};
+
+jest.mock("@/lib/db", () => ({
+  getDb: jest.fn(() => mockDb),
+}));
+
+import { GET } from "@/app/api/agent/commands/route";
+import { POST } from "@/app/api/agent/commands/[id]/result/route";
+import { GET as listCommands, POST as queueCommand } from "@/app/api/machines/[id]/commands/route";
+import { createAccessToken } from "@/lib/auth/jwt";
+import { bodyDigest, signRequest } from "@/lib/auth/signature";
+import { COMMAND_RESULT_TIMEOUT_MS, signCommand } from "@/lib/utils/agent-commands";
+
+// ---------------------------------------------------------------------------
+// Helpers
+// ---------------------------------------------------------------------------
+
+const commandId = "3b241101-e2bb-4255-8caf-4136c566a962";
+const expiresAt = new Date(Date.now() + 60_000);
+
+const signingSecret = "msecret_test";
+
+/** A request for pending commands, signed unless signed is false. */
+function get(signed = true) {
+  const headers: Record<string, string> = { Authorization: "Bearer mtoken_test" };
+  if (signed) {
+    const timestamp = String(Math.floor(Date.now() / 1000));
+    const nonce = "00112233445566778899aabbccddeeff";
+    headers["X-Vitalis-Timestamp"] = timestamp;
+    headers["X-Vitalis-Nonce"] = nonce;
+    headers["X-Vitalis-Signature"] = signRequest(signingSecret, "GET", "/api/agent/commands", timestamp, nonce, bodyDigest(Buffer.alloc(0)));
+  }
+  return new NextRequest("http://localhost/api/agent/commands", { method: "GET", headers });
+}
+
+function postResult(body: unknown, id = commandId) {
+  const req = new NextRequest(`http://localhost/api/agent/commands/${id}/result`, {
+    method: "POST",
+    body: JSON.stringify(body),
+    headers: { Authorization: "Bearer mtoken_test", "Content-Type": "application/json" },
+  });
+  return POST(req, { params: Promise.resolve({ id }) });
+}
+
+beforeEach(() => {
+  jest.clearAllMocks();
+  mockNonceReturning.mockResolvedValue([{ nonce: "n" }]);
+});
+
+// ---------------------------------------------------------------------------
+// Tests
+// ---------------------------------------------------------------------------
+
+describe("GET /api/agent/commands", () => {
+  it("delivers pending commands signed with the signing secret", async () => {
+    mockLimit
+      .mockResolvedValueOnce([{ id: "machine-1", signingSecret, commandsQueuedAt: new Date() }])
+      .mockResolvedValueOnce([{ id: commandId, command: "collect_now", expiresAt }]);
+
+    const res = await GET(get());
+    expect(res.status).toBe(200);
+    const { commands } = (await res.json()).data;
+    expect(commands).toEqual([
+      {
+        id: commandId,
+        command: "collect_now",
+        expires_at: Math.floor(expiresAt.getTime() / 1000),
+        signature: signCommand(signingSecret, commandId, "collect_now", expiresAt),
+      },
+    ]);
+
+    // The ingest hint is cleared and the command marked delivered
+    expect(mockUpdateSet).toHaveBeenCalledWith({ commandsQueuedAt: null });
+    expect(mockUpdateSet).toHaveBeenCalledWith(expect.objectContaining({ status: "delivered" }));
+  });
+
+  it("signs over the command under the key", () => {
+    expect(signCommand("msecret_test", commandId, "restart", expiresAt)).not.toBe(signCommand("msecret_other", commandId, "restart", expiresAt));
+    expect(signCommand("msecret_test", commandId, "restart", expiresAt)).not.toBe(signCommand("msecret_test", commandId, "collect_now", expiresAt));
+  });
+
+  it("delivers nothing to machines without a signing secret", async () => {
+    mockLimit.mockResolvedValueOnce([{ id: "machine-1", commandsQueuedAt: new Date() }]);
+
+    const res = await GET(get(false));
+    expect(res.status).toBe(403);
+    expect(mockUpdateSet).not.toHaveBeenCalled();
+  });
+
+  it("returns 401 for an unsigned request", async () => {
+    mockLimit.mockResolvedValueOnce([{ id: "machine-1", signingSecret }]);
+
+    expect((await GET(get(false))).status).toBe(401);
+    expect(mockUpdateSet).not.toHaveBeenCalled();
+  });
+
+  it("returns an empty list when nothing is pending", async () => {
+    mockLimit.mockResolvedValueOnce([{ id: "machine-1", signingSecret }]).mockResolvedValueOnce([]);
+
+    const res = await GET(get());
+    expect(res.status).toBe(200);
+    expect((await res.json()).data.commands).toEqual([]);
+    expect(mockUpdateSet).not.toHaveBeenCalled();
+  });
+
+  it("returns 401 for an unknown token", async () => {
+    mockLimit.mockResolvedValueOnce([]);
+
+    expect((await GET(get())).status).toBe(401);
+  });
+});
+
+describe("POST /api/agent/commands/[id]/result", () => {
+  it("records the result of a delivered command", async () => {
+    mockLimit.mockResolvedValueOnce([{ id: "machine-1" }]);
+    mockUpdateReturning.mockResolvedValueOnce([{ id: commandId }]);
+
+    const res = await postResult({ status: "succeeded", output: "collected" });
+    expect(res.status).toBe(200);
+    expect(mockUpdateSet).toHaveBeenCalledWith(expect.objectContaining({ status: "succeeded", output: "collected", outputTruncated: false, error: null }));
+  });
+
+  it("records that the agent truncated the output", async () => {
+    mockLimit.mockResolvedValueOnce([{ id: "machine-1" }]);
+    mockUpdateReturning.mockResolvedValueOnce([{ id: commandId }]);
+
+    const res = await postResult({ status: "succeeded", output: "partial", truncated: true });
+    expect(res.status).toBe(200);
+    expect(mockUpdateSet).toHaveBeenCalledWith(expect.objectContaining({ output: "partial", outputTruncated: true }));
+  });
+
+  it("returns 404 for a command not delivered to this machine", async () => {
+    mockLimit.mockResolvedValueOnce([{ id: "machine-1" }]);
+    mockUpdateReturning.mockResolvedValueOnce([]);
+
+    expect((await postResult({ status: "failed", error: "boom" })).status).toBe(404);
+    expect((await postResult({ status: "failed" }, "not-a-uuid")).status).toBe(404);
+  });
+
+  it("returns 422 for an invalid result", async () => {
+    mockLimit.mockResolvedValueOnce([{ id: "machine-1" }]);
+
+    expect((await postResult({ status: "done" })).status).toBe(422);
+  });
+});
+
+describe("POST /api/machines/[id]/commands", () => {
+  async function queue(command: string) {
+    const req = new NextRequest("http://localhost/api/machines/machine-1/commands", {
+      method: "POST",
+      body: JSON.stringify({ command }),
+      headers: { "Content-Type": "application/json" },
+    });
+    req.cookies.set("access_token", await createAccessToken({ sub: "user-1", email: "test@example.com", role: "USER" }));
+    return queueCommand(req, { params: Promise.resolve({ id: "machine-1" }) });
+  }
+
+  it("refuses commands for a machine without a signing secret", async () => {
+    mockLimit.mockResolvedValueOnce([{ userId: "user-1", signingSecret: null }]);
+
+    const res = await queue("restart");
+    expect(res.status).toBe(409);
+    expect(mockDb.insert).not.toHaveBeenCalled();
+  });
+
+  it("refuses commands for another user's machine", async () => {
+    mockLimit.mockResolvedValueOnce([{ userId: "user-2", signingSecret }]);
+
+    expect((await queue("restart")).status).toBe(403);
+    expect(mockDb.insert).not.toHaveBeenCalled();
+  });
+});
+
+describe("GET /api/machines/[id]/commands", () => {
+  it("lists commands delivered without a result as timed out", async () => {
+    const ago = (ms: number) => new Date(Date.now() - ms);
+    mockLimit.mockResolvedValueOnce([{ userId: "user-1", signingSecret }]).mockResolvedValueOnce([
+      { id: "c1", status: "delivered", expiresAt: ago(60_000), deliveredAt: ago(COMMAND_RESULT_TIMEOUT_MS + 1000) },
+      { id: "c2", status: "delivered", expiresAt: ago(60_000), deliveredAt: ago(60_000) },
+      { id: "c3", status: "delivered", expiresAt: new Date(Date.now() + 60_000), deliveredAt: ago(COMMAND_RESULT_TIMEOUT_MS + 1000) },
+      { id: "c4", status: "pending", expiresAt: ago(1000), deliveredAt: null },
+      { id: "c5", status: "succeeded", expiresAt: ago(60_000), deliveredAt: ago(COMMAND_RESULT_TIMEOUT_MS + 1000) },
+    ]);
+    const req = new NextRequest("http://localhost/api/machines/machine-1/commands");
+    req.cookies.set("access_token", await createAccessToken({ sub: "user-1", email: "test@example.com", role: "USER" }));
+
+    const res = await listCommands(req, { params: Promise.resolve({ id: "machine-1" }) });
+    expect(res.status).toBe(200);
+    const { data } = await res.json();
+    expect(data.commands.map((c: { status: string }) => c.status)).toEqual(["timed_out", "delivered", "delivered", "expired", "succeeded"]);
+  });
+});
@@ -0,0 +1,90 @@
+// Integration tests for GET /api/agent/config — config overrides for agents
+
+import { NextRequest } from "next/server";
+
+// ---------------------------------------------------------------------------
+// Mocks — must be declared before importing the route handler
+// ---------------------------------------------------------------------------
+
+const mockLimit = jest.fn();
+const mockNonceReturning = jest.fn();
+const mockDb = {
+  select: jest.fn(() => ({ from: jest.fn(() => ({ where: jest.fn(() => ({ limit: mockLimit })) })) })),
+  insert: jest.fn(() => ({ values: jest.fn(() => ({ onConflictDoNothing: jest.fn(() => ({ returning: mockNonceReturning })) })) })),
+};
+
+jest.mock("@/lib/db", () => ({
+  getDb: jest.fn(() => mockDb),
+}));
+
+import { GET } from "@/app/api/agent/config/route";
+import { bodyDigest, signRequest } from "@/lib/auth/signature";
+import { configETag } from "@/lib/utils/agent-config";
+
+// ---------------------------------------------------------------------------
+// Helpers
+// ---------------------------------------------------------------------------
+
+function get(headers: Record<string, string> = {}) {
+  return new NextRequest("http://localhost/api/agent/config", {
+    method: "GET",
+    headers: { Authorization: "Bearer mtoken_test", ...headers },
+  });
+}
+
+const overrides = { interval_seconds: 5, log_level: "debug" as const };
+
+beforeEach(() => {
+  jest.clearAllMocks();
+  mockNonceReturning.mockResolvedValue([{ nonce: "n" }]);
+});
+
+// ---------------------------------------------------------------------------
+// Tests
+// ---------------------------------------------------------------------------
+
+describe("GET /api/agent/config", () => {
+  it("returns the machine's overrides with their ETag", async () => {
+    mockLimit.mockResolvedValueOnce([{ id: "machine-1", configOverrides: overrides }]);
+
+    const res = await GET(get());
+    expect(res.status).toBe(200);
+    expect(res.headers.get("ETag")).toBe(configETag(overrides));
+    expect((await res.json()).data.overrides).toEqual(overrides);
+  });
+
+  it("returns null when no overrides are set", async () => {
+    mockLimit.mockResolvedValueOnce([{ id: "machine-1", configOverrides: null }]);
+
+    const res = await GET(get());
+    expect(res.status).toBe(200);
+    expect((await res.json()).data.overrides).toBeNull();
+  });
+
+  it("returns 304 while the overrides are unchanged", async () => {
+    mockLimit.mockResolvedValueOnce([{ id: "machine-1", configOverrides: overrides }]);
+
+    const res = await GET(get({ "If-None-Match": configETag(overrides) }));
+    expect(res.status).toBe(304);
+  });
+
+  it("returns 401 for an unknown token", async () => {
+    mockLimit.mockResolvedValueOnce([]);
+
+    const res = await GET(get());
+    expect(res.status).toBe(401);
+  });
+
+  it("requires a signature from machines with a signing secret", async () => {
+    const signingSecret = "msecret_test";
+    mockLimit.mockResolvedValue([{ id: "machine-1", signingSecret, configOverrides: overrides }]);
+
+    expect((await GET(get())).status).toBe(401);
+
+    const timestamp = String(Math.floor(Date.now() / 1000));
+    const nonce = "00112233445566778899aabbccddeeff";
+    const signature = signRequest(signingSecret, "GET", "/api/agent/config", timestamp, nonce, bodyDigest(Buffer.alloc(0)));
+    const res = await GET(get({ "X-Vitalis-Timestamp": timestamp, "X-Vitalis-Nonce": nonce, "X-Vitalis-Signature": signature }));
+    expect(res.status).toBe(200);
+  });
+});
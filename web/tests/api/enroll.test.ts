@@ -0,0 +1,184 @@
+// Integration tests for POST /api/enroll and POST /api/rotate — machine enrollment and token rotation
+
+import { NextRequest } from "next/server";
+
+// ---------------------------------------------------------------------------
+// Mocks — must be declared before importing the route handlers
+// ---------------------------------------------------------------------------
+
+const mockLimit = jest.fn();
+const mockUpdateReturning = jest.fn();
+const mockUpdateWhere = jest.fn();
+const mockUpdateSet = jest.fn();
+const mockInsertValues = jest.fn();
+const mockDb = {
+  select: jest.fn(() => ({ from: jest.fn(() => ({ where: jest.fn(() => ({ limit: mockLimit })) })) })),
+  update: jest.fn(() => ({ set: mockUpdateSet })),
+  insert: jest.fn(() => ({ values: mockInsertValues })),
+};
+
+jest.mock("@/lib/db", () => ({
+  getDb: jest.fn(() => mockDb),
+}));
+
+jest.mock("@/lib/utils/rate-limit", () => ({
+  checkRateLimit: jest.fn().mockReturnValue({ allowed: true, remaining: 19, resetAt: Date.now() + 60_000 }),
+  RATE_LIMITS: {
+    enroll: { windowMs: 15 * 60 * 1000, maxRequests: 20 },
+  },
+}));
+
+import { POST as enroll } from "@/app/api/enroll/route";
+import { POST as rotate } from "@/app/api/rotate/route";
+import { hashEnrollmentCode, PREVIOUS_TOKEN_GRACE_MS, ROTATION_GRACE_MS } from "@/lib/auth/machine-token";
+
+// ---------------------------------------------------------------------------
+// Helpers
+// ---------------------------------------------------------------------------
+
+function post(path: string, body: unknown, headers: Record<string, string> = {}) {
+  return new NextRequest(`http://localhost${path}`, {
+    method: "POST",
+    body: JSON.stringify(body),
+    headers: { "Content-Type": "application/json", ...headers },
+  });
+}
+
+beforeEach(() => {
+  jest.clearAllMocks();
+  mockUpdateWhere.mockReturnValue(Object.assign(Promise.resolve(undefined), { returning: mockUpdateReturning }));
+  mockUpdateSet.mockReturnValue({ where: mockUpdateWhere });
+  mockInsertValues.mockReturnValue({ returning: jest.fn().mockResolvedValue([{ id: "machine-1" }]) });
+});
+
+// ---------------------------------------------------------------------------
+// Tests
+// ---------------------------------------------------------------------------
+
+describe("POST /api/enroll", () => {
+  it("exchanges a valid code for an expiring machine token", async () => {
+    mockUpdateReturning.mockResolvedValueOnce([{ userId: "user-1", name: "web-01", codeHash: hashEnrollmentCode("enr_abc") }]);
+
+    const res = await enroll(post("/api/enroll", { code: "enr_abc", name: "ignored", os: "linux", arch: "amd64" }));
+    expect(res.status).toBe(201);
+
+    const { data } = await res.json();
+    expect(data.machine_id).toBe("machine-1");
+    expect(data.machine_token).toMatch(/^mtoken_/);
+    expect(new Date(data.rotate_at).getTime()).toBeLessThan(new Date(data.expires_at).getTime());
+    expect(mockInsertValues).toHaveBeenCalledWith(expect.objectContaining({ userId: "user-1", name: "web-01", machineToken: data.machine_token, os: "linux" }));
+  });
+
+  it("returns 401 for an unknown, used or expired code", async () => {
+    mockUpdateReturning.mockResolvedValueOnce([]);
+
+    const res = await enroll(post("/api/enroll", { code: "enr_used" }));
+    expect(res.status).toBe(401);
+    expect(mockInsertValues).not.toHaveBeenCalled();
+  });
+
+  it("keeps the nonce of the request that spends the code", async () => {
+    mockUpdateReturning.mockResolvedValueOnce([{ userId: "user-1", name: null, codeHash: hashEnrollmentCode("enr_abc") }]);
+
+    const res = await enroll(post("/api/enroll", { code: "enr_abc", nonce: "0123456789abcdef0123456789abcdef" }));
+    expect(res.status).toBe(201);
+    expect(mockUpdateSet).toHaveBeenCalledWith(expect.objectContaining({ enrollmentNonce: "0123456789abcdef0123456789abcdef" }));
+  });
+
+  it("issues a new token to the agent repeating its enrollment with the same nonce", async () => {
+    mockUpdateReturning.mockResolvedValueOnce([]);
+    mockLimit.mockResolvedValueOnce([{ machineId: "machine-1" }]);
+
+    const res = await enroll(post("/api/enroll", { code: "enr_abc", nonce: "0123456789abcdef0123456789abcdef" }));
+    expect(res.status).toBe(200);
+
+    const { data } = await res.json();
+    expect(data.machine_id).toBe("machine-1");
+    expect(mockUpdateSet).toHaveBeenLastCalledWith({ machineToken: data.machine_token, tokenExpiresAt: expect.any(Date) });
+    expect(mockInsertValues).not.toHaveBeenCalled();
+  });
+
+  it("returns 401 for a spent code repeated with another nonce or too late", async () => {
+    mockUpdateReturning.mockResolvedValueOnce([]);
+    mockLimit.mockResolvedValueOnce([]);
+
+    const res = await enroll(post("/api/enroll", { code: "enr_abc", nonce: "fedcba9876543210fedcba9876543210" }));
+    expect(res.status).toBe(401);
+    expect(mockUpdateSet).toHaveBeenCalledTimes(1);
+    expect(mockInsertValues).not.toHaveBeenCalled();
+  });
+
+  it("returns 422 without a code", async () => {
+    const res = await enroll(post("/api/enroll", { name: "web-01" }));
+    expect(res.status).toBe(422);
+  });
+});
+
+describe("POST /api/rotate", () => {
+  it("replaces the current token and keeps it as the previous one", async () => {
+    mockLimit.mockResolvedValueOnce([{ id: "machine-1", signingSecret: null, tokenExpiresAt: new Date(Date.now() - 1000), previousMachineToken: null }]);
+
+    const res = await rotate(post("/api/rotate", {}, { Authorization: "Bearer mtoken_old" }));
+    expect(res.status).toBe(200);
+
+    const { data } = await res.json();
+    expect(data.machine_token).toMatch(/^mtoken_/);
+    expect(data.machine_token).not.toBe("mtoken_old");
+    expect(mockUpdateSet).toHaveBeenCalledWith(
+      expect.objectContaining({ machineToken: data.machine_token, previousMachineToken: "mtoken_old", previousTokenReplacedAt: expect.any(Date) }),
+    );
+  });
+
+  it("issues a new token to an agent that lost the last one", async () => {
+    mockLimit.mockResolvedValueOnce([
+      { id: "machine-1", signingSecret: null, tokenExpiresAt: new Date(Date.now() + 1000), previousMachineToken: "mtoken_old", previousTokenReplacedAt: new Date(Date.now() - 60_000) },
+    ]);
+
+    const res = await rotate(post("/api/rotate", {}, { Authorization: "Bearer mtoken_old" }));
+    expect(res.status).toBe(200);
+    // The replaced token keeps its place and its grace window
+    expect(mockUpdateSet).toHaveBeenCalledTimes(1);
+    expect(mockUpdateSet).toHaveBeenCalledWith(expect.not.objectContaining({ previousMachineToken: expect.anything() }));
+    expect(mockUpdateSet).toHaveBeenCalledWith(expect.not.objectContaining({ previousTokenReplacedAt: expect.anything() }));
+  });
+
+  it("returns 401 for a replaced token past its grace window", async () => {
+    for (const previousTokenReplacedAt of [new Date(Date.now() - PREVIOUS_TOKEN_GRACE_MS - 1000), null]) {
+      mockLimit.mockResolvedValueOnce([
+        { id: "machine-1", signingSecret: null, tokenExpiresAt: new Date(Date.now() + 1000), previousMachineToken: "mtoken_old", previousTokenReplacedAt },
+      ]);
+      expect((await rotate(post("/api/rotate", {}, { Authorization: "Bearer mtoken_old" }))).status).toBe(401);
+    }
+    expect(mockUpdateSet).not.toHaveBeenCalled();
+  });
+
+  it("drops the replaced token the first time the new one is used", async () => {
+    mockLimit.mockResolvedValueOnce([
+      { id: "machine-1", signingSecret: null, tokenExpiresAt: new Date(Date.now() - 1000), previousMachineToken: "mtoken_older", previousTokenReplacedAt: new Date() },
+    ]);
+
+    const res = await rotate(post("/api/rotate", {}, { Authorization: "Bearer mtoken_old" }));
+    expect(res.status).toBe(200);
+    expect(mockUpdateSet).toHaveBeenNthCalledWith(1, { previousMachineToken: null, previousTokenReplacedAt: null });
+    expect(mockUpdateSet).toHaveBeenNthCalledWith(2, expect.objectContaining({ previousMachineToken: "mtoken_old" }));
+  });
+
+  it("returns 401 for unknown tokens and tokens past the grace period", async () => {
+    mockLimit.mockResolvedValueOnce([]);
+    expect((await rotate(post("/api/rotate", {}, { Authorization: "Bearer mtoken_unknown" }))).status).toBe(401);
+
+    mockLimit.mockResolvedValueOnce([{ id: "machine-1", signingSecret: null, tokenExpiresAt: new Date(Date.now() - ROTATION_GRACE_MS - 1000), previousMachineToken: null }]);
+    expect((await rotate(post("/api/rotate", {}, { Authorization: "Bearer mtoken_ancient" }))).status).toBe(401);
+
+    expect(mockUpdateSet).not.toHaveBeenCalled();
+  });
+
+  it("requires a signature from machines with a signing secret", async () => {
+    mockLimit.mockResolvedValueOnce([{ id: "machine-1", signingSecret: "msecret_test", tokenExpiresAt: new Date(Date.now() - 1000), previousMachineToken: null }]);
+
+    const res = await rotate(post("/api/rotate", {}, { Authorization: "Bearer mtoken_old" }));
+    expect(res.status).toBe(401);
+    expect((await res.json()).error).toBe("Request signature required");
+    expect(mockUpdateSet).not.toHaveBeenCalled();
+  });
+});
@@ -1,6 +1,7 @@
 // Integration tests for POST /api/ingest — metric ingestion endpoint
 
 import { NextRequest } from "next/server";
+import { gzipSync } from "zlib";
 
 // ---------------------------------------------------------------------------
 // Mocks — must be declared before importing the route handler
@@ -21,7 +22,9 @@ jest.mock("@/lib/utils/rate-limit", () => ({
   },
 }));
 
-import { POST } from "@/app/api/ingest/route";
+import { GET, POST } from "@/app/api/ingest/route";
+import { bodyDigest, signRequest } from "@/lib/auth/signature";
+import { configETag } from "@/lib/utils/agent-config";
 
 // ---------------------------------------------------------------------------
 // Helpers
@@ -31,9 +34,15 @@ import { POST } from "@/app/api/ingest/route";
 function createMockDb() {
   // --- INSERT chain ---
   const mockReturning = jest.fn().mockResolvedValue([{ id: "metric-1" }]);
-  const mockInsertValues = jest.fn().mockReturnValue({ returning: mockReturning });
+  const mockClaimReturning = jest.fn().mockResolvedValue([{ batchId: "claimed" }]);
+  const mockOnConflictDoNothing = jest.fn().mockReturnValue({ returning: mockClaimReturning });
+  const mockInsertValues = jest.fn().mockReturnValue({ returning: mockReturning, onConflictDoNothing: mockOnConflictDoNothing });
   const mockInsert = jest.fn().mockReturnValue({ values: mockInsertValues });
 
+  // --- DELETE chain ---
+  const mockDeleteWhere = jest.fn().mockResolvedValue(undefined);
+  const mockDelete = jest.fn().mockReturnValue({ where: mockDeleteWhere });
+
   // --- SELECT chain ---
   const mockLimit = jest.fn().mockResolvedValue([{ id: "machine-1", machineToken: "mtoken_test", userId: "user-1" }]);
   const mockWhere = jest.fn().mockReturnValue({ limit: mockLimit });
@@ -45,10 +54,15 @@ function createMockDb() {
   const mockUpdateSet = jest.fn().mockReturnValue({ where: mockUpdateWhere });
   const mockUpdate = jest.fn().mockReturnValue({ set: mockUpdateSet });
 
+  // --- BATCH (one transaction) ---
+  const mockBatch = jest.fn().mockResolvedValue([]);
+
   return {
     select: mockSelect,
     insert: mockInsert,
     update: mockUpdate,
+    delete: mockDelete,
+    batch: mockBatch,
     _mocks: {
       mockSelect,
       mockFrom,
@@ -57,9 +71,14 @@ function createMockDb() {
       mockInsert,
       mockInsertValues,
       mockReturning,
+      mockClaimReturning,
+      mockOnConflictDoNothing,
+      mockDelete,
+      mockDeleteWhere,
       mockUpdate,
       mockUpdateSet,
       mockUpdateWhere,
+      mockBatch,
     },
   };
 }
@@ -103,10 +122,36 @@ function ingestRequest(body: unknown, headers: Record<string, string> = {}) {
   });
 }
 
+/** Minimal MessagePack encoder for test payloads (maps, arrays, strings, numbers). */
+function toMsgpack(value: unknown): Buffer {
+  if (value === null || value === undefined) return Buffer.from([0xc0]);
+  if (typeof value === "boolean") return Buffer.from([value ? 0xc3 : 0xc2]);
+  if (typeof value === "number") {
+    const buf = Buffer.alloc(9);
+    buf[0] = 0xcb;
+    buf.writeDoubleBE(value, 1);
+    return buf;
+  }
+  if (typeof value === "string") {
+    const data = Buffer.from(value, "utf-8");
+    return Buffer.concat([Buffer.from([0xd9, data.length]), data]);
+  }
+  if (Array.isArray(value)) {
+    return Buffer.concat([Buffer.from([0xdc, value.length >> 8, value.length & 0xff]), ...value.map(toMsgpack)]);
+  }
+  const entries = Object.entries(value as Record<string, unknown>);
+  return Buffer.concat([
+    Buffer.from([0xde, entries.length >> 8, entries.length & 0xff]),
+    ...entries.flatMap(([k, v]) => [toMsgpack(k), toMsgpack(v)]),
+  ]);
+}
+
 /** Reset all mock return values after clearAllMocks. */
 function resetMockDefaults() {
   mockDb._mocks.mockReturning.mockResolvedValue([{ id: "metric-1" }]);
-  mockDb._mocks.mockInsertValues.mockReturnValue({ returning: mockDb._mocks.mockReturning });
+  mockDb._mocks.mockClaimReturning.mockResolvedValue([{ batchId: "claimed" }]);
+  mockDb._mocks.mockOnConflictDoNothing.mockReturnValue({ returning: mockDb._mocks.mockClaimReturning });
+  mockDb._mocks.mockInsertValues.mockReturnValue({ returning: mockDb._mocks.mockReturning, onConflictDoNothing: mockDb._mocks.mockOnConflictDoNothing });
   mockDb._mocks.mockInsert.mockReturnValue({ values: mockDb._mocks.mockInsertValues });
 
   mockDb._mocks.mockLimit.mockResolvedValue([{ id: "machine-1", machineToken: "mtoken_test", userId: "user-1" }]);
@@ -117,6 +162,11 @@ function resetMockDefaults() {
   mockDb._mocks.mockUpdateWhere.mockResolvedValue(undefined);
   mockDb._mocks.mockUpdateSet.mockReturnValue({ where: mockDb._mocks.mockUpdateWhere });
   mockDb._mocks.mockUpdate.mockReturnValue({ set: mockDb._mocks.mockUpdateSet });
+
+  mockDb._mocks.mockDeleteWhere.mockResolvedValue(undefined);
+  mockDb._mocks.mockDelete.mockReturnValue({ where: mockDb._mocks.mockDeleteWhere });
+
+  mockDb._mocks.mockBatch.mockResolvedValue([]);
 }
 
 // ---------------------------------------------------------------------------
@@ -183,6 +233,20 @@ describe("POST /api/ingest", () => {
     expect(json.error).toBe("Invalid machine token");
   });
 
+  it("asks the agent to rotate an expired or replaced token", async () => {
+    for (const machine of [
+      { id: "machine-1", tokenExpiresAt: new Date(Date.now() - 1000), previousMachineToken: null },
+      { id: "machine-1", tokenExpiresAt: new Date(Date.now() + 1000), previousMachineToken: "mtoken_test", previousTokenReplacedAt: new Date() },
+    ]) {
+      mockDb._mocks.mockLimit.mockResolvedValueOnce([machine]);
+
+      const res = await POST(ingestRequest({ metrics: [validMetricEntry()] }, { Authorization: "Bearer mtoken_test" }));
+      expect(res.status).toBe(401);
+      expect(res.headers.get("x-vitalis-token")).toBe("rotate");
+    }
+    expect(mockDb._mocks.mockInsert).not.toHaveBeenCalled();
+  });
+
   // -----------------------------------------------------------------------
   // Successful ingestion
   // -----------------------------------------------------------------------
@@ -198,6 +262,25 @@ describe("POST /api/ingest", () => {
     expect(json.data.inserted).toBe(1);
   });
 
+  it("reports the ETag of the machine's config overrides", async () => {
+    mockDb._mocks.mockLimit.mockResolvedValueOnce([{ id: "machine-1", configOverrides: { log_level: "debug" } }]);
+
+    const res = await POST(ingestRequest({ metrics: [validMetricEntry()] }, { Authorization: "Bearer mtoken_test" }));
+    expect(res.status).toBe(201);
+    expect(res.headers.get("X-Config-ETag")).toBe(configETag({ log_level: "debug" }));
+    expect(configETag({ log_level: "debug" })).not.toBe(configETag(null));
+  });
+
+  it("tells the agent when commands are waiting", async () => {
+    const res = await POST(ingestRequest({ metrics: [validMetricEntry()] }, { Authorization: "Bearer mtoken_test" }));
+    expect(res.headers.get("X-Pending-Commands")).toBeNull();
+
+    mockDb._mocks.mockLimit.mockResolvedValueOnce([{ id: "machine-1", commandsQueuedAt: new Date() }]);
+    const pending = await POST(ingestRequest({ metrics: [validMetricEntry()] }, { Authorization: "Bearer mtoken_test" }));
+    expect(pending.status).toBe(201);
+    expect(pending.headers.get("X-Pending-Commands")).toBe("1");
+  });
+
   it("returns 201 for valid payload with machine_token in body (legacy)", async () => {
     const req = ingestRequest({
       machine_token: "mtoken_test",
@@ -249,8 +332,6 @@ describe("POST /api/ingest", () => {
   });
 
   it("returns correct inserted count for multiple metrics", async () => {
-    mockDb._mocks.mockReturning.mockResolvedValueOnce([{ id: "metric-1" }, { id: "metric-2" }, { id: "metric-3" }]);
-
     const req = ingestRequest(
       {
         metrics: [validMetricEntry(), validMetricEntry(), validMetricEntry()],
@@ -264,4 +345,164 @@ describe("POST /api/ingest", () => {
     const json = await res.json();
     expect(json.data.inserted).toBe(3);
   });
+
+  // -----------------------------------------------------------------------
+  // Deduplication by batch ID
+  // -----------------------------------------------------------------------
+
+  const batchId = "6f1c2d3e-4a5b-4c6d-8e7f-901234567890";
+
+  it("claims the batch ID in the same transaction as the metrics", async () => {
+    const req = ingestRequest({ batch_id: batchId, sequence: 7, metrics: [validMetricEntry()] }, { Authorization: "Bearer mtoken_test" });
+
+    const res = await POST(req);
+    expect(res.status).toBe(201);
+
+    // insert is called for the batch claim, metrics and processSnapshots,
+    // all sent in one batch with the machine update
+    expect(mockDb._mocks.mockInsert).toHaveBeenCalledTimes(3);
+    expect(mockDb._mocks.mockInsertValues).toHaveBeenNthCalledWith(1, { machineId: "machine-1", batchId, sequence: 7 });
+    expect(mockDb._mocks.mockBatch).toHaveBeenCalledTimes(1);
+    expect(mockDb._mocks.mockBatch.mock.calls[0][0]).toHaveLength(4);
+  });
+
+  it("acknowledges a duplicate batch without inserting it again", async () => {
+    // The claim's unique violation rolls back the whole transaction; drizzle
+    // may wrap the driver error
+    const conflict = Object.assign(new Error("duplicate key value"), { code: "23505", constraint: "ingested_batches_pkey" });
+    mockDb._mocks.mockBatch.mockRejectedValueOnce(new Error("Failed query", { cause: conflict }));
+
+    const req = ingestRequest({ metrics: [validMetricEntry()] }, { Authorization: "Bearer mtoken_test", "Idempotency-Key": batchId });
+
+    const res = await POST(req);
+    expect(res.status).toBe(200);
+
+    const json = await res.json();
+    expect(json.data.duplicate).toBe(true);
+    expect(json.data.inserted).toBe(0);
+  });
+
+  it("fails without recording the batch when the transaction fails", async () => {
+    mockDb._mocks.mockBatch.mockRejectedValueOnce(new Error("db down"));
+
+    const req = ingestRequest({ batch_id: batchId, metrics: [validMetricEntry()] }, { Authorization: "Bearer mtoken_test" });
+
+    const res = await POST(req);
+    expect(res.status).toBe(500);
+    // Nothing to release: the claim was rolled back with the metrics
+    expect(mockDb._mocks.mockDelete).not.toHaveBeenCalled();
+  });
+
+  // -----------------------------------------------------------------------
+  // Wire formats
+  // -----------------------------------------------------------------------
+
+  it("accepts a gzip-compressed MessagePack batch", async () => {
+    const body = gzipSync(toMsgpack({ batch_id: batchId, metrics: [validMetricEntry(), validMetricEntry()] }));
+    const req = new NextRequest("http://localhost/api/ingest", {
+      method: "POST",
+      body,
+      headers: { "Content-Type": "application/msgpack", "Content-Encoding": "gzip", Authorization: "Bearer mtoken_test" },
+    });
+
+    const res = await POST(req);
+    expect(res.status).toBe(201);
+    expect(mockDb._mocks.mockInsertValues).toHaveBeenNthCalledWith(1, { machineId: "machine-1", batchId, sequence: null });
+  });
+
+  it("returns 415 with the accepted encodings for an unknown content encoding", async () => {
+    const req = ingestRequest({ metrics: [validMetricEntry()] }, { Authorization: "Bearer mtoken_test", "Content-Encoding": "br" });
+
+    const res = await POST(req);
+    expect(res.status).toBe(415);
+    expect(res.headers.get("accept-encoding")).toContain("gzip");
+    expect(mockDb._mocks.mockInsert).not.toHaveBeenCalled();
+  });
+
+  it("rebuilds the snapshots of a delta batch", async () => {
+    const first = validMetricEntry({ timestamp: "2026-02-18T23:00:00.000000000Z" });
+    const req = ingestRequest(
+      { format: "delta", metrics: [first, { timestamp: 15_000_000_000, uptime_seconds: 15, cpu_overall: 50 }] },
+      { Authorization: "Bearer mtoken_test" },
+    );
+
+    const res = await POST(req);
+    expect(res.status).toBe(201);
+    expect(mockDb._mocks.mockInsertValues).toHaveBeenCalledWith(
+      expect.arrayContaining([
+        expect.objectContaining({ timestamp: new Date("2026-02-18T23:00:15.000Z"), cpuOverall: 50, ramTotal: first.ram_total }),
+      ]),
+    );
+  });
+
+  it("returns 422 for a malformed delta batch", async () => {
+    const req = ingestRequest({ format: "delta", metrics: [validMetricEntry(), { uptime_seconds: "soon" }] }, { Authorization: "Bearer mtoken_test" });
+
+    const res = await POST(req);
+    expect(res.status).toBe(422);
+    expect(mockDb._mocks.mockInsert).not.toHaveBeenCalled();
+  });
+
+  it("returns 400 for a corrupt compressed payload", async () => {
+    const req = ingestRequest({ metrics: [validMetricEntry()] }, { Authorization: "Bearer mtoken_test", "Content-Encoding": "gzip" });
+
+    const res = await POST(req);
+    expect(res.status).toBe(400);
+  });
+
+  // -----------------------------------------------------------------------
+  // Request signing
+  // -----------------------------------------------------------------------
+
+  const signingSecret = "msecret_test";
+
+  /** Headers of a request signed now over `body`. */
+  function signedHeaders(body: string, nonce = "00112233445566778899aabbccddeeff") {
+    const timestamp = String(Math.floor(Date.now() / 1000));
+    const signature = signRequest(signingSecret, "POST", "/api/ingest", timestamp, nonce, bodyDigest(Buffer.from(body)));
+    return { Authorization: "Bearer mtoken_test", "X-Vitalis-Timestamp": timestamp, "X-Vitalis-Nonce": nonce, "X-Vitalis-Signature": signature };
+  }
+
+  it("accepts a signed request and records its nonce", async () => {
+    mockDb._mocks.mockLimit.mockResolvedValueOnce([{ id: "machine-1", signingSecret }]);
+    const body = { metrics: [validMetricEntry()] };
+
+    const res = await POST(ingestRequest(body, signedHeaders(JSON.stringify(body))));
+    expect(res.status).toBe(201);
+    expect(mockDb._mocks.mockInsertValues).toHaveBeenNthCalledWith(1, { machineId: "machine-1", nonce: "00112233445566778899aabbccddeeff" });
+  });
+
+  it("returns 401 for an unsigned or tampered request from a signing machine", async () => {
+    const body = { metrics: [validMetricEntry()] };
+    for (const headers of [{ Authorization: "Bearer mtoken_test" }, signedHeaders(JSON.stringify({ metrics: [] }))]) {
+      mockDb._mocks.mockLimit.mockResolvedValueOnce([{ id: "machine-1", signingSecret }]);
+
+      const res = await POST(ingestRequest(body, headers));
+      expect(res.status).toBe(401);
+    }
+    expect(mockDb._mocks.mockInsert).not.toHaveBeenCalled();
+  });
+
+  it("returns 401 for a replayed signed request", async () => {
+    mockDb._mocks.mockLimit.mockResolvedValueOnce([{ id: "machine-1", signingSecret }]);
+    mockDb._mocks.mockClaimReturning.mockResolvedValueOnce([]);
+    const body = { metrics: [validMetricEntry()] };
+
+    const res = await POST(ingestRequest(body, signedHeaders(JSON.stringify(body))));
+    expect(res.status).toBe(401);
+    expect((await res.json()).error).toBe("Replayed request");
+    expect(mockDb._mocks.mockInsert).toHaveBeenCalledTimes(1);
+  });
+});
+
+describe("GET /api/ingest", () => {
+  it("advertises the accepted content types and encodings", async () => {
+    const res = await GET();
+    expect(res.status).toBe(200);
+
+    const json = await res.json();
+    expect(json.data.content_types).toEqual(["application/json", "application/msgpack"]);
+    expect(json.data.content_encodings).toContain("gzip");
+    expect(json.data.batch_formats).toEqual(["full", "delta"]);
+  });
 });
@@ -0,0 +1,139 @@
+// Integration tests for POST /api/stream — live snapshot stream
+
+import { NextRequest } from "next/server";
+
+// ---------------------------------------------------------------------------
+// Mocks — must be declared before importing the route handler
+// ---------------------------------------------------------------------------
+
+const mockLimit = jest.fn();
+const mockDb = {
+  select: jest.fn(() => ({ from: jest.fn(() => ({ where: jest.fn(() => ({ limit: mockLimit })) })) })),
+};
+const mockInsertMetrics = jest.fn();
+const mockCheckSignedRequest = jest.fn();
+
+jest.mock("@/lib/db", () => ({
+  getDb: jest.fn(() => mockDb),
+}));
+
+jest.mock("@/lib/db/ingest", () => ({
+  insertMetrics: (...args: unknown[]) => mockInsertMetrics(...args),
+  checkSignedRequest: (...args: unknown[]) => mockCheckSignedRequest(...args),
+}));
+
+jest.mock("@/lib/utils/rate-limit", () => ({
+  checkRateLimit: jest.fn().mockReturnValue({ allowed: true, remaining: 4, resetAt: Date.now() + 60_000 }),
+  RATE_LIMITS: {
+    stream: { windowMs: 60 * 1000, maxRequests: 5 },
+  },
+}));
+
+import { POST } from "@/app/api/stream/route";
+import { SignatureError, UNSIGNED_PAYLOAD } from "@/lib/auth/signature";
+
+// ---------------------------------------------------------------------------
+// Helpers
+// ---------------------------------------------------------------------------
+
+function snapshot(overrides: Record<string, unknown> = {}) {
+  return {
+    timestamp: "2026-02-18T23:00:00.000000000Z",
+    cpu_overall: 12.5,
+    cpu_cores: [10, 15],
+    ram_used: 1_000,
+    ram_total: 8_000,
+    disk_usage: [],
+    network_rx: 0,
+    network_tx: 0,
+    uptime_seconds: 60,
+    processes: [],
+    ...overrides,
+  };
+}
+
+function streamRequest(lines: unknown[], headers: Record<string, string> = { Authorization: "Bearer mtoken_test" }) {
+  return new NextRequest("http://localhost/api/stream", {
+    method: "POST",
+    body: lines.map((l) => JSON.stringify(l) + "\n").join(""),
+    headers: { "Content-Type": "application/x-ndjson", ...headers },
+  });
+}
+
+/** Read the whole NDJSON response into objects. */
+async function readMessages(res: Response) {
+  const text = await res.text();
+  return text
+    .split("\n")
+    .filter((l) => l.trim())
+    .map((l) => JSON.parse(l));
+}
+
+// ---------------------------------------------------------------------------
+// Tests
+// ---------------------------------------------------------------------------
+
+describe("POST /api/stream", () => {
+  beforeEach(() => {
+    jest.clearAllMocks();
+    mockLimit.mockResolvedValue([{ id: "machine-1" }]);
+    mockInsertMetrics.mockResolvedValue(1);
+  });
+
+  it("returns 401 without a machine token", async () => {
+    const res = await POST(streamRequest([], {}));
+    expect(res.status).toBe(401);
+  });
+
+  it("returns 401 for an unknown machine token", async () => {
+    mockLimit.mockResolvedValueOnce([]);
+
+    const res = await POST(streamRequest([]));
+    expect(res.status).toBe(401);
+  });
+
+  it("requires a signature from machines with a signing secret", async () => {
+    mockLimit.mockResolvedValueOnce([{ id: "machine-1", signingSecret: "msecret_test" }]);
+    mockCheckSignedRequest.mockRejectedValueOnce(new SignatureError("Request signature required"));
+
+    const res = await POST(streamRequest([{ type: "heartbeat" }]));
+    expect(res.status).toBe(401);
+    expect((await res.json()).error).toBe("Request signature required");
+    expect(mockCheckSignedRequest).toHaveBeenCalledWith(mockDb, "machine-1", "msecret_test", expect.anything(), "/api/stream", UNSIGNED_PAYLOAD);
+  });
+
+  it("acknowledges stored snapshots and answers heartbeats", async () => {
+    const res = await POST(
+      streamRequest([
+        { type: "snapshot", seq: 1, snapshot: snapshot() },
+        { type: "heartbeat" },
+        { type: "snapshot", seq: 2, snapshot: snapshot({ cpu_overall: 20 }) },
+      ]),
+    );
+    expect(res.status).toBe(200);
+    expect(res.headers.get("content-type")).toBe("application/x-ndjson");
+
+    const messages = await readMessages(res);
+    expect(messages).toEqual([{ ready: true }, { ack: 1 }, { heartbeat: true }, { ack: 2 }]);
+    expect(mockInsertMetrics).toHaveBeenCalledTimes(2);
+    expect(mockInsertMetrics).toHaveBeenCalledWith(mockDb, "machine-1", [expect.objectContaining({ cpu_overall: 12.5 })]);
+  });
+
+  it("rejects invalid snapshots without storing them", async () => {
+    const res = await POST(streamRequest([{ type: "snapshot", seq: 7, snapshot: snapshot({ cpu_overall: 150 }) }]));
+
+    const messages = await readMessages(res);
+    expect(messages).toContainEqual({ nack: 7, error: "Invalid snapshot" });
+    expect(mockInsertMetrics).not.toHaveBeenCalled();
+  });
+
+  it("does not acknowledge a snapshot that failed to insert", async () => {
+    mockInsertMetrics.mockRejectedValueOnce(new Error("db down"));
+
+    const res = await POST(streamRequest([{ type: "snapshot", seq: 3, snapshot: snapshot() }]));
+
+    const messages = await readMessages(res);
+    expect(messages).toContainEqual({ nack: 3, error: "Internal server error" });
+    expect(messages).not.toContainEqual({ ack: 3 });
+  });
+});
@@ -0,0 +1,61 @@
+import { bodyDigest, canonicalString, generateSigningSecret, signRequest, verifySignature, SignatureError, UNSIGNED_PAYLOAD } from "@/lib/auth/signature";
+
+const SECRET = "msecret_test";
+const NONCE = "00112233445566778899aabbccddeeff";
+const BODY = Buffer.from('{"metrics":[]}');
+
+/** Headers of a request signed at `timestamp` (Unix seconds). */
+function signedHeaders(timestamp: number, overrides: Record<string, string> = {}): Headers {
+  const ts = String(timestamp);
+  return new Headers({
+    "X-Vitalis-Timestamp": ts,
+    "X-Vitalis-Nonce": NONCE,
+    "X-Vitalis-Signature": signRequest(SECRET, "POST", "/api/ingest", ts, NONCE, bodyDigest(BODY)),
+    ...overrides,
+  });
+}
+
+describe("signRequest", () => {
+  it("matches the agent's signature (same vector as the Go tests)", () => {
+    expect(bodyDigest(BODY)).toBe("a69e56a23ab5bff43021c11840a51cac0a306b8e77e0eafefcd7e658aae21ffe");
+    expect(signRequest(SECRET, "post", "/api/ingest", "1771455600", NONCE, bodyDigest(BODY))).toBe("6968ce3ff8c3de9b047e7fbc30d1735366dec71e928ec8ec416779cae886707a");
+  });
+
+  it("covers every part of the canonical string", () => {
+    expect(canonicalString("post", "/api/stream", "1", NONCE, UNSIGNED_PAYLOAD)).toBe(`VITALIS-HMAC-SHA256\nPOST\n/api/stream\n1\n${NONCE}\nUNSIGNED-PAYLOAD`);
+  });
+});
+
+describe("verifySignature", () => {
+  const now = 1_771_455_600_000;
+
+  it("accepts a correctly signed request and returns its nonce", () => {
+    expect(verifySignature(signedHeaders(now / 1000), SECRET, "POST", "/api/ingest", bodyDigest(BODY), now)).toBe(NONCE);
+  });
+
+  it("rejects unsigned, malformed, stale and tampered requests", () => {
+    const digest = bodyDigest(BODY);
+    const cases: [Headers, string][] = [
+      [new Headers(), "Request signature required"],
+      [signedHeaders(now / 1000, { "X-Vitalis-Nonce": "short" }), "Malformed request signature"],
+      [signedHeaders(now / 1000 - 301), "Request timestamp outside the allowed window"],
+      [signedHeaders(now / 1000 + 301), "Request timestamp outside the allowed window"],
+    ];
+    for (const [headers, message] of cases) {
+      expect(() => verifySignature(headers, SECRET, "POST", "/api/ingest", digest, now)).toThrow(new SignatureError(message));
+    }
+
+    const headers = signedHeaders(now / 1000);
+    expect(() => verifySignature(headers, SECRET, "POST", "/api/ingest", bodyDigest(Buffer.from('{"metrics":[{}]}')), now)).toThrow("Invalid request signature");
+    expect(() => verifySignature(headers, SECRET, "POST", "/api/stream", digest, now)).toThrow("Invalid request signature");
+    expect(() => verifySignature(headers, "msecret_other", "POST", "/api/ingest", digest, now)).toThrow("Invalid request signature");
+  });
+});
+
+describe("generateSigningSecret", () => {
+  it("returns distinct prefixed secrets", () => {
+    const secret = generateSigningSecret();
+    expect(secret).toMatch(/^msecret_[0-9a-f]{64}$/);
+    expect(generateSigningSecret()).not.toBe(secret);
+  });
+});
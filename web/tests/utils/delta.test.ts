@@ -0,0 +1,46 @@
+import { expandDeltaBatch, DeltaError } from "@/lib/utils/delta";
+
+describe("expandDeltaBatch", () => {
+  const first = {
+    timestamp: "2026-02-18T23:00:00.999999999Z",
+    cpu_overall: 10,
+    ram_used: 4_000,
+    ram_total: 16_000,
+    uptime_seconds: 60,
+    os_name: "linux",
+    disk_usage: [{ mount: "/", total: 100, used: 40, free: 60 }],
+  };
+
+  it("returns bodies without the delta format unchanged", () => {
+    const body = { metrics: [first] };
+    expect(expandDeltaBatch(body)).toBe(body);
+  });
+
+  it("carries missing fields over and applies differences", () => {
+    const expanded = expandDeltaBatch({
+      batch_id: "b",
+      format: "delta",
+      metrics: [first, { timestamp: 1, ram_used: -500, uptime_seconds: 15 }, { timestamp: 15_000_000_000, cpu_overall: 20, os_name: "windows" }],
+    });
+
+    expect(expanded).toEqual({
+      batch_id: "b",
+      metrics: [
+        first,
+        { ...first, timestamp: "2026-02-18T23:00:01.000000000Z", ram_used: 3_500, uptime_seconds: 75 },
+        { ...first, timestamp: "2026-02-18T23:00:16.000000000Z", ram_used: 3_500, uptime_seconds: 75, cpu_overall: 20, os_name: "windows" },
+      ],
+    });
+  });
+
+  it("keeps explicit nulls in a frame", () => {
+    const expanded = expandDeltaBatch({ format: "delta", metrics: [{ ...first, cpu_temp: 50 }, { cpu_temp: null }] }) as { metrics: Record<string, unknown>[] };
+    expect(expanded.metrics[1].cpu_temp).toBeNull();
+  });
+
+  it("rejects malformed frames", () => {
+    expect(() => expandDeltaBatch({ format: "delta", metrics: [first, "frame"] })).toThrow(DeltaError);
+    expect(() => expandDeltaBatch({ format: "delta", metrics: [first, { ram_used: "1" }] })).toThrow(DeltaError);
+    expect(() => expandDeltaBatch({ format: "delta", metrics: [first, { timestamp: 0.5 }] })).toThrow(DeltaError);
+  });
+});
@@ -0,0 +1,57 @@
+import { decodeMsgpack, MsgpackError } from "@/lib/utils/msgpack";
+
+const bytes = (hex: string) => new Uint8Array(Buffer.from(hex, "hex"));
+
+describe("decodeMsgpack", () => {
+  it("decodes a batch encoded by the Go agent to the same object as its JSON", () => {
+    // MetricBatch as produced by the agent's wire.MarshalMsgpack
+    const encoded =
+      "83a862617463685f6964a178a873657175656e6365cf0000010000000000a76d657472696373918ca974696d657374616d70be323032332d31312d3134" +
+      "5432323a31333a32302e3030303030303030355aab6370755f6f766572616c6ccb4028b0f27bb2fec5a96370755f636f7265739300ca3fc00000f9a872" +
+      "616d5f7573656400a972616d5f746f74616ccf0000000400000000aa6469736b5f75736167659184a56d6f756e74a12fa5746f74616ccd012ca4757365" +
+      "6400a46672656500aa6e6574776f726b5f727800aa6e6574776f726b5f747800ae757074696d655f7365636f6e647300a86370755f74656d70ca405000" +
+      "00a86770755f74656d70c0a970726f636573736573c0";
+
+    expect(decodeMsgpack(bytes(encoded))).toEqual({
+      batch_id: "x",
+      sequence: 2 ** 40,
+      metrics: [
+        {
+          timestamp: "2023-11-14T22:13:20.000000005Z",
+          cpu_overall: 12.3456,
+          cpu_cores: [0, 1.5, -7],
+          ram_used: 0,
+          ram_total: 2 ** 34,
+          disk_usage: [{ mount: "/", total: 300, used: 0, free: 0 }],
+          network_rx: 0,
+          network_tx: 0,
+          uptime_seconds: 0,
+          cpu_temp: 3.25,
+          gpu_temp: null,
+          processes: null,
+        },
+      ],
+    });
+  });
+
+  it("decodes negative integers and booleans", () => {
+    expect(decodeMsgpack(bytes("94ffd080d1fc18c3"))).toEqual([-1, -128, -1000, true]);
+  });
+
+  it("does not let keys alter the prototype", () => {
+    // {"__proto__": {"polluted": true}}
+    const decoded = decodeMsgpack(bytes("81a95f5f70726f746f5f5f81a8706f6c6c75746564c3")) as Record<string, unknown>;
+    expect(Object.getPrototypeOf(decoded)).toBe(Object.prototype);
+    expect(Object.keys(decoded)).toEqual(["__proto__"]);
+  });
+
+  it("rejects truncated input and trailing bytes", () => {
+    expect(() => decodeMsgpack(bytes("92a3616263"))).toThrow(MsgpackError);
+    expect(() => decodeMsgpack(bytes("dc0010"))).toThrow(MsgpackError);
+    expect(() => decodeMsgpack(bytes("c0c0"))).toThrow(MsgpackError);
+  });
+
+  it("rejects extension types", () => {
+    expect(() => decodeMsgpack(bytes("d40100"))).toThrow(MsgpackError);
+  });
+});
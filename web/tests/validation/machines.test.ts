@@ -1,4 +1,4 @@
-import { createMachineSchema, updateMachineSchema, shareMachineSchema, metricQuerySchema } from "../../src/lib/validation/machines";
+import { createMachineSchema, updateMachineSchema, shareMachineSchema, metricQuerySchema, createCommandSchema, commandResultSchema } from "../../src/lib/validation/machines";
 
 describe("createMachineSchema", () => {
   it("accepts valid input with all fields", () => {
@@ -70,6 +70,24 @@ describe("updateMachineSchema", () => {
     const result = updateMachineSchema.safeParse({ name: "" });
     expect(result.success).toBe(false);
   });
+
+  it("accepts config overrides, or null to clear them", () => {
+    const overrides = { interval_seconds: 5, batch_interval_seconds: 10, top_processes: 20, collectors: ["cpu", "memory"], log_level: "debug" };
+    expect(updateMachineSchema.safeParse({ config_overrides: overrides }).success).toBe(true);
+    expect(updateMachineSchema.safeParse({ config_overrides: null }).success).toBe(true);
+  });
+
+  it("rejects invalid config overrides", () => {
+    for (const overrides of [
+      { interval_seconds: 0 },
+      { interval_seconds: 30, batch_interval_seconds: 10 },
+      { top_processes: 101 },
+      { collectors: ["gpu"] },
+      { log_level: "trace" },
+    ]) {
+      expect(updateMachineSchema.safeParse({ config_overrides: overrides }).success).toBe(false);
+    }
+  });
 });
 
 describe("shareMachineSchema", () => {
@@ -176,3 +194,23 @@ describe("metricQuerySchema", () => {
     expect(result.success).toBe(false);
   });
 });
+
+describe("createCommandSchema", () => {
+  it("accepts an allowlisted command", () => {
+    expect(createCommandSchema.safeParse({ command: "flush_buffer" }).success).toBe(true);
+  });
+
+  it("rejects any other command", () => {
+    expect(createCommandSchema.safeParse({ command: "shell" }).success).toBe(false);
+  });
+});
+
+describe("commandResultSchema", () => {
+  it("accepts a result with output", () => {
+    expect(commandResultSchema.safeParse({ status: "succeeded", output: "{}" }).success).toBe(true);
+  });
+
+  it("rejects an unknown status", () => {
+    expect(commandResultSchema.safeParse({ status: "running" }).success).toBe(false);
+  });
+});
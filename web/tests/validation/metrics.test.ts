@@ -339,6 +339,22 @@ describe("singleMetricSchema", () => {
     });
     expect(result.success).toBe(false);
   });
+
+  it("accepts agent self-metrics", () => {
+    const result = singleMetricSchema.safeParse({
+      ...validMetric,
+      agent: { sender_state: "half_open", send_failures: 6, buffered_batches: 12 },
+    });
+    expect(result.success).toBe(true);
+  });
+
+  it("rejects an unknown sender state", () => {
+    const result = singleMetricSchema.safeParse({
+      ...validMetric,
+      agent: { sender_state: "broken", send_failures: 0, buffered_batches: 0 },
+    });
+    expect(result.success).toBe(false);
+  });
 });
 
 // ---------------------------------------------------------------------------